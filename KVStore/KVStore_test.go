@@ -1,279 +1,592 @@
-package KVStore_test
-
-import (
-	"encoding/json"
-	"store/KVStore"
-	"testing"
-)
-
-func FindIndex(a []string, x string) int {
-	for i, n := range a {
-		if x == n {
-			return i
-		}
-	}
-	return len(a)
-}
-
-func handleShutdown(t *testing.T) {
-	err := KVStore.Shutdown()
-	if err != nil {
-		t.Error("Unable to shutdown properly", err)
-	}
-}
-
-func TestStartupShutdown(t *testing.T) {
-	KVStore.Startup(100, 100)
-	err := KVStore.Shutdown()
-	if err != nil {
-		t.Error("Unable to shutdown properly", err)
-	}
-}
-
-func TestPutGet(t *testing.T) {
-	KVStore.Startup(100, 100)
-	defer handleShutdown(t)
-	key := "key"
-	user := "test"
-	data := "value"
-
-	if err := KVStore.PutValue(key, user, data); err != nil {
-		t.Error("unable to put a value in the kv store", err)
-	}
-
-	testData, err := KVStore.LookupValue(key, user)
-
-	if err != nil || testData != data {
-		t.Errorf("unable to retrieve value from KV store. Wanted %s, got %s. Error is %v\n", data, testData, err)
-	}
-}
-
-func TestPutChange(t *testing.T) {
-	KVStore.Startup(100, 100)
-	defer handleShutdown(t)
-	key := "key"
-	user := "test"
-	data := "value"
-	newData := "new data"
-
-	if err := KVStore.PutValue(key, user, data); err != nil {
-		t.Error("unable to put a value in the kv store", err)
-	}
-	testData, err := KVStore.LookupValue(key, user)
-	if err != nil || testData != data {
-		t.Errorf("unable to retrieve value from KV store. Wanted %s, got %s. Error is %v\n", data, testData, err)
-	}
-
-	errPut := KVStore.PutValue(key, user, newData)
-	if errPut != nil {
-		t.Error("unable to put a second value in the kv store under the same key", errPut)
-	}
-
-	testData2, err2 := KVStore.LookupValue(key, user)
-	if err2 != nil || testData2 != newData {
-		t.Errorf("unable to retrieve changed data from KV store. Wanted %s, got %s. Error is %v\n", newData, testData2, err)
-	}
-
-}
-
-func TestPutChangeUnauthorised(t *testing.T) {
-	KVStore.Startup(100, 100)
-	defer handleShutdown(t)
-	key := "key"
-	user := "test"
-	wrongUser := "wrong"
-	data := "value"
-	newData := "new data"
-
-	if err := KVStore.PutValue(key, user, data); err != nil {
-		t.Error("unable to put a value in the kv store", err)
-	}
-	testData, err := KVStore.LookupValue(key, user)
-	if err != nil || testData != data {
-		t.Errorf("unable to retrieve value from KV store. Wanted %s, got %s. Error is %v\n", data, testData, err)
-	}
-
-	errPut := KVStore.PutValue(key, wrongUser, newData)
-	if errPut != KVStore.ErrUnauthorized {
-		t.Error("Able to change a value for a different user")
-	}
-
-}
-
-func TestGetNotThere(t *testing.T) {
-	KVStore.Startup(100, 100)
-	defer handleShutdown(t)
-	key := "key"
-	user := "test"
-
-	testData, err := KVStore.LookupValue(key, user)
-	if err != KVStore.ErrKeyNotPresent || testData != "" {
-		t.Errorf("able to retrieve value from KV store when key is not present. Got %s. Error is %v\n", testData, err)
-	}
-}
-
-func TestGetNotAuthorised(t *testing.T) {
-	KVStore.Startup(100, 100)
-	defer handleShutdown(t)
-	key := "key"
-	user := "test"
-	wrongUser := "wrong"
-	data := "value"
-
-	if err := KVStore.PutValue(key, user, data); err != nil {
-		t.Error("unable to put a value in the kv store", err)
-	}
-
-	testData, err := KVStore.LookupValue(key, wrongUser)
-	if err != KVStore.ErrUnauthorized || testData != "" {
-		t.Errorf("able to retrieve value from KV store with wrong user. Got %s. Error is %v\n", testData, err)
-	}
-
-}
-
-func TestDelete(t *testing.T) {
-	KVStore.Startup(100, 100)
-	defer handleShutdown(t)
-	key := "key"
-	user := "test"
-	data := "value"
-
-	if err := KVStore.PutValue(key, user, data); err != nil {
-		t.Error("unable to put a value in the kv store", err)
-	}
-
-	testData, err1 := KVStore.LookupValue(key, user)
-	if err1 != nil || testData != data {
-		t.Errorf("unable to retrieve value from KV store. Wanted %s, got %s. Error is %v\n", data, testData, err1)
-	}
-
-	err := KVStore.Delete(key, user)
-	if err != nil {
-		t.Error("unable to delete a key from the kv store", err)
-	}
-	testData, errLookup := KVStore.LookupValue(key, user)
-	if errLookup != KVStore.ErrKeyNotPresent || testData != "" {
-		t.Errorf("able to retrieve value from KV store after deleting. Got %s. Error is %v\n", testData, err)
-	}
-}
-
-func TestDeleteUnauthorised(t *testing.T) {
-	KVStore.Startup(100, 100)
-	defer handleShutdown(t)
-
-	key := "key"
-	user := "test"
-	wrongUser := "wrong"
-	data := "value"
-
-	if err := KVStore.PutValue(key, user, data); err != nil {
-		t.Error("unable to put a value in the kv store", err)
-	}
-
-	testData, err1 := KVStore.LookupValue(key, user)
-	if err1 != nil || testData != data {
-		t.Errorf("unable to retrieve value from KV store. Wanted %s, got %s. Error is %v\n", data, testData, err1)
-	}
-
-	err := KVStore.Delete(key, wrongUser)
-	if err != KVStore.ErrUnauthorized {
-		t.Error("able to delete a key from another user", err)
-	}
-	testData, errLookup := KVStore.LookupValue(key, user)
-	if errLookup != nil || testData != data {
-		t.Errorf("attempt to delete by unauthorised user corrupted the data. Wanted %s, got %s. Error is %v\n", data, testData, errLookup)
-	}
-}
-
-func TestDeleteNotThere(t *testing.T) {
-	KVStore.Startup(100, 100)
-	defer handleShutdown(t)
-	key := "key"
-	user := "test"
-
-	err := KVStore.Delete(key, user)
-	if err != KVStore.ErrKeyNotPresent {
-		t.Error("able to delete a non-existent key", err)
-	}
-}
-
-func TestListing(t *testing.T) {
-	KVStore.Startup(100, 100)
-	defer handleShutdown(t)
-	keys := []string{"key1", "key2", "key3"}
-	users := []string{"user1", "user2", "user3"}
-	values := []string{"value1", "value2", "value3"}
-	wrongKey := "wrong"
-
-	for i := 0; i < len(keys); i++ {
-		if err := KVStore.PutValue(keys[i], users[i], values[i]); err != nil {
-			t.Error("unable to put a value in the kv store", err)
-		}
-	}
-	t.Run("TestListStore", func(t *testing.T) {
-		testJSON, err := KVStore.ListStore()
-		if err != nil {
-			t.Error("unable to list store contents", err)
-		}
-		var testData []KVStore.Key
-		errJSON := json.Unmarshal(testJSON, &testData)
-		if errJSON != nil {
-			t.Error("error unmarshaling store list json", errJSON)
-		}
-		if len(testData) != len(keys) {
-			t.Errorf("did not list enough objects. Expected %d, got %d\n", len(keys), len(testData))
-		} else {
-			for j := 0; j < len(testData); j++ {
-				data := testData[j]
-				k := FindIndex(keys, data.Key) //list store may not return keys in the same order
-				if data.Key != keys[k] || data.Owner != users[k] {
-					t.Errorf("returned key had incorrect values. expected key %s and owner %s, got %v\n", keys[k], users[k], data)
-				}
-			}
-		}
-	})
-
-	t.Run("TestListKey", func(t *testing.T) {
-		testJSON, err := KVStore.ListKey(keys[0])
-		if err != nil {
-			t.Error("unable to list store key", err)
-		}
-		var testData KVStore.Key
-		errJSON := json.Unmarshal(testJSON, &testData)
-		if errJSON != nil {
-			t.Error("error unmarshaling json", errJSON)
-		}
-		if testData.Key != keys[0] || testData.Owner != users[0] {
-			t.Errorf("returned key had incorrect values. expected key %s and owner %s, got %v\n", keys[0], users[0], testData)
-		}
-	})
-
-	t.Run("TestListKeyNotThere", func(t *testing.T) {
-		testData, err := KVStore.ListKey(wrongKey)
-		if err != KVStore.ErrKeyNotPresent || testData != nil {
-			t.Errorf("able to list non-existent key. Got %s. Error is %v\n", testData, err)
-		}
-	})
-
-}
-
-func TestDepth(t *testing.T) {
-	keys := []string{"key1", "key2", "key3", "key4"}
-	users := []string{"user1", "user2", "user3", "user4"}
-	values := []string{"value1", "value2", "value3", "value4"}
-
-	KVStore.Startup(100, len(keys)-1)
-	defer handleShutdown(t)
-
-	for i := 0; i < len(keys); i++ {
-		if err := KVStore.PutValue(keys[i], users[i], values[i]); err != nil {
-			t.Error("unable to put a value in the kv store", err)
-		}
-	} //key1 should be ejected from the store
-
-	testData, errLookup := KVStore.LookupValue(keys[0], users[0])
-	if errLookup != KVStore.ErrKeyNotPresent || testData != "" {
-		t.Errorf("able to retrieve value from KV store that should have been rejected due to depth. Got %s. Error is %v\n", testData, errLookup)
-	}
-
-}
+package KVStore_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"store/KVStore"
+	"store/metrics"
+	"store/rbac"
+	"strings"
+	"testing"
+	"time"
+)
+
+func FindIndex(a []string, x string) int {
+	for i, n := range a {
+		if x == n {
+			return i
+		}
+	}
+	return len(a)
+}
+
+func handleShutdown(t *testing.T) {
+	err := KVStore.Shutdown()
+	if err != nil {
+		t.Error("Unable to shutdown properly", err)
+	}
+}
+
+func TestStartupShutdown(t *testing.T) {
+	KVStore.Startup(100, 100)
+	err := KVStore.Shutdown()
+	if err != nil {
+		t.Error("Unable to shutdown properly", err)
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	key := "key"
+	user := rbac.NewIdentity("test", rbac.RoleWriter)
+	data := "value"
+
+	if err := KVStore.PutValue(key, user, data); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+
+	testData, err := KVStore.LookupValue(key, user)
+
+	if err != nil || testData != data {
+		t.Errorf("unable to retrieve value from KV store. Wanted %s, got %s. Error is %v\n", data, testData, err)
+	}
+}
+
+func TestPutChange(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	key := "key"
+	user := rbac.NewIdentity("test", rbac.RoleWriter)
+	data := "value"
+	newData := "new data"
+
+	if err := KVStore.PutValue(key, user, data); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+	testData, err := KVStore.LookupValue(key, user)
+	if err != nil || testData != data {
+		t.Errorf("unable to retrieve value from KV store. Wanted %s, got %s. Error is %v\n", data, testData, err)
+	}
+
+	errPut := KVStore.PutValue(key, user, newData)
+	if errPut != nil {
+		t.Error("unable to put a second value in the kv store under the same key", errPut)
+	}
+
+	testData2, err2 := KVStore.LookupValue(key, user)
+	if err2 != nil || testData2 != newData {
+		t.Errorf("unable to retrieve changed data from KV store. Wanted %s, got %s. Error is %v\n", newData, testData2, err)
+	}
+
+}
+
+func TestPutChangeUnauthorised(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	key := "key"
+	user := rbac.NewIdentity("test", rbac.RoleWriter)
+	wrongUser := rbac.NewIdentity("wrong", rbac.RoleWriter)
+	data := "value"
+	newData := "new data"
+
+	if err := KVStore.PutValue(key, user, data); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+	testData, err := KVStore.LookupValue(key, user)
+	if err != nil || testData != data {
+		t.Errorf("unable to retrieve value from KV store. Wanted %s, got %s. Error is %v\n", data, testData, err)
+	}
+
+	errPut := KVStore.PutValue(key, wrongUser, newData)
+	if errPut != KVStore.ErrUnauthorized {
+		t.Error("Able to change a value for a different user")
+	}
+
+}
+
+func TestGetNotThere(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	key := "key"
+	user := rbac.NewIdentity("test", rbac.RoleWriter)
+
+	testData, err := KVStore.LookupValue(key, user)
+	if err != KVStore.ErrKeyNotPresent || testData != "" {
+		t.Errorf("able to retrieve value from KV store when key is not present. Got %s. Error is %v\n", testData, err)
+	}
+}
+
+func TestGetNotAuthorised(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	key := "key"
+	user := rbac.NewIdentity("test", rbac.RoleWriter)
+	wrongUser := rbac.NewIdentity("wrong", rbac.RoleWriter)
+	data := "value"
+
+	if err := KVStore.PutValue(key, user, data); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+
+	testData, err := KVStore.LookupValue(key, wrongUser)
+	if err != KVStore.ErrUnauthorized || testData != "" {
+		t.Errorf("able to retrieve value from KV store with wrong user. Got %s. Error is %v\n", testData, err)
+	}
+
+}
+
+func TestDelete(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	key := "key"
+	user := rbac.NewIdentity("test", rbac.RoleWriter)
+	data := "value"
+
+	if err := KVStore.PutValue(key, user, data); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+
+	testData, err1 := KVStore.LookupValue(key, user)
+	if err1 != nil || testData != data {
+		t.Errorf("unable to retrieve value from KV store. Wanted %s, got %s. Error is %v\n", data, testData, err1)
+	}
+
+	err := KVStore.Delete(key, user)
+	if err != nil {
+		t.Error("unable to delete a key from the kv store", err)
+	}
+	testData, errLookup := KVStore.LookupValue(key, user)
+	if errLookup != KVStore.ErrKeyNotPresent || testData != "" {
+		t.Errorf("able to retrieve value from KV store after deleting. Got %s. Error is %v\n", testData, err)
+	}
+}
+
+func TestDeleteUnauthorised(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+
+	key := "key"
+	user := rbac.NewIdentity("test", rbac.RoleWriter)
+	wrongUser := rbac.NewIdentity("wrong", rbac.RoleWriter)
+	data := "value"
+
+	if err := KVStore.PutValue(key, user, data); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+
+	testData, err1 := KVStore.LookupValue(key, user)
+	if err1 != nil || testData != data {
+		t.Errorf("unable to retrieve value from KV store. Wanted %s, got %s. Error is %v\n", data, testData, err1)
+	}
+
+	err := KVStore.Delete(key, wrongUser)
+	if err != KVStore.ErrUnauthorized {
+		t.Error("able to delete a key from another user", err)
+	}
+	testData, errLookup := KVStore.LookupValue(key, user)
+	if errLookup != nil || testData != data {
+		t.Errorf("attempt to delete by unauthorised user corrupted the data. Wanted %s, got %s. Error is %v\n", data, testData, errLookup)
+	}
+}
+
+func TestDeleteNotThere(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	key := "key"
+	user := rbac.NewIdentity("test", rbac.RoleWriter)
+
+	err := KVStore.Delete(key, user)
+	if err != KVStore.ErrKeyNotPresent {
+		t.Error("able to delete a non-existent key", err)
+	}
+}
+
+func TestListing(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	keys := []string{"key1", "key2", "key3"}
+	users := []rbac.Identity{rbac.NewIdentity("user1", rbac.RoleWriter), rbac.NewIdentity("user2", rbac.RoleWriter), rbac.NewIdentity("user3", rbac.RoleWriter)}
+	values := []string{"value1", "value2", "value3"}
+	wrongKey := "wrong"
+	admin := rbac.NewIdentity("admin", rbac.RoleAdmin)
+
+	for i := 0; i < len(keys); i++ {
+		if err := KVStore.PutValue(keys[i], users[i], values[i]); err != nil {
+			t.Error("unable to put a value in the kv store", err)
+		}
+	}
+	t.Run("TestListStore", func(t *testing.T) {
+		testJSON, err := KVStore.ListStore(admin, true)
+		if err != nil {
+			t.Error("unable to list store contents", err)
+		}
+		var testData []KVStore.Key
+		errJSON := json.Unmarshal(testJSON, &testData)
+		if errJSON != nil {
+			t.Error("error unmarshaling store list json", errJSON)
+		}
+		if len(testData) != len(keys) {
+			t.Errorf("did not list enough objects. Expected %d, got %d\n", len(keys), len(testData))
+		} else {
+			for j := 0; j < len(testData); j++ {
+				data := testData[j]
+				k := FindIndex(keys, data.Key) //list store may not return keys in the same order
+				if data.Key != keys[k] || data.Owner != users[k].Username {
+					t.Errorf("returned key had incorrect values. expected key %s and owner %s, got %v\n", keys[k], users[k].Username, data)
+				}
+			}
+		}
+	})
+
+	t.Run("TestListKey", func(t *testing.T) {
+		testJSON, err := KVStore.ListKey(keys[0], admin)
+		if err != nil {
+			t.Error("unable to list store key", err)
+		}
+		var testData KVStore.Key
+		errJSON := json.Unmarshal(testJSON, &testData)
+		if errJSON != nil {
+			t.Error("error unmarshaling json", errJSON)
+		}
+		if testData.Key != keys[0] || testData.Owner != users[0].Username {
+			t.Errorf("returned key had incorrect values. expected key %s and owner %s, got %v\n", keys[0], users[0].Username, testData)
+		}
+	})
+
+	t.Run("TestListKeyNotThere", func(t *testing.T) {
+		testData, err := KVStore.ListKey(wrongKey, admin)
+		if err != KVStore.ErrKeyNotPresent || testData != nil {
+			t.Errorf("able to list non-existent key. Got %s. Error is %v\n", testData, err)
+		}
+	})
+
+}
+
+func TestDepth(t *testing.T) {
+	keys := []string{"key1", "key2", "key3", "key4"}
+	users := []rbac.Identity{rbac.NewIdentity("user1", rbac.RoleWriter), rbac.NewIdentity("user2", rbac.RoleWriter), rbac.NewIdentity("user3", rbac.RoleWriter), rbac.NewIdentity("user4", rbac.RoleWriter)}
+	values := []string{"value1", "value2", "value3", "value4"}
+
+	KVStore.Startup(100, len(keys)-1)
+	defer handleShutdown(t)
+
+	for i := 0; i < len(keys); i++ {
+		if err := KVStore.PutValue(keys[i], users[i], values[i]); err != nil {
+			t.Error("unable to put a value in the kv store", err)
+		}
+	} //key1 should be ejected from the store
+
+	testData, errLookup := KVStore.LookupValue(keys[0], users[0])
+	if errLookup != KVStore.ErrKeyNotPresent || testData != "" {
+		t.Errorf("able to retrieve value from KV store that should have been rejected due to depth. Got %s. Error is %v\n", testData, errLookup)
+	}
+
+}
+
+func TestRoles(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	key := "key"
+	owner := rbac.NewIdentity("test", rbac.RoleWriter)
+	reader := rbac.NewIdentity("test", rbac.RoleReader)
+	operator := rbac.NewIdentity("test", rbac.RoleOperator)
+	admin := rbac.NewIdentity("root", rbac.RoleAdmin)
+	data := "value"
+
+	if err := KVStore.PutValue(key, owner, data); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+
+	if err := KVStore.PutValue(key, reader, "new data"); err != KVStore.ErrUnauthorized {
+		t.Error("able to write a key with only the reader role", err)
+	}
+	if testData, err := KVStore.LookupValue(key, reader); err != nil || testData != data {
+		t.Errorf("reader unable to read their own key. Got %s. Error is %v\n", testData, err)
+	}
+	if testData, err := KVStore.LookupValue(key, operator); err != KVStore.ErrUnauthorized || testData != "" {
+		t.Errorf("able to read a key without the read permission. Got %s. Error is %v\n", testData, err)
+	}
+	if _, err := KVStore.ListStore(operator, false); err != nil {
+		t.Error("operator unable to list the store", err)
+	}
+	if _, err := KVStore.ListStore(rbac.NewIdentity("test"), false); err != KVStore.ErrUnauthorized {
+		t.Error("able to list the store without the list permission", err)
+	}
+	if testData, err := KVStore.LookupValue(key, admin); err != nil || testData != data {
+		t.Errorf("admin unable to read another user's key. Got %s. Error is %v\n", testData, err)
+	}
+	if err := KVStore.Delete(key, admin); err != nil {
+		t.Error("admin unable to delete another user's key", err)
+	}
+}
+
+//listKeys lists the store as the user and returns the names of the keys that came back
+func listKeys(t *testing.T, user rbac.Identity, all bool) ([]string, error) {
+	testJSON, err := KVStore.ListStore(user, all)
+	if err != nil {
+		return nil, err
+	}
+	var testData []KVStore.Key
+	if errJSON := json.Unmarshal(testJSON, &testData); errJSON != nil {
+		t.Error("error unmarshaling store list json", errJSON)
+	}
+	keys := []string{}
+	for _, data := range testData {
+		keys = append(keys, data.Key)
+	}
+	return keys, nil
+}
+
+func TestListFiltering(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	user1 := rbac.NewIdentity("user1", rbac.RoleWriter)
+	user2 := rbac.NewIdentity("user2", rbac.RoleWriter)
+	admin := rbac.NewIdentity("admin", rbac.RoleAdmin)
+
+	puts := []struct {
+		key  string
+		user rbac.Identity
+	}{{"key1", user1}, {"key2", user1}, {"key3", user2}, {"key4", admin}}
+	for _, put := range puts {
+		if err := KVStore.PutValue(put.key, put.user, "value"); err != nil {
+			t.Error("unable to put a value in the kv store", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		user     rbac.Identity
+		all      bool
+		expected []string
+	}{
+		{"OwnKeysOnly", user1, false, []string{"key1", "key2"}},
+		{"OtherUser", user2, false, []string{"key3"}},
+		{"AdminDefault", admin, false, []string{"key4"}},
+		{"AdminAll", admin, true, []string{"key1", "key2", "key3", "key4"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, err := listKeys(t, test.user, test.all)
+			if err != nil {
+				t.Error("unable to list store contents", err)
+			}
+			if len(keys) != len(test.expected) {
+				t.Errorf("expected keys %v, got %v\n", test.expected, keys)
+				return
+			}
+			for _, key := range test.expected {
+				if FindIndex(keys, key) == len(keys) {
+					t.Errorf("expected keys %v, got %v\n", test.expected, keys)
+				}
+			}
+		})
+	}
+
+	t.Run("NonAdminAll", func(t *testing.T) {
+		if _, err := listKeys(t, user1, true); err != KVStore.ErrUnauthorized {
+			t.Error("non admin able to list every key", err)
+		}
+	})
+
+	t.Run("ListOtherUsersKey", func(t *testing.T) {
+		if testData, err := KVStore.ListKey("key3", user1); err != KVStore.ErrKeyNotPresent || testData != nil {
+			t.Errorf("able to list another user's key. Got %s. Error is %v\n", testData, err)
+		}
+		if _, err := KVStore.ListKey("key3", admin); err != nil {
+			t.Error("admin unable to list another user's key", err)
+		}
+	})
+}
+
+func TestScopedIdentity(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	user := rbac.NewIdentity("test", rbac.RoleWriter)
+	scoped := rbac.NewIdentity("test", rbac.RoleWriter)
+	scoped.Scope = &rbac.Scope{KeyPrefix: "batch_", Permissions: rbac.PermRead | rbac.PermList}
+
+	for _, key := range []string{"batch_1", "other"} {
+		if err := KVStore.PutValue(key, user, "value"); err != nil {
+			t.Error("unable to put a value in the kv store", err)
+		}
+	}
+
+	if _, err := KVStore.LookupValue("batch_1", scoped); err != nil {
+		t.Error("scoped identity unable to read a key matching its prefix", err)
+	}
+	if _, err := KVStore.LookupValue("other", scoped); err != KVStore.ErrUnauthorized {
+		t.Error("scoped identity able to read a key outside its prefix", err)
+	}
+	if err := KVStore.PutValue("batch_1", scoped, "new data"); err != KVStore.ErrUnauthorized {
+		t.Error("read only scoped identity able to write", err)
+	}
+	keys, err := listKeys(t, scoped, false)
+	if err != nil || len(keys) != 1 || keys[0] != "batch_1" {
+		t.Errorf("scoped identity listed keys outside its prefix. Got %v. Error is %v\n", keys, err)
+	}
+
+	//a scoped identity can't share or give away its owner's keys, even with write permission or an admin owner
+	writeScoped := rbac.NewIdentity("test", rbac.RoleWriter)
+	writeScoped.Scope = &rbac.Scope{KeyPrefix: "batch_", Permissions: rbac.PermRead | rbac.PermList | rbac.PermWrite}
+	for _, identity := range []rbac.Identity{scoped, writeScoped} {
+		if err := KVStore.SetACL("batch_1", identity, rbac.UserPrincipal("other"), rbac.PermRead); err != KVStore.ErrUnauthorized {
+			t.Error("scoped identity able to change the access control list", err)
+		}
+		if err := KVStore.TransferOwnership("batch_1", identity, "other"); err != KVStore.ErrUnauthorized {
+			t.Error("scoped identity able to transfer ownership", err)
+		}
+	}
+	scopedAdmin := rbac.NewIdentity("admin", rbac.RoleAdmin)
+	scopedAdmin.Scope = &rbac.Scope{Permissions: rbac.PermRead | rbac.PermList | rbac.PermWrite}
+	if _, err := KVStore.LookupValue("other", scopedAdmin); err != KVStore.ErrUnauthorized {
+		t.Error("scoped identity of an admin able to read another user's key", err)
+	}
+}
+
+func TestUsageMetrics(t *testing.T) {
+	KVStore.Startup(100, 2)
+	defer handleShutdown(t)
+	user := rbac.NewIdentity("test", rbac.RoleWriter)
+
+	var output bytes.Buffer
+	readMetrics := func() string {
+		output.Reset()
+		metrics.WriteText(&output)
+		return output.String()
+	}
+	evictions := func() string { //the counter is shared by every test, so only the change is checked
+		text := readMetrics()
+		start := strings.Index(text, "\nkvstore_evictions_total ")
+		return text[start : start+strings.Index(text[start+1:], "\n")+1]
+	}
+
+	evictionsBefore := evictions()
+	KVStore.PutValue("a", user, "12345")
+	KVStore.PutValue("b", user, "1")
+	KVStore.PutValue("b", user, "123")
+	if text := readMetrics(); !strings.Contains(text, "kvstore_keys 2\n") || !strings.Contains(text, "kvstore_bytes 10\n") {
+		t.Errorf("expected 2 keys using 10 bytes, got\n%s", text)
+	}
+	KVStore.PutValue("c", user, "")
+	if text := readMetrics(); !strings.Contains(text, "kvstore_keys 2\n") {
+		t.Errorf("expected the oldest key to be evicted, got\n%s", text)
+	}
+	if evictions() == evictionsBefore {
+		t.Error("expected the eviction to be counted")
+	}
+	KVStore.LookupValue("missing", user)
+	if text := readMetrics(); !strings.Contains(text, `kvstore_operation_errors_total{operation="lookup",error="key not present"}`) {
+		t.Errorf("expected the failed lookup to be counted, got\n%s", text)
+	}
+}
+
+func TestStats(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	writer := rbac.NewIdentity("test", rbac.RoleWriter)
+	admin := rbac.NewIdentity("admin", rbac.RoleAdmin)
+
+	KVStore.PutValue("a", writer, "12345")
+	KVStore.PutValue("b", writer, "123")
+	KVStore.PutValue("c", admin, "1")
+	KVStore.LookupValue("a", writer)
+	KVStore.LookupValue("a", writer)
+	KVStore.LookupValue("a", writer)
+	KVStore.LookupValue("missing", writer)
+
+	if _, err := KVStore.GetStats(writer); err != KVStore.ErrUnauthorized {
+		t.Errorf("expected only admins to see the stats, got %v\n", err)
+	}
+	output, err := KVStore.GetStats(admin)
+	if err != nil {
+		t.Fatal("unable to get the stats", err)
+	}
+	var stats KVStore.Stats
+	if err := json.Unmarshal(output, &stats); err != nil {
+		t.Fatal("stats are not valid JSON", err)
+	}
+	if stats.Keys != 3 || stats.ValueBytes != 9 {
+		t.Errorf("expected 3 keys with 9 bytes of values, got %d keys with %d bytes\n", stats.Keys, stats.ValueBytes)
+	}
+	if stats.Hits != 3 || stats.Misses != 1 || stats.HitRatio != 0.75 {
+		t.Errorf("expected 3 hits and 1 miss, got %d hits, %d misses and a ratio of %v\n", stats.Hits, stats.Misses, stats.HitRatio)
+	}
+	if stats.KeysPerUser["test"] != 2 || stats.KeysPerUser["admin"] != 1 {
+		t.Errorf("expected 2 keys for test and 1 for admin, got %v\n", stats.KeysPerUser)
+	}
+	if stats.MaxDepth != 100 || stats.BufferSize != 100 || stats.Goroutines == 0 || stats.StartedAt.IsZero() {
+		t.Errorf("expected the store settings and runtime details to be filled in, got %+v\n", stats)
+	}
+}
+
+func TestPingAndReady(t *testing.T) {
+	KVStore.Startup(100, 100)
+	if !KVStore.Ready() {
+		t.Error("expected the store to be ready once it has started")
+	}
+	if err := KVStore.Ping(time.Second); err != nil {
+		t.Error("expected the store actor to answer a ping", err)
+	}
+	resume := KVStore.Pause()
+	if err := KVStore.Ping(50 * time.Millisecond); err != KVStore.ErrPingTimeout {
+		t.Errorf("expected a ping to a hung actor to fail with %v, got %v\n", KVStore.ErrPingTimeout, err)
+	}
+	resume()
+	if err := KVStore.Ping(time.Second); err != nil {
+		t.Error("expected the store actor to answer again once it carried on", err)
+	}
+	handleShutdown(t)
+	if KVStore.Ready() {
+		t.Error("expected the store not to be ready after a shutdown")
+	}
+	if err := KVStore.Ping(time.Second); err != KVStore.ErrShutdown {
+		t.Errorf("expected a ping after shutdown to fail with %v, got %v\n", KVStore.ErrShutdown, err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	KVStore.Startup(100, 10)
+	defer handleShutdown(t)
+	user := rbac.NewIdentity("test", rbac.RoleWriter)
+	for i := 0; i < 10; i++ {
+		if err := KVStore.PutValue(fmt.Sprintf("key%d", i), user, "value"); err != nil {
+			t.Fatal("unable to put a value in the kv store", err)
+		}
+		time.Sleep(time.Millisecond) //so the keys have different access times
+	}
+	if _, err := KVStore.LookupValue("key0", user); err != nil { //key0 is now the most recently used
+		t.Fatal("unable to retrieve value from KV store", err)
+	}
+
+	evicted, err := KVStore.Resize(4)
+	if err != nil || evicted != 6 {
+		t.Errorf("expected shrinking to 4 to evict 6 keys, evicted %d. Error is %v\n", evicted, err)
+	}
+	for i, want := range []bool{true, false, false, false, false, false, false, true, true, true} {
+		_, err := KVStore.LookupValue(fmt.Sprintf("key%d", i), user)
+		if (err == nil) != want {
+			t.Errorf("expected key%d to be kept %v, lookup error was %v\n", i, want, err)
+		}
+	}
+
+	evicted, err = KVStore.Resize(20)
+	if err != nil || evicted != 0 {
+		t.Errorf("expected growing the store not to evict anything, evicted %d. Error is %v\n", evicted, err)
+	}
+	for i := 0; i < 10; i++ {
+		KVStore.PutValue(fmt.Sprintf("new%d", i), user, "value")
+	}
+	list, _ := KVStore.ListStore(user, false)
+	var keys []KVStore.Key
+	json.Unmarshal(list, &keys)
+	if len(keys) != 14 {
+		t.Errorf("expected the store to hold 14 keys after growing, got %d\n", len(keys))
+	}
+
+	if _, err := KVStore.Resize(0); err != KVStore.ErrBadRequest {
+		t.Errorf("expected resizing to 0 to fail with %v, got %v\n", KVStore.ErrBadRequest, err)
+	}
+}
@@ -1,99 +1,134 @@
-package KVStore
-
-import (
-	"errors"
-	"time"
-)
-
-var (
-	ErrKeyNotPresent = errors.New("key not present")
-	ErrUnauthorized  = errors.New("user is not authorised to view this key")
-	ErrBadRequest    = errors.New("bad store request")
-	ErrShutdown      = errors.New("the KV store is shutting down")
-)
-
-var kvStore map[string]*Data
-
-var (
-	MaxDepth   int
-	BufferSize int
-)
-
-const StewardTimeout = 10 * time.Second //may want to make this an argument of the startup function
-
-var (
-	//StoreChannel is the channel used to communicate with the actor
-	StoreChannel chan StoreRequest
-	//ShutdownChannel will unblock after a shutdown has been initiated
-	ShutdownChannel chan struct{}
-	//StoreGuardianDoneChan will only unblock after the store guardian has been shut down
-	StoreGuardianDoneChan chan struct{}
-)
-
-const adminUser = "admin"
-
-const (
-	LookupString   = "lookup"
-	PutString      = "put"
-	DeleteString   = "delete"
-	ListString     = "list"
-	ShutdownString = "shutdown"
-)
-
-func Startup(bufferSize int, depth int) error {
-	BufferSize = bufferSize
-	StoreChannel = make(chan StoreRequest, BufferSize)
-	kvStore = map[string]*Data{}
-	MaxDepth = depth
-	ShutdownChannel = make(chan struct{})
-	StoreGuardianDoneChan = ListenForStoreRequests(StewardTimeout)
-	return nil //no scope for errors currently, but may happen in the future iterations
-}
-
-func Shutdown() error {
-	request := StoreRequest{command: ShutdownString}
-	select {
-	case <-ShutdownChannel: //Already initiated shutdown
-		return ErrShutdown
-	default:
-		close(ShutdownChannel)
-	}
-	//closing the store guardian by sending a message instead of closing the store channel
-	//This will prevent a panic if another endpoint tries to send a request before shutdown completes
-	StoreChannel <- request //Tell store guardian to initiate shutdown
-	<-StoreGuardianDoneChan //Wait for guardian to receive message and initiate shutdown
-	close(StoreChannel)
-	//could add a wait group in here to wait for all processes to receive and handle their results,
-	//but probably unnecessary and could lead to deadlock if one of the processes dies
-	return nil
-}
-
-func LookupValue(key, user string) (string, error) {
-	request := StoreRequest{command: LookupString, data: StoreData{key: key, user: user}}
-	response := MakeRequest(request)
-	return response.value, response.err
-}
-
-func PutValue(key, user, value string) error {
-	request := StoreRequest{command: PutString, data: StoreData{key: key, user: user, value: value}}
-	response := MakeRequest(request)
-	return response.err
-}
-
-func Delete(key, user string) error {
-	request := StoreRequest{command: DeleteString, data: StoreData{key: key, user: user}}
-	response := MakeRequest(request)
-	return response.err
-}
-
-func ListStore() ([]byte, error) {
-	request := StoreRequest{command: ListString, data: StoreData{}}
-	response := MakeRequest(request)
-	return response.json, response.err
-}
-
-func ListKey(key string) ([]byte, error) {
-	request := StoreRequest{command: ListString, data: StoreData{key: key}}
-	response := MakeRequest(request)
-	return response.json, response.err
-}
+package KVStore
+
+import (
+	"errors"
+	"store/rbac"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrKeyNotPresent = errors.New("key not present")
+	ErrUnauthorized  = errors.New("user is not authorised to view this key")
+	ErrBadRequest    = errors.New("bad store request")
+	ErrShutdown      = errors.New("the KV store is shutting down")
+)
+
+var kvStore map[string]map[string]*Data //namespace -> key -> data. Only the "" namespace is used unless Namespaced is set
+
+var (
+	MaxDepth   int
+	BufferSize int
+	//Namespaced gives every user their own keyspace, so two users can both have a key with the same name.
+	//Must be set before Startup
+	Namespaced bool
+	//Clustered records the time the leader proposed each write as the key's access time, and doesn't count reads,
+	//so every node in a cluster evicts the same keys. Must be set before Startup
+	Clustered bool
+)
+
+//StewardTimeout is how long the store guardian waits to hear from the monitor before restarting it. Must be set before Startup
+var StewardTimeout = 10 * time.Second
+
+var (
+	//StoreChannel is the channel used to communicate with the actor
+	StoreChannel chan StoreRequest
+	//ShutdownChannel will unblock after a shutdown has been initiated
+	ShutdownChannel chan struct{}
+	//StoreGuardianDoneChan will only unblock after the store guardian has been shut down
+	StoreGuardianDoneChan chan struct{}
+)
+
+const (
+	LookupString   = "lookup"
+	PutString      = "put"
+	DeleteString   = "delete"
+	ListString     = "list"
+	GetACLString   = "getacl"
+	SetACLString   = "setacl"
+	TransferString = "transfer"
+	StatsString    = "stats"
+	PingString     = "ping"
+	PauseString    = "pause"
+	ResizeString   = "resize"
+	SnapshotString = "snapshot"
+	RestoreString  = "restore"
+	ApplyString    = "apply"
+	ExportString   = "export"
+	ImportString   = "import"
+	ReleaseString  = "release"
+	ShutdownString = "shutdown"
+)
+
+func Startup(bufferSize int, depth int) error {
+	BufferSize = bufferSize
+	StoreChannel = make(chan StoreRequest, BufferSize)
+	kvStore = map[string]map[string]*Data{}
+	resetUsage()
+	resetStats()
+	resetMutations()
+	MaxDepth = depth
+	ShutdownChannel = make(chan struct{})
+	StoreGuardianDoneChan = ListenForStoreRequests(StewardTimeout)
+	//anything that has to be loaded before requests are served should happen before the store is marked ready
+	atomic.StoreInt32(&ready, 1)
+	return nil //no scope for errors currently, but may happen in the future iterations
+}
+
+func Shutdown() error {
+	request := StoreRequest{command: ShutdownString}
+	atomic.StoreInt32(&ready, 0)
+	select {
+	case <-ShutdownChannel: //Already initiated shutdown
+		return ErrShutdown
+	default:
+		close(ShutdownChannel)
+	}
+	//closing the store guardian by sending a message instead of closing the store channel
+	//This will prevent a panic if another endpoint tries to send a request before shutdown completes
+	StoreChannel <- request //Tell store guardian to initiate shutdown
+	<-StoreGuardianDoneChan //Wait for guardian to receive message and initiate shutdown
+	close(StoreChannel)
+	//could add a wait group in here to wait for all processes to receive and handle their results,
+	//but probably unnecessary and could lead to deadlock if one of the processes dies
+	return nil
+}
+
+//Resize changes MaxDepth while the store is running, evicting the least recently used keys from any namespace that is now over it.
+//It returns how many keys were evicted
+func Resize(depth int) (int, error) {
+	if depth <= 0 {
+		return 0, ErrBadRequest
+	}
+	request := StoreRequest{command: ResizeString, data: StoreData{depth: depth}}
+	response := MakeRequest(request)
+	return response.count, response.err
+}
+
+func LookupValue(key string, user rbac.Identity) (string, error) {
+	return LookupValueIn(DefaultNamespace(user), key, user)
+}
+
+func PutValue(key string, user rbac.Identity, value string) error {
+	return PutValueIn(DefaultNamespace(user), key, user, value)
+}
+
+func Delete(key string, user rbac.Identity) error {
+	return DeleteIn(DefaultNamespace(user), key, user)
+}
+
+//ListStore lists the keys the user owns or that have been shared with them.
+//If all is set every key in the store is listed instead, which is only allowed for admins
+func ListStore(user rbac.Identity, all bool) ([]byte, error) {
+	return background.ListStore(user, all)
+}
+
+func (s Store) ListStore(user rbac.Identity, all bool) ([]byte, error) {
+	request := StoreRequest{ctx: s.ctx, command: ListString, data: StoreData{user: user, all: all}}
+	response := MakeRequest(request)
+	return response.json, response.err
+}
+
+func ListKey(key string, user rbac.Identity) ([]byte, error) {
+	return ListKeyIn(DefaultNamespace(user), key, user)
+}
@@ -0,0 +1,174 @@
+package KVStore
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"store/rbac"
+)
+
+var (
+	ErrBadPermission = errors.New("only read, write and delete can be granted on a key")
+	ErrKeyExists     = errors.New("the new owner already has a key with that name")
+	ErrNamespaceFull = errors.New("the new owner has no room for another key")
+)
+
+//grantablePermissions are the only permissions that can be shared through a key's access control list
+const grantablePermissions = rbac.PermRead | rbac.PermWrite | rbac.PermDelete
+
+//ACLEntry is a single grant in a key's access control list
+type ACLEntry struct {
+	Principal   string   `json:"principal"`
+	Permissions []string `json:"permissions"`
+}
+
+//ACL is used to return a key's owner and access control list, sorted by principal
+type ACL struct {
+	Key     string     `json:"key"`
+	Owner   string     `json:"owner"`
+	Entries []ACLEntry `json:"entries"`
+}
+
+//Data.granted returns the permissions granted to the user by the access control list, either directly or through one of their groups
+func (d *Data) granted(user rbac.Identity) rbac.Permission {
+	perms := rbac.PermNone
+	for _, principal := range user.Principals() {
+		perms |= d.acl[principal]
+	}
+	return perms
+}
+
+//Data.canSee checks if the key should be visible to the user at all, i.e. they own it, are an admin or it has been shared with them
+func (d *Data) canSee(user rbac.Identity) bool {
+	return d.ownedOrShared(user) || user.IsAdmin()
+}
+
+//Data.ownedOrShared checks if the user owns the key or has been granted access to it. Unlike canSee, admins are not special
+func (d *Data) ownedOrShared(user rbac.Identity) bool {
+	return user.Username == d.owner || d.granted(user) != rbac.PermNone
+}
+
+//Data.canManage checks if the user is allowed to change the access control list or owner of the key.
+//This needs write permission, and is never allowed for scoped identities, so an API key can't hand its owner's keys out
+func (d *Data) canManage(user rbac.Identity) bool {
+	if !user.Can(rbac.PermWrite) || user.Scope != nil {
+		return false
+	}
+	return user.Username == d.owner || user.IsAdmin()
+}
+
+func GetACL(key string, user rbac.Identity) ([]byte, error) {
+	return GetACLIn(DefaultNamespace(user), key, user)
+}
+
+func GetACLIn(namespace, key string, user rbac.Identity) ([]byte, error) {
+	return background.GetACLIn(namespace, key, user)
+}
+
+func (s Store) GetACLIn(namespace, key string, user rbac.Identity) ([]byte, error) {
+	request := StoreRequest{ctx: s.ctx, command: GetACLString, data: StoreData{namespace: namespace, key: key, user: user}}
+	response := makeNamespacedRequest(request)
+	return response.json, response.err
+}
+
+//SetACL replaces the permissions granted to the principal on the key. Granting rbac.PermNone removes the principal from the list
+func SetACL(key string, user rbac.Identity, principal string, perm rbac.Permission) error {
+	return SetACLIn(DefaultNamespace(user), key, user, principal, perm)
+}
+
+func SetACLIn(namespace, key string, user rbac.Identity, principal string, perm rbac.Permission) error {
+	return background.SetACLIn(namespace, key, user, principal, perm)
+}
+
+func (s Store) SetACLIn(namespace, key string, user rbac.Identity, principal string, perm rbac.Permission) error {
+	request := StoreRequest{ctx: s.ctx, command: SetACLString, data: StoreData{namespace: namespace, key: key, user: user, principal: principal, perm: perm}}
+	response := makeNamespacedRequest(request)
+	return response.err
+}
+
+//TransferOwnership makes newOwner the owner of the key. The access control list is kept.
+//In namespaced mode the key is also moved into the new owner's namespace
+func TransferOwnership(key string, user rbac.Identity, newOwner string) error {
+	return TransferOwnershipIn(DefaultNamespace(user), key, user, newOwner)
+}
+
+func TransferOwnershipIn(namespace, key string, user rbac.Identity, newOwner string) error {
+	return background.TransferOwnershipIn(namespace, key, user, newOwner)
+}
+
+func (s Store) TransferOwnershipIn(namespace, key string, user rbac.Identity, newOwner string) error {
+	request := StoreRequest{ctx: s.ctx, command: TransferString, data: StoreData{namespace: namespace, key: key, user: user, value: newOwner}}
+	response := makeNamespacedRequest(request)
+	return response.err
+}
+
+func directGetACL(namespace, key string, user rbac.Identity) ([]byte, error) {
+	data, present := directGetData(namespace, key)
+	if !present {
+		return nil, ErrKeyNotPresent
+	}
+	if !data.canManage(user) || !user.CanAccessKey(key) {
+		return nil, ErrUnauthorized
+	}
+	output := ACL{Key: key, Owner: data.owner, Entries: []ACLEntry{}}
+	for principal, perms := range data.acl {
+		output.Entries = append(output.Entries, ACLEntry{Principal: principal, Permissions: perms.Names()})
+	}
+	sort.Slice(output.Entries, func(i, j int) bool { return output.Entries[i].Principal < output.Entries[j].Principal })
+	jsonOut, errJSON := json.Marshal(output)
+	if errJSON != nil {
+		return nil, errJSON
+	}
+	return jsonOut, nil
+}
+
+func directSetACL(namespace, key string, user rbac.Identity, principal string, perm rbac.Permission) error {
+	if perm&^grantablePermissions != 0 {
+		return ErrBadPermission
+	}
+	principal, err := rbac.ParsePrincipal(principal)
+	if err != nil {
+		return err
+	}
+	data, present := directGetData(namespace, key)
+	if !present {
+		return ErrKeyNotPresent
+	}
+	if !data.canManage(user) || !user.CanAccessKey(key) {
+		return ErrUnauthorized
+	}
+	if perm == rbac.PermNone {
+		delete(data.acl, principal)
+		return nil
+	}
+	if data.acl == nil {
+		data.acl = map[string]rbac.Permission{}
+	}
+	data.acl[principal] = perm
+	return nil
+}
+
+func directTransferOwnership(namespace, key string, user rbac.Identity, newOwner string) error {
+	if newOwner == "" {
+		return ErrBadRequest
+	}
+	data, present := directGetData(namespace, key)
+	if !present {
+		return ErrKeyNotPresent
+	}
+	if !data.canManage(user) || !user.CanAccessKey(key) {
+		return ErrUnauthorized
+	}
+	if namespace != "" && namespace != newOwner { //the key has to move so that it stays in its owner's namespace
+		if _, exists := directGetData(newOwner, key); exists {
+			return ErrKeyExists
+		}
+		if len(kvStore[newOwner]) >= MaxDepth { //refused rather than evicting, which could remove the key being transferred
+			return ErrNamespaceFull
+		}
+		directDeleteData(namespace, key)
+		directSetData(newOwner, key, data)
+	}
+	data.owner = newOwner
+	return nil
+}
@@ -0,0 +1,155 @@
+package KVStore_test
+
+import (
+	"encoding/json"
+	"store/KVStore"
+	"store/rbac"
+	"testing"
+)
+
+func TestShareWithUser(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	key := "key"
+	owner := rbac.NewIdentity("owner", rbac.RoleWriter)
+	friend := rbac.NewIdentity("friend", rbac.RoleWriter)
+	data := "value"
+
+	if err := KVStore.PutValue(key, owner, data); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+	if err := KVStore.SetACL(key, owner, rbac.UserPrincipal(friend.Username), rbac.PermRead); err != nil {
+		t.Error("unable to share a key", err)
+	}
+
+	if testData, err := KVStore.LookupValue(key, friend); err != nil || testData != data {
+		t.Errorf("unable to read a shared key. Got %s. Error is %v\n", testData, err)
+	}
+	if err := KVStore.PutValue(key, friend, "new data"); err != KVStore.ErrUnauthorized {
+		t.Error("able to write a key that was only shared for reading", err)
+	}
+	if err := KVStore.SetACL(key, friend, rbac.UserPrincipal(friend.Username), rbac.PermWrite); err != KVStore.ErrUnauthorized {
+		t.Error("able to change the acl of a key owned by someone else", err)
+	}
+
+	if err := KVStore.SetACL(key, owner, rbac.UserPrincipal(friend.Username), rbac.PermNone); err != nil {
+		t.Error("unable to revoke access to a key", err)
+	}
+	if _, err := KVStore.LookupValue(key, friend); err != KVStore.ErrUnauthorized {
+		t.Error("able to read a key after access was revoked", err)
+	}
+}
+
+func TestShareWithGroup(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	key := "key"
+	owner := rbac.NewIdentity("owner", rbac.RoleWriter)
+	member := rbac.Identity{Username: "member", Roles: []rbac.Role{rbac.RoleWriter}, Groups: []string{"devs"}}
+	reader := rbac.Identity{Username: "reader", Roles: []rbac.Role{rbac.RoleReader}, Groups: []string{"devs"}}
+	outsider := rbac.NewIdentity("outsider", rbac.RoleWriter)
+
+	if err := KVStore.PutValue(key, owner, "value"); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+	if err := KVStore.SetACL(key, owner, rbac.GroupPrincipal("devs"), rbac.PermRead|rbac.PermWrite); err != nil {
+		t.Error("unable to share a key with a group", err)
+	}
+
+	if err := KVStore.PutValue(key, member, "new data"); err != nil {
+		t.Error("group member unable to write a shared key", err)
+	}
+	if err := KVStore.PutValue(key, reader, "newer data"); err != KVStore.ErrUnauthorized {
+		t.Error("acl granted more than the user's role allows", err)
+	}
+	if _, err := KVStore.LookupValue(key, outsider); err != KVStore.ErrUnauthorized {
+		t.Error("able to read a key shared with a group the user is not in", err)
+	}
+	if err := KVStore.Delete(key, member); err != KVStore.ErrUnauthorized {
+		t.Error("able to delete a key that was not shared for deleting", err)
+	}
+}
+
+func TestBadACL(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	key := "key"
+	owner := rbac.NewIdentity("owner", rbac.RoleWriter)
+
+	if err := KVStore.PutValue(key, owner, "value"); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+	if err := KVStore.SetACL(key, owner, "bob", rbac.PermRead); err != rbac.ErrInvalidPrincipal {
+		t.Error("able to use a malformed principal", err)
+	}
+	if err := KVStore.SetACL(key, owner, "user:bob", rbac.PermShutdown); err != KVStore.ErrBadPermission {
+		t.Error("able to grant a permission that does not apply to keys", err)
+	}
+	if err := KVStore.SetACL("wrong", owner, "user:bob", rbac.PermRead); err != KVStore.ErrKeyNotPresent {
+		t.Error("able to set the acl of a non-existent key", err)
+	}
+}
+
+func TestTransferOwnership(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	key := "key"
+	owner := rbac.NewIdentity("owner", rbac.RoleWriter)
+	newOwner := rbac.NewIdentity("newOwner", rbac.RoleWriter)
+
+	if err := KVStore.PutValue(key, owner, "value"); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+	if err := KVStore.TransferOwnership(key, newOwner, newOwner.Username); err != KVStore.ErrUnauthorized {
+		t.Error("able to take ownership of someone else's key", err)
+	}
+	if err := KVStore.TransferOwnership(key, owner, newOwner.Username); err != nil {
+		t.Error("unable to transfer ownership", err)
+	}
+	if err := KVStore.PutValue(key, owner, "new data"); err != KVStore.ErrUnauthorized {
+		t.Error("previous owner still able to write the key", err)
+	}
+
+	testJSON, err := KVStore.GetACL(key, newOwner)
+	if err != nil {
+		t.Error("new owner unable to view the acl", err)
+	}
+	var acl KVStore.ACL
+	if errJSON := json.Unmarshal(testJSON, &acl); errJSON != nil || acl.Owner != newOwner.Username {
+		t.Errorf("acl has the wrong owner. Got %v. Error is %v\n", acl, errJSON)
+	}
+}
+
+func TestListShared(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	owner := rbac.NewIdentity("owner", rbac.RoleWriter)
+	friend := rbac.NewIdentity("friend", rbac.RoleWriter)
+
+	for _, key := range []string{"private", "shared"} {
+		if err := KVStore.PutValue(key, owner, "value"); err != nil {
+			t.Error("unable to put a value in the kv store", err)
+		}
+	}
+	if err := KVStore.SetACL("shared", owner, rbac.UserPrincipal(friend.Username), rbac.PermRead); err != nil {
+		t.Error("unable to share a key", err)
+	}
+
+	testJSON, err := KVStore.ListStore(friend, false)
+	if err != nil {
+		t.Error("unable to list store contents", err)
+	}
+	var testData []KVStore.Key
+	if errJSON := json.Unmarshal(testJSON, &testData); errJSON != nil {
+		t.Error("error unmarshaling store list json", errJSON)
+	}
+	if len(testData) != 1 || testData[0].Key != "shared" {
+		t.Errorf("expected only the shared key to be listed, got %v\n", testData)
+	} else if len(testData[0].Permissions) != 1 || testData[0].Permissions[0] != "read" {
+		t.Errorf("expected the shared key to be listed as read only, got %v\n", testData[0].Permissions)
+	}
+
+	if _, err := KVStore.ListKey("private", friend); err != KVStore.ErrKeyNotPresent {
+		t.Error("expected a key that has not been shared to look missing", err)
+	}
+}
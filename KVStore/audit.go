@@ -0,0 +1,50 @@
+package KVStore
+
+import (
+	"context"
+	"store/audit"
+	"store/logging"
+	"store/rbac"
+)
+
+//directVersion returns the number of writes to the key, or zero if it isn't in the store
+func directVersion(namespace, key string) int {
+	data, present := directGetData(namespace, key)
+	if !present {
+		return 0
+	}
+	return data.writes
+}
+
+//auditMutation records a change to the store, or a refused attempt at one, in the audit log.
+//The event is only queued, so the actor never waits for the audit log to be written or verified
+func auditMutation(ctx context.Context, action string, data StoreData, err error, oldVersion, newVersion int) {
+	event := audit.Event{
+		RequestID:  logging.RequestID(ctx),
+		Action:     action,
+		User:       data.user.Username,
+		Key:        data.key,
+		Namespace:  data.namespace,
+		OldVersion: oldVersion,
+		NewVersion: newVersion,
+	}
+	switch action {
+	case audit.ActionSetACL:
+		event.Detail = data.principal + " " + data.perm.String()
+		if data.perm == rbac.PermNone {
+			event.Detail = data.principal + " removed"
+		}
+	case audit.ActionTransfer:
+		event.Detail = "to " + data.value
+	}
+	switch err {
+	case nil:
+		event.Outcome = audit.OutcomeSuccess
+	case ErrUnauthorized:
+		event.Outcome = audit.OutcomeDenied
+	default:
+		event.Outcome = audit.OutcomeFailure
+		event.Detail = err.Error()
+	}
+	audit.Record(event)
+}
@@ -0,0 +1,60 @@
+package KVStore_test
+
+import (
+	"context"
+	"path/filepath"
+	"store/KVStore"
+	"store/audit"
+	"store/logging"
+	"store/rbac"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logging.SetupLoggers("../info.log", "../htaccess.log", false) //the audit log writes to the loggers
+	defer logging.Shutdown()
+	m.Run()
+}
+
+func TestAuditMutations(t *testing.T) {
+	if err := audit.Open(filepath.Join(t.TempDir(), "audit.log")); err != nil {
+		t.Fatal("unable to open audit log", err)
+	}
+	defer audit.Close()
+
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	owner := rbac.NewIdentity("user_a", rbac.RoleWriter)
+	other := rbac.NewIdentity("user_b", rbac.RoleWriter)
+	KVStore.PutValue("key", owner, "one")
+	KVStore.PutValue("key", owner, "two")
+	KVStore.PutValue("key", other, "three")
+	KVStore.Delete("key", owner)
+
+	events, err := audit.Query(audit.Filter{Key: "key"})
+	if err != nil || len(events) != 4 {
+		t.Fatalf("expected 4 audit events, got %d %v\n", len(events), err)
+	}
+	expected := []audit.Event{
+		{Action: audit.ActionPut, User: "user_a", Outcome: audit.OutcomeSuccess, OldVersion: 0, NewVersion: 1},
+		{Action: audit.ActionPut, User: "user_a", Outcome: audit.OutcomeSuccess, OldVersion: 1, NewVersion: 2},
+		{Action: audit.ActionPut, User: "user_b", Outcome: audit.OutcomeDenied, OldVersion: 2, NewVersion: 2},
+		{Action: audit.ActionDelete, User: "user_a", Outcome: audit.OutcomeSuccess, OldVersion: 2, NewVersion: 0},
+	}
+	for i, want := range expected {
+		got := events[i]
+		if got.Action != want.Action || got.User != want.User || got.Outcome != want.Outcome || got.OldVersion != want.OldVersion || got.NewVersion != want.NewVersion {
+			t.Errorf("event %d: expected %+v, got %+v\n", i, want, got)
+		}
+	}
+
+	//the request ID is carried through the actor into the audit log
+	ctx := logging.WithRequestID(context.Background(), "req-1")
+	if err := KVStore.WithContext(ctx).PutValueIn("", "traced", owner, "value"); err != nil {
+		t.Fatal("unable to put with a context", err)
+	}
+	events, err = audit.Query(audit.Filter{Key: "traced"})
+	if err != nil || len(events) != 1 || events[0].RequestID != "req-1" {
+		t.Errorf("request ID was not recorded %+v %v\n", events, err)
+	}
+}
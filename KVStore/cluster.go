@@ -0,0 +1,159 @@
+package KVStore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"store/logging"
+	"store/rbac"
+	"store/tracing"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNotLeader          = errors.New("this node is not the cluster leader")
+	ErrClusterUnavailable = errors.New("the cluster was unable to commit the request in time")
+)
+
+//ClusterTimeout is how long a request waits for the cluster to commit a write, or to be sure a read is up to date
+var ClusterTimeout = 5 * time.Second
+
+//Consensus commits the store's writes across a cluster, so that every node makes them in the same order
+type Consensus interface {
+	//Propose commits the command and waits for this node to apply it, returning what ClusterStateMachine.Apply returned.
+	//It returns ErrNotLeader if this node can't commit commands
+	Propose(ctx context.Context, command []byte) (interface{}, error)
+	//ReadIndex waits until this node has applied every command committed before it was called.
+	//It returns ErrNotLeader if this node can't be sure of that
+	ReadIndex(ctx context.Context) error
+}
+
+//consensus holds a consensusHolder, as an atomic.Value can't hold nil
+var consensus atomic.Value
+
+type consensusHolder struct {
+	Consensus
+}
+
+//SetConsensus sends every write through the cluster before the actor makes it, and makes every read wait until this node is up to date.
+//nil goes back to the store acting on its own
+func SetConsensus(c Consensus) {
+	consensus.Store(consensusHolder{c})
+}
+
+func currentConsensus() Consensus {
+	holder, _ := consensus.Load().(consensusHolder)
+	return holder.Consensus
+}
+
+//Command is a write to the store, as committed to the cluster's log
+type Command struct {
+	Op        string          `json:"op"`
+	Namespace string          `json:"namespace,omitempty"`
+	Key       string          `json:"key,omitempty"`
+	User      rbac.Identity   `json:"user"`
+	Value     string          `json:"value,omitempty"`
+	Principal string          `json:"principal,omitempty"`
+	Perm      rbac.Permission `json:"perm,omitempty"`
+	Depth     int             `json:"depth,omitempty"`
+	At        time.Time       `json:"at"`                  //when the leader proposed it, which every node records as the key's access time
+	RequestID string          `json:"requestId,omitempty"` //so the logs and audit events on every node can be matched up with the request
+}
+
+var (
+	//clusteredWrites change the store, so are committed by the cluster before the actor makes them
+	clusteredWrites = map[string]bool{PutString: true, DeleteString: true, SetACLString: true, TransferString: true, ResizeString: true}
+	//clusteredReads have to see every write committed before them
+	clusteredReads = map[string]bool{LookupString: true, ListString: true, GetACLString: true}
+)
+
+//needsCluster checks if the request has to go through the cluster before it reaches the actor
+func needsCluster(request StoreRequest) bool {
+	return !request.ordered && (clusteredWrites[request.command] || clusteredReads[request.command])
+}
+
+//makeClusteredRequest commits a write to the cluster, which applies it on every node, or waits until a read will be up to date
+func makeClusteredRequest(consensus Consensus, request StoreRequest) StoreResponse {
+	var span *tracing.Span
+	request.ctx, span = tracing.Start(request.ctx, "cluster "+request.command)
+	defer span.End()
+	ctx, cancel := context.WithTimeout(request.ctx, ClusterTimeout)
+	defer cancel()
+
+	if clusteredWrites[request.command] {
+		command, err := json.Marshal(Command{
+			Op:        request.command,
+			Namespace: request.data.namespace,
+			Key:       request.data.key,
+			User:      request.data.user,
+			Value:     request.data.value,
+			Principal: request.data.principal,
+			Perm:      request.data.perm,
+			Depth:     request.data.depth,
+			At:        time.Now(),
+			RequestID: logging.RequestID(request.ctx),
+		})
+		if err != nil {
+			span.SetError(err)
+			return StoreResponse{err: err}
+		}
+		result, err := consensus.Propose(ctx, command)
+		if err != nil {
+			span.SetError(err)
+			return StoreResponse{err: err}
+		}
+		response, _ := result.(StoreResponse)
+		return response
+	}
+
+	if err := consensus.ReadIndex(ctx); err != nil {
+		span.SetError(err)
+		return StoreResponse{err: err}
+	}
+	request.ordered = true
+	return MakeRequest(request)
+}
+
+//ClusterStateMachine applies the writes committed by the cluster to the store. They go through the actor like any other request
+type ClusterStateMachine struct{}
+
+func (ClusterStateMachine) Apply(command []byte) interface{} {
+	var c Command
+	if err := json.Unmarshal(command, &c); err != nil || !clusteredWrites[c.Op] {
+		logging.ErrorLogger.Println("unable to apply a command committed by the cluster", string(command), err)
+		return StoreResponse{err: ErrBadRequest}
+	}
+	request := StoreRequest{
+		ctx:     logging.WithRequestID(context.Background(), c.RequestID),
+		command: c.Op,
+		ordered: true,
+		data: StoreData{
+			namespace: c.Namespace,
+			key:       c.Key,
+			user:      c.User,
+			value:     c.Value,
+			principal: c.Principal,
+			perm:      c.Perm,
+			depth:     c.Depth,
+			at:        c.At,
+		},
+	}
+	return MakeRequest(request)
+}
+
+func (ClusterStateMachine) Snapshot() ([]byte, error) {
+	snapshot, err := TakeSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(snapshot)
+}
+
+func (ClusterStateMachine) Restore(data []byte) error {
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	return Restore(snapshot)
+}
@@ -0,0 +1,122 @@
+package KVStore_test
+
+import (
+	"context"
+	"encoding/json"
+	"store/KVStore"
+	"store/rbac"
+	"testing"
+	"time"
+)
+
+//fakeConsensus commits every command straight away, as a cluster of one would
+type fakeConsensus struct {
+	leader   bool
+	commands []KVStore.Command
+	reads    int
+}
+
+func (c *fakeConsensus) Propose(ctx context.Context, command []byte) (interface{}, error) {
+	if !c.leader {
+		return nil, KVStore.ErrNotLeader
+	}
+	var decoded KVStore.Command
+	if err := json.Unmarshal(command, &decoded); err != nil {
+		return nil, err
+	}
+	c.commands = append(c.commands, decoded)
+	return KVStore.ClusterStateMachine{}.Apply(command), nil
+}
+
+func (c *fakeConsensus) ReadIndex(ctx context.Context) error {
+	if !c.leader {
+		return KVStore.ErrNotLeader
+	}
+	c.reads++
+	return nil
+}
+
+func TestClusteredRequests(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	consensus := &fakeConsensus{leader: true}
+	KVStore.SetConsensus(consensus)
+	defer KVStore.SetConsensus(nil)
+
+	owner := rbac.NewIdentity("owner", rbac.RoleWriter)
+	if err := KVStore.PutValue("a", owner, "1"); err != nil {
+		t.Fatal("unable to put a through the cluster", err)
+	}
+	if err := KVStore.SetACL("a", owner, "user:friend", rbac.PermRead); err != nil {
+		t.Fatal("unable to set an ACL through the cluster", err)
+	}
+	if len(consensus.commands) != 2 || consensus.commands[0].Op != "put" || consensus.commands[0].Value != "1" || consensus.commands[0].At.IsZero() {
+		t.Fatalf("expected both writes to be committed, with the time they were proposed, got %+v", consensus.commands)
+	}
+	if value, err := KVStore.LookupValue("a", owner); err != nil || value != "1" {
+		t.Errorf("expected a to be 1 once committed, got %q. Error is %v", value, err)
+	}
+	if consensus.reads != 1 {
+		t.Errorf("expected the lookup to wait for the cluster once, got %d", consensus.reads)
+	}
+	if err := KVStore.Ping(time.Second); err != nil || consensus.reads != 1 || len(consensus.commands) != 2 {
+		t.Errorf("expected a ping not to go through the cluster, got %d reads and %d commands. Error is %v", consensus.reads, len(consensus.commands), err)
+	}
+
+	consensus.leader = false
+	if err := KVStore.PutValue("b", owner, "2"); err != KVStore.ErrNotLeader {
+		t.Errorf("expected a write on a follower to fail with %v, got %v", KVStore.ErrNotLeader, err)
+	}
+	if _, err := KVStore.LookupValue("a", owner); err != KVStore.ErrNotLeader {
+		t.Errorf("expected a read on a node that can't reach the leader to fail with %v, got %v", KVStore.ErrNotLeader, err)
+	}
+}
+
+func TestClusteredEviction(t *testing.T) {
+	KVStore.Clustered = true
+	defer func() { KVStore.Clustered = false }()
+	KVStore.Startup(100, 2)
+	owner := rbac.NewIdentity("owner", rbac.RoleWriter)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	apply := func(key string, at int) {
+		t.Helper()
+		command, _ := json.Marshal(KVStore.Command{Op: "put", Key: key, User: owner, Value: key, At: start.Add(time.Duration(at) * time.Second)})
+		if response := (KVStore.ClusterStateMachine{}).Apply(command); response == nil {
+			t.Fatal("expected a response to", key)
+		}
+	}
+	present := func(key string) bool {
+		_, err := KVStore.LookupValue(key, owner)
+		return err == nil
+	}
+
+	apply("b", 1)
+	apply("a", 1)
+	KVStore.LookupValue("b", owner) //reads aren't committed, so mustn't change which key is evicted
+	apply("c", 2)
+	if present("a") || !present("b") || !present("c") {
+		t.Errorf("expected the key that sorts first to be evicted when both were accessed at the same time")
+	}
+	data, err := (KVStore.ClusterStateMachine{}).Snapshot()
+	if err != nil {
+		t.Fatal("unable to snapshot the store", err)
+	}
+	handleShutdown(t)
+
+	//a new node, restored from the snapshot, has to evict the same keys
+	KVStore.Startup(100, 2)
+	defer handleShutdown(t)
+	if err := (KVStore.ClusterStateMachine{}).Restore(data); err != nil {
+		t.Fatal("unable to restore the snapshot", err)
+	}
+	apply("d", 3)
+	if present("b") || !present("c") || !present("d") {
+		t.Errorf("expected b to be evicted, as the snapshot records when it was last written")
+	}
+	if response := (KVStore.ClusterStateMachine{}).Apply([]byte(`{"op":"shutdown"}`)); response == nil {
+		t.Error("expected a response to a command the cluster can't commit")
+	}
+	if !present("d") {
+		t.Error("expected the store to still be running after a bad command")
+	}
+}
@@ -0,0 +1,20 @@
+package KVStore
+
+import "context"
+
+//Store makes requests on behalf of a single incoming request. Its context travels with each request to the actor,
+//so the request ID it carries shows up in the store's logs and audit events
+type Store struct {
+	ctx context.Context
+}
+
+//background is used by the package level functions, which aren't tied to any particular request
+var background = Store{ctx: context.Background()}
+
+//WithContext returns a Store whose requests carry ctx
+func WithContext(ctx context.Context) Store {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return Store{ctx: ctx}
+}
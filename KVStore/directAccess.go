@@ -1,155 +1,274 @@
-package KVStore
-
-import (
-	"encoding/json"
-	"fmt"
-	"time"
-)
-
-//Data stores all information relevant to a key
-type Data struct {
-	owner        string
-	value        string
-	reads        int
-	writes       int
-	lastAccessed time.Time
-}
-
-//Data.isAuthorised checks if the user is authorised to access that data
-func (d *Data) isAuthorised(user string) bool {
-	return user == d.owner || user == adminUser
-}
-
-//Data.getValue returns the current value of the data and also updates the access timestamp
-func (d *Data) getValue() string {
-	d.reads++
-	d.lastAccessed = time.Now()
-	return d.value
-}
-
-//Data.setValue sets the current value of the data and also updates the access timestamp
-func (d *Data) setValue(value string) {
-	d.writes++
-	d.lastAccessed = time.Now()
-	d.value = value
-}
-
-//NewData initialises a (pointer to) an instance of a Data struct, initialising the number of writes to 1 and reads to 0
-//it also initialises the timestamp to now
-func NewData(owner string, value string) *Data {
-	d := Data{
-		owner:        owner,
-		value:        value,
-		lastAccessed: time.Now(),
-		writes:       1,
-		reads:        0,
-	}
-	return &d
-}
-
-//Key is a struct used to return information about a key, excluding its value. Used by the list functions
-type Key struct {
-	Key    string `json:"key"`
-	Owner  string `json:"owner"`
-	Writes int    `json:"writes"`
-	Reads  int    `json:"reads"`
-	Age    int64  `json:"age"`
-}
-
-func directRemoveOldKeys() {
-	for len(kvStore) > MaxDepth { //Should only run once, but no harm in being certain
-		var oldestKey string
-		oldestTime := time.Now()
-		for key, data := range kvStore {
-			if data.lastAccessed.Before(oldestTime) {
-				oldestTime = data.lastAccessed
-				oldestKey = key
-			}
-		}
-		delete(kvStore, oldestKey)
-	}
-}
-
-func directLookupValue(key, user string) (string, error) {
-	value, present := kvStore[key]
-	if !present {
-		return "", ErrKeyNotPresent
-	}
-	if !value.isAuthorised(user) {
-		return "", ErrUnauthorized
-	}
-	return value.getValue(), nil
-}
-
-func directPutValue(key, user, value string) error {
-	data, present := kvStore[key]
-	if present {
-		if data.isAuthorised(user) {
-			data.setValue(value)
-			return nil
-		} else {
-			return ErrUnauthorized
-		}
-	}
-	data = NewData(user, value)
-	kvStore[key] = data
-	directRemoveOldKeys()
-	return nil
-}
-
-func directDelete(key, user string) error {
-	value, present := kvStore[key]
-	if !present {
-		return ErrKeyNotPresent
-	}
-	if !value.isAuthorised(user) {
-		return ErrUnauthorized
-	}
-	delete(kvStore, key)
-	return nil
-}
-
-func directGetKeyInfo(key string) (*Key, error) {
-	data, err := kvStore[key]
-	if !err {
-		return nil, ErrKeyNotPresent
-	}
-	output := Key{
-		Key:    key,
-		Owner:  data.owner,
-		Writes: data.writes,
-		Reads:  data.reads,
-		Age:    time.Since(data.lastAccessed).Milliseconds(),
-	}
-	return &output, nil
-}
-
-func directListStore() ([]byte, error) {
-	output := []*Key{}
-	for key := range kvStore {
-		data, err := directGetKeyInfo(key)
-		if err != nil {
-			fmt.Println("something has gone terribly wrong")
-			fmt.Println("list store cannot find a key")
-			return nil, ErrKeyNotPresent //this should never fire
-		}
-		output = append(output, data)
-	}
-	jsonOut, errJSON := json.Marshal(output)
-	if errJSON != nil {
-		return nil, errJSON
-	}
-	return jsonOut, nil
-}
-
-func directListKey(key string) ([]byte, error) {
-	data, err := directGetKeyInfo(key)
-	if err != nil {
-		return nil, err
-	}
-	jsonOut, errJSON := json.Marshal(data)
-	if errJSON != nil {
-		return nil, errJSON
-	}
-	return jsonOut, nil
-}
+package KVStore
+
+import (
+	"encoding/json"
+	"fmt"
+	"store/audit"
+	"store/rbac"
+	"sync/atomic"
+	"time"
+)
+
+//Data stores all information relevant to a key
+type Data struct {
+	owner        string
+	value        string
+	reads        int
+	writes       int
+	lastAccessed time.Time
+	acl          map[string]rbac.Permission //principal -> permissions granted by the owner
+}
+
+//Data.isAuthorised checks if the user is authorised to access that data. Their roles must grant the permission,
+//and they must either own the key, be an admin or have been granted the permission in the key's access control list
+func (d *Data) isAuthorised(user rbac.Identity, perm rbac.Permission) bool {
+	if !user.Can(perm) {
+		return false
+	}
+	return user.Username == d.owner || user.IsAdmin() || d.granted(user).Has(perm)
+}
+
+//Data.effectivePermissions returns the permissions the user actually has on this key, taking into account both roles and the access control list
+func (d *Data) effectivePermissions(user rbac.Identity) rbac.Permission {
+	if user.Username == d.owner || user.IsAdmin() {
+		return user.Permissions() & grantablePermissions
+	}
+	return user.Permissions() & d.granted(user)
+}
+
+//Data.getValue returns the current value of the data and also updates the access timestamp.
+//In clustered mode reads only happen on the leader, so they are left out of the timestamp
+func (d *Data) getValue() string {
+	d.reads++
+	if !Clustered {
+		d.lastAccessed = time.Now()
+	}
+	return d.value
+}
+
+//Data.setValue sets the current value of the data and also updates the access timestamp
+func (d *Data) setValue(value string, at time.Time) {
+	d.writes++
+	d.lastAccessed = at
+	atomic.AddInt64(&bytesUsed, int64(len(value)-len(d.value)))
+	d.value = value
+}
+
+//NewData initialises a (pointer to) an instance of a Data struct, initialising the number of writes to 1 and reads to 0
+//it also initialises the timestamp to now
+func NewData(owner string, value string) *Data {
+	d := Data{
+		owner:        owner,
+		value:        value,
+		lastAccessed: time.Now(),
+		writes:       1,
+		reads:        0,
+	}
+	return &d
+}
+
+//Key is a struct used to return information about a key, excluding its value. Used by the list functions
+type Key struct {
+	Key         string   `json:"key"`
+	Namespace   string   `json:"namespace,omitempty"`
+	Owner       string   `json:"owner"`
+	Writes      int      `json:"writes"`
+	Reads       int      `json:"reads"`
+	Age         int64    `json:"age"`
+	Permissions []string `json:"permissions"` //what the user listing the key is allowed to do with it
+}
+
+//directGetData finds the data stored under the key in the namespace
+func directGetData(namespace, key string) (*Data, bool) {
+	data, present := kvStore[namespace][key]
+	return data, present
+}
+
+//directSetData stores the data under the key in the namespace, creating the namespace if needed
+func directSetData(namespace, key string, data *Data) {
+	keys, present := kvStore[namespace]
+	if !present {
+		keys = map[string]*Data{}
+		kvStore[namespace] = keys
+	}
+	if old, exists := keys[key]; exists { //replacing a key, so take the old one off the usage first
+		atomic.AddInt64(&keyCount, -1)
+		atomic.AddInt64(&bytesUsed, -int64(len(key)+len(old.value)))
+	}
+	keys[key] = data
+	atomic.AddInt64(&keyCount, 1)
+	atomic.AddInt64(&bytesUsed, int64(len(key)+len(data.value)))
+}
+
+//directDeleteData removes the key from the namespace, removing the namespace as well if it is now empty
+func directDeleteData(namespace, key string) {
+	if data, present := kvStore[namespace][key]; present {
+		atomic.AddInt64(&keyCount, -1)
+		atomic.AddInt64(&bytesUsed, -int64(len(key)+len(data.value)))
+	}
+	delete(kvStore[namespace], key)
+	if len(kvStore[namespace]) == 0 {
+		delete(kvStore, namespace)
+	}
+}
+
+//directRemoveOldKeys evicts the least recently used keys from the namespace until it is within MaxDepth.
+//Each namespace has its own quota, so one user filling their namespace cannot evict anybody else's keys.
+//Ties go to the first key alphabetically, so the same keys are evicted whatever order the map is iterated in
+func directRemoveOldKeys(namespace string) {
+	for len(kvStore[namespace]) > MaxDepth { //Should only run once, but no harm in being certain
+		var oldestKey string
+		var oldest *Data
+		for key, data := range kvStore[namespace] {
+			if oldest == nil || data.lastAccessed.Before(oldest.lastAccessed) || (data.lastAccessed.Equal(oldest.lastAccessed) && key < oldestKey) {
+				oldest = data
+				oldestKey = key
+			}
+		}
+		audit.Record(audit.Event{Action: audit.ActionEvict, Key: oldestKey, Namespace: namespace, OldVersion: oldest.writes})
+		directDeleteData(namespace, oldestKey)
+		directRecordMutation(namespace, oldestKey)
+		evictionsTotal.Inc()
+	}
+}
+
+//directResize sets MaxDepth and evicts keys from every namespace that is now over it, returning how many were evicted
+func directResize(depth int) int {
+	before := atomic.LoadInt64(&keyCount)
+	MaxDepth = depth
+	for namespace := range kvStore {
+		directRemoveOldKeys(namespace)
+	}
+	return int(before - atomic.LoadInt64(&keyCount))
+}
+
+func directLookupValue(namespace, key string, user rbac.Identity) (string, error) {
+	if !user.Can(rbac.PermRead) || !user.CanAccessKey(key) {
+		return "", ErrUnauthorized
+	}
+	value, present := directGetData(namespace, key)
+	if !present {
+		atomic.AddInt64(&lookupMisses, 1)
+		return "", ErrKeyNotPresent
+	}
+	if !value.isAuthorised(user, rbac.PermRead) {
+		return "", ErrUnauthorized
+	}
+	atomic.AddInt64(&lookupHits, 1)
+	return value.getValue(), nil
+}
+
+//directPutValue sets the key, recording at as the time it was accessed
+func directPutValue(namespace, key string, user rbac.Identity, value string, at time.Time) error {
+	if !user.Can(rbac.PermWrite) || !user.CanAccessKey(key) {
+		return ErrUnauthorized
+	}
+	data, present := directGetData(namespace, key)
+	if present {
+		if data.isAuthorised(user, rbac.PermWrite) {
+			data.setValue(value, at)
+			return nil
+		} else {
+			return ErrUnauthorized
+		}
+	}
+	owner := user.Username
+	if namespace != "" { //keys in a namespace always belong to the namespace's user, even when created by an admin
+		if namespace != user.Username && !user.IsAdmin() {
+			return ErrUnauthorized
+		}
+		owner = namespace
+	}
+	data = NewData(owner, value)
+	data.lastAccessed = at
+	directSetData(namespace, key, data)
+	directRemoveOldKeys(namespace)
+	return nil
+}
+
+func directDelete(namespace, key string, user rbac.Identity) error {
+	if !user.Can(rbac.PermDelete) || !user.CanAccessKey(key) {
+		return ErrUnauthorized
+	}
+	value, present := directGetData(namespace, key)
+	if !present {
+		return ErrKeyNotPresent
+	}
+	if !value.isAuthorised(user, rbac.PermDelete) {
+		return ErrUnauthorized
+	}
+	directDeleteData(namespace, key)
+	return nil
+}
+
+func directGetKeyInfo(namespace, key string, user rbac.Identity) (*Key, error) {
+	data, err := directGetData(namespace, key)
+	if !err {
+		return nil, ErrKeyNotPresent
+	}
+	output := Key{
+		Key:         key,
+		Namespace:   namespace,
+		Owner:       data.owner,
+		Writes:      data.writes,
+		Reads:       data.reads,
+		Age:         time.Since(data.lastAccessed).Milliseconds(),
+		Permissions: data.effectivePermissions(user).Names(),
+	}
+	return &output, nil
+}
+
+//directListStore lists keys from every namespace, or if inOne is set just the keys in onlyNamespace
+func directListStore(user rbac.Identity, all bool, onlyNamespace string, inOne bool) ([]byte, error) {
+	if !user.Can(rbac.PermList) || (all && !user.IsAdmin()) {
+		return nil, ErrUnauthorized
+	}
+	output := []*Key{}
+	for namespace, keys := range kvStore {
+		if inOne && namespace != onlyNamespace {
+			continue
+		}
+		for key, value := range keys {
+			if !all && !value.ownedOrShared(user) { //only list keys the user owns or that have been shared with them
+				continue
+			}
+			if !user.CanAccessKey(key) { //the user may be limited to a subset of their keys, e.g. by an API key
+				continue
+			}
+			data, err := directGetKeyInfo(namespace, key, user)
+			if err != nil {
+				fmt.Println("something has gone terribly wrong")
+				fmt.Println("list store cannot find a key")
+				return nil, ErrKeyNotPresent //this should never fire
+			}
+			output = append(output, data)
+		}
+	}
+	jsonOut, errJSON := json.Marshal(output)
+	if errJSON != nil {
+		return nil, errJSON
+	}
+	return jsonOut, nil
+}
+
+func directListKey(namespace, key string, user rbac.Identity) ([]byte, error) {
+	if !user.Can(rbac.PermList) || !user.CanAccessKey(key) {
+		return nil, ErrUnauthorized
+	}
+	value, present := directGetData(namespace, key)
+	if !present {
+		return nil, ErrKeyNotPresent
+	}
+	if !value.canSee(user) {
+		return nil, ErrKeyNotPresent //the same as a missing key, so keys the user can't see aren't given away
+	}
+	data, err := directGetKeyInfo(namespace, key, user)
+	if err != nil {
+		return nil, err
+	}
+	jsonOut, errJSON := json.Marshal(data)
+	if errJSON != nil {
+		return nil, errJSON
+	}
+	return jsonOut, nil
+}
@@ -0,0 +1,52 @@
+package KVStore
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var ErrPingTimeout = errors.New("the store actor did not answer in time")
+
+//ready is set once Startup has finished and cleared when Shutdown starts
+var ready int32
+
+//Ready checks if the store has started up and isn't shutting down
+func Ready() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
+//Pause holds up the store actor, as if it had hung, until resume is called. Requests sent in the meantime wait for it,
+//and the steward restarts the actor if it is paused for longer than StewardTimeout. Used for testing
+func Pause() (resume func()) {
+	resumeChannel := make(chan struct{})
+	StoreChannel <- StoreRequest{command: PauseString, data: StoreData{resume: resumeChannel}}
+	return func() { close(resumeChannel) }
+}
+
+//Ping sends a request that does nothing through the store actor, to check that it is still handling requests.
+//Unlike MakeRequest it gives up after the timeout, including while waiting for the answer, so a dead actor can't hang the caller
+func Ping(timeout time.Duration) error {
+	select {
+	case <-ShutdownChannel: //checked on its own first, as StoreChannel is closed once the shutdown has finished
+		return ErrShutdown
+	default:
+	}
+	request := StoreRequest{command: PingString, responseChannel: make(chan StoreResponse), doneChannel: make(chan struct{})}
+	defer close(request.doneChannel) //stops the monitor bothering to answer if we've given up
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ShutdownChannel:
+		return ErrShutdown
+	case <-timer.C:
+		return ErrPingTimeout
+	case StoreChannel <- request:
+	}
+	select {
+	case response := <-request.responseChannel:
+		return response.err
+	case <-timer.C:
+		return ErrPingTimeout
+	}
+}
@@ -0,0 +1,52 @@
+package KVStore
+
+import (
+	"store/metrics"
+	"sync/atomic"
+)
+
+var (
+	operationsTotal = metrics.NewCounterVec("kvstore_operations_total",
+		"Requests handled by the store actor, by operation", "operation")
+	operationErrorsTotal = metrics.NewCounterVec("kvstore_operation_errors_total",
+		"Requests handled by the store actor that returned an error, by operation and error", "operation", "error")
+	evictionsTotal = metrics.NewCounterVec("kvstore_evictions_total",
+		"Keys evicted because their namespace went over the maximum depth")
+	monitorRestartsTotal = metrics.NewCounterVec("kvstore_monitor_restarts_total",
+		"Times the store guardian has restarted the monitor routine after it crashed or stopped sending heartbeats")
+)
+
+//keyCount and bytesUsed are only changed by the actor, but are read by the metrics endpoint so are accessed atomically
+var (
+	keyCount  int64
+	bytesUsed int64 //length of every key plus its value
+)
+
+func init() {
+	metrics.NewGaugeFunc("kvstore_keys", "Keys in the store, across every namespace", func() float64 {
+		return float64(atomic.LoadInt64(&keyCount))
+	})
+	metrics.NewGaugeFunc("kvstore_bytes", "Bytes used by the keys and values in the store", func() float64 {
+		return float64(atomic.LoadInt64(&bytesUsed))
+	})
+	metrics.NewGaugeFunc("kvstore_queue_depth", "Requests waiting on StoreChannel for the actor", func() float64 {
+		return float64(len(StoreChannel))
+	})
+	metrics.NewGaugeFunc("kvstore_queue_capacity", "Size of the StoreChannel buffer, set by BufferSize", func() float64 {
+		return float64(cap(StoreChannel))
+	})
+}
+
+//countOperation records a request handled by the actor and, if it failed, why
+func countOperation(operation string, err error) {
+	operationsTotal.Inc(operation)
+	if err != nil {
+		operationErrorsTotal.Inc(operation, err.Error())
+	}
+}
+
+//resetUsage is called when the store is emptied at startup
+func resetUsage() {
+	atomic.StoreInt64(&keyCount, 0)
+	atomic.StoreInt64(&bytesUsed, 0)
+}
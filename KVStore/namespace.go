@@ -0,0 +1,87 @@
+package KVStore
+
+import (
+	"errors"
+	"store/rbac"
+)
+
+var ErrNamespacesDisabled = errors.New("the KV store is not running in namespaced mode")
+
+//DefaultNamespace returns the namespace used when the user doesn't ask for one: their own in namespaced mode, otherwise the single shared keyspace
+func DefaultNamespace(user rbac.Identity) string {
+	if Namespaced {
+		return user.Username
+	}
+	return ""
+}
+
+//checkNamespace makes sure an explicitly requested namespace is valid for the current mode
+func checkNamespace(namespace string) error {
+	if !Namespaced && namespace != "" {
+		return ErrNamespacesDisabled
+	}
+	if Namespaced && namespace == "" {
+		return ErrBadRequest
+	}
+	return nil
+}
+
+//makeNamespacedRequest is MakeRequest, but rejects requests for namespaces that cannot exist before they reach the actor
+func makeNamespacedRequest(request StoreRequest) StoreResponse {
+	if err := checkNamespace(request.data.namespace); err != nil {
+		return StoreResponse{err: err}
+	}
+	return MakeRequest(request)
+}
+
+func LookupValueIn(namespace, key string, user rbac.Identity) (string, error) {
+	return background.LookupValueIn(namespace, key, user)
+}
+
+func (s Store) LookupValueIn(namespace, key string, user rbac.Identity) (string, error) {
+	request := StoreRequest{ctx: s.ctx, command: LookupString, data: StoreData{namespace: namespace, key: key, user: user}}
+	response := makeNamespacedRequest(request)
+	return response.value, response.err
+}
+
+func PutValueIn(namespace, key string, user rbac.Identity, value string) error {
+	return background.PutValueIn(namespace, key, user, value)
+}
+
+func (s Store) PutValueIn(namespace, key string, user rbac.Identity, value string) error {
+	request := StoreRequest{ctx: s.ctx, command: PutString, data: StoreData{namespace: namespace, key: key, user: user, value: value}}
+	response := makeNamespacedRequest(request)
+	return response.err
+}
+
+func DeleteIn(namespace, key string, user rbac.Identity) error {
+	return background.DeleteIn(namespace, key, user)
+}
+
+func (s Store) DeleteIn(namespace, key string, user rbac.Identity) error {
+	request := StoreRequest{ctx: s.ctx, command: DeleteString, data: StoreData{namespace: namespace, key: key, user: user}}
+	response := makeNamespacedRequest(request)
+	return response.err
+}
+
+func ListKeyIn(namespace, key string, user rbac.Identity) ([]byte, error) {
+	return background.ListKeyIn(namespace, key, user)
+}
+
+func (s Store) ListKeyIn(namespace, key string, user rbac.Identity) ([]byte, error) {
+	request := StoreRequest{ctx: s.ctx, command: ListString, data: StoreData{namespace: namespace, key: key, user: user}}
+	response := makeNamespacedRequest(request)
+	return response.json, response.err
+}
+
+//ListNamespace lists the keys in a single namespace that the user is able to see. Admins see every key in the namespace
+func ListNamespace(namespace string, user rbac.Identity) ([]byte, error) {
+	return background.ListNamespace(namespace, user)
+}
+
+//Store.ListNamespace lists the keys in a single namespace that the user is able to see. Admins see every key in the namespace
+func (s Store) ListNamespace(namespace string, user rbac.Identity) ([]byte, error) {
+	request := StoreRequest{ctx: s.ctx, command: ListString, data: StoreData{namespace: namespace, user: user, all: user.IsAdmin(), inOne: true}}
+	response := makeNamespacedRequest(request)
+	return response.json, response.err
+}
@@ -0,0 +1,200 @@
+package KVStore_test
+
+import (
+	"encoding/json"
+	"store/KVStore"
+	"store/rbac"
+	"testing"
+)
+
+func startNamespaced(depth int) {
+	KVStore.Namespaced = true
+	KVStore.Startup(100, depth)
+}
+
+func shutdownNamespaced(t *testing.T) {
+	handleShutdown(t)
+	KVStore.Namespaced = false
+}
+
+func TestNamespacesDontCollide(t *testing.T) {
+	startNamespaced(100)
+	defer shutdownNamespaced(t)
+	key := "config"
+	user1 := rbac.NewIdentity("user1", rbac.RoleWriter)
+	user2 := rbac.NewIdentity("user2", rbac.RoleWriter)
+
+	if err := KVStore.PutValue(key, user1, "value1"); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+	if err := KVStore.PutValue(key, user2, "value2"); err != nil {
+		t.Error("second user unable to use the same key name", err)
+	}
+	for user, expected := range map[*rbac.Identity]string{&user1: "value1", &user2: "value2"} {
+		if testData, err := KVStore.LookupValue(key, *user); err != nil || testData != expected {
+			t.Errorf("wrong value for user %s. Wanted %s, got %s. Error is %v\n", user.Username, expected, testData, err)
+		}
+	}
+}
+
+func TestNamespaceAccess(t *testing.T) {
+	startNamespaced(100)
+	defer shutdownNamespaced(t)
+	key := "config"
+	owner := rbac.NewIdentity("owner", rbac.RoleWriter)
+	friend := rbac.NewIdentity("friend", rbac.RoleWriter)
+	admin := rbac.NewIdentity("admin", rbac.RoleAdmin)
+
+	if err := KVStore.PutValue(key, owner, "value"); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+	if _, err := KVStore.LookupValueIn(owner.Username, key, friend); err != KVStore.ErrUnauthorized {
+		t.Error("able to read a key in another namespace without it being shared", err)
+	}
+	if err := KVStore.PutValueIn(owner.Username, "new", friend, "value"); err != KVStore.ErrUnauthorized {
+		t.Error("able to create a key in another user's namespace", err)
+	}
+
+	if err := KVStore.SetACL(key, owner, rbac.UserPrincipal(friend.Username), rbac.PermRead); err != nil {
+		t.Error("unable to share a key", err)
+	}
+	if testData, err := KVStore.LookupValueIn(owner.Username, key, friend); err != nil || testData != "value" {
+		t.Errorf("unable to read a shared key in another namespace. Got %s. Error is %v\n", testData, err)
+	}
+
+	if err := KVStore.PutValueIn(owner.Username, "fromAdmin", admin, "value"); err != nil {
+		t.Error("admin unable to create a key in another user's namespace", err)
+	}
+	if testData, err := KVStore.LookupValue("fromAdmin", owner); err != nil || testData != "value" {
+		t.Errorf("key created by an admin does not belong to the namespace owner. Got %s. Error is %v\n", testData, err)
+	}
+}
+
+func TestNamespaceDepth(t *testing.T) {
+	startNamespaced(2)
+	defer shutdownNamespaced(t)
+	user1 := rbac.NewIdentity("user1", rbac.RoleWriter)
+	user2 := rbac.NewIdentity("user2", rbac.RoleWriter)
+
+	if err := KVStore.PutValue("key1", user2, "value"); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+	for _, key := range []string{"key1", "key2", "key3"} {
+		if err := KVStore.PutValue(key, user1, "value"); err != nil {
+			t.Error("unable to put a value in the kv store", err)
+		}
+	} //user1's key1 should be ejected, but user2's should not
+
+	if _, err := KVStore.LookupValue("key1", user1); err != KVStore.ErrKeyNotPresent {
+		t.Error("key was not evicted when the namespace went over its quota", err)
+	}
+	if _, err := KVStore.LookupValue("key1", user2); err != nil {
+		t.Error("a full namespace evicted a key from a different namespace", err)
+	}
+}
+
+func TestListNamespace(t *testing.T) {
+	startNamespaced(100)
+	defer shutdownNamespaced(t)
+	user1 := rbac.NewIdentity("user1", rbac.RoleWriter)
+	user2 := rbac.NewIdentity("user2", rbac.RoleWriter)
+	admin := rbac.NewIdentity("admin", rbac.RoleAdmin)
+
+	for _, user := range []rbac.Identity{user1, user2} {
+		for _, key := range []string{"key1", "key2"} {
+			if err := KVStore.PutValue(key, user, "value"); err != nil {
+				t.Error("unable to put a value in the kv store", err)
+			}
+		}
+	}
+
+	countKeys := func(testJSON []byte) int {
+		var testData []KVStore.Key
+		if errJSON := json.Unmarshal(testJSON, &testData); errJSON != nil {
+			t.Error("error unmarshaling store list json", errJSON)
+		}
+		for _, data := range testData {
+			if data.Namespace != data.Owner {
+				t.Errorf("key %s in namespace %s is owned by %s\n", data.Key, data.Namespace, data.Owner)
+			}
+		}
+		return len(testData)
+	}
+
+	if testJSON, err := KVStore.ListStore(user1, false); err != nil || countKeys(testJSON) != 2 {
+		t.Errorf("expected user1 to see their 2 keys. Got %s. Error is %v\n", testJSON, err)
+	}
+	if testJSON, err := KVStore.ListNamespace(user2.Username, user1); err != nil || countKeys(testJSON) != 0 {
+		t.Errorf("expected user1 to see nothing in user2's namespace. Got %s. Error is %v\n", testJSON, err)
+	}
+	if testJSON, err := KVStore.ListNamespace(user2.Username, admin); err != nil || countKeys(testJSON) != 2 {
+		t.Errorf("expected admin to see all of user2's namespace. Got %s. Error is %v\n", testJSON, err)
+	}
+}
+
+func TestNamespaceTransfer(t *testing.T) {
+	startNamespaced(100)
+	defer shutdownNamespaced(t)
+	user1 := rbac.NewIdentity("user1", rbac.RoleWriter)
+	user2 := rbac.NewIdentity("user2", rbac.RoleWriter)
+
+	for _, key := range []string{"key1", "key2"} {
+		if err := KVStore.PutValue(key, user1, "value"); err != nil {
+			t.Error("unable to put a value in the kv store", err)
+		}
+	}
+	if err := KVStore.PutValue("key2", user2, "value"); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+
+	if err := KVStore.TransferOwnership("key1", user1, user2.Username); err != nil {
+		t.Error("unable to transfer ownership", err)
+	}
+	if _, err := KVStore.LookupValue("key1", user2); err != nil {
+		t.Error("transferred key did not move into the new owner's namespace", err)
+	}
+	if _, err := KVStore.LookupValue("key1", user1); err != KVStore.ErrKeyNotPresent {
+		t.Error("transferred key is still in the old owner's namespace", err)
+	}
+	if err := KVStore.TransferOwnership("key2", user1, user2.Username); err != KVStore.ErrKeyExists {
+		t.Error("transfer overwrote a key in the new owner's namespace", err)
+	}
+}
+
+func TestTransferToFullNamespace(t *testing.T) {
+	startNamespaced(2)
+	defer shutdownNamespaced(t)
+	user1 := rbac.NewIdentity("user1", rbac.RoleWriter)
+	user2 := rbac.NewIdentity("user2", rbac.RoleWriter)
+
+	if err := KVStore.PutValue("key1", user1, "value"); err != nil {
+		t.Error("unable to put a value in the kv store", err)
+	}
+	for _, key := range []string{"key2", "key3"} {
+		if err := KVStore.PutValue(key, user2, "value"); err != nil {
+			t.Error("unable to put a value in the kv store", err)
+		}
+	}
+
+	if err := KVStore.TransferOwnership("key1", user1, user2.Username); err != KVStore.ErrNamespaceFull {
+		t.Error("expected a transfer into a full namespace to be refused", err)
+	}
+	for _, key := range []string{"key2", "key3"} {
+		if _, err := KVStore.LookupValue(key, user2); err != nil {
+			t.Error("a refused transfer evicted a key from the new owner's namespace", err)
+		}
+	}
+	if _, err := KVStore.LookupValue("key1", user1); err != nil {
+		t.Error("a refused transfer moved the key", err)
+	}
+}
+
+func TestNamespacesDisabled(t *testing.T) {
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	user := rbac.NewIdentity("test", rbac.RoleWriter)
+
+	if err := KVStore.PutValueIn("test", "key", user, "value"); err != KVStore.ErrNamespacesDisabled {
+		t.Error("able to use a namespace when namespaces are disabled", err)
+	}
+}
@@ -0,0 +1,77 @@
+package KVStore
+
+//Export copies up to limit of the keys selected by their name, from every namespace, e.g. to move them to another node.
+//selected is called by the actor, so must be quick and must not make store requests of its own
+func Export(selected func(key string) bool, limit int) ([]Mutation, error) {
+	if selected == nil || limit <= 0 {
+		return nil, ErrBadRequest
+	}
+	request := StoreRequest{command: ExportString, data: StoreData{selected: selected, limit: limit}}
+	response := MakeRequest(request)
+	return response.keys, response.err
+}
+
+//Import adds keys exported by another node, returning how many were added.
+//Keys that are already here are left alone, as they have been written here since
+func Import(keys []Mutation) (int, error) {
+	request := StoreRequest{command: ImportString, data: StoreData{keys: keys}}
+	response := MakeRequest(request)
+	return response.count, response.err
+}
+
+//Release removes keys that have been moved to another node, returning how many were removed
+func Release(keys []Mutation) (int, error) {
+	request := StoreRequest{command: ReleaseString, data: StoreData{keys: keys}}
+	response := MakeRequest(request)
+	return response.count, response.err
+}
+
+func directExport(selected func(key string) bool, limit int) []Mutation {
+	keys := []Mutation{}
+	for namespace, namespaceKeys := range kvStore {
+		for key, data := range namespaceKeys {
+			if len(keys) == limit {
+				return keys
+			}
+			if selected(key) {
+				keys = append(keys, Mutation{Namespace: namespace, Key: key, Entry: data.entry()})
+			}
+		}
+	}
+	return keys
+}
+
+//directImport adds the keys that aren't already here, then evicts keys from any namespace that is now over MaxDepth
+func directImport(keys []Mutation) int {
+	imported := 0
+	namespaces := map[string]bool{}
+	for _, mutation := range keys {
+		if mutation.Entry == nil {
+			continue
+		}
+		if _, present := directGetData(mutation.Namespace, mutation.Key); present {
+			continue
+		}
+		directSetData(mutation.Namespace, mutation.Key, newDataFromEntry(mutation.Entry))
+		directRecordMutation(mutation.Namespace, mutation.Key)
+		namespaces[mutation.Namespace] = true
+		imported++
+	}
+	for namespace := range namespaces {
+		directRemoveOldKeys(namespace)
+	}
+	return imported
+}
+
+func directRelease(keys []Mutation) int {
+	released := 0
+	for _, mutation := range keys {
+		if _, present := directGetData(mutation.Namespace, mutation.Key); !present {
+			continue
+		}
+		directDeleteData(mutation.Namespace, mutation.Key)
+		directRecordMutation(mutation.Namespace, mutation.Key)
+		released++
+	}
+	return released
+}
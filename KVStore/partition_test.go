@@ -0,0 +1,50 @@
+package KVStore_test
+
+import (
+	"store/KVStore"
+	"store/rbac"
+	"strings"
+	"testing"
+)
+
+func TestExportImportRelease(t *testing.T) {
+	KVStore.Startup(100, 3)
+	owner := rbac.NewIdentity("owner", rbac.RoleWriter)
+	KVStore.PutValue("a1", owner, "1")
+	KVStore.SetACL("a1", owner, "user:friend", rbac.PermRead)
+	KVStore.PutValue("a2", owner, "2")
+	KVStore.PutValue("b", owner, "3")
+	if _, err := KVStore.Export(nil, 10); err != KVStore.ErrBadRequest {
+		t.Errorf("expected exporting without a selection to fail with %v, got %v", KVStore.ErrBadRequest, err)
+	}
+	exported, err := KVStore.Export(func(key string) bool { return strings.HasPrefix(key, "a") }, 10)
+	if err != nil || len(exported) != 2 {
+		t.Fatalf("expected to export the two keys starting with a, got %+v. Error is %v", exported, err)
+	}
+	if limited, _ := KVStore.Export(func(string) bool { return true }, 1); len(limited) != 1 {
+		t.Errorf("expected the export to be limited to 1 key, got %d", len(limited))
+	}
+	if released, err := KVStore.Release(exported); err != nil || released != 2 {
+		t.Errorf("expected to release 2 keys, released %d. Error is %v", released, err)
+	}
+	if _, err := KVStore.LookupValue("a1", owner); err != KVStore.ErrKeyNotPresent {
+		t.Errorf("expected a1 to have gone once released, got %v", err)
+	}
+	handleShutdown(t)
+
+	//another node
+	KVStore.Startup(100, 3)
+	defer handleShutdown(t)
+	KVStore.PutValue("a2", owner, "written here since")
+	KVStore.PutValue("c", owner, "4")
+	if imported, err := KVStore.Import(exported); err != nil || imported != 1 {
+		t.Errorf("expected to import only the key that isn't here yet, imported %d. Error is %v", imported, err)
+	}
+	friend := rbac.NewIdentity("friend", rbac.RoleReader)
+	if value, err := KVStore.LookupValue("a1", friend); err != nil || value != "1" {
+		t.Errorf("expected a1 to be imported along with its ACL, got %q. Error is %v", value, err)
+	}
+	if value, _ := KVStore.LookupValue("a2", owner); value != "written here since" {
+		t.Errorf("expected the import to leave a2 alone, got %q", value)
+	}
+}
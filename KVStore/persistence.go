@@ -0,0 +1,54 @@
+package KVStore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+//SaveToFile writes a snapshot of every key in the store to the file, returning the number of keys saved.
+//The file is replaced in one go, so a crash while saving leaves either the old snapshot or the new one
+func SaveToFile(path string) (int, error) {
+	snapshot, err := TakeSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	contents, err := json.Marshal(snapshot)
+	if err != nil {
+		return 0, err
+	}
+	tmpFile := path + ".tmp"
+	file, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := file.Write(contents); err != nil {
+		file.Close()
+		return 0, err
+	}
+	if err := file.Sync(); err != nil { //the server is about to exit, so make sure it is really on disk
+		file.Close()
+		return 0, err
+	}
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+	return len(snapshot.Keys), os.Rename(tmpFile, path)
+}
+
+//LoadFromFile replaces everything in the store with the snapshot saved by SaveToFile, returning the number of keys loaded.
+//A file that doesn't exist yet, such as on the first start, leaves the store empty
+func LoadFromFile(path string) (int, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(contents, &snapshot); err != nil {
+		return 0, err
+	}
+	return len(snapshot.Keys), Restore(snapshot)
+}
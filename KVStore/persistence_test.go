@@ -0,0 +1,53 @@
+package KVStore_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"store/KVStore"
+	"store/rbac"
+	"testing"
+)
+
+func TestSaveAndLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	KVStore.Startup(100, 100)
+	owner := rbac.NewIdentity("owner", rbac.RoleWriter)
+	friend := rbac.NewIdentity("friend", rbac.RoleReader)
+	KVStore.PutValue("a", owner, "1")
+	KVStore.SetACL("a", owner, "user:friend", rbac.PermRead)
+	KVStore.PutValue("b", owner, "2")
+	if saved, err := KVStore.SaveToFile(path); err != nil || saved != 2 {
+		t.Fatalf("expected to save 2 keys, saved %d. Error is %v", saved, err)
+	}
+	handleShutdown(t)
+
+	//a restarted server starts from the saved keys
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	if loaded, err := KVStore.LoadFromFile(path); err != nil || loaded != 2 {
+		t.Fatalf("expected to load 2 keys, loaded %d. Error is %v", loaded, err)
+	}
+	if value, err := KVStore.LookupValue("a", friend); err != nil || value != "1" {
+		t.Errorf("expected the saved key and its ACL to let friend read a, got %q. Error is %v", value, err)
+	}
+	if value, err := KVStore.LookupValue("b", owner); err != nil || value != "2" {
+		t.Errorf("expected b to be 2, got %q. Error is %v", value, err)
+	}
+	if KVStore.LastMutation() != 3 {
+		t.Errorf("expected to carry on from mutation 3, got %d", KVStore.LastMutation())
+	}
+
+	//there is nothing to load the first time the server starts
+	if loaded, err := KVStore.LoadFromFile(filepath.Join(t.TempDir(), "missing.json")); err != nil || loaded != 0 {
+		t.Errorf("expected a missing file to load nothing, loaded %d. Error is %v", loaded, err)
+	}
+	if value, err := KVStore.LookupValue("a", owner); err != nil || value != "1" {
+		t.Errorf("expected a missing file to leave the store alone, got %q. Error is %v", value, err)
+	}
+	if err := ioutil.WriteFile(path, []byte("not a snapshot"), 0600); err != nil {
+		t.Fatal("unable to write the file", err)
+	}
+	if _, err := KVStore.LoadFromFile(path); err == nil {
+		t.Error("expected a corrupt file to fail to load")
+	}
+}
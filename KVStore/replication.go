@@ -0,0 +1,163 @@
+package KVStore
+
+import (
+	"errors"
+	"store/rbac"
+	"sync/atomic"
+	"time"
+)
+
+var ErrReplicationGap = errors.New("replicated mutation is not the next one, so some have been missed")
+
+//Entry is the state of a key that is copied to other servers
+type Entry struct {
+	Owner    string                     `json:"owner"`
+	Value    string                     `json:"value"`
+	Writes   int                        `json:"writes"`
+	ACL      map[string]rbac.Permission `json:"acl,omitempty"`
+	Accessed time.Time                  `json:"accessed"` //so a cluster node restoring a snapshot goes on to evict the same keys as the others
+}
+
+//Mutation is the state of a key after the actor changed it. Entry is nil if the key was deleted or evicted.
+//Seq numbers every mutation in the order the actor made them, starting from 1
+type Mutation struct {
+	Seq       uint64 `json:"seq"`
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key"`
+	Entry     *Entry `json:"entry,omitempty"`
+}
+
+//Snapshot is every key in the store, as of mutation Seq
+type Snapshot struct {
+	Seq  uint64     `json:"seq"`
+	Keys []Mutation `json:"keys"`
+}
+
+//mutationSeq is the sequence number of the last mutation. It is only changed by the actor, but is read by LastMutation so is accessed atomically
+var mutationSeq uint64
+
+//mutationListener holds the func(Mutation) set by SetMutationListener
+var mutationListener atomic.Value
+
+//SetMutationListener sets a function that is given every change the actor makes to the store, in order. It is called by the actor,
+//so must be quick and must not make store requests of its own. nil stops changes being passed on
+func SetMutationListener(listener func(Mutation)) {
+	mutationListener.Store(listener)
+}
+
+//TakeSnapshot returns a copy of every key in the store, along with the sequence number of the last mutation it includes
+func TakeSnapshot() (Snapshot, error) {
+	request := StoreRequest{command: SnapshotString}
+	response := MakeRequest(request)
+	if response.snapshot == nil {
+		return Snapshot{}, response.err
+	}
+	return *response.snapshot, response.err
+}
+
+//Restore replaces everything in the store with the snapshot, e.g. when a follower starts copying a primary
+func Restore(snapshot Snapshot) error {
+	request := StoreRequest{command: RestoreString, data: StoreData{snapshot: &snapshot}}
+	response := MakeRequest(request)
+	return response.err
+}
+
+//Apply makes a mutation that came from another store. Mutations that have already been applied are ignored,
+//and ErrReplicationGap is returned if the mutation isn't the next one
+func Apply(mutation Mutation) error {
+	request := StoreRequest{command: ApplyString, data: StoreData{namespace: mutation.Namespace, key: mutation.Key, mutation: &mutation}}
+	response := MakeRequest(request)
+	return response.err
+}
+
+//directRecordMutation numbers a change to the key and passes its new state to the mutation listener, if there is one
+func directRecordMutation(namespace, key string) {
+	seq := atomic.AddUint64(&mutationSeq, 1)
+	listener, _ := mutationListener.Load().(func(Mutation))
+	if listener == nil {
+		return
+	}
+	mutation := Mutation{Seq: seq, Namespace: namespace, Key: key}
+	if data, present := directGetData(namespace, key); present {
+		mutation.Entry = data.entry()
+	}
+	listener(mutation)
+}
+
+//Data.entry copies the parts of the data that are replicated
+func (d *Data) entry() *Entry {
+	entry := &Entry{Owner: d.owner, Value: d.value, Writes: d.writes, Accessed: d.lastAccessed}
+	if len(d.acl) > 0 {
+		entry.ACL = make(map[string]rbac.Permission, len(d.acl))
+		for principal, perm := range d.acl {
+			entry.ACL[principal] = perm
+		}
+	}
+	return entry
+}
+
+//newDataFromEntry rebuilds data from a replicated entry. Reads aren't replicated, so start again from zero
+func newDataFromEntry(entry *Entry) *Data {
+	data := NewData(entry.Owner, entry.Value)
+	data.writes = entry.Writes
+	if !entry.Accessed.IsZero() {
+		data.lastAccessed = entry.Accessed
+	}
+	for principal, perm := range entry.ACL {
+		if data.acl == nil {
+			data.acl = map[string]rbac.Permission{}
+		}
+		data.acl[principal] = perm
+	}
+	return data
+}
+
+func directSnapshot() *Snapshot {
+	seq := atomic.LoadUint64(&mutationSeq)
+	snapshot := &Snapshot{Seq: seq, Keys: []Mutation{}}
+	for namespace, keys := range kvStore {
+		for key, data := range keys {
+			snapshot.Keys = append(snapshot.Keys, Mutation{Seq: seq, Namespace: namespace, Key: key, Entry: data.entry()})
+		}
+	}
+	return snapshot
+}
+
+func directRestore(snapshot *Snapshot) {
+	kvStore = map[string]map[string]*Data{}
+	resetUsage()
+	for _, mutation := range snapshot.Keys {
+		if mutation.Entry != nil {
+			directSetData(mutation.Namespace, mutation.Key, newDataFromEntry(mutation.Entry))
+		}
+	}
+	atomic.StoreUint64(&mutationSeq, snapshot.Seq)
+}
+
+//directApply makes a replicated mutation. Keys aren't evicted here, as the evictions are replicated from the store that made them
+func directApply(mutation *Mutation) error {
+	seq := atomic.LoadUint64(&mutationSeq)
+	if mutation.Seq <= seq {
+		return nil
+	}
+	if mutation.Seq != seq+1 {
+		return ErrReplicationGap
+	}
+	if mutation.Entry == nil {
+		directDeleteData(mutation.Namespace, mutation.Key)
+	} else {
+		directSetData(mutation.Namespace, mutation.Key, newDataFromEntry(mutation.Entry))
+	}
+	atomic.StoreUint64(&mutationSeq, mutation.Seq)
+	return nil
+}
+
+//LastMutation returns the sequence number of the latest change to the store
+func LastMutation() uint64 {
+	return atomic.LoadUint64(&mutationSeq)
+}
+
+//resetMutations is called when the store is emptied at startup
+func resetMutations() {
+	atomic.StoreUint64(&mutationSeq, 0)
+}
@@ -0,0 +1,91 @@
+package KVStore_test
+
+import (
+	"store/KVStore"
+	"store/rbac"
+	"testing"
+)
+
+func TestMutationListener(t *testing.T) {
+	KVStore.Startup(100, 2)
+	defer handleShutdown(t)
+	mutations := []KVStore.Mutation{}
+	KVStore.SetMutationListener(func(mutation KVStore.Mutation) { mutations = append(mutations, mutation) }) //called by the actor, so only read once the requests below have returned
+	defer KVStore.SetMutationListener(nil)
+
+	owner := rbac.NewIdentity("owner", rbac.RoleWriter)
+	KVStore.PutValue("a", owner, "1")
+	KVStore.SetACL("a", owner, "user:friend", rbac.PermRead)
+	KVStore.PutValue("b", owner, "2")
+	KVStore.Delete("b", owner)
+	KVStore.PutValue("c", owner, "3")
+	KVStore.PutValue("d", owner, "4") //evicts a
+	KVStore.Delete("missing", owner)  //failed requests don't change anything
+
+	want := []struct {
+		key   string
+		value string //empty for a deletion
+	}{{"a", "1"}, {"a", "1"}, {"b", "2"}, {"b", ""}, {"c", "3"}, {"a", ""}, {"d", "4"}}
+	if len(mutations) != len(want) {
+		t.Fatalf("expected %d mutations, got %+v", len(want), mutations)
+	}
+	for i, mutation := range mutations {
+		if mutation.Seq != uint64(i+1) || mutation.Key != want[i].key {
+			t.Errorf("expected mutation %d to be for key %s, got %+v", i+1, want[i].key, mutation)
+		}
+		if (mutation.Entry == nil) != (want[i].value == "") || (mutation.Entry != nil && mutation.Entry.Value != want[i].value) {
+			t.Errorf("expected mutation %d to set %s to %q, got %+v", i+1, want[i].key, want[i].value, mutation.Entry)
+		}
+	}
+	if acl := mutations[1].Entry.ACL; acl["user:friend"] != rbac.PermRead {
+		t.Errorf("expected the ACL to be replicated, got %v", acl)
+	}
+	if KVStore.LastMutation() != 7 {
+		t.Errorf("expected the last mutation to be 7, got %d", KVStore.LastMutation())
+	}
+}
+
+func TestSnapshotRestoreApply(t *testing.T) {
+	KVStore.Startup(100, 100)
+	owner := rbac.NewIdentity("owner", rbac.RoleWriter)
+	friend := rbac.NewIdentity("friend", rbac.RoleReader)
+	KVStore.PutValue("a", owner, "1")
+	KVStore.SetACL("a", owner, "user:friend", rbac.PermRead)
+	KVStore.PutValue("b", owner, "2")
+	snapshot, err := KVStore.TakeSnapshot()
+	if err != nil || snapshot.Seq != 3 || len(snapshot.Keys) != 2 {
+		t.Fatalf("expected a snapshot of 2 keys as of mutation 3, got %+v. Error is %v", snapshot, err)
+	}
+	handleShutdown(t)
+
+	//a new store, as if on a follower
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	if err := KVStore.Restore(snapshot); err != nil {
+		t.Fatal("unable to restore the snapshot", err)
+	}
+	if value, err := KVStore.LookupValue("a", friend); err != nil || value != "1" {
+		t.Errorf("expected the restored key and its ACL to let friend read a, got %q. Error is %v", value, err)
+	}
+	if err := KVStore.Apply(KVStore.Mutation{Seq: 4, Key: "b"}); err != nil {
+		t.Error("unable to apply a deletion", err)
+	}
+	if _, err := KVStore.LookupValue("b", owner); err != KVStore.ErrKeyNotPresent {
+		t.Errorf("expected b to have been deleted, got %v", err)
+	}
+	if err := KVStore.Apply(KVStore.Mutation{Seq: 4, Key: "b", Entry: &KVStore.Entry{Owner: "owner", Value: "again"}}); err != nil {
+		t.Error("expected a mutation that has already been applied to be ignored", err)
+	}
+	if err := KVStore.Apply(KVStore.Mutation{Seq: 6, Key: "c", Entry: &KVStore.Entry{Owner: "owner", Value: "3"}}); err != KVStore.ErrReplicationGap {
+		t.Errorf("expected skipping a mutation to fail with %v, got %v", KVStore.ErrReplicationGap, err)
+	}
+	if err := KVStore.Apply(KVStore.Mutation{Seq: 5, Key: "c", Entry: &KVStore.Entry{Owner: "owner", Value: "3", Writes: 2}}); err != nil {
+		t.Error("unable to apply a new key", err)
+	}
+	if value, err := KVStore.LookupValue("c", owner); err != nil || value != "3" {
+		t.Errorf("expected c to be 3, got %q. Error is %v", value, err)
+	}
+	if KVStore.LastMutation() != 5 {
+		t.Errorf("expected the last mutation to be 5, got %d", KVStore.LastMutation())
+	}
+}
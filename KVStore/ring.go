@@ -0,0 +1,105 @@
+package KVStore
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+//DefaultVirtualNodes is how many times each node is placed on a ring if not told otherwise. Fewer spread the keys less evenly
+const DefaultVirtualNodes = 256
+
+//Ring shares keys out between nodes with consistent hashing. Every node is placed on the ring many times, as virtual nodes,
+//and a key belongs to the first virtual node at or after its own place on the ring. Adding or removing a node only moves
+//the keys that node gains or loses. A Ring is never changed once made, so can be shared without locking
+type Ring struct {
+	virtualNodes int
+	nodes        []string    //sorted
+	points       []ringPoint //sorted by position
+}
+
+type ringPoint struct {
+	position uint64
+	node     string
+}
+
+//NewRing places the nodes on a ring, each as virtualNodes virtual nodes
+func NewRing(virtualNodes int, nodes ...string) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	r := &Ring{virtualNodes: virtualNodes, nodes: []string{}, points: []ringPoint{}}
+	for _, node := range nodes {
+		if !r.Contains(node) {
+			r.nodes = append(r.nodes, node)
+		}
+	}
+	sort.Strings(r.nodes)
+	for _, node := range r.nodes {
+		for i := 0; i < virtualNodes; i++ {
+			r.points = append(r.points, ringPoint{position: ringPosition(node + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].position == r.points[j].position { //so every node breaks ties the same way
+			return r.points[i].node < r.points[j].node
+		}
+		return r.points[i].position < r.points[j].position
+	})
+	return r
+}
+
+//With returns a new ring that also has the node
+func (r *Ring) With(node string) *Ring {
+	return NewRing(r.virtualNodes, append(r.Nodes(), node)...)
+}
+
+//Without returns a new ring that doesn't have the node
+func (r *Ring) Without(node string) *Ring {
+	nodes := []string{}
+	for _, existing := range r.nodes {
+		if existing != node {
+			nodes = append(nodes, existing)
+		}
+	}
+	return NewRing(r.virtualNodes, nodes...)
+}
+
+//Nodes returns the nodes on the ring, sorted
+func (r *Ring) Nodes() []string {
+	return append([]string{}, r.nodes...)
+}
+
+func (r *Ring) Contains(node string) bool {
+	for _, existing := range r.nodes {
+		if existing == node {
+			return true
+		}
+	}
+	return false
+}
+
+//Owner returns the node the key belongs to, or an empty string if the ring has no nodes
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	position := ringPosition(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].position >= position })
+	if i == len(r.points) { //past the last virtual node, so wrap around to the first
+		i = 0
+	}
+	return r.points[i].node
+}
+
+//ringPosition places a key or virtual node on the ring. hash is a polynomial hash, so strings that only differ at the end,
+//like a node's virtual nodes, land evenly spaced, and short keys all land near 0. Mixing its bits spreads them around the whole ring
+func ringPosition(s string) uint64 {
+	x := math.Float64bits(hash(s))
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
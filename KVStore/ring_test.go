@@ -0,0 +1,62 @@
+package KVStore_test
+
+import (
+	"store/KVStore"
+	"strconv"
+	"testing"
+)
+
+func TestRingOwner(t *testing.T) {
+	if owner := KVStore.NewRing(0).Owner("a"); owner != "" {
+		t.Errorf("expected an empty ring to have no owners, got %q", owner)
+	}
+	ring := KVStore.NewRing(0, "http://node3:8080", "http://node1:8080", "http://node2:8080", "http://node1:8080")
+	if nodes := ring.Nodes(); len(nodes) != 3 || nodes[0] != "http://node1:8080" {
+		t.Errorf("expected the nodes to be sorted without duplicates, got %q", nodes)
+	}
+	again := KVStore.NewRing(0, "http://node1:8080", "http://node2:8080", "http://node3:8080")
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := strconv.Itoa(i) //short keys are the hardest to spread evenly
+		owner := ring.Owner(key)
+		if owner != again.Owner(key) {
+			t.Fatalf("expected every ring with the same nodes to agree on the owner of %s", key)
+		}
+		counts[owner]++
+	}
+	for node, count := range counts {
+		if count < 700 || count > 1300 {
+			t.Errorf("expected the keys to be spread roughly evenly, but %s owns %d of 3000: %v", node, count, counts)
+		}
+	}
+}
+
+func TestRingChanges(t *testing.T) {
+	ring := KVStore.NewRing(64, "http://node1:8080", "http://node2:8080", "http://node3:8080")
+	bigger := ring.With("http://node4:8080")
+	if !bigger.Contains("http://node4:8080") || ring.Contains("http://node4:8080") {
+		t.Fatal("expected With to return a new ring, leaving the old one alone")
+	}
+	moved := 0
+	for i := 0; i < 2000; i++ {
+		key := "key" + strconv.Itoa(i)
+		before, after := ring.Owner(key), bigger.Owner(key)
+		if before != after {
+			if after != "http://node4:8080" {
+				t.Fatalf("expected keys to only move to the new node, but %s moved from %s to %s", key, before, after)
+			}
+			moved++
+		}
+	}
+	if moved < 300 || moved > 700 {
+		t.Errorf("expected about a quarter of the keys to move to the new node, got %d of 2000", moved)
+	}
+
+	smaller := bigger.Without("http://node2:8080")
+	for i := 0; i < 2000; i++ {
+		key := "key" + strconv.Itoa(i)
+		if before := bigger.Owner(key); before != "http://node2:8080" && smaller.Owner(key) != before {
+			t.Fatalf("expected only node2's keys to move when it is removed, but %s moved from %s", key, before)
+		}
+	}
+}
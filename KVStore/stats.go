@@ -0,0 +1,120 @@
+package KVStore
+
+import (
+	"encoding/json"
+	"runtime"
+	"store/rbac"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//maxRestartHistory is how many monitor restarts are remembered for the stats
+const maxRestartHistory = 100
+
+//reasons the store guardian restarts the monitor
+const (
+	RestartMonitorStopped  = "monitor stopped"
+	RestartMissedHeartbeat = "missed heartbeat"
+)
+
+//Stats is used to return the internals of the store and its supervisor to admins
+type Stats struct {
+	Keys            int              `json:"keys"`
+	ValueBytes      int64            `json:"valueBytes"`
+	Hits            int64            `json:"hits"`
+	Misses          int64            `json:"misses"`
+	HitRatio        float64          `json:"hitRatio"` //hits as a fraction of lookups, zero before the first lookup
+	Evictions       int64            `json:"evictions"`
+	StartedAt       time.Time        `json:"startedAt"`
+	Uptime          float64          `json:"uptimeSeconds"`
+	MaxDepth        int              `json:"maxDepth"`
+	BufferSize      int              `json:"bufferSize"`
+	QueueDepth      int              `json:"queueDepth"`
+	Goroutines      int              `json:"goroutines"`
+	MonitorRestarts []MonitorRestart `json:"monitorRestarts"` //oldest first
+	KeysPerUser     map[string]int   `json:"keysPerUser"`
+}
+
+//MonitorRestart is a time the store guardian restarted the monitor routine, and why
+type MonitorRestart struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+}
+
+var (
+	startedAt    time.Time
+	lookupHits   int64
+	lookupMisses int64
+
+	restarts     []MonitorRestart
+	restartsLock sync.Mutex //restarts are recorded by the guardian, but read by the actor
+)
+
+//resetStats is called when the store starts up
+func resetStats() {
+	startedAt = time.Now()
+	atomic.StoreInt64(&lookupHits, 0)
+	atomic.StoreInt64(&lookupMisses, 0)
+	restartsLock.Lock()
+	restarts = nil
+	restartsLock.Unlock()
+}
+
+//recordRestart remembers a monitor restart, forgetting the oldest once there are maxRestartHistory of them
+func recordRestart(reason string) {
+	restartsLock.Lock()
+	defer restartsLock.Unlock()
+	restarts = append(restarts, MonitorRestart{Time: time.Now(), Reason: reason})
+	if len(restarts) > maxRestartHistory {
+		restarts = restarts[len(restarts)-maxRestartHistory:]
+	}
+}
+
+//GetStats returns the store's statistics as JSON. Only admins can see them
+func GetStats(user rbac.Identity) ([]byte, error) {
+	return background.GetStats(user)
+}
+
+func (s Store) GetStats(user rbac.Identity) ([]byte, error) {
+	request := StoreRequest{ctx: s.ctx, command: StatsString, data: StoreData{user: user}}
+	response := MakeRequest(request)
+	return response.json, response.err
+}
+
+func directStats(user rbac.Identity) ([]byte, error) {
+	if !user.IsAdmin() {
+		return nil, ErrUnauthorized
+	}
+	stats := Stats{
+		Hits:        atomic.LoadInt64(&lookupHits),
+		Misses:      atomic.LoadInt64(&lookupMisses),
+		Evictions:   int64(evictionsTotal.Value()), //since the process started, like the metric
+		StartedAt:   startedAt,
+		Uptime:      time.Since(startedAt).Seconds(),
+		MaxDepth:    MaxDepth,
+		BufferSize:  BufferSize,
+		QueueDepth:  len(StoreChannel),
+		Goroutines:  runtime.NumGoroutine(),
+		KeysPerUser: map[string]int{},
+	}
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(lookups)
+	}
+	for _, keys := range kvStore {
+		for _, data := range keys {
+			stats.Keys++
+			stats.ValueBytes += int64(len(data.value))
+			stats.KeysPerUser[data.owner]++
+		}
+	}
+	restartsLock.Lock()
+	stats.MonitorRestarts = append([]MonitorRestart{}, restarts...)
+	restartsLock.Unlock()
+
+	jsonOut, errJSON := json.Marshal(stats)
+	if errJSON != nil {
+		return nil, errJSON
+	}
+	return jsonOut, nil
+}
@@ -1,178 +1,320 @@
-package KVStore
-
-import "time"
-
-//StoreRequest struct sent to the store guardian. Includes a response channel as well as a done channel, which can be closed to cancel the request
-type StoreRequest struct {
-	command         string
-	data            StoreData
-	responseChannel chan StoreResponse
-	doneChannel     chan struct{}
-}
-
-// SendData having this as a method allows it to run in its own goroutine and takes care of the shutdown case which doesn't have a channel
-func (s StoreRequest) SendData(data StoreResponse) bool {
-	if s.responseChannel != nil {
-		defer close(s.responseChannel)
-		select {
-		case s.responseChannel <- data:
-			return true
-		case <-s.doneChannel: //requester is no longer waiting for the response
-			return false
-		}
-	} else {
-		return false
-	}
-}
-
-//StoreResponse format of data expected as a response to a store request
-type StoreResponse struct {
-	json  []byte
-	value string
-	err   error
-}
-
-//StoreData format of data expected as in a store request
-type StoreData struct {
-	key   string
-	user  string
-	value string
-}
-
-func MakeRequest(request StoreRequest) StoreResponse {
-	request.responseChannel = make(chan StoreResponse)
-	request.doneChannel = make(chan struct{})
-	defer close(request.doneChannel)
-	select {
-	case <-ShutdownChannel:
-		return StoreResponse{err: ErrShutdown}
-	case StoreChannel <- request:
-		return <-request.responseChannel //Don't want to select on shutdown here because data return happens in its own go routine, may still be data waiting after guardian has shut down
-	}
-}
-
-//MonitorRoutine is a struct that wraps around an instance of a monitor routine, storing the heartbeat, done channel and kill channel
-//this struct means that each time the monitor routine is started it gets a new killChan, so we can be sure that we are killing one and only one instance
-//the old way without using this struct meant that a monitor instance that did not receive the kill signal before a new instance was started would not be killed since the two instances had the same killchan
-type MonitorRoutine struct {
-	HeartBeat chan struct{}
-	DoneChan  chan struct{}
-	killChan  chan struct{}
-}
-
-func (m *MonitorRoutine) Kill() {
-	close(m.killChan)
-}
-
-func NewMonitorRoutine(heartRate time.Duration) *MonitorRoutine {
-	out := &MonitorRoutine{
-		killChan: make(chan struct{}),
-	}
-	out.HeartBeat, out.DoneChan = monitor(heartRate, out.killChan)
-	return out
-}
-
-func monitor(heartBeat time.Duration, killChan chan struct{}) (heartBeatChan chan struct{}, doneChan chan struct{}) {
-	pulse := time.Tick(heartBeat)
-	heartBeatChan = make(chan struct{})
-	doneChan = make(chan struct{})
-	go func() {
-		defer close(doneChan)
-		var response StoreResponse
-		var storeRequest StoreRequest
-		var storeOpen bool
-	monitorLoop:
-		for {
-			select {
-			case <-pulse: //send a heartbeat to let the steward know we're still alive
-				heartBeatChan <- struct{}{}
-				continue monitorLoop
-			case <-killChan: //monitor has been killed by the steward
-				break monitorLoop
-			case storeRequest, storeOpen = <-StoreChannel:
-				if !storeOpen { //store channel has been closed, cannot continue to monitor
-					break monitorLoop
-				}
-			}
-
-			select {
-			case <-storeRequest.doneChannel: //check if this request is still needed
-				continue monitorLoop
-			default:
-			}
-
-			switch storeRequest.command {
-			case LookupString:
-				value, err := directLookupValue(storeRequest.data.key, storeRequest.data.user)
-				response = StoreResponse{
-					value: value,
-					err:   err,
-				}
-			case PutString:
-				err := directPutValue(storeRequest.data.key, storeRequest.data.user, storeRequest.data.value)
-				response = StoreResponse{
-					err: err,
-				}
-			case DeleteString:
-				err := directDelete(storeRequest.data.key, storeRequest.data.user)
-				response = StoreResponse{
-					err: err,
-				}
-			case ListString:
-				var json []byte
-				var err error
-				if storeRequest.data.key == "" {
-					json, err = directListStore()
-				} else {
-					json, err = directListKey(storeRequest.data.key)
-				}
-				response = StoreResponse{
-					json: json,
-					err:  err,
-				}
-			case ShutdownString:
-				break monitorLoop //this should cause the store guardian to complete and exit
-			default:
-				response = StoreResponse{
-					err: ErrBadRequest,
-				}
-			}
-			go storeRequest.SendData(response) //this is run on a new goroutine to prevent the store guardian getting stock waiting to send a response
-		}
-	}()
-	return heartBeatChan, doneChan
-}
-
-//ListenForStoreRequests is the main monitoring routine. Waits for requests to be made and then calls the direct methods
-func ListenForStoreRequests(timeout time.Duration) (doneChan chan struct{}) {
-	doneChan = make(chan struct{})
-	var monitorInstance *MonitorRoutine
-	go func() {
-		defer close(doneChan)
-		monitorInstance = NewMonitorRoutine(timeout / 5) //set the monitors heartrate at 1/5 the timeout so as not to have uneccessary restarts
-	monitorLoop:
-		for {
-			select {
-			case <-monitorInstance.HeartBeat: //everything is OK, monitor is still doing its thing
-				continue monitorLoop
-
-			case <-doneWithTimeout(monitorInstance.DoneChan, timeout): //either monitor has crashed or hasn't checked in. Either way we need to check in on it
-				close(monitorInstance.killChan) //monitor is about to be restarted so let's make sure the old instance is definitely dead
-				select {
-				case <-ShutdownChannel: //a shutdown has been initialised, so everything is fine, proceed to kill the steward
-					break monitorLoop
-				default:
-				}
-
-				request, storeOpen := <-StoreChannel //need to see if crash has caused the store channel to close
-				if storeOpen {
-					StoreChannel <- request //channel is still open, but we need to put the request we stole back in
-				} else { //store channel has unexpectedly closed, reopen it (note, some requests will have been lost)
-					StoreChannel = make(chan StoreRequest, BufferSize)
-				}
-				monitorInstance = NewMonitorRoutine(timeout / 5) //this restarts the monitor
-			}
-		}
-	}()
-	return doneChan
-}
+package KVStore
+
+import (
+	"context"
+	"store/audit"
+	"store/logging"
+	"store/rbac"
+	"store/tracing"
+	"time"
+)
+
+//StoreRequest struct sent to the store guardian. Includes a response channel as well as a done channel, which can be closed to cancel the request
+type StoreRequest struct {
+	ctx             context.Context //the context of the request that asked for this, which carries its request ID and trace
+	queued          *tracing.Span   //covers the time spent waiting in StoreChannel, ended by the monitor when it picks the request up
+	command         string
+	data            StoreData
+	ordered         bool //in clustered mode, set once a write has been committed by the cluster, or the leader is sure a read is up to date
+	responseChannel chan StoreResponse
+	doneChannel     chan struct{}
+}
+
+// SendData having this as a method allows it to run in its own goroutine and takes care of the shutdown case which doesn't have a channel
+func (s StoreRequest) SendData(data StoreResponse) bool {
+	if s.responseChannel != nil {
+		defer close(s.responseChannel)
+		select {
+		case s.responseChannel <- data:
+			return true
+		case <-s.doneChannel: //requester is no longer waiting for the response
+			return false
+		}
+	} else {
+		return false
+	}
+}
+
+//StoreResponse format of data expected as a response to a store request
+type StoreResponse struct {
+	json     []byte
+	value    string
+	count    int        //only used when resizing, the number of keys evicted, and when importing or releasing keys
+	snapshot *Snapshot  //only used when taking a snapshot
+	keys     []Mutation //only used when exporting keys
+	err      error
+}
+
+//StoreData format of data expected as in a store request
+type StoreData struct {
+	namespace string
+	key       string
+	user      rbac.Identity
+	value     string
+	principal string                //only used when changing an access control list
+	perm      rbac.Permission       //only used when changing an access control list
+	all       bool                  //only used when listing the store
+	inOne     bool                  //only used when listing the store, restricts the list to the keys in namespace
+	depth     int                   //only used when resizing the store
+	at        time.Time             //only used in clustered mode, the time the leader proposed a write
+	mutation  *Mutation             //only used when applying a change replicated from another store
+	snapshot  *Snapshot             //only used when restoring the store from a snapshot
+	selected  func(key string) bool //only used when exporting keys
+	limit     int                   //only used when exporting keys
+	keys      []Mutation            //only used when importing or releasing keys
+	resume    chan struct{}         //only used when pausing the store, closed to let it carry on
+}
+
+func MakeRequest(request StoreRequest) StoreResponse {
+	if request.ctx == nil {
+		request.ctx = context.Background()
+	}
+	if consensus := currentConsensus(); consensus != nil && needsCluster(request) {
+		return makeClusteredRequest(consensus, request)
+	}
+	var span *tracing.Span
+	request.ctx, span = tracing.Start(request.ctx, "kvstore "+request.command)
+	defer span.End()
+	span.SetAttribute("kvstore.key", request.data.key)
+	span.SetAttribute("kvstore.namespace", request.data.namespace)
+	_, request.queued = tracing.Start(request.ctx, "kvstore.enqueue")
+	defer request.queued.End() //only does anything if the request never reached the monitor
+
+	request.responseChannel = make(chan StoreResponse)
+	request.doneChannel = make(chan struct{})
+	defer close(request.doneChannel)
+	select {
+	case <-ShutdownChannel:
+		span.SetError(ErrShutdown)
+		return StoreResponse{err: ErrShutdown}
+	case <-request.ctx.Done(): //the caller has given up before the request reached the actor
+		span.SetError(request.ctx.Err())
+		return StoreResponse{err: request.ctx.Err()}
+	case StoreChannel <- request:
+		response := <-request.responseChannel //Don't want to select on shutdown here because data return happens in its own go routine, may still be data waiting after guardian has shut down
+		span.SetError(response.err)
+		return response
+	}
+}
+
+//MonitorRoutine is a struct that wraps around an instance of a monitor routine, storing the heartbeat, done channel and kill channel
+//this struct means that each time the monitor routine is started it gets a new killChan, so we can be sure that we are killing one and only one instance
+//the old way without using this struct meant that a monitor instance that did not receive the kill signal before a new instance was started would not be killed since the two instances had the same killchan
+type MonitorRoutine struct {
+	HeartBeat chan struct{}
+	DoneChan  chan struct{}
+	killChan  chan struct{}
+}
+
+func (m *MonitorRoutine) Kill() {
+	close(m.killChan)
+}
+
+func NewMonitorRoutine(heartRate time.Duration) *MonitorRoutine {
+	out := &MonitorRoutine{
+		killChan: make(chan struct{}),
+	}
+	out.HeartBeat, out.DoneChan = monitor(heartRate, out.killChan)
+	return out
+}
+
+func monitor(heartBeat time.Duration, killChan chan struct{}) (heartBeatChan chan struct{}, doneChan chan struct{}) {
+	pulse := time.Tick(heartBeat)
+	heartBeatChan = make(chan struct{})
+	doneChan = make(chan struct{})
+	go func() {
+		defer close(doneChan)
+		var response StoreResponse
+		var storeRequest StoreRequest
+		var storeOpen bool
+	monitorLoop:
+		for {
+			select {
+			case <-pulse: //send a heartbeat to let the steward know we're still alive
+				heartBeatChan <- struct{}{}
+				continue monitorLoop
+			case <-killChan: //monitor has been killed by the steward
+				break monitorLoop
+			case storeRequest, storeOpen = <-StoreChannel:
+				if !storeOpen { //store channel has been closed, cannot continue to monitor
+					break monitorLoop
+				}
+			}
+
+			storeRequest.queued.End()
+			select {
+			case <-storeRequest.doneChannel: //check if this request is still needed
+				continue monitorLoop
+			default:
+			}
+			var executeSpan *tracing.Span
+			if storeRequest.queued != nil { //only requests that are being traced, so pings and shutdowns don't start traces of their own
+				_, executeSpan = tracing.Start(storeRequest.ctx, "kvstore.execute")
+			}
+
+			logging.Debug(storeRequest.ctx).Printf("store handling %s request for key %s in namespace %q\n", storeRequest.command, storeRequest.data.key, storeRequest.data.namespace)
+			switch storeRequest.command {
+			case LookupString:
+				value, err := directLookupValue(storeRequest.data.namespace, storeRequest.data.key, storeRequest.data.user)
+				response = StoreResponse{
+					value: value,
+					err:   err,
+				}
+			case PutString:
+				oldVersion := directVersion(storeRequest.data.namespace, storeRequest.data.key)
+				at := storeRequest.data.at
+				if at.IsZero() {
+					at = time.Now()
+				}
+				err := directPutValue(storeRequest.data.namespace, storeRequest.data.key, storeRequest.data.user, storeRequest.data.value, at)
+				if err == nil {
+					directRecordMutation(storeRequest.data.namespace, storeRequest.data.key)
+				}
+				auditMutation(storeRequest.ctx, audit.ActionPut, storeRequest.data, err, oldVersion, directVersion(storeRequest.data.namespace, storeRequest.data.key))
+				response = StoreResponse{
+					err: err,
+				}
+			case DeleteString:
+				oldVersion := directVersion(storeRequest.data.namespace, storeRequest.data.key)
+				err := directDelete(storeRequest.data.namespace, storeRequest.data.key, storeRequest.data.user)
+				if err == nil {
+					directRecordMutation(storeRequest.data.namespace, storeRequest.data.key)
+				}
+				auditMutation(storeRequest.ctx, audit.ActionDelete, storeRequest.data, err, oldVersion, directVersion(storeRequest.data.namespace, storeRequest.data.key))
+				response = StoreResponse{
+					err: err,
+				}
+			case ListString:
+				var json []byte
+				var err error
+				if storeRequest.data.key == "" {
+					json, err = directListStore(storeRequest.data.user, storeRequest.data.all, storeRequest.data.namespace, storeRequest.data.inOne)
+				} else {
+					json, err = directListKey(storeRequest.data.namespace, storeRequest.data.key, storeRequest.data.user)
+				}
+				response = StoreResponse{
+					json: json,
+					err:  err,
+				}
+			case GetACLString:
+				json, err := directGetACL(storeRequest.data.namespace, storeRequest.data.key, storeRequest.data.user)
+				response = StoreResponse{
+					json: json,
+					err:  err,
+				}
+			case SetACLString:
+				err := directSetACL(storeRequest.data.namespace, storeRequest.data.key, storeRequest.data.user, storeRequest.data.principal, storeRequest.data.perm)
+				if err == nil {
+					directRecordMutation(storeRequest.data.namespace, storeRequest.data.key)
+				}
+				auditMutation(storeRequest.ctx, audit.ActionSetACL, storeRequest.data, err, 0, 0)
+				response = StoreResponse{
+					err: err,
+				}
+			case TransferString:
+				err := directTransferOwnership(storeRequest.data.namespace, storeRequest.data.key, storeRequest.data.user, storeRequest.data.value)
+				if err == nil {
+					directRecordMutation(storeRequest.data.namespace, storeRequest.data.key)
+					if storeRequest.data.namespace != "" && storeRequest.data.namespace != storeRequest.data.value { //the key moved to the new owner's namespace
+						directRecordMutation(storeRequest.data.value, storeRequest.data.key)
+					}
+				}
+				auditMutation(storeRequest.ctx, audit.ActionTransfer, storeRequest.data, err, 0, 0)
+				response = StoreResponse{
+					err: err,
+				}
+			case StatsString:
+				json, err := directStats(storeRequest.data.user)
+				response = StoreResponse{
+					json: json,
+					err:  err,
+				}
+			case ResizeString:
+				response = StoreResponse{
+					count: directResize(storeRequest.data.depth),
+				}
+			case SnapshotString:
+				response = StoreResponse{
+					snapshot: directSnapshot(),
+				}
+			case RestoreString:
+				directRestore(storeRequest.data.snapshot)
+				response = StoreResponse{}
+			case ApplyString:
+				response = StoreResponse{
+					err: directApply(storeRequest.data.mutation),
+				}
+			case ExportString:
+				response = StoreResponse{
+					keys: directExport(storeRequest.data.selected, storeRequest.data.limit),
+				}
+			case ImportString:
+				response = StoreResponse{
+					count: directImport(storeRequest.data.keys),
+				}
+			case ReleaseString:
+				response = StoreResponse{
+					count: directRelease(storeRequest.data.keys),
+				}
+			case PingString:
+				response = StoreResponse{} //nothing to do, getting here shows the monitor is handling requests
+			case PauseString:
+				<-storeRequest.data.resume //every other request waits too, as if the monitor had hung
+				response = StoreResponse{}
+			case ShutdownString:
+				break monitorLoop //this should cause the store guardian to complete and exit
+			default:
+				response = StoreResponse{
+					err: ErrBadRequest,
+				}
+			}
+			executeSpan.SetError(response.err)
+			executeSpan.End()
+			countOperation(storeRequest.command, response.err)
+			go storeRequest.SendData(response) //this is run on a new goroutine to prevent the store guardian getting stock waiting to send a response
+		}
+	}()
+	return heartBeatChan, doneChan
+}
+
+//ListenForStoreRequests is the main monitoring routine. Waits for requests to be made and then calls the direct methods
+func ListenForStoreRequests(timeout time.Duration) (doneChan chan struct{}) {
+	doneChan = make(chan struct{})
+	var monitorInstance *MonitorRoutine
+	go func() {
+		defer close(doneChan)
+		monitorInstance = NewMonitorRoutine(timeout / 5) //set the monitors heartrate at 1/5 the timeout so as not to have uneccessary restarts
+	monitorLoop:
+		for {
+			select {
+			case <-monitorInstance.HeartBeat: //everything is OK, monitor is still doing its thing
+				continue monitorLoop
+
+			case <-doneWithTimeout(monitorInstance.DoneChan, timeout): //either monitor has crashed or hasn't checked in. Either way we need to check in on it
+				reason := RestartMissedHeartbeat
+				select {
+				case <-monitorInstance.DoneChan:
+					reason = RestartMonitorStopped
+				default:
+				}
+				close(monitorInstance.killChan) //monitor is about to be restarted so let's make sure the old instance is definitely dead
+				select {
+				case <-ShutdownChannel: //a shutdown has been initialised, so everything is fine, proceed to kill the steward
+					break monitorLoop
+				default:
+				}
+
+				request, storeOpen := <-StoreChannel //need to see if crash has caused the store channel to close
+				if storeOpen {
+					StoreChannel <- request //channel is still open, but we need to put the request we stole back in
+				} else { //store channel has unexpectedly closed, reopen it (note, some requests will have been lost)
+					StoreChannel = make(chan StoreRequest, BufferSize)
+				}
+				monitorInstance = NewMonitorRoutine(timeout / 5) //this restarts the monitor
+				monitorRestartsTotal.Inc()
+				recordRestart(reason)
+			}
+		}
+	}()
+	return doneChan
+}
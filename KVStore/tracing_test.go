@@ -0,0 +1,59 @@
+package KVStore_test
+
+import (
+	"context"
+	"store/KVStore"
+	"store/rbac"
+	"store/tracing"
+	"sync"
+	"testing"
+)
+
+type spanRecorder struct {
+	lock  sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (s *spanRecorder) Export(spans []tracing.SpanData) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.spans = append(s.spans, spans...)
+	return nil
+}
+
+func (s *spanRecorder) Shutdown() error {
+	return nil
+}
+
+func TestStoreSpans(t *testing.T) {
+	recorder := &spanRecorder{}
+	tracing.SetExporter(recorder)
+	defer tracing.SetExporter(nil)
+	KVStore.Startup(100, 100)
+	defer handleShutdown(t)
+	user := rbac.NewIdentity("test", rbac.RoleWriter)
+
+	ctx, request := tracing.Start(context.Background(), "request")
+	KVStore.WithContext(ctx).LookupValueIn("", "missing", user)
+	request.End()
+	tracing.Flush()
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	spans := map[string]tracing.SpanData{}
+	for _, span := range recorder.spans {
+		spans[span.Name] = span
+	}
+	store, present := spans["kvstore lookup"]
+	if !present || store.ParentID != request.SpanContext().SpanID.String() {
+		t.Fatalf("expected a store span under the request span, got %+v\n", recorder.spans)
+	}
+	if store.Error != KVStore.ErrKeyNotPresent.Error() {
+		t.Errorf("expected the store span to record the error, got %q\n", store.Error)
+	}
+	for _, name := range []string{"kvstore.enqueue", "kvstore.execute"} {
+		if spans[name].ParentID != store.SpanID {
+			t.Errorf("expected %s to be a child of the store span, got %+v\n", name, spans[name])
+		}
+	}
+}
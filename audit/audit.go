@@ -0,0 +1,373 @@
+//Package audit keeps a tamper evident record of every change to the store and every privileged action.
+//Events are written as JSON lines, each including the hash of the line before it, so editing or removing
+//an event breaks the chain from that point on and is picked up by Verify
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"store/logging"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrNotOpen = errors.New("audit log is not open")
+
+//actions recorded in the audit log
+const (
+	ActionPut           = "put"
+	ActionDelete        = "delete"
+	ActionEvict         = "evict"
+	ActionSetACL        = "setacl"
+	ActionTransfer      = "transfer"
+	ActionLogin         = "login"
+	ActionLockout       = "lockout"
+	ActionClearLockout  = "clearlockout"
+	ActionMintAPIKey    = "mintapikey"
+	ActionRevokeAPIKey  = "revokeapikey"
+	ActionEnrolTOTP     = "enroltotp"
+	ActionConfirmTOTP   = "confirmtotp"
+	ActionDisableTOTP   = "disabletotp"
+	ActionShutdown      = "shutdown"
+	ActionReload        = "reload"
+	ActionPromote       = "promote"
+	ActionAddMember     = "addmember"
+	ActionRemoveMember  = "removemember"
+	ActionQueryAuditLog = "queryaudit"
+)
+
+//outcomes of an action
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure" //the action was allowed but didn't work, e.g. a wrong password or a missing key
+	OutcomeDenied  = "denied"  //the user wasn't allowed to do it
+)
+
+//genesisHash is the previous hash of the first event in a log
+const genesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+//Event is one line of the audit log
+type Event struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Outcome    string    `json:"outcome"`
+	User       string    `json:"user,omitempty"` //who did it. Empty for things the store does itself, like evictions
+	Source     string    `json:"source,omitempty"`
+	Key        string    `json:"key,omitempty"`
+	Namespace  string    `json:"namespace,omitempty"`
+	OldVersion int       `json:"oldVersion,omitempty"` //the number of writes to the key before the change, zero if it didn't exist
+	NewVersion int       `json:"newVersion,omitempty"` //the number of writes after the change, zero if it no longer exists
+	Detail     string    `json:"detail,omitempty"`
+	RequestID  string    `json:"requestId,omitempty"`
+	PrevHash   string    `json:"prevHash"`
+	Hash       string    `json:"hash"`
+}
+
+//computeHash hashes the event, minus its own hash, chained on to the previous event's hash
+func (e Event) computeHash() string {
+	e.Hash = ""
+	contents, _ := json.Marshal(e) //an Event always marshals
+	sum := sha256.Sum256(append([]byte(e.PrevHash), contents...))
+	return hex.EncodeToString(sum[:])
+}
+
+//BufferSize is how many events can be waiting to be written before Record blocks
+const BufferSize = 1024
+
+//entry is either an event to write, or a request to be told once everything before it has been written
+type entry struct {
+	event   Event
+	flushed chan struct{}
+}
+
+var (
+	file    *os.File
+	path    string
+	entries chan entry    //nil while the log is closed
+	stopped chan struct{} //closed by the writer once it has written everything and stopped
+	lastSeq uint64        //the sequence number of the last event written, only read and written atomically
+	lock    sync.RWMutex  //held for reading while sending to entries, and for writing to open or close the log
+)
+
+//Open starts writing events to the file at filePath, carrying on the chain of any events already in it
+func Open(filePath string) error {
+	lock.Lock()
+	defer lock.Unlock()
+	result, err := verifyFile(filePath, 0)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !result.Valid {
+		//keep going so that the gap is itself recorded, but make sure somebody notices
+		logging.ErrorLogger.Printf("audit log %s failed verification at event %d: %s\n", filePath, result.BrokenAt, result.Problem)
+	}
+	newFile, err := os.OpenFile(filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if file != nil {
+		stopWriter()
+		file.Close()
+	}
+	file = newFile
+	path = filePath
+	lastHash := genesisHash
+	if result.LastHash != "" {
+		lastHash = result.LastHash
+	}
+	atomic.StoreUint64(&lastSeq, result.LastSeq)
+	entries = make(chan entry, BufferSize)
+	stopped = make(chan struct{})
+	go writeEntries(file, entries, stopped, lastHash)
+	logging.InfoLogger.Printf("audit log %s opened with %d events\n", filePath, result.Events)
+	return nil
+}
+
+//Close writes any events still waiting and stops writing to the audit log. Later events are dropped
+func Close() error {
+	lock.Lock()
+	defer lock.Unlock()
+	if file == nil {
+		return nil
+	}
+	stopWriter()
+	err := file.Close()
+	file = nil
+	path = ""
+	atomic.StoreUint64(&lastSeq, 0)
+	return err
+}
+
+//stopWriter waits for the writer to finish the events it has been sent. The lock must be held
+func stopWriter() {
+	close(entries)
+	<-stopped
+	entries = nil
+}
+
+//Record queues the event to be added to the audit log, which fills in its sequence number and hashes.
+//It only blocks if BufferSize events are already waiting, so callers like the store actor aren't held up by the disk.
+//Nothing is recorded if the log isn't open
+func Record(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if event.Outcome == "" {
+		event.Outcome = OutcomeSuccess
+	}
+	lock.RLock()
+	defer lock.RUnlock()
+	if entries == nil {
+		return
+	}
+	entries <- entry{event: event}
+}
+
+//Flush waits until every event recorded so far has been written
+func Flush() {
+	flushed := make(chan struct{})
+	lock.RLock()
+	if entries == nil {
+		lock.RUnlock()
+		return
+	}
+	entries <- entry{flushed: flushed}
+	lock.RUnlock()
+	<-flushed
+}
+
+//writeEntries is the only thing that writes to the file, chaining each event on to the one before
+func writeEntries(output *os.File, entries <-chan entry, stopped chan<- struct{}, lastHash string) {
+	defer close(stopped)
+	for next := range entries {
+		if next.flushed != nil {
+			close(next.flushed)
+			continue
+		}
+		event := next.event
+		event.Seq = atomic.LoadUint64(&lastSeq) + 1
+		event.PrevHash = lastHash
+		event.Hash = event.computeHash()
+		line, err := json.Marshal(event)
+		if err != nil {
+			logging.ErrorLogger.Println("unable to marshal audit event", err)
+			continue
+		}
+		if _, err := output.Write(append(line, '\n')); err != nil {
+			logging.ErrorLogger.Println("unable to write audit event", err)
+			continue
+		}
+		lastHash = event.Hash
+		atomic.StoreUint64(&lastSeq, event.Seq)
+	}
+}
+
+//Filter selects events from the audit log. Empty fields match everything
+type Filter struct {
+	User   string
+	Key    string
+	Action string
+	From   time.Time
+	To     time.Time
+	Limit  int //the most recent Limit events are returned. Zero means no limit
+}
+
+func (f Filter) matches(e Event) bool {
+	if f.User != "" && e.User != f.User {
+		return false
+	}
+	if f.Key != "" && e.Key != f.Key {
+		return false
+	}
+	if f.Action != "" && e.Action != f.Action {
+		return false
+	}
+	if !f.From.IsZero() && e.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && e.Time.After(f.To) {
+		return false
+	}
+	return true
+}
+
+//readEvents calls fn with each event in the file, in order. Stops at the first line that isn't a valid event.
+//A last line without a newline is skipped, since it may still be being written
+func readEvents(filePath string, fn func(event Event) error) error {
+	input, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	reader := bufio.NewReader(input)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == nil {
+			var event Event
+			if errJSON := json.Unmarshal(line, &event); errJSON != nil {
+				return errJSON
+			}
+			if errFn := fn(event); errFn != nil {
+				return errFn
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+//Query returns the events matching the filter, oldest first
+func Query(filter Filter) ([]Event, error) {
+	Flush()
+	lock.RLock()
+	filePath := path
+	lock.RUnlock()
+	if filePath == "" {
+		return nil, ErrNotOpen
+	}
+	output := []Event{}
+	err := readEvents(filePath, func(event Event) error {
+		if filter.matches(event) {
+			output = append(output, event)
+			if filter.Limit > 0 && len(output) > filter.Limit {
+				output = output[1:]
+			}
+		}
+		return nil
+	})
+	return output, err
+}
+
+//VerifyResult describes whether the hash chain in an audit log is intact
+type VerifyResult struct {
+	Valid    bool   `json:"valid"`
+	Events   int    `json:"events"`
+	BrokenAt uint64 `json:"brokenAt,omitempty"` //the sequence number of the first bad event
+	Problem  string `json:"problem,omitempty"`
+	LastSeq  uint64 `json:"lastSeq"`
+	LastHash string `json:"lastHash,omitempty"`
+}
+
+//verifyFile checks the chain in the file up to the event numbered upTo, or the whole file if upTo is zero
+func verifyFile(filePath string, upTo uint64) (VerifyResult, error) {
+	result := VerifyResult{Valid: true}
+	prevHash := genesisHash
+	errBroken := errors.New("broken")
+	errDone := errors.New("done")
+	err := readEvents(filePath, func(event Event) error {
+		if upTo > 0 && result.LastSeq >= upTo {
+			return errDone //anything later was written after the check started
+		}
+		problem := ""
+		switch {
+		case event.Seq != result.LastSeq+1:
+			problem = "sequence number out of order"
+		case event.PrevHash != prevHash:
+			problem = "previous hash does not match"
+		case event.computeHash() != event.Hash:
+			problem = "event has been modified"
+		}
+		if problem != "" {
+			result.Valid = false
+			result.BrokenAt = event.Seq
+			result.Problem = problem
+			return errBroken
+		}
+		result.Events++
+		result.LastSeq = event.Seq
+		result.LastHash = event.Hash
+		prevHash = event.Hash
+		return nil
+	})
+	if err == errBroken {
+		//carry the chain on from the last event in the file so new events can still be checked against each other
+		result.LastSeq, result.LastHash = lastEvent(filePath, result.LastSeq, result.LastHash)
+		return result, nil
+	}
+	if err == errDone {
+		return result, nil
+	}
+	if _, isJSONError := err.(*json.SyntaxError); isJSONError {
+		result.Valid = false
+		result.BrokenAt = result.LastSeq + 1
+		result.Problem = "line is not a valid event"
+		return result, nil
+	}
+	return result, err
+}
+
+//lastEvent finds the sequence number and hash of the last readable event in the file
+func lastEvent(filePath string, seq uint64, hash string) (uint64, string) {
+	_ = readEvents(filePath, func(event Event) error {
+		if event.Seq > seq {
+			seq = event.Seq
+		}
+		hash = event.Hash
+		return nil
+	})
+	return seq, hash
+}
+
+//Verify checks the hash chain of the open audit log, up to the last event written when it was called.
+//Events can carry on being recorded while the check runs
+func Verify() (VerifyResult, error) {
+	Flush()
+	lock.RLock()
+	filePath := path
+	upTo := atomic.LoadUint64(&lastSeq)
+	lock.RUnlock()
+	if filePath == "" {
+		return VerifyResult{}, ErrNotOpen
+	}
+	return verifyFile(filePath, upTo)
+}
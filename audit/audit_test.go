@@ -0,0 +1,141 @@
+package audit_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"store/audit"
+	"store/logging"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logging.SetupLoggers("../info.log", "../htaccess.log", false) //pass in the log files so they can be closed at the end of the main function
+	defer logging.Shutdown()
+	m.Run()
+}
+
+//openTempLog opens an audit log in a new temp dir, returning its path and a function to clean up afterwards
+func openTempLog(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal("unable to create temp dir", err)
+	}
+	path := filepath.Join(dir, "audit.log")
+	if err := audit.Open(path); err != nil {
+		t.Fatal("unable to open audit log", err)
+	}
+	return path, func() {
+		audit.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	_, cleanup := openTempLog(t)
+	defer cleanup()
+	audit.Record(audit.Event{Action: audit.ActionPut, User: "user_a", Key: "k1", NewVersion: 1})
+	audit.Record(audit.Event{Action: audit.ActionPut, User: "user_b", Key: "k2", NewVersion: 1})
+	audit.Record(audit.Event{Action: audit.ActionDelete, User: "user_a", Key: "k1", OldVersion: 1})
+	audit.Record(audit.Event{Action: audit.ActionLogin, User: "user_a", Outcome: audit.OutcomeFailure})
+
+	events, err := audit.Query(audit.Filter{User: "user_a"})
+	if err != nil || len(events) != 3 {
+		t.Fatalf("expected 3 events for user_a, got %d %v\n", len(events), err)
+	}
+	if events[0].Seq != 1 || events[2].Seq != 4 || events[0].Outcome != audit.OutcomeSuccess {
+		t.Errorf("events have the wrong sequence numbers or outcome %+v\n", events)
+	}
+	if events, _ := audit.Query(audit.Filter{Key: "k1"}); len(events) != 2 {
+		t.Errorf("expected 2 events for k1, got %d\n", len(events))
+	}
+	if events, _ := audit.Query(audit.Filter{User: "user_a", Limit: 1}); len(events) != 1 || events[0].Action != audit.ActionLogin {
+		t.Errorf("limit should return the most recent event, got %+v\n", events)
+	}
+	if events, _ := audit.Query(audit.Filter{From: time.Now().Add(time.Hour)}); len(events) != 0 {
+		t.Errorf("expected no events in the future, got %d\n", len(events))
+	}
+	if events, _ := audit.Query(audit.Filter{From: time.Now().Add(-time.Hour), To: time.Now()}); len(events) != 4 {
+		t.Errorf("expected every event in the last hour, got %d\n", len(events))
+	}
+}
+
+func TestVerify(t *testing.T) {
+	path, cleanup := openTempLog(t)
+	defer cleanup()
+	for i := 0; i < 5; i++ {
+		audit.Record(audit.Event{Action: audit.ActionPut, User: "user_a", Key: "k1", OldVersion: i, NewVersion: i + 1})
+	}
+	result, err := audit.Verify()
+	if err != nil || !result.Valid || result.Events != 5 {
+		t.Fatalf("untouched log failed verification %+v %v\n", result, err)
+	}
+
+	//reopening carries on the same chain
+	audit.Close()
+	if err := audit.Open(path); err != nil {
+		t.Fatal("unable to reopen audit log", err)
+	}
+	audit.Record(audit.Event{Action: audit.ActionShutdown, User: "admin"})
+	if result, _ := audit.Verify(); !result.Valid || result.LastSeq != 6 {
+		t.Fatalf("chain broken after reopening %+v\n", result)
+	}
+
+	//quietly change who made the third write
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("unable to read audit log", err)
+	}
+	lines := strings.Split(string(contents), "\n")
+	lines[2] = strings.Replace(lines[2], `"user":"user_a"`, `"user":"user_b"`, 1)
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal("unable to write audit log", err)
+	}
+	result, err = audit.Verify()
+	if err != nil || result.Valid || result.BrokenAt != 3 {
+		t.Errorf("tampering was not detected at event 3 %+v %v\n", result, err)
+	}
+
+	//removing an event is also detected
+	lines = append(lines[:1], lines[2:]...)
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal("unable to write audit log", err)
+	}
+	if result, _ := audit.Verify(); result.Valid || result.BrokenAt != 3 {
+		t.Errorf("removed event was not detected %+v\n", result)
+	}
+}
+
+func TestRecordWhileVerifying(t *testing.T) {
+	path, cleanup := openTempLog(t)
+	defer cleanup()
+	const writers, events = 4, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < events; i++ {
+				audit.Record(audit.Event{Action: audit.ActionPut, User: "user_a", Key: "k1"})
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if result, err := audit.Verify(); err != nil || !result.Valid {
+			t.Fatalf("log failed verification while being written %+v %v\n", result, err)
+		}
+	}
+	wg.Wait()
+
+	//closing writes everything that was still queued
+	audit.Close()
+	if err := audit.Open(path); err != nil {
+		t.Fatal("unable to reopen audit log", err)
+	}
+	if result, err := audit.Verify(); err != nil || !result.Valid || result.Events != writers*events {
+		t.Errorf("expected %d events after closing, got %+v %v\n", writers*events, result, err)
+	}
+}
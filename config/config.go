@@ -0,0 +1,398 @@
+//Package config loads the server's settings into a single Config. Each setting can come from a YAML file,
+//an environment variable or a command line flag. Flags win over environment variables, which win over the file,
+//which wins over the defaults
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+//EnvPrefix is added to the upper case, underscored name of a setting to get its environment variable, e.g. KVSTORE_LOG_LEVEL
+const EnvPrefix = "KVSTORE_"
+
+//ConfigFileEnv names the config file when the -config flag isn't given
+const ConfigFileEnv = EnvPrefix + "CONFIG"
+
+//Config holds every setting. The name tag is used for the YAML key and the flag, and gives the environment variable.
+//env lists any older environment variables that are also read, for existing deployments.
+//Settings tagged reload:"live" can be changed by reloading the configuration, the rest need a restart.
+//Settings tagged secret are hidden when the config is printed
+type Config struct {
+	Port       int           `name:"port" env:"PORT" help:"Port number to run on"`
+	Host       string        `name:"host" help:"Host name shown in the startup message"`
+	Depth      int           `name:"depth" reload:"live" help:"Maximum size of the KV store"`
+	Buffer     int           `name:"buffer" help:"KV store buffer"`
+	Namespaced bool          `name:"namespaced" help:"Give each user their own keyspace. depth then applies to each user separately"`
+	Steward    time.Duration `name:"steward-timeout" help:"How long the store guardian waits for a heartbeat before restarting the store monitor"`
+	Grace      time.Duration `name:"shutdown-grace" help:"How long in-flight requests get to finish when shutting down, after /shutdown, SIGTERM or SIGINT"`
+	DataFile   string        `name:"data-file" help:"File the store is saved to when the server shuts down and loaded from when it starts. If not set the store is lost when the server stops. Cluster nodes use cluster-data-dir instead"`
+
+	UsersFile          string        `name:"users-file" reload:"live" help:"csv file of users, their passwords, roles and groups"`
+	TokenLifetime      time.Duration `name:"token-lifetime" help:"How long a login token lasts"`
+	JWTSecret          string        `name:"jwt-secret" secret:"true" help:"Key login tokens are signed with, at least 32 characters. Must be the same on every node"`
+	Auth               string        `name:"auth" help:"Comma separated list of authentication backends to try in order (local, htpasswd, ldap)"`
+	Htpasswd           string        `name:"htpasswd" help:"Path to the htpasswd file used by the htpasswd backend"`
+	LDAPURL            string        `name:"ldap-url" help:"URL of the LDAP server used by the ldap backend, e.g. ldaps://ldap.example.com"`
+	LDAPBindDN         string        `name:"ldap-bind-dn" help:"Bind DN template for the ldap backend. %s is replaced by the username"`
+	APIKeys            string        `name:"api-keys" help:"File to keep API keys in. If not set API keys are lost when the server stops"`
+	LockoutThreshold   int           `name:"lockout-threshold" help:"Failed logins for a username before it is temporarily locked out"`
+	LockoutIPThreshold int           `name:"lockout-ip-threshold" help:"Failed logins from an IP before it is temporarily locked out. 0 to only lock out usernames, e.g. when every client comes through the same proxy"`
+	LockoutDuration    time.Duration `name:"lockout-duration" help:"How long a username or IP stays locked out"`
+	TrustedProxies     string        `name:"trusted-proxies" help:"Comma separated IPs or CIDRs of proxies trusted to give the client's IP in X-Forwarded-For, e.g. a load balancer"`
+	TOTPFile           string        `name:"totp-file" help:"File to keep two factor enrolments in. If not set enrolments are lost when the server stops"`
+	Require2FA         string        `name:"require-2fa" help:"Comma separated roles that must use two factor authentication to log in with a password. Empty for none. Client certificates and API keys are not affected"`
+
+	TLSCert           string `name:"tls-cert" reload:"live" help:"TLS certificate file. Serves HTTPS if set, and is reloaded when the file changes"`
+	TLSKey            string `name:"tls-key" reload:"live" help:"TLS private key file"`
+	ClientCA          string `name:"client-ca" help:"CA bundle used to verify client certificates. Verified clients don't need to log in"`
+	RequireClientCert bool   `name:"require-client-cert" help:"Reject connections without a valid client certificate"`
+	CertUsers         string `name:"cert-users" help:"csv file mapping client certificate subjects to usernames. Required with client-ca, only mapped certificates are accepted"`
+
+	AuditLog string `name:"audit-log" help:"File to write the tamper evident audit log to. Empty to turn the audit log off"`
+
+	LogLocation       string        `name:"log-location" env:"LOG_LOCATION" help:"Where to log, local files or cloud logging"`
+	LogFile           string        `name:"log-file" help:"File for the server log when logging locally"`
+	AccessLogFile     string        `name:"access-log-file" help:"File for the access log when logging locally"`
+	LogLevel          string        `name:"log-level" reload:"live" help:"Minimum level to log (debug, info, warning or error). Can be changed at runtime through /admin/loglevel"`
+	AccessLogFormat   string        `name:"access-log-format" help:"Format of the access log, combined (Apache Combined Log Format) or json"`
+	LogMaxSize        int           `name:"log-max-size" reload:"live" help:"Rotate the local log files once they reach this many megabytes. 0 for no size limit"`
+	LogRotateInterval time.Duration `name:"log-rotate-interval" reload:"live" help:"Rotate the local log files this often. 0 to only rotate on size"`
+	LogMaxBackups     int           `name:"log-max-backups" reload:"live" help:"Rotated log files to keep. 0 to keep them all"`
+	LogMaxAge         time.Duration `name:"log-max-age" reload:"live" help:"Remove rotated log files older than this. 0 to keep them however old they are"`
+	LogCompress       bool          `name:"log-compress" reload:"live" help:"gzip rotated log files"`
+
+	TraceExporter string `name:"trace-exporter" help:"Where to send trace spans: none, stdout, file or otlp"`
+	TraceFile     string `name:"trace-file" help:"File the file trace exporter appends spans to"`
+	OTLPEndpoint  string `name:"otlp-endpoint" help:"OpenTelemetry collector the otlp trace exporter sends spans to, over HTTP"`
+
+	Replication        string `name:"replication" help:"Replication role: none, primary (serves followers) or follower (copies replica-of and serves reads)"`
+	ReplicaOf          string `name:"replica-of" help:"URL of the primary a follower copies, e.g. http://primary:8080. Writes sent to a follower are redirected there"`
+	ReplicationSecret  string `name:"replication-secret" secret:"true" help:"Shared secret followers use to read from the primary"`
+	ReplicationLogSize int    `name:"replication-log-size" help:"Mutations the primary keeps for followers that fall behind. Followers further behind start again from a snapshot"`
+
+	Cluster                  bool          `name:"cluster" help:"Commit every change to the store through a Raft log shared by the cluster, so it survives losing a minority of the nodes"`
+	ClusterAddress           string        `name:"cluster-address" help:"URL the other nodes reach this one on, e.g. http://node1:8080. It is also this node's ID"`
+	ClusterPeers             string        `name:"cluster-peers" help:"Comma separated URLs of every node, including this one, to start a new cluster with. Leave empty when joining an existing cluster, which adds the node through /admin/cluster/members"`
+	ClusterSecret            string        `name:"cluster-secret" secret:"true" help:"Shared secret the nodes use to talk to each other"`
+	ClusterDataDir           string        `name:"cluster-data-dir" help:"Directory to keep the Raft log and snapshots in. If not set they are lost when the node stops"`
+	ClusterSnapshotThreshold int           `name:"cluster-snapshot-threshold" help:"Entries applied since the last snapshot before the log is compacted into a new one"`
+	ClusterElectionTimeout   time.Duration `name:"cluster-election-timeout" help:"How long a node waits without hearing from the leader before standing for election"`
+
+	Partition             bool   `name:"partition" help:"Share the keys out between the nodes with a consistent hash ring, passing requests on to the node that owns the key"`
+	PartitionAddress      string `name:"partition-address" help:"URL the other nodes reach this one on, e.g. http://node1:8080"`
+	PartitionNodes        string `name:"partition-nodes" help:"Comma separated URLs of the nodes on the ring. A new node is given the existing nodes, then added through /admin/partition/nodes"`
+	PartitionSecret       string `name:"partition-secret" secret:"true" help:"Shared secret the nodes use to talk to each other"`
+	PartitionVirtualNodes int    `name:"partition-virtual-nodes" help:"Points each node has on the ring. More spread the keys more evenly. Must be the same on every node"`
+
+	Gossip                 bool          `name:"gossip" help:"Find the other nodes and detect failures by gossiping with them. The members are listed at /cluster/members"`
+	GossipAddress          string        `name:"gossip-address" help:"URL the other nodes reach this one on, e.g. http://node1:8080. It is also this node's ID"`
+	GossipSeeds            string        `name:"gossip-seeds" help:"Comma separated URLs of nodes to join through. Any running member will do, and the node keeps trying until one replies"`
+	GossipSecret           string        `name:"gossip-secret" secret:"true" help:"Shared secret the nodes use to talk to each other"`
+	GossipMeta             string        `name:"gossip-meta" reload:"live" help:"Comma separated key=value pairs spread to the other nodes, e.g. zone=west,rack=3"`
+	GossipProbeInterval    time.Duration `name:"gossip-probe-interval" help:"How often a node probes another to check it is alive"`
+	GossipSuspicionTimeout time.Duration `name:"gossip-suspicion-timeout" help:"How long a node that doesn't reply to probes has to show it is alive before it is declared dead"`
+}
+
+//Default returns the settings used when nothing else is given
+func Default() Config {
+	return Config{
+		Host:    "localhost",
+		Depth:   1000,
+		Buffer:  100,
+		Steward: 10 * time.Second,
+		Grace:   10 * time.Second,
+
+		UsersFile:          "users/users.csv",
+		TokenLifetime:      5 * time.Minute,
+		Auth:               "local",
+		LDAPBindDN:         "uid=%s,ou=people,dc=example,dc=com",
+		LockoutThreshold:   5,
+		LockoutIPThreshold: 20,
+		LockoutDuration:    15 * time.Minute,
+		Require2FA:         "admin",
+
+		AuditLog: "audit.log",
+
+		LogLocation:       "local",
+		LogFile:           "info.log",
+		AccessLogFile:     "htaccess.log",
+		LogLevel:          "info",
+		AccessLogFormat:   "combined",
+		LogMaxSize:        100,
+		LogRotateInterval: 24 * time.Hour,
+		LogMaxBackups:     10,
+		LogMaxAge:         30 * 24 * time.Hour,
+		LogCompress:       true,
+
+		TraceExporter: "none",
+		TraceFile:     "traces.json",
+		OTLPEndpoint:  "http://localhost:4318",
+
+		Replication:        "none",
+		ReplicationLogSize: 10000,
+
+		ClusterSnapshotThreshold: 1000,
+		ClusterElectionTimeout:   time.Second,
+
+		PartitionVirtualNodes: 256,
+
+		GossipProbeInterval:    time.Second,
+		GossipSuspicionTimeout: 5 * time.Second,
+	}
+}
+
+//setting is one field of Config, along with where it can be set from
+type setting struct {
+	name   string
+	envs   []string //checked in order, the first one set wins
+	help   string
+	live   bool //can be applied without a restart
+	secret bool //hidden when printed
+	value  reflect.Value
+}
+
+//settings lists the fields of the config so they can be set by name
+func (c *Config) settings() []setting {
+	out := []setting{}
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("name")
+		envs := []string{EnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))}
+		if legacy := field.Tag.Get("env"); legacy != "" {
+			envs = append(envs, legacy)
+		}
+		out = append(out, setting{name: name, envs: envs, help: field.Tag.Get("help"), live: field.Tag.Get("reload") == "live", secret: field.Tag.Get("secret") == "true", value: v.Field(i)})
+	}
+	return out
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+//set parses the string into the setting's type
+func (s setting) set(raw string) error {
+	switch {
+	case s.value.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration like 30s or 5m, got %q", s.name, raw)
+		}
+		s.value.SetInt(int64(d))
+	case s.value.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%s must be a whole number, got %q", s.name, raw)
+		}
+		s.value.SetInt(int64(n))
+	case s.value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false, got %q", s.name, raw)
+		}
+		s.value.SetBool(b)
+	default:
+		s.value.SetString(raw)
+	}
+	return nil
+}
+
+//hidden replaces the value of a secret setting when it is printed
+const hidden = "********"
+
+func (s setting) String() string {
+	if s.secret && s.value.String() != "" {
+		return hidden
+	}
+	if s.value.Type() == durationType {
+		return time.Duration(s.value.Int()).String()
+	}
+	return fmt.Sprint(s.value.Interface())
+}
+
+//flagValue records a flag so it can be applied after the file and environment have been read
+type flagValue struct {
+	setting setting
+	raw     *string
+	isBool  bool
+}
+
+func (f flagValue) String() string {
+	if f.raw == nil {
+		return ""
+	}
+	return *f.raw
+}
+
+func (f flagValue) Set(raw string) error {
+	*f.raw = raw
+	return nil
+}
+
+func (f flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+//Options are the flags that control loading, rather than being settings themselves
+type Options struct {
+	File        string //config file that was read, if any
+	PrintConfig bool   //print the settings and exit
+}
+
+//ValidationError lists every problem found with the config, so they can all be fixed at once
+type ValidationError struct {
+	Problems []string
+}
+
+func (v *ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(v.Problems, "\n  ")
+}
+
+var ErrUnknownKey = errors.New("unknown setting in config file")
+
+//Load builds the config from the defaults, the config file, the environment and then the command line arguments.
+//The config file is named by the -config flag or the KVSTORE_CONFIG environment variable
+func Load(args []string, output io.Writer) (Config, Options, error) {
+	cfg := Default()
+	var options Options
+
+	//the flags are parsed first, to find the config file, but only applied once everything else has been
+	flags := flag.NewFlagSet("kv-store", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&options.File, "config", os.Getenv(ConfigFileEnv), "YAML config file. Settings from flags and environment variables override it")
+	flags.BoolVar(&options.PrintConfig, "print-config", false, "Print the configuration that would be used and exit")
+	fromFlags := map[string]*string{}
+	settings := cfg.settings()
+	for _, s := range settings {
+		raw := new(string)
+		fromFlags[s.name] = raw
+		flags.Var(flagValue{setting: s, raw: raw, isBool: s.value.Kind() == reflect.Bool}, s.name, s.help+" (default "+s.String()+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return cfg, options, err
+	}
+
+	problems := []string{}
+	if options.File != "" {
+		if err := cfg.loadFile(options.File); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, s := range settings {
+		for _, env := range s.envs {
+			if raw, present := os.LookupEnv(env); present {
+				if err := s.set(raw); err != nil {
+					problems = append(problems, env+": "+err.Error())
+				}
+				break
+			}
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if value, ok := f.Value.(flagValue); ok {
+			if err := value.setting.set(*value.raw); err != nil {
+				problems = append(problems, "-"+err.Error())
+			}
+		}
+	})
+	if len(problems) > 0 {
+		return cfg, options, &ValidationError{Problems: problems}
+	}
+	return cfg, options, nil
+}
+
+//loadFile reads settings from a YAML file of name: value pairs, using the same names as the flags
+func (c *Config) loadFile(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(contents, &values); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	byName := map[string]setting{}
+	for _, s := range c.settings() {
+		byName[s.name] = s
+	}
+	problems := []string{}
+	for key, value := range values {
+		s, known := byName[key]
+		if !known {
+			problems = append(problems, fmt.Sprintf("%s: %v %q", path, ErrUnknownKey, key))
+			continue
+		}
+		if value == nil { //an empty value, e.g. "audit-log:" to turn the audit log off
+			value = ""
+		}
+		if err := s.set(fmt.Sprint(value)); err != nil {
+			problems = append(problems, path+": "+err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+//WriteYAML writes the config in the same format as the config file, e.g. for -print-config
+func (c Config) WriteYAML(w io.Writer) error {
+	out := yaml.MapSlice{}
+	for _, s := range c.settings() {
+		var value interface{} = s.value.Interface()
+		if s.value.Type() == durationType || s.secret {
+			value = s.String()
+		}
+		out = append(out, yaml.MapItem{Key: s.name, Value: value})
+	}
+	contents, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(contents)
+	return err
+}
+
+//Change is a setting that is different in a new config
+type Change struct {
+	Setting string `json:"setting"`
+	Old     string `json:"old"`
+	New     string `json:"new"`
+	Live    bool   `json:"-"`               //can be applied without a restart
+	Error   string `json:"error,omitempty"` //why the change couldn't be applied, if it couldn't
+}
+
+//Diff lists the settings that are different in next, in the order they appear in Config. Secret settings are listed, but not their values
+func (c Config) Diff(next Config) []Change {
+	changes := []Change{}
+	nextSettings := next.settings()
+	for i, s := range c.settings() {
+		if s.value.Interface() != nextSettings[i].value.Interface() {
+			changes = append(changes, Change{Setting: s.name, Old: s.String(), New: nextSettings[i].String(), Live: s.live})
+		}
+	}
+	return changes
+}
+
+//Set changes a setting by name, e.g. to apply a Change from Diff
+func (c *Config) Set(name, raw string) error {
+	for _, s := range c.settings() {
+		if s.name == name {
+			return s.set(raw)
+		}
+	}
+	return fmt.Errorf("unknown setting %q", name)
+}
@@ -0,0 +1,382 @@
+package config_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"store/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+//writeConfigFile writes a config file into a temporary directory and returns its path
+func writeConfigFile(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "kvstore.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+//jwtSecret is long enough to be a valid jwt-secret
+const jwtSecret = "0123456789abcdef0123456789abcdef"
+
+//setEnv sets an environment variable for the rest of the test
+func setEnv(t *testing.T, key, value string) {
+	old, present := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if present {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestDefaults(t *testing.T) {
+	cfg, options, err := config.Load([]string{"-port", "8080", "-jwt-secret", jwtSecret}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.File != "" || options.PrintConfig {
+		t.Errorf("unexpected options %+v", options)
+	}
+	want := config.Default()
+	want.Port = 8080
+	want.JWTSecret = jwtSecret
+	if cfg != want {
+		t.Errorf("expected the defaults, got %+v", cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Error("the defaults with a port and jwt-secret should be valid", err)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+port: 7000
+depth: 50
+buffer: 5
+log-level: debug
+namespaced: true
+`)
+	setEnv(t, "KVSTORE_DEPTH", "60")
+	setEnv(t, "KVSTORE_BUFFER", "6")
+	cfg, options, err := config.Load([]string{"-config", path, "-buffer", "7"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.File != path {
+		t.Errorf("expected the config file to be %s, got %s", path, options.File)
+	}
+	if cfg.Port != 7000 || !cfg.Namespaced || cfg.LogLevel != "debug" {
+		t.Errorf("expected settings from the file, got %+v", cfg)
+	}
+	if cfg.Depth != 60 {
+		t.Errorf("expected the environment to override the file, got depth %d", cfg.Depth)
+	}
+	if cfg.Buffer != 7 {
+		t.Errorf("expected the flag to override the environment, got buffer %d", cfg.Buffer)
+	}
+	if cfg.Host != config.Default().Host {
+		t.Errorf("expected the default host, got %s", cfg.Host)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	path := writeConfigFile(t, "depth: 20\n")
+	setEnv(t, config.ConfigFileEnv, path)
+	setEnv(t, "PORT", "9000")
+	setEnv(t, "LOG_LOCATION", "cloud")
+	setEnv(t, "KVSTORE_LOG_LOCATION", "local")
+	setEnv(t, "KVSTORE_TOKEN_LIFETIME", "1h")
+	setEnv(t, "KVSTORE_LOG_COMPRESS", "false")
+	cfg, _, err := config.Load(nil, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Depth != 20 {
+		t.Errorf("expected the config file named in %s to be read, got depth %d", config.ConfigFileEnv, cfg.Depth)
+	}
+	if cfg.Port != 9000 {
+		t.Errorf("expected the port from PORT, got %d", cfg.Port)
+	}
+	if cfg.CloudLogging() {
+		t.Error("expected KVSTORE_LOG_LOCATION to win over LOG_LOCATION")
+	}
+	if cfg.TokenLifetime != time.Hour || cfg.LogCompress {
+		t.Errorf("expected settings from the environment, got %+v", cfg)
+	}
+}
+
+func TestEmptyFileValue(t *testing.T) {
+	path := writeConfigFile(t, "port: 80\naudit-log:\n")
+	cfg, _, err := config.Load([]string{"-config", path}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AuditLog != "" {
+		t.Errorf("expected an empty value to clear the audit log, got %q", cfg.AuditLog)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	path := writeConfigFile(t, `
+port: eighty
+prot: 80
+log-compress: sometimes
+`)
+	setEnv(t, "KVSTORE_LOCKOUT_DURATION", "forever")
+	_, _, err := config.Load([]string{"-config", path, "-depth", "lots"}, ioutil.Discard)
+	validationErr, ok := err.(*config.ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	message := validationErr.Error()
+	for _, want := range []string{`"prot"`, "port must be a whole number", "log-compress must be true or false", "KVSTORE_LOCKOUT_DURATION", "-depth must be a whole number"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("expected the error to mention %s, got:\n%s", want, message)
+		}
+	}
+
+	_, _, err = config.Load([]string{"-config", filepath.Join(filepath.Dir(path), "missing.yaml")}, ioutil.Discard)
+	if err == nil {
+		t.Error("expected an error for a missing config file")
+	}
+
+	_, _, err = config.Load([]string{"-no-such-flag"}, ioutil.Discard)
+	if err == nil {
+		t.Error("expected an error for an unknown flag")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := config.Default()
+	cfg.Depth = 0
+	cfg.Auth = "local,kerberos"
+	cfg.TLSCert = "server.crt"
+	cfg.ClientCA = "ca.crt"
+	cfg.LogLevel = "loud"
+	cfg.TraceExporter = "jaeger"
+	err := cfg.Validate()
+	validationErr, ok := err.(*config.ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	if len(validationErr.Problems) != 8 {
+		t.Errorf("expected every problem to be listed, got %d:\n%s", len(validationErr.Problems), err)
+	}
+	for _, want := range []string{"port", "depth", "jwt-secret", "kerberos", "tls-key", "cert-users", "log-level", "trace-exporter"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %s, got:\n%s", want, err)
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	cfg := config.Default()
+	cfg.TrustedProxies = "10.0.0.0/8, 192.168.1.7,,2001:db8::/32"
+	networks, err := cfg.TrustedProxyNetworks()
+	if err != nil || len(networks) != 3 {
+		t.Fatalf("expected three networks, got %v %v", networks, err)
+	}
+	if !networks[1].Contains(net.ParseIP("192.168.1.7")) || networks[1].Contains(net.ParseIP("192.168.1.8")) {
+		t.Errorf("expected a single IP to only contain itself, got %v", networks[1])
+	}
+
+	cfg.TrustedProxies = "10.0.0.0/8,proxy"
+	cfg.LockoutIPThreshold = -1
+	err = cfg.Validate()
+	for _, want := range []string{"\"proxy\"", "lockout-ip-threshold"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %s, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestValidateCluster(t *testing.T) {
+	cfg := config.Default()
+	cfg.Port = 8080
+	cfg.JWTSecret = jwtSecret
+	cfg.Cluster = true
+	cfg.ClusterAddress = "http://node1:8080"
+	cfg.ClusterPeers = " http://node1:8080/, http://node2:8080,http://node3:8080 "
+	cfg.ClusterSecret = "hunter2"
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("expected a three node cluster to be valid", err)
+	}
+	if members := cfg.ClusterMembers(); len(members) != 3 || members[0] != "http://node1:8080" || members[2] != "http://node3:8080" {
+		t.Errorf("expected the peers to be trimmed, got %q", members)
+	}
+
+	cfg.ClusterPeers = "http://node2:8080,node3"
+	cfg.ClusterSecret = ""
+	cfg.Replication = "primary"
+	cfg.ReplicationSecret = "hunter2"
+	cfg.DataFile = "store.json"
+	err := cfg.Validate()
+	validationErr, ok := err.(*config.ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	if len(validationErr.Problems) != 5 {
+		t.Errorf("expected every problem to be listed, got %d:\n%s", len(validationErr.Problems), err)
+	}
+	for _, want := range []string{"replication", "cluster-secret", "\"node3\"", "include cluster-address", "data-file"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %s, got:\n%s", want, err)
+		}
+	}
+}
+
+func TestValidatePartition(t *testing.T) {
+	cfg := config.Default()
+	cfg.Port = 8080
+	cfg.JWTSecret = jwtSecret
+	cfg.Partition = true
+	cfg.PartitionAddress = "http://node4:8080"
+	cfg.PartitionNodes = "http://node1:8080/, http://node2:8080"
+	cfg.PartitionSecret = "hunter2"
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("expected a node joining a two node ring to be valid", err)
+	}
+	if nodes := cfg.PartitionMembers(); len(nodes) != 2 || nodes[0] != "http://node1:8080" {
+		t.Errorf("expected the nodes to be trimmed, got %q", nodes)
+	}
+
+	cfg.PartitionNodes = " , "
+	cfg.PartitionVirtualNodes = 0
+	cfg.Cluster = true
+	cfg.ClusterAddress = "http://node4:8080"
+	cfg.ClusterSecret = "hunter2"
+	err := cfg.Validate()
+	validationErr, ok := err.(*config.ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	if len(validationErr.Problems) != 3 {
+		t.Errorf("expected every problem to be listed, got %d:\n%s", len(validationErr.Problems), err)
+	}
+	for _, want := range []string{"partition and cluster", "partition-nodes", "partition-virtual-nodes"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %s, got:\n%s", want, err)
+		}
+	}
+}
+
+func TestValidateGossip(t *testing.T) {
+	cfg := config.Default()
+	cfg.Port = 8080
+	cfg.JWTSecret = jwtSecret
+	cfg.Gossip = true
+	cfg.GossipAddress = "http://node2:8080"
+	cfg.GossipSeeds = "http://node1:8080/"
+	cfg.GossipSecret = "hunter2"
+	cfg.GossipMeta = "zone = west, rack=3,"
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("expected a node joining through a seed to be valid", err)
+	}
+	if meta, _ := cfg.GossipMetadata(); len(meta) != 2 || meta["zone"] != "west" || meta["rack"] != "3" {
+		t.Errorf("expected the metadata to be trimmed, got %v", meta)
+	}
+
+	cfg.GossipSeeds = "node1"
+	cfg.GossipMeta = "zone"
+	cfg.GossipSuspicionTimeout = time.Millisecond
+	err := cfg.Validate()
+	validationErr, ok := err.(*config.ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	if len(validationErr.Problems) != 3 {
+		t.Errorf("expected every problem to be listed, got %d:\n%s", len(validationErr.Problems), err)
+	}
+	for _, want := range []string{"\"node1\"", "gossip-suspicion-timeout", "key=value"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %s, got:\n%s", want, err)
+		}
+	}
+}
+
+func TestWriteYAML(t *testing.T) {
+	cfg := config.Default()
+	cfg.Port = 1234
+	cfg.Steward = 3 * time.Second
+	cfg.AuditLog = ""
+	out := &bytes.Buffer{}
+	if err := cfg.WriteYAML(out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "port: 1234\n") || !strings.Contains(out.String(), "steward-timeout: 3s\n") {
+		t.Errorf("unexpected YAML:\n%s", out)
+	}
+
+	//the printed config can be read back in
+	path := writeConfigFile(t, out.String())
+	loaded, _, err := config.Load([]string{"-config", path}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != cfg {
+		t.Errorf("expected the printed config to load as\n%+v\ngot\n%+v", cfg, loaded)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := config.Default()
+	next := config.Default()
+	next.Depth = 10
+	next.Buffer = 5
+	next.LogMaxAge = time.Hour
+	changes := old.Diff(next)
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got %+v", changes)
+	}
+	want := []config.Change{
+		{Setting: "depth", Old: "1000", New: "10", Live: true},
+		{Setting: "buffer", Old: "100", New: "5", Live: false},
+		{Setting: "log-max-age", Old: "720h0m0s", New: "1h0m0s", Live: true},
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("expected change %+v, got %+v", want[i], changes[i])
+		}
+	}
+
+	//applying the changes makes the configs the same
+	for _, change := range changes {
+		if err := old.Set(change.Setting, change.New); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if old != next {
+		t.Errorf("expected applying the changes to give\n%+v\ngot\n%+v", next, old)
+	}
+	if err := old.Set("no-such-setting", "1"); err == nil {
+		t.Error("expected an error setting an unknown setting")
+	}
+}
+
+func TestSecretsHidden(t *testing.T) {
+	cfg := config.Default()
+	cfg.ReplicationSecret = "hunter2"
+	out := &bytes.Buffer{}
+	if err := cfg.WriteYAML(out); err != nil {
+		t.Fatal(err)
+	}
+	next := cfg
+	next.ReplicationSecret = "hunter3"
+	changes := cfg.Diff(next)
+	if strings.Contains(out.String(), "hunter2") || len(changes) != 1 || strings.Contains(changes[0].Old+changes[0].New, "hunter") {
+		t.Errorf("expected the secret to be hidden, got\n%s\n%+v", out, changes)
+	}
+}
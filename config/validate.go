@@ -0,0 +1,227 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"store/logging"
+	"store/rbac"
+	"strings"
+)
+
+//minJWTSecretLength is the shortest jwt-secret accepted, so tokens can't be forged by guessing it
+const minJWTSecretLength = 32
+
+//Validate checks every setting, and returns a ValidationError listing all the problems found, or nil
+func (c Config) Validate() error {
+	problems := []string{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Port > 0 && c.Port <= 65535, "port is required, and must be between 1 and 65535 (got %d)", c.Port)
+	check(c.Depth > 0, "depth must be positive (got %d)", c.Depth)
+	check(c.Buffer >= 0, "buffer can't be negative (got %d)", c.Buffer)
+	check(c.Steward > 0, "steward-timeout must be positive (got %v)", c.Steward)
+	check(c.Grace > 0, "shutdown-grace must be positive (got %v)", c.Grace)
+
+	check(c.UsersFile != "", "users-file is required")
+	check(c.TokenLifetime > 0, "token-lifetime must be positive (got %v)", c.TokenLifetime)
+	check(len(c.JWTSecret) >= minJWTSecretLength, "jwt-secret is required, and must be at least %d characters", minJWTSecretLength)
+	for _, backend := range strings.Split(c.Auth, ",") {
+		switch strings.TrimSpace(strings.ToLower(backend)) {
+		case "local":
+		case "htpasswd":
+			check(c.Htpasswd != "", "htpasswd must be set to use the htpasswd backend")
+		case "ldap":
+			check(c.LDAPURL != "", "ldap-url must be set to use the ldap backend")
+			check(strings.Count(c.LDAPBindDN, "%s") == 1, "ldap-bind-dn must contain %%s exactly once")
+		default:
+			problems = append(problems, fmt.Sprintf("auth has an unknown backend %q, expected local, htpasswd or ldap", backend))
+		}
+	}
+	check(c.LockoutThreshold > 0, "lockout-threshold must be positive (got %d)", c.LockoutThreshold)
+	check(c.LockoutIPThreshold >= 0, "lockout-ip-threshold can't be negative (got %d)", c.LockoutIPThreshold)
+	check(c.LockoutDuration > 0, "lockout-duration must be positive (got %v)", c.LockoutDuration)
+	if _, err := c.TrustedProxyNetworks(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := rbac.ParseRoles(c.Require2FA, ","); err != nil {
+		problems = append(problems, fmt.Sprintf("require-2fa: %v", err))
+	}
+
+	check((c.TLSCert == "") == (c.TLSKey == ""), "tls-cert and tls-key must be set together")
+	check(c.ClientCA == "" || c.TLSCert != "", "client-ca needs tls-cert and tls-key")
+	check(!c.RequireClientCert || c.ClientCA != "", "require-client-cert needs client-ca")
+	check(c.ClientCA == "" || c.CertUsers != "", "client-ca needs cert-users to say which user each client certificate is")
+
+	switch strings.ToLower(c.LogLocation) {
+	case "local":
+		check(c.LogFile != "" && c.AccessLogFile != "", "log-file and access-log-file are required when logging locally")
+	case "cloud":
+	default:
+		problems = append(problems, fmt.Sprintf("log-location must be local or cloud (got %q)", c.LogLocation))
+	}
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		problems = append(problems, fmt.Sprintf("log-level must be debug, info, warning or error (got %q)", c.LogLevel))
+	}
+	switch strings.ToLower(c.AccessLogFormat) {
+	case "combined", "json":
+	default:
+		problems = append(problems, fmt.Sprintf("access-log-format must be combined or json (got %q)", c.AccessLogFormat))
+	}
+	check(c.LogMaxSize >= 0 && c.LogRotateInterval >= 0 && c.LogMaxBackups >= 0 && c.LogMaxAge >= 0, "log rotation settings can't be negative")
+
+	switch strings.ToLower(c.TraceExporter) {
+	case "", "none", "stdout", "otlp":
+	case "file":
+		check(c.TraceFile != "", "trace-file is required for the file trace exporter")
+	default:
+		problems = append(problems, fmt.Sprintf("trace-exporter must be none, stdout, file or otlp (got %q)", c.TraceExporter))
+	}
+
+	switch strings.ToLower(c.Replication) {
+	case "", "none":
+	case "primary":
+		check(c.ReplicationSecret != "", "replication-secret is required for the primary")
+		check(c.ReplicationLogSize > 0, "replication-log-size must be positive (got %d)", c.ReplicationLogSize)
+	case "follower":
+		check(c.ReplicationSecret != "", "replication-secret is required for a follower")
+		check(isHTTPURL(c.ReplicaOf), "replica-of must be the http or https URL of the primary (got %q)", c.ReplicaOf)
+	default:
+		problems = append(problems, fmt.Sprintf("replication must be none, primary or follower (got %q)", c.Replication))
+	}
+
+	if c.Cluster {
+		check(!strings.EqualFold(c.Replication, "primary") && !strings.EqualFold(c.Replication, "follower"), "cluster and replication can't be used together")
+		check(c.ClusterSecret != "", "cluster-secret is required in cluster mode")
+		check(c.DataFile == "", "data-file can't be used in cluster mode, the store is kept in cluster-data-dir")
+		check(isHTTPURL(c.ClusterAddress), "cluster-address must be the http or https URL other nodes reach this one on (got %q)", c.ClusterAddress)
+		peers := c.ClusterMembers()
+		for _, peer := range peers {
+			check(isHTTPURL(peer), "cluster-peers must be http or https URLs (got %q)", peer)
+		}
+		if len(peers) > 0 {
+			check(contains(peers, strings.TrimRight(c.ClusterAddress, "/")), "cluster-peers must include cluster-address")
+		}
+		check(c.ClusterSnapshotThreshold > 0, "cluster-snapshot-threshold must be positive (got %d)", c.ClusterSnapshotThreshold)
+		check(c.ClusterElectionTimeout > 0, "cluster-election-timeout must be positive (got %v)", c.ClusterElectionTimeout)
+	}
+
+	if c.Partition {
+		check(!c.Cluster, "partition and cluster can't be used together")
+		check(!strings.EqualFold(c.Replication, "primary") && !strings.EqualFold(c.Replication, "follower"), "partition and replication can't be used together")
+		check(c.PartitionSecret != "", "partition-secret is required in partition mode")
+		check(isHTTPURL(c.PartitionAddress), "partition-address must be the http or https URL other nodes reach this one on (got %q)", c.PartitionAddress)
+		nodes := c.PartitionMembers()
+		check(len(nodes) > 0, "partition-nodes must list at least one node")
+		for _, node := range nodes {
+			check(isHTTPURL(node), "partition-nodes must be http or https URLs (got %q)", node)
+		}
+		check(c.PartitionVirtualNodes > 0, "partition-virtual-nodes must be positive (got %d)", c.PartitionVirtualNodes)
+	}
+
+	if c.Gossip {
+		check(c.GossipSecret != "", "gossip-secret is required to gossip")
+		check(isHTTPURL(c.GossipAddress), "gossip-address must be the http or https URL other nodes reach this one on (got %q)", c.GossipAddress)
+		for _, seed := range c.GossipSeedList() {
+			check(isHTTPURL(seed), "gossip-seeds must be http or https URLs (got %q)", seed)
+		}
+		check(c.GossipProbeInterval > 0, "gossip-probe-interval must be positive (got %v)", c.GossipProbeInterval)
+		check(c.GossipSuspicionTimeout >= c.GossipProbeInterval, "gossip-suspicion-timeout must be at least gossip-probe-interval (got %v)", c.GossipSuspicionTimeout)
+	}
+	if _, err := c.GossipMetadata(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+//CloudLogging checks if logs go to cloud logging rather than local files
+func (c Config) CloudLogging() bool {
+	return strings.ToLower(c.LogLocation) == "cloud"
+}
+
+//ClusterMembers returns the nodes given by cluster-peers, without trailing slashes so they match the IDs nodes use
+func (c Config) ClusterMembers() []string {
+	return splitURLs(c.ClusterPeers)
+}
+
+//PartitionMembers returns the nodes given by partition-nodes, without trailing slashes so they match the addresses nodes use
+func (c Config) PartitionMembers() []string {
+	return splitURLs(c.PartitionNodes)
+}
+
+//GossipSeedList returns the nodes given by gossip-seeds, without trailing slashes so they match the IDs nodes use
+func (c Config) GossipSeedList() []string {
+	return splitURLs(c.GossipSeeds)
+}
+
+//GossipMetadata reads the key=value pairs in gossip-meta
+func (c Config) GossipMetadata() (map[string]string, error) {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(c.GossipMeta, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("gossip-meta must be comma separated key=value pairs (got %q)", pair)
+		}
+		meta[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return meta, nil
+}
+
+//TrustedProxyNetworks reads the IPs and CIDRs in trusted-proxies. A single IP is treated as a network of just that address
+func (c Config) TrustedProxyNetworks() ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, proxy := range strings.Split(c.TrustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		}
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted-proxies must be comma separated IPs or CIDRs (got %q)", proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func splitURLs(list string) []string {
+	urls := []string{}
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimRight(strings.TrimSpace(u), "/"); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+func isHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -6,4 +6,5 @@ require (
 	cloud.google.com/go/logging v1.4.2
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	golang.org/x/crypto v0.0.0-20220313003712-b769efc7c000
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,169 @@
+//Package gossip keeps track of which nodes are running, without a coordinator, using the SWIM protocol
+//(https://www.cs.cornell.edu/projects/Quicksilver/public_pdfs/SWIM.pdf). Each node probes a random member every
+//ProbeInterval, and asks a few others to probe it too if it doesn't reply. A member nobody can reach is suspected, and
+//declared dead if it doesn't refute the suspicion within SuspicionTimeout. Changes to members, including their metadata,
+//are spread by piggybacking them on the probes, and nodes swap their whole member lists now and again so they converge.
+//Every claim about a member carries its incarnation number, which only the member itself increases, so a node that
+//is wrongly suspected can always prove it is alive
+package gossip
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrStopped     = errors.New("the gossip node has stopped")
+	ErrNoSeeds     = errors.New("none of the seeds could be reached")
+	ErrUnreachable = errors.New("the member didn't reply to the probe")
+)
+
+//State is what the cluster believes about a member
+type State int
+
+const (
+	Alive State = iota
+	Suspect
+	Dead
+	Left //the member said it was leaving, so isn't suspected first
+)
+
+func (s State) String() string {
+	switch s {
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	case Left:
+		return "left"
+	}
+	return "alive"
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *State) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "alive":
+		*s = Alive
+	case "suspect":
+		*s = Suspect
+	case "dead":
+		*s = Dead
+	case "left":
+		*s = Left
+	default:
+		return errors.New("unknown member state " + string(text))
+	}
+	return nil
+}
+
+//Member is a node in the cluster, as sent between nodes. Every change to a member is sent as the whole member
+type Member struct {
+	ID          string            `json:"id"` //how the other nodes reach it through the transport, e.g. its URL
+	Incarnation uint64            `json:"incarnation"`
+	State       State             `json:"state"`
+	Meta        map[string]string `json:"meta,omitempty"`
+}
+
+//overrides checks if the claim about a member is newer than what is known. A higher incarnation always wins,
+//and for the same incarnation dead beats suspect beats alive, so a suspicion can only be refuted by the member itself
+func (m Member) overrides(known Member) bool {
+	if m.Incarnation != known.Incarnation {
+		return m.Incarnation > known.Incarnation
+	}
+	return rank(m.State) > rank(known.State)
+}
+
+func rank(s State) int {
+	if s == Left {
+		return int(Dead)
+	}
+	return int(s)
+}
+
+//PingArgs asks a member to show it is alive. The updates are changes the sender is spreading
+type PingArgs struct {
+	From    Member   `json:"from"`
+	Updates []Member `json:"updates,omitempty"`
+}
+
+type PingReply struct {
+	From    Member   `json:"from"`
+	Updates []Member `json:"updates,omitempty"`
+}
+
+//PingReqArgs asks a member to probe Target, for a node that couldn't reach it directly
+type PingReqArgs struct {
+	From    Member   `json:"from"`
+	Target  string   `json:"target"`
+	Updates []Member `json:"updates,omitempty"`
+}
+
+type PingReqReply struct {
+	Acked   bool     `json:"acked"`
+	Updates []Member `json:"updates,omitempty"`
+}
+
+//SyncArgs sends every member the sender knows about, which the receiver merges into its own and replies with its own.
+//It is how a node joins, and how nodes catch up on anything they missed
+type SyncArgs struct {
+	From    Member   `json:"from"`
+	Members []Member `json:"members"`
+}
+
+type SyncReply struct {
+	Members []Member `json:"members"`
+}
+
+//Transport sends messages to other nodes, which are identified by their IDs
+type Transport interface {
+	Ping(ctx context.Context, to string, args PingArgs) (PingReply, error)
+	PingReq(ctx context.Context, to string, args PingReqArgs) (PingReqReply, error)
+	Sync(ctx context.Context, to string, args SyncArgs) (SyncReply, error)
+}
+
+//Config configures a node. Zero durations and counts are replaced by the defaults
+type Config struct {
+	ID        string            //how the other nodes reach this one through the transport, e.g. its URL
+	Seeds     []string          //nodes to join the cluster through. The node keeps trying them until one replies
+	Meta      map[string]string //spread to every node, e.g. the node's role
+	Transport Transport
+	//OnChange is called whenever a member joins, changes state or changes its metadata. It is called from the node's goroutines,
+	//one change at a time, and mustn't block for long
+	OnChange func(Member)
+
+	ProbeInterval        time.Duration //how often a member is probed
+	ProbeTimeout         time.Duration //how long a probe waits for a reply before asking other members to try
+	IndirectChecks       int           //how many other members are asked to probe a member that didn't reply
+	SuspicionTimeout     time.Duration //how long a suspected member has to refute it before it is declared dead
+	SyncInterval         time.Duration //how often the whole member list is swapped with a random member
+	DeadRetention        time.Duration //how long dead members are listed before they are forgotten
+	RetransmitMultiplier int           //each change is sent this many times the log of the cluster's size
+}
+
+const (
+	DefaultProbeInterval        = time.Second
+	DefaultProbeTimeout         = 500 * time.Millisecond
+	DefaultIndirectChecks       = 3
+	DefaultSuspicionTimeout     = 5 * time.Second
+	DefaultSyncInterval         = 30 * time.Second
+	DefaultDeadRetention        = time.Hour
+	DefaultRetransmitMultiplier = 4
+)
+
+//MemberStatus is a member as seen by this node
+type MemberStatus struct {
+	Member
+	Since time.Time `json:"since"` //when this node last saw the member change state
+}
+
+//Status describes a node, e.g. for an endpoint
+type Status struct {
+	ID          string         `json:"id"`
+	Incarnation uint64         `json:"incarnation"`
+	Members     []MemberStatus `json:"members"`
+}
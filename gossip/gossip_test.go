@@ -0,0 +1,283 @@
+package gossip_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"store/gossip"
+	"store/logging"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logging.SetupLoggers("../info.log", "../htaccess.log", false)
+	defer logging.Shutdown()
+	m.Run()
+}
+
+//blockingTransport is an HTTP transport whose messages to some nodes can be dropped, to see how the cluster copes
+type blockingTransport struct {
+	*gossip.HTTPTransport
+	lock    sync.Mutex
+	blocked map[string]bool
+}
+
+func (t *blockingTransport) block(to string, blocked bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.blocked[to] = blocked
+}
+
+func (t *blockingTransport) check(to string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.blocked[to] {
+		return gossip.ErrUnreachable
+	}
+	return nil
+}
+
+func (t *blockingTransport) Ping(ctx context.Context, to string, args gossip.PingArgs) (gossip.PingReply, error) {
+	if err := t.check(to); err != nil {
+		return gossip.PingReply{}, err
+	}
+	return t.HTTPTransport.Ping(ctx, to, args)
+}
+
+func (t *blockingTransport) PingReq(ctx context.Context, to string, args gossip.PingReqArgs) (gossip.PingReqReply, error) {
+	if err := t.check(to); err != nil {
+		return gossip.PingReqReply{}, err
+	}
+	return t.HTTPTransport.PingReq(ctx, to, args)
+}
+
+func (t *blockingTransport) Sync(ctx context.Context, to string, args gossip.SyncArgs) (gossip.SyncReply, error) {
+	if err := t.check(to); err != nil {
+		return gossip.SyncReply{}, err
+	}
+	return t.HTTPTransport.Sync(ctx, to, args)
+}
+
+//testNode is a node served over loopback. The node can be replaced, to restart it on the same address
+type testNode struct {
+	lock      sync.Mutex
+	node      *gossip.Node
+	transport *blockingTransport
+	server    *httptest.Server
+	changes   []gossip.Member
+}
+
+func (n *testNode) current() *gossip.Node {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.node
+}
+
+func (n *testNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	node := n.current()
+	if node == nil {
+		http.Error(w, "not started", http.StatusServiceUnavailable)
+		return
+	}
+	gossip.Handler(node, "secret").ServeHTTP(w, r)
+}
+
+//start starts a new node for the server, joining through the seeds
+func (n *testNode) start(t *testing.T, meta map[string]string, seeds ...string) {
+	n.transport = &blockingTransport{HTTPTransport: gossip.NewHTTPTransport("secret"), blocked: map[string]bool{}}
+	node, err := gossip.NewNode(gossip.Config{
+		ID:               n.server.URL,
+		Seeds:            seeds,
+		Meta:             meta,
+		Transport:        n.transport,
+		OnChange:         n.record,
+		ProbeInterval:    50 * time.Millisecond,
+		ProbeTimeout:     25 * time.Millisecond,
+		SuspicionTimeout: 300 * time.Millisecond,
+		SyncInterval:     200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("unable to create a node", err)
+	}
+	n.lock.Lock()
+	n.node = node
+	n.lock.Unlock()
+	node.Start()
+	t.Cleanup(node.Stop)
+}
+
+func (n *testNode) record(m gossip.Member) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.changes = append(n.changes, m)
+}
+
+func (n *testNode) recorded() []gossip.Member {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return append([]gossip.Member{}, n.changes...)
+}
+
+func newCluster(t *testing.T, size int) []*testNode {
+	nodes := make([]*testNode, size)
+	for i := range nodes {
+		nodes[i] = &testNode{}
+		nodes[i].server = httptest.NewServer(nodes[i])
+		t.Cleanup(nodes[i].server.Close)
+	}
+	for i, n := range nodes {
+		n.start(t, map[string]string{"index": string(rune('a' + i))}, nodes[0].server.URL)
+	}
+	return nodes
+}
+
+//member returns what the node knows about the member
+func member(n *testNode, id string) (gossip.MemberStatus, bool) {
+	for _, m := range n.current().Members() {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return gossip.MemberStatus{}, false
+}
+
+//everyoneSees checks every node apart from the member itself has it in the state
+func everyoneSees(nodes []*testNode, id string, state gossip.State) func() bool {
+	return func() bool {
+		for _, n := range nodes {
+			if n.server.URL == id {
+				continue
+			}
+			if m, present := member(n, id); !present || m.State != state {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+//waitFor waits for the condition to become true, failing the test if it takes too long
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJoinAndMeta(t *testing.T) {
+	nodes := newCluster(t, 4)
+	waitFor(t, "every node to know about every other", func() bool {
+		for _, n := range nodes {
+			if len(n.current().Live()) != 4 {
+				return false
+			}
+		}
+		return true
+	})
+	if m, _ := member(nodes[2], nodes[3].server.URL); m.Meta["index"] != "d" {
+		t.Errorf("expected the metadata to be spread when a node joins, got %v", m.Meta)
+	}
+
+	nodes[3].current().SetMeta(map[string]string{"index": "d", "zone": "west"})
+	waitFor(t, "the new metadata to spread", func() bool {
+		for _, n := range nodes[:3] {
+			if m, _ := member(n, nodes[3].server.URL); m.Meta["zone"] != "west" || m.Incarnation != 1 {
+				return false
+			}
+		}
+		return true
+	})
+	changes := nodes[0].recorded()
+	if last := changes[len(changes)-1]; last.ID != nodes[3].server.URL || last.Meta["zone"] != "west" {
+		t.Errorf("expected the change to be passed to OnChange, got %+v", last)
+	}
+	if status := nodes[3].current().Status(); status.Incarnation != 1 || len(status.Members) != 4 {
+		t.Errorf("expected the status to show the new incarnation and every member, got %+v", status)
+	}
+}
+
+func TestFailureDetection(t *testing.T) {
+	nodes := newCluster(t, 4)
+	failed := nodes[3].server.URL
+	waitFor(t, "every node to join", everyoneSees(nodes, failed, gossip.Alive))
+
+	//a node that can't reach another directly gets the others to check on it, so it isn't suspected
+	nodes[0].transport.block(failed, true)
+	time.Sleep(500 * time.Millisecond)
+	if m, _ := member(nodes[0], failed); m.State != gossip.Alive || m.Incarnation != 0 {
+		t.Errorf("expected indirect probes to keep the node alive, got %+v", m)
+	}
+	nodes[0].transport.block(failed, false)
+
+	nodes[3].current().Stop()
+	waitFor(t, "the stopped node to be suspected then declared dead", everyoneSees(nodes[:3], failed, gossip.Dead))
+	suspected := false
+	for _, change := range nodes[1].recorded() {
+		suspected = suspected || (change.ID == failed && change.State == gossip.Suspect)
+	}
+	if !suspected {
+		t.Error("expected the node to be suspected before it was declared dead")
+	}
+	if live := nodes[1].current().Live(); len(live) != 3 {
+		t.Errorf("expected the dead node to be left out of the live members, got %+v", live)
+	}
+
+	//restarting it on the same address refutes its death with a higher incarnation
+	nodes[3].start(t, nil, nodes[1].server.URL)
+	waitFor(t, "the restarted node to be alive again", everyoneSees(nodes, failed, gossip.Alive))
+	if m, _ := member(nodes[0], failed); m.Incarnation == 0 {
+		t.Errorf("expected the restarted node to have refuted its death, got %+v", m)
+	}
+}
+
+func TestRefuteSuspicion(t *testing.T) {
+	nodes := newCluster(t, 3)
+	target := nodes[2].server.URL
+	waitFor(t, "every node to join", everyoneSees(nodes, target, gossip.Alive))
+
+	//a node wrongly suspected hears about it and refutes it, which every node accepts
+	nodes[0].current().HandlePing(gossip.PingArgs{
+		From:    gossip.Member{ID: nodes[1].server.URL},
+		Updates: []gossip.Member{{ID: target, State: gossip.Suspect}},
+	})
+	if m, _ := member(nodes[0], target); m.State != gossip.Suspect {
+		t.Fatalf("expected the suspicion to be taken in, got %+v", m)
+	}
+	waitFor(t, "the suspicion to be refuted", func() bool {
+		return everyoneSees(nodes, target, gossip.Alive)() && nodes[2].current().Status().Incarnation == 1
+	})
+	if m, _ := member(nodes[1], target); m.Incarnation != 1 {
+		t.Errorf("expected the refutation to have a higher incarnation, got %+v", m)
+	}
+
+	//stale claims are ignored
+	nodes[0].current().HandlePing(gossip.PingArgs{
+		From:    gossip.Member{ID: nodes[1].server.URL},
+		Updates: []gossip.Member{{ID: target, State: gossip.Dead}},
+	})
+	if m, _ := member(nodes[0], target); m.State != gossip.Alive {
+		t.Errorf("expected a claim about an older incarnation to be ignored, got %+v", m)
+	}
+}
+
+func TestLeave(t *testing.T) {
+	nodes := newCluster(t, 3)
+	leaving := nodes[2].server.URL
+	waitFor(t, "every node to join", everyoneSees(nodes, leaving, gossip.Alive))
+
+	if err := nodes[2].current().Leave(context.Background()); err != nil {
+		t.Fatal("unable to leave", err)
+	}
+	waitFor(t, "every node to hear the node left", everyoneSees(nodes[:2], leaving, gossip.Left))
+	for _, change := range nodes[0].recorded() {
+		if change.ID == leaving && change.State != gossip.Alive && change.State != gossip.Left {
+			t.Errorf("expected a node that left not to be suspected, got %+v", change)
+		}
+	}
+}
@@ -0,0 +1,597 @@
+package gossip
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"store/logging"
+	"sync"
+	"time"
+)
+
+//maxPiggyback is the most changes sent along with one message
+const maxPiggyback = 32
+
+//Node is this server's view of the cluster's members
+type Node struct {
+	id                   string
+	transport            Transport
+	seeds                []string
+	onChange             func(Member)
+	probeInterval        time.Duration
+	probeTimeout         time.Duration
+	indirectChecks       int
+	suspicionTimeout     time.Duration
+	syncInterval         time.Duration
+	deadRetention        time.Duration
+	retransmitMultiplier int
+	random               *rand.Rand //only used with the lock held
+
+	lock       sync.Mutex
+	members    map[string]*memberState //every member this node knows about, including itself
+	broadcasts []*broadcast            //changes being spread, at most one for each member
+	probeOrder []string                //members left to probe this round, so each one is probed once a round
+	changes    []Member                //waiting to be passed to onChange
+	notify     chan struct{}           //wakes up the goroutine that calls onChange
+
+	ctx     context.Context //cancelled when the node stops, to abandon the messages in flight
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	wg      sync.WaitGroup
+}
+
+type memberState struct {
+	Member
+	since time.Time
+}
+
+//broadcast is a change being piggybacked on messages until it has been sent enough times to have reached everyone
+type broadcast struct {
+	member    Member
+	transmits int
+}
+
+//NewNode creates a node that only knows about itself. Start starts it joining the cluster through the seeds
+func NewNode(config Config) (*Node, error) {
+	if config.ID == "" {
+		return nil, errors.New("a gossip node needs an ID")
+	}
+	if config.Transport == nil {
+		return nil, errors.New("a gossip node needs a transport")
+	}
+	if config.ProbeInterval == 0 {
+		config.ProbeInterval = DefaultProbeInterval
+	}
+	if config.ProbeTimeout == 0 {
+		config.ProbeTimeout = DefaultProbeTimeout
+	}
+	if config.IndirectChecks == 0 {
+		config.IndirectChecks = DefaultIndirectChecks
+	}
+	if config.SuspicionTimeout == 0 {
+		config.SuspicionTimeout = DefaultSuspicionTimeout
+	}
+	if config.SyncInterval == 0 {
+		config.SyncInterval = DefaultSyncInterval
+	}
+	if config.DeadRetention == 0 {
+		config.DeadRetention = DefaultDeadRetention
+	}
+	if config.RetransmitMultiplier == 0 {
+		config.RetransmitMultiplier = DefaultRetransmitMultiplier
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Node{
+		id:                   config.ID,
+		transport:            config.Transport,
+		seeds:                append([]string{}, config.Seeds...),
+		onChange:             config.OnChange,
+		probeInterval:        config.ProbeInterval,
+		probeTimeout:         config.ProbeTimeout,
+		indirectChecks:       config.IndirectChecks,
+		suspicionTimeout:     config.SuspicionTimeout,
+		syncInterval:         config.SyncInterval,
+		deadRetention:        config.DeadRetention,
+		retransmitMultiplier: config.RetransmitMultiplier,
+		random:               rand.New(rand.NewSource(time.Now().UnixNano())),
+		members:              map[string]*memberState{},
+		notify:               make(chan struct{}, 1),
+		ctx:                  ctx,
+		cancel:               cancel,
+		stopped:              make(chan struct{}),
+	}
+	n.members[n.id] = &memberState{Member: Member{ID: n.id, State: Alive, Meta: copyMeta(config.Meta)}, since: time.Now()}
+	return n, nil
+}
+
+//Start starts the node probing the other members, and joining the cluster through the seeds until one of them replies
+func (n *Node) Start() {
+	n.wg.Add(3)
+	go n.probe()
+	go n.syncMembers()
+	go n.notifyChanges()
+}
+
+//Stop stops the node taking part in the cluster. The others will decide it is dead. Leave tells them it is going first
+func (n *Node) Stop() {
+	n.lock.Lock()
+	select {
+	case <-n.stopped:
+		n.lock.Unlock()
+		return
+	default:
+	}
+	close(n.stopped)
+	n.cancel()
+	n.lock.Unlock()
+	n.wg.Wait()
+}
+
+func (n *Node) isStopped() bool {
+	select {
+	case <-n.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+//Leave tells some of the other members this node is leaving, so the cluster doesn't have to detect it, then stops the node
+func (n *Node) Leave(ctx context.Context) error {
+	n.lock.Lock()
+	self := n.members[n.id]
+	self.Incarnation++
+	self.State = Left
+	self.since = time.Now()
+	n.queueBroadcast(self.Member)
+	targets := n.randomMembers(n.indirectChecks, "")
+	args := SyncArgs{From: self.Member, Members: n.memberList()}
+	n.lock.Unlock()
+
+	told := 0
+	for _, target := range targets {
+		if _, err := n.transport.Sync(ctx, target, args); err != nil {
+			logging.DebugLogger.Println("unable to tell", target, "this node is leaving", err)
+			continue
+		}
+		told++
+	}
+	n.Stop()
+	if told == 0 && len(targets) > 0 {
+		return ErrUnreachable
+	}
+	return nil
+}
+
+//ID returns the node's ID
+func (n *Node) ID() string {
+	return n.id
+}
+
+//Members returns every member this node knows about, including itself and members that have recently died or left
+func (n *Node) Members() []MemberStatus {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	members := []MemberStatus{}
+	for _, m := range n.members {
+		member := m.Member
+		member.Meta = copyMeta(m.Meta)
+		members = append(members, MemberStatus{Member: member, Since: m.since})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+//Live returns the members that are alive or suspected, including this node, which is what other subsystems should treat as the cluster
+func (n *Node) Live() []Member {
+	live := []Member{}
+	for _, m := range n.Members() {
+		if isLive(m.State) {
+			live = append(live, m.Member)
+		}
+	}
+	return live
+}
+
+func (n *Node) Status() Status {
+	members := n.Members()
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return Status{ID: n.id, Incarnation: n.members[n.id].Incarnation, Members: members}
+}
+
+//SetMeta changes this node's metadata, and spreads it to the other members
+func (n *Node) SetMeta(meta map[string]string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	self := n.members[n.id]
+	self.Incarnation++
+	self.Meta = copyMeta(meta)
+	n.queueBroadcast(self.Member)
+	n.changed(self.Member)
+}
+
+//Join swaps member lists with each of the seeds, returning how many replied
+func (n *Node) Join(ctx context.Context, seeds ...string) (int, error) {
+	joined := 0
+	for _, seed := range seeds {
+		if seed == n.id {
+			continue
+		}
+		if err := n.sync(ctx, seed); err != nil {
+			logging.DebugLogger.Println("unable to join the cluster through", seed, err)
+			continue
+		}
+		joined++
+	}
+	if joined == 0 {
+		return 0, ErrNoSeeds
+	}
+	return joined, nil
+}
+
+//HandlePing replies to a probe, sending back changes for the sender to spread
+func (n *Node) HandlePing(args PingArgs) PingReply {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.applyAll(append([]Member{args.From}, args.Updates...))
+	return PingReply{From: n.selfLocked(), Updates: n.takeBroadcasts()}
+}
+
+//HandlePingReq probes a member for a node that couldn't reach it
+func (n *Node) HandlePingReq(ctx context.Context, args PingReqArgs) PingReqReply {
+	n.lock.Lock()
+	n.applyAll(append([]Member{args.From}, args.Updates...))
+	n.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, n.probeTimeout)
+	defer cancel()
+	acked := n.ping(ctx, args.Target) == nil
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return PingReqReply{Acked: acked, Updates: n.takeBroadcasts()}
+}
+
+//HandleSync merges the sender's members into this node's, and replies with every member this node knows about
+func (n *Node) HandleSync(args SyncArgs) SyncReply {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.applyAll(append([]Member{args.From}, args.Members...))
+	return SyncReply{Members: n.memberList()}
+}
+
+//probe probes one member every probe interval, and looks for suspects that have run out of time
+func (n *Node) probe() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n.expire()
+		if target := n.nextTarget(); target != "" {
+			n.probeMember(target)
+		}
+	}
+}
+
+//probeMember pings the member, then asks others to ping it if it doesn't reply. If nobody can reach it, it is suspected
+func (n *Node) probeMember(target string) {
+	ctx, cancel := context.WithTimeout(n.ctx, n.probeTimeout)
+	err := n.ping(ctx, target)
+	cancel()
+	if err == nil || n.ctx.Err() != nil {
+		return
+	}
+	logging.DebugLogger.Println("no reply from", target, "so asking other members to probe it.", err)
+
+	n.lock.Lock()
+	helpers := n.randomMembers(n.indirectChecks, target)
+	args := PingReqArgs{From: n.selfLocked(), Target: target, Updates: n.takeBroadcasts()}
+	n.lock.Unlock()
+
+	//the helpers get the rest of the probe interval, but at least a probe timeout for them to ping the target in
+	wait := n.probeInterval - n.probeTimeout
+	if wait < 2*n.probeTimeout {
+		wait = 2 * n.probeTimeout
+	}
+	ctx, cancel = context.WithTimeout(n.ctx, wait)
+	defer cancel()
+	acks := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper string) {
+			reply, err := n.transport.PingReq(ctx, helper, args)
+			if err != nil {
+				acks <- false
+				return
+			}
+			n.lock.Lock()
+			n.applyAll(reply.Updates)
+			n.lock.Unlock()
+			acks <- reply.Acked
+		}(helper)
+	}
+	for range helpers {
+		if <-acks {
+			return
+		}
+	}
+	if n.ctx.Err() != nil {
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if m, present := n.members[target]; present && m.State == Alive {
+		logging.WarningLogger.Println("suspecting", target, "as it didn't reply to any probes")
+		suspect := m.Member
+		suspect.State = Suspect
+		n.apply(suspect)
+	}
+}
+
+//ping sends a probe to the member, spreading changes both ways
+func (n *Node) ping(ctx context.Context, target string) error {
+	n.lock.Lock()
+	args := PingArgs{From: n.selfLocked(), Updates: n.takeBroadcasts()}
+	n.lock.Unlock()
+	reply, err := n.transport.Ping(ctx, target, args)
+	if err != nil {
+		return err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.applyAll(append([]Member{reply.From}, reply.Updates...))
+	return nil
+}
+
+//nextTarget picks the next member to probe. Members are probed in a random order, once each per round
+func (n *Node) nextTarget() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		for len(n.probeOrder) > 0 {
+			target := n.probeOrder[0]
+			n.probeOrder = n.probeOrder[1:]
+			if m, present := n.members[target]; present && isLive(m.State) {
+				return target
+			}
+		}
+		n.probeOrder = n.randomMembers(len(n.members), "")
+	}
+	return ""
+}
+
+//expire declares suspects that haven't refuted the suspicion in time dead, and forgets members that have been dead for long enough
+func (n *Node) expire() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	now := time.Now()
+	for id, m := range n.members {
+		switch {
+		case m.State == Suspect && now.Sub(m.since) >= n.suspicionTimeout:
+			logging.WarningLogger.Println("declaring", id, "dead as it didn't refute the suspicion in time")
+			dead := m.Member
+			dead.State = Dead
+			n.apply(dead)
+		case (m.State == Dead || m.State == Left) && now.Sub(m.since) >= n.deadRetention:
+			delete(n.members, id)
+		}
+	}
+}
+
+//syncMembers swaps member lists with a random member every sync interval, so nodes catch up on anything they missed.
+//While this node doesn't know of any other live members it tries the seeds instead, every probe interval
+func (n *Node) syncMembers() {
+	defer n.wg.Done()
+	for {
+		n.lock.Lock()
+		targets := n.randomMembers(1, "")
+		n.lock.Unlock()
+
+		wait := n.syncInterval
+		ctx, cancel := context.WithTimeout(n.ctx, n.probeInterval)
+		if len(targets) > 0 {
+			if err := n.sync(ctx, targets[0]); err != nil {
+				logging.DebugLogger.Println("unable to swap members with", targets[0], err)
+			}
+		} else if len(n.seeds) > 0 {
+			if _, err := n.Join(ctx, n.seeds...); err != nil {
+				wait = n.probeInterval
+			}
+		}
+		cancel()
+
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+//sync swaps member lists with the node
+func (n *Node) sync(ctx context.Context, target string) error {
+	n.lock.Lock()
+	args := SyncArgs{From: n.selfLocked(), Members: n.memberList()}
+	n.lock.Unlock()
+	reply, err := n.transport.Sync(ctx, target, args)
+	if err != nil {
+		return err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.applyAll(reply.Members)
+	return nil
+}
+
+func (n *Node) applyAll(updates []Member) {
+	for _, update := range updates {
+		n.apply(update)
+	}
+}
+
+//apply takes in a claim about a member if it is newer than what this node knows, and spreads it on.
+//A claim that this node is suspected or dead is refuted with a higher incarnation. Must be called with the lock held
+func (n *Node) apply(update Member) {
+	if update.ID == "" {
+		return
+	}
+	update.Meta = copyMeta(update.Meta)
+	known, present := n.members[update.ID]
+	if update.ID == n.id {
+		if known.State == Left || !update.overrides(known.Member) {
+			return
+		}
+		logging.InfoLogger.Printf("refuting a claim that this node is %s at incarnation %d\n", update.State, update.Incarnation)
+		known.Incarnation = update.Incarnation + 1
+		n.queueBroadcast(known.Member)
+		return
+	}
+	if !present {
+		if update.State == Dead || update.State == Left { //it has been forgotten, or was never known, so there is nothing to update
+			return
+		}
+		logging.InfoLogger.Printf("%s joined the cluster as %s\n", update.ID, update.State)
+		n.members[update.ID] = &memberState{Member: update, since: time.Now()}
+		n.queueBroadcast(update)
+		n.changed(update)
+		return
+	}
+	if !update.overrides(known.Member) {
+		return
+	}
+	if update.State != known.State {
+		logging.InfoLogger.Printf("%s is now %s at incarnation %d\n", update.ID, update.State, update.Incarnation)
+		known.since = time.Now()
+	}
+	known.Member = update
+	n.queueBroadcast(update)
+	n.changed(update)
+}
+
+//queueBroadcast starts spreading the change, replacing any older change to the same member
+func (n *Node) queueBroadcast(m Member) {
+	m.Meta = copyMeta(m.Meta)
+	for i, b := range n.broadcasts {
+		if b.member.ID == m.ID {
+			n.broadcasts = append(n.broadcasts[:i], n.broadcasts[i+1:]...)
+			break
+		}
+	}
+	n.broadcasts = append(n.broadcasts, &broadcast{member: m})
+}
+
+//takeBroadcasts picks the changes to send with a message, those sent the fewest times first.
+//Each is sent a multiple of the log of the cluster's size, which is enough for it to reach every member with high probability
+func (n *Node) takeBroadcasts() []Member {
+	if len(n.broadcasts) == 0 {
+		return nil
+	}
+	live := 0
+	for _, m := range n.members {
+		if isLive(m.State) {
+			live++
+		}
+	}
+	limit := n.retransmitMultiplier * int(math.Ceil(math.Log10(float64(live+1))))
+	sort.SliceStable(n.broadcasts, func(i, j int) bool { return n.broadcasts[i].transmits < n.broadcasts[j].transmits })
+	updates := []Member{}
+	for _, b := range n.broadcasts {
+		if len(updates) == maxPiggyback {
+			break
+		}
+		updates = append(updates, b.member)
+		b.transmits++
+	}
+	remaining := n.broadcasts[:0]
+	for _, b := range n.broadcasts {
+		if b.transmits < limit {
+			remaining = append(remaining, b)
+		}
+	}
+	n.broadcasts = remaining
+	return updates
+}
+
+//randomMembers picks up to count live members other than this node and the excluded one, in a random order
+func (n *Node) randomMembers(count int, exclude string) []string {
+	candidates := []string{}
+	for id, m := range n.members {
+		if id != n.id && id != exclude && isLive(m.State) {
+			candidates = append(candidates, id)
+		}
+	}
+	sort.Strings(candidates) //so the order only depends on the random source
+	n.random.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if len(candidates) > count {
+		candidates = candidates[:count]
+	}
+	return candidates
+}
+
+//memberList returns every member, to send to another node. Must be called with the lock held
+func (n *Node) memberList() []Member {
+	members := []Member{}
+	for _, m := range n.members {
+		members = append(members, m.Member)
+	}
+	return members
+}
+
+func (n *Node) selfLocked() Member {
+	return n.members[n.id].Member
+}
+
+//changed queues a change for onChange. Must be called with the lock held
+func (n *Node) changed(m Member) {
+	if n.onChange == nil {
+		return
+	}
+	m.Meta = copyMeta(m.Meta)
+	n.changes = append(n.changes, m)
+	select {
+	case n.notify <- struct{}{}:
+	default:
+	}
+}
+
+//notifyChanges passes changes to onChange one at a time, in the order they happened, without holding the lock
+func (n *Node) notifyChanges() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-n.notify:
+		}
+		n.lock.Lock()
+		changes := n.changes
+		n.changes = nil
+		n.lock.Unlock()
+		for _, change := range changes {
+			n.onChange(change)
+		}
+	}
+}
+
+func isLive(s State) bool {
+	return s == Alive || s == Suspect
+}
+
+func copyMeta(meta map[string]string) map[string]string {
+	if meta == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(meta))
+	for key, value := range meta {
+		copied[key] = value
+	}
+	return copied
+}
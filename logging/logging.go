@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 
 	"cloud.google.com/go/logging"
@@ -13,23 +12,20 @@ import (
 const logName = "kv-store-log"
 
 var (
-	WarningLogger *log.Logger
-	InfoLogger    *log.Logger
-	ErrorLogger   *log.Logger
+	DebugLogger   = &Logger{level: LevelDebug}
+	InfoLogger    = &Logger{level: LevelInfo}
+	WarningLogger = &Logger{level: LevelWarning}
+	ErrorLogger   = &Logger{level: LevelError}
 	AccessLogger  *log.Logger
 )
 
 var (
-	serverLogFile *os.File
-	accessLogFile *os.File
+	serverLogFile *RotatingFile
+	accessLogFile *RotatingFile
 
 	client *logging.Client
 )
 
-func LogAccessRequest(r *http.Request) {
-	AccessLogger.Printf("url: %s, HTTP method: %s, Source IP address: %s\n", r.Host+r.URL.Path, r.Method, r.RemoteAddr)
-}
-
 func SetupLoggers(serverLogName string, accessLogName string, cloudLogs bool) {
 	if cloudLogs {
 		setupCloudLoggers()
@@ -40,24 +36,40 @@ func SetupLoggers(serverLogName string, accessLogName string, cloudLogs bool) {
 
 func setupLocalLoggers(serverLogName string, accessLogName string) {
 	var err error
-	serverLogFile, err = os.OpenFile(serverLogName,
-		os.O_CREATE|os.O_APPEND|os.O_WRONLY,
-		0644)
+	serverLogFile, err = OpenRotatingFile(serverLogName, RotationPolicy{}) //nothing is rotated until SetRotationPolicy is called
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	accessLogFile, err = os.OpenFile(accessLogName,
-		os.O_CREATE|os.O_APPEND|os.O_WRONLY,
-		0644)
+	accessLogFile, err = OpenRotatingFile(accessLogName, RotationPolicy{})
 	if err != nil {
 		log.Fatal(err)
 	}
-	InfoLogger = log.New(serverLogFile, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-	WarningLogger = log.New(serverLogFile, "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
-	ErrorLogger = log.New(serverLogFile, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
+	setSink(&writerSink{writer: serverLogFile})
 
-	AccessLogger = log.New(accessLogFile, "INFO: ", log.Ldate|log.Ltime)
+	AccessLogger = log.New(accessLogFile, "", 0) //access log lines are already complete, in whichever format the server uses
+}
+
+//SetRotationPolicy sets when the local log files are rotated and how many rotated files are kept. Does nothing for cloud logging
+func SetRotationPolicy(policy RotationPolicy) {
+	for _, file := range []*RotatingFile{serverLogFile, accessLogFile} {
+		if file != nil {
+			file.SetPolicy(policy)
+		}
+	}
+}
+
+//Reopen reopens the local log files by name, so lines go to new files after an external tool like logrotate has moved the old ones
+func Reopen() error {
+	for _, file := range []*RotatingFile{serverLogFile, accessLogFile} {
+		if file == nil {
+			continue
+		}
+		if err := file.Reopen(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func setupCloudLoggers() {
@@ -73,15 +85,45 @@ func setupCloudLoggers() {
 		log.Fatalf("Failed to create client: %v", err)
 		return
 	}
-	InfoLogger = client.Logger(logName).StandardLogger(logging.Info)
-	WarningLogger = client.Logger(logName).StandardLogger(logging.Warning)
-	ErrorLogger = client.Logger(logName).StandardLogger(logging.Error)
+	setSink(&cloudSink{logger: client.Logger(logName)})
 
 	AccessLogger = client.Logger("kv-store-access-log").StandardLogger(logging.Info)
 }
 
+//cloudSink sends structured log lines to the cloud logging backend, with the request ID as a label so it can be searched on
+type cloudSink struct {
+	logger *logging.Logger
+}
+
+var cloudSeverities = map[Level]logging.Severity{
+	LevelDebug:   logging.Debug,
+	LevelInfo:    logging.Info,
+	LevelWarning: logging.Warning,
+	LevelError:   logging.Error,
+}
+
+func (s *cloudSink) write(level Level, e entry) {
+	payload := map[string]interface{}{"msg": e.Message}
+	if e.Caller != "" {
+		payload["caller"] = e.Caller
+	}
+	for key, value := range e.Fields {
+		payload[key] = value
+	}
+	cloudEntry := logging.Entry{
+		Timestamp: e.Time,
+		Severity:  cloudSeverities[level],
+		Payload:   payload,
+	}
+	if requestID, ok := e.Fields["request_id"].(string); ok {
+		cloudEntry.Labels = map[string]string{"request_id": requestID}
+	}
+	s.logger.Log(cloudEntry) //buffered, sent in the background
+}
+
 func Shutdown() {
 	fmt.Println("Shutting down loggers")
+	setSink(&writerSink{writer: os.Stderr}) //anything logged after this point still goes somewhere
 	if serverLogFile != nil {
 		fmt.Println("closing serverlogfile")
 		serverLogFile.Close()
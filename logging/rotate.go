@@ -0,0 +1,269 @@
+package logging
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//backupTimeFormat is used in the names of rotated files, e.g. info-2022-03-14T12-00-00.000.log. It sorts in time order
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+var ErrRotatingFileClosed = errors.New("log file has been closed")
+
+//RotationPolicy decides when a local log file is rotated and how many of the rotated files are kept.
+//Zero values turn that part of the policy off, so the zero policy never rotates
+type RotationPolicy struct {
+	MaxSize    int64         //rotate once the file would grow past this many bytes
+	Interval   time.Duration //rotate once the file has been open this long
+	MaxBackups int           //rotated files to keep, oldest are removed first
+	MaxAge     time.Duration //remove rotated files older than this
+	Compress   bool          //gzip rotated files
+}
+
+//RotatingFile is a log file that rotates itself according to its policy. Writes, rotations and reopens hold the same lock,
+//so every line ends up whole in exactly one file
+type RotatingFile struct {
+	lock     sync.Mutex
+	name     string
+	policy   RotationPolicy
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	closed   bool
+
+	millLock sync.Mutex     //one compress and prune pass at a time
+	milling  sync.WaitGroup //so Close waits for compression to finish
+}
+
+//OpenRotatingFile opens name for appending, creating it if needed
+func OpenRotatingFile(name string, policy RotationPolicy) (*RotatingFile, error) {
+	r := &RotatingFile{name: name, policy: policy}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	file, size, err := openAppend(r.name)
+	if err != nil {
+		return err
+	}
+	r.file, r.size, r.openedAt = file, size, time.Now()
+	return nil
+}
+
+//openAppend opens the file for appending and returns its current size
+func openAppend(name string) (*os.File, int64, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return 0, ErrRotatingFileClosed
+	}
+	if r.due(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			os.Stderr.WriteString("unable to rotate " + r.name + ": " + err.Error() + "\n") //keep writing to the old file rather than lose the line
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+//due checks if writing another n bytes means the file should be rotated first. An empty file is never rotated
+func (r *RotatingFile) due(n int64) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.policy.MaxSize > 0 && r.size+n > r.policy.MaxSize {
+		return true
+	}
+	return r.policy.Interval > 0 && time.Since(r.openedAt) >= r.policy.Interval
+}
+
+//Rotate moves the current file aside and starts a new one, whatever the policy says
+func (r *RotatingFile) Rotate() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return ErrRotatingFileClosed
+	}
+	return r.rotate()
+}
+
+func (r *RotatingFile) rotate() error {
+	backup := r.backupName(time.Now())
+	if err := os.Rename(r.name, backup); err != nil {
+		return err
+	}
+	old := r.file
+	if err := r.open(); err != nil {
+		return err //the old file is still open under its new name, so nothing is lost
+	}
+	old.Close()
+	policy := r.policy
+	r.milling.Add(1)
+	go r.mill(backup, policy)
+	return nil
+}
+
+//Reopen closes the file and opens it again by name. This is for external tools like logrotate, which move the file and then send SIGHUP
+func (r *RotatingFile) Reopen() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return ErrRotatingFileClosed
+	}
+	old := r.file
+	if err := r.open(); err != nil {
+		return err //carry on with the old file
+	}
+	old.Close()
+	return nil
+}
+
+//SetPolicy changes the rotation policy. The new policy is applied on the next write
+func (r *RotatingFile) SetPolicy(policy RotationPolicy) {
+	r.lock.Lock()
+	r.policy = policy
+	r.lock.Unlock()
+	r.milling.Add(1)
+	go r.mill("", policy) //apply the new retention limits to existing backups straight away
+}
+
+//Close closes the file, after waiting for any rotated files to be compressed
+func (r *RotatingFile) Close() error {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil
+	}
+	r.closed = true
+	err := r.file.Close()
+	r.lock.Unlock()
+	r.milling.Wait()
+	return err
+}
+
+//backupName picks the name a rotated file is moved to, making sure it doesn't replace an earlier one
+func (r *RotatingFile) backupName(t time.Time) string {
+	ext := filepath.Ext(r.name)
+	for {
+		name := strings.TrimSuffix(r.name, ext) + "-" + t.UTC().Format(backupTimeFormat) + ext
+		if !fileExists(name) && !fileExists(name+".gz") {
+			return name
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+//backup is a rotated file and the time it was rotated, taken from its name
+type backup struct {
+	path      string
+	rotatedAt time.Time
+}
+
+//backups lists the rotated files, newest first
+func (r *RotatingFile) backups() ([]backup, error) {
+	ext := filepath.Ext(r.name)
+	prefix := filepath.Base(strings.TrimSuffix(r.name, ext)) + "-"
+	entries, err := ioutil.ReadDir(filepath.Dir(r.name))
+	if err != nil {
+		return nil, err
+	}
+	found := []backup{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ext)
+		rotatedAt, err := time.Parse(backupTimeFormat, strings.TrimPrefix(stamp, prefix))
+		if err != nil {
+			continue //not one of ours
+		}
+		found = append(found, backup{path: filepath.Join(filepath.Dir(r.name), name), rotatedAt: rotatedAt})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].rotatedAt.After(found[j].rotatedAt) })
+	return found, nil
+}
+
+//mill compresses a newly rotated file, if the policy asks for it, then removes backups beyond the retention limits
+func (r *RotatingFile) mill(rotated string, policy RotationPolicy) {
+	defer r.milling.Done()
+	r.millLock.Lock()
+	defer r.millLock.Unlock()
+
+	if rotated != "" && policy.Compress {
+		if err := compressFile(rotated); err != nil {
+			os.Stderr.WriteString("unable to compress " + rotated + ": " + err.Error() + "\n")
+		}
+	}
+	if policy.MaxBackups <= 0 && policy.MaxAge <= 0 {
+		return
+	}
+	backups, err := r.backups()
+	if err != nil {
+		os.Stderr.WriteString("unable to list rotated logs for " + r.name + ": " + err.Error() + "\n")
+		return
+	}
+	for i, old := range backups {
+		tooMany := policy.MaxBackups > 0 && i >= policy.MaxBackups
+		tooOld := policy.MaxAge > 0 && time.Since(old.rotatedAt) > policy.MaxAge
+		if tooMany || tooOld {
+			os.Remove(old.path)
+		}
+	}
+}
+
+//compressFile gzips the file to file.gz and removes the original. The original is only removed once the copy is complete
+func compressFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zipper := gzip.NewWriter(out)
+	if _, err = io.Copy(zipper, in); err == nil {
+		err = zipper.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	in.Close()
+	return os.Remove(name)
+}
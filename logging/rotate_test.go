@@ -0,0 +1,156 @@
+package logging_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"store/logging"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//readLogLines reads every line in the log directory, unzipping rotated files
+func readLogLines(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{}
+	for _, info := range files {
+		file, err := os.Open(filepath.Join(dir, info.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reader io.Reader = file
+		if strings.HasSuffix(info.Name(), ".gz") {
+			zipped, err := gzip.NewReader(file)
+			if err != nil {
+				t.Fatalf("%s is not gzipped: %v\n", info.Name(), err)
+			}
+			reader = zipped
+		}
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		file.Close()
+	}
+	return lines
+}
+
+func TestRotateOnSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := logging.OpenRotatingFile(filepath.Join(dir, "info.log"), logging.RotationPolicy{MaxSize: 1000, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, linesEach = 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < linesEach; i++ {
+				fmt.Fprintf(file, "writer %d line %d\n", w, i)
+			}
+		}(w)
+	}
+	wg.Wait()
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) < 2 {
+		t.Fatalf("expected the log to have been rotated, found %d files\n", len(files))
+	}
+	for _, info := range files {
+		if info.Size() > 1000 && !strings.HasSuffix(info.Name(), ".gz") {
+			t.Errorf("%s is %d bytes, over the size limit\n", info.Name(), info.Size())
+		}
+		if info.Name() != "info.log" && !strings.HasSuffix(info.Name(), ".gz") {
+			t.Errorf("rotated file %s was not compressed\n", info.Name())
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, line := range readLogLines(t, dir) {
+		if seen[line] {
+			t.Errorf("line %q was written twice\n", line)
+		}
+		seen[line] = true
+	}
+	if len(seen) != writers*linesEach {
+		t.Errorf("expected %d lines across all the files, found %d\n", writers*linesEach, len(seen))
+	}
+}
+
+func TestRotateMaxBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := logging.OpenRotatingFile(filepath.Join(dir, "access.log"), logging.RotationPolicy{MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(file, "line %d\n", i)
+		if err := file.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fmt.Fprintln(file, "line 5")
+	file.Close()
+
+	lines := readLogLines(t, dir)
+	if strings.Join(lines, ",") != "line 3,line 4,line 5" {
+		t.Errorf("expected only the two newest backups and the current file to be kept, got %v\n", lines)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "info.log")
+	file, err := logging.OpenRotatingFile(name, logging.RotationPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	fmt.Fprintln(file, "before")
+	if err := os.Rename(name, name+".1"); err != nil { //what logrotate does before sending SIGHUP
+		t.Fatal(err)
+	}
+	fmt.Fprintln(file, "moved")
+	if err := file.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(file, "after")
+
+	old, _ := ioutil.ReadFile(name + ".1")
+	current, _ := ioutil.ReadFile(name)
+	if string(old) != "before\nmoved\n" {
+		t.Errorf("expected lines written before the reopen in the moved file, got %q\n", old)
+	}
+	if string(current) != "after\n" {
+		t.Errorf("expected lines written after the reopen in a new file, got %q\n", current)
+	}
+}
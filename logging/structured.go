@@ -0,0 +1,219 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Level is the severity of a log line. Lines below the minimum level set with SetLevel are dropped
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug:   "DEBUG",
+	LevelInfo:    "INFO",
+	LevelWarning: "WARNING",
+	LevelError:   "ERROR",
+}
+
+var ErrUnknownLevel = errors.New("unknown log level")
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return "Level(" + strconv.Itoa(int(l)) + ")"
+}
+
+//ParseLevel converts a level name, e.g. "debug" or "WARNING", into a Level
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	if strings.EqualFold(name, "warn") {
+		return LevelWarning, nil
+	}
+	return LevelInfo, ErrUnknownLevel
+}
+
+var minLevel = int32(LevelInfo)
+
+//SetLevel changes the minimum level that is logged. Safe to call while the server is running
+func SetLevel(level Level) {
+	atomic.StoreInt32(&minLevel, int32(level))
+}
+
+//GetLevel returns the current minimum level
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&minLevel))
+}
+
+//Fields are extra values added to a log line, e.g. the request ID
+type Fields map[string]interface{}
+
+//Logger writes structured log lines at a single level. It has the same Println and Printf methods as log.Logger,
+//so the package loggers can be used as before, while With adds fields that appear on every line
+type Logger struct {
+	level  Level
+	fields Fields
+}
+
+//With returns a logger that adds the fields to every line, as well as any this logger already adds
+func (l *Logger) With(fields Fields) *Logger {
+	merged := Fields{}
+	for key, value := range l.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &Logger{level: l.level, fields: merged}
+}
+
+func (l *Logger) Println(v ...interface{}) {
+	if l.level < GetLevel() { //check before formatting, so disabled debug lines are cheap
+		return
+	}
+	l.output(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+func (l *Logger) Printf(format string, v ...interface{}) {
+	if l.level < GetLevel() {
+		return
+	}
+	l.output(strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"))
+}
+
+//entry is a single structured log line
+type entry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"msg"`
+	Caller  string    `json:"caller,omitempty"`
+	Fields  Fields    `json:"fields,omitempty"`
+}
+
+func (l *Logger) output(message string) {
+	e := entry{
+		Time:    time.Now().UTC(),
+		Level:   l.level.String(),
+		Message: message,
+		Fields:  l.fields,
+	}
+	if _, file, line, ok := runtime.Caller(2); ok { //skip output and Println/Printf
+		e.Caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	currentSink().write(l.level, e)
+}
+
+//sink is where structured log lines end up: a local file (or stderr) as JSON lines, or the cloud logging backend
+type sink interface {
+	write(level Level, e entry)
+}
+
+//writerSink writes JSON lines to a writer, one at a time so lines from different goroutines don't interleave
+type writerSink struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+func (s *writerSink) write(level Level, e entry) {
+	line, err := json.Marshal(e)
+	if err != nil { //a field couldn't be marshalled, so fall back to its string form
+		fields := Fields{}
+		for key, value := range e.Fields {
+			fields[key] = fmt.Sprint(value)
+		}
+		e.Fields = fields
+		line, _ = json.Marshal(e)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.writer.Write(append(line, '\n'))
+}
+
+var (
+	activeSink sink = &writerSink{writer: os.Stderr} //used until SetupLoggers is called, e.g. in tests
+	sinkLock   sync.RWMutex
+)
+
+func currentSink() sink {
+	sinkLock.RLock()
+	defer sinkLock.RUnlock()
+	return activeSink
+}
+
+func setSink(s sink) {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+	activeSink = s
+}
+
+//SetOutput sends log lines to w as JSON, instead of wherever SetupLoggers pointed them
+func SetOutput(w io.Writer) {
+	setSink(&writerSink{writer: w})
+}
+
+type contextKey struct{}
+
+//WithRequestID returns a copy of the context carrying the request ID, which is then added to every line logged with it
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, contextKey{}, requestID)
+}
+
+//RequestID returns the request ID carried by the context, or an empty string if there isn't one
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	requestID, _ := ctx.Value(contextKey{}).(string)
+	return requestID
+}
+
+//forContext adds the context's request ID, if it has one, to the logger
+func (l *Logger) forContext(ctx context.Context) *Logger {
+	requestID := RequestID(ctx)
+	if requestID == "" || l.level < GetLevel() {
+		return l
+	}
+	return l.With(Fields{"request_id": requestID})
+}
+
+//Debug returns the debug logger for a request, adding its request ID to every line
+func Debug(ctx context.Context) *Logger {
+	return DebugLogger.forContext(ctx)
+}
+
+//Info returns the info logger for a request, adding its request ID to every line
+func Info(ctx context.Context) *Logger {
+	return InfoLogger.forContext(ctx)
+}
+
+//Warning returns the warning logger for a request, adding its request ID to every line
+func Warning(ctx context.Context) *Logger {
+	return WarningLogger.forContext(ctx)
+}
+
+//Error returns the error logger for a request, adding its request ID to every line
+func Error(ctx context.Context) *Logger {
+	return ErrorLogger.forContext(ctx)
+}
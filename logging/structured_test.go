@@ -0,0 +1,77 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"store/logging"
+	"strings"
+	"testing"
+)
+
+type logLine struct {
+	Level   string                 `json:"level"`
+	Message string                 `json:"msg"`
+	Caller  string                 `json:"caller"`
+	Fields  map[string]interface{} `json:"fields"`
+}
+
+func readLines(t *testing.T, buffer *bytes.Buffer) []logLine {
+	lines := []logLine{}
+	for _, raw := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		if raw == "" {
+			continue
+		}
+		var line logLine
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			t.Fatalf("log line is not JSON: %s\n", raw)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestStructuredLogging(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logging.SetOutput(buffer)
+	defer logging.SetOutput(os.Stderr)
+	defer logging.SetLevel(logging.LevelInfo)
+
+	ctx := logging.WithRequestID(context.Background(), "abc123")
+	logging.Info(ctx).Printf("stored key %s\n", "k1")
+	logging.Debug(ctx).Println("not shown at info level")
+	logging.SetLevel(logging.LevelDebug)
+	logging.Debug(ctx).Println("shown at debug level")
+	logging.SetLevel(logging.LevelError)
+	logging.WarningLogger.Println("not shown at error level")
+	logging.ErrorLogger.With(logging.Fields{"key": "k1"}).Println("something broke")
+
+	lines := readLines(t, buffer)
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d: %s\n", len(lines), buffer.String())
+	}
+	if lines[0].Level != "INFO" || lines[0].Message != "stored key k1" || lines[0].Fields["request_id"] != "abc123" {
+		t.Errorf("info line is wrong %+v\n", lines[0])
+	}
+	if !strings.HasPrefix(lines[0].Caller, "structured_test.go:") {
+		t.Errorf("caller should be the test file, got %s\n", lines[0].Caller)
+	}
+	if lines[1].Level != "DEBUG" || lines[1].Message != "shown at debug level" {
+		t.Errorf("debug line is wrong %+v\n", lines[1])
+	}
+	if lines[2].Level != "ERROR" || lines[2].Fields["key"] != "k1" || lines[2].Fields["request_id"] != nil {
+		t.Errorf("error line is wrong %+v\n", lines[2])
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, expected := range map[string]logging.Level{"debug": logging.LevelDebug, "INFO": logging.LevelInfo, "warn": logging.LevelWarning, "Error": logging.LevelError} {
+		if level, err := logging.ParseLevel(name); err != nil || level != expected {
+			t.Errorf("expected %s to parse as %s, got %s %v\n", name, expected, level, err)
+		}
+	}
+	if _, err := logging.ParseLevel("loud"); err != logging.ErrUnknownLevel {
+		t.Error("parsed an unknown level", err)
+	}
+}
@@ -0,0 +1,256 @@
+//Package metrics keeps counters, gauges and histograms and writes them out in the Prometheus text exposition format.
+//Metrics are created once, usually as package level variables, and are safe to update from any goroutine
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//DefaultBuckets are the upper bounds, in seconds, of the buckets used for request latencies
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+//metric is anything that can write itself out in the text format
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	registry     = map[string]metric{}
+	registryLock sync.Mutex
+)
+
+func register(m metric) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, exists := registry[m.name()]; exists {
+		panic("metrics: " + m.name() + " registered twice")
+	}
+	registry[m.name()] = m
+}
+
+//WriteText writes every metric in the Prometheus text exposition format, sorted by name
+func WriteText(w io.Writer) error {
+	registryLock.Lock()
+	all := make([]metric, 0, len(registry))
+	for _, m := range registry {
+		all = append(all, m)
+	}
+	registryLock.Unlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].name() < all[j].name() })
+
+	buffered := bufio.NewWriter(w)
+	for _, m := range all {
+		m.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+//ContentType is the content type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+//desc is the name, help text and label names shared by every kind of metric
+type desc struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (d desc) name() string {
+	return d.metricName
+}
+
+func (d desc) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.metricName, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help), d.metricName, kind)
+}
+
+//key joins label values so they can be used as a map key
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels but was given %d values", d.metricName, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+//labelString formats the labels as {name="value",...}, with any extra label added at the end
+func (d desc) labelString(key string, extra ...string) string {
+	pairs := []string{}
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+"="+strconv.Quote(value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+//CounterVec is a set of counters, one for each combination of label values
+type CounterVec struct {
+	desc
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+//NewCounterVec creates and registers a counter with the given label names
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: desc{metricName: name, help: help, labels: labels}, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+//Inc adds one to the counter with the label values, which must be in the same order as the label names
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+//Add adds delta, which must not be negative, to the counter with the label values
+func (c *CounterVec) Add(delta float64, values ...string) {
+	key := c.key(values)
+	c.lock.Lock()
+	c.values[key] += delta
+	c.lock.Unlock()
+}
+
+//Value returns the current value of the counter with the label values
+func (c *CounterVec) Value(values ...string) float64 {
+	key := c.key(values)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[key]
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.header(w, "counter")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.labels) == 0 { //a counter with no labels is always shown, even before it has been incremented
+		fmt.Fprintf(w, "%s %s\n", c.metricName, formatFloat(c.values[""]))
+		return
+	}
+	keys := map[string]bool{}
+	for key := range c.values {
+		keys[key] = true
+	}
+	for _, key := range sortedKeys(keys) {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.labelString(key), formatFloat(c.values[key]))
+	}
+}
+
+//GaugeFunc is a gauge whose value is read when the metrics are written, e.g. the length of a queue
+type GaugeFunc struct {
+	desc
+	value func() float64
+}
+
+//NewGaugeFunc creates and registers a gauge that calls value each time the metrics are written
+func NewGaugeFunc(name, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{metricName: name, help: help}, value: value}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.header(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.value()))
+}
+
+//histogram is the counts for a single combination of label values
+type histogram struct {
+	counts []uint64 //counts[i] is the number of observations in bucket i alone, they are added up when written
+	count  uint64
+	sum    float64
+}
+
+//HistogramVec is a set of histograms, one for each combination of label values
+type HistogramVec struct {
+	desc
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogram
+}
+
+//NewHistogramVec creates and registers a histogram with the given bucket upper bounds and label names
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	h := &HistogramVec{desc: desc{metricName: name, help: help, labels: labels}, buckets: sorted, values: map[string]*histogram{}}
+	register(h)
+	return h
+}
+
+//Observe adds a value to the histogram with the label values
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	key := h.key(values)
+	bucket := sort.SearchFloat64s(h.buckets, value) //the first bucket with an upper bound >= value, or len(buckets) for +Inf
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	hist, present := h.values[key]
+	if !present {
+		hist = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = hist
+	}
+	hist.counts[bucket]++
+	hist.count++
+	hist.sum += value
+}
+
+//ObserveDuration adds the time since start, in seconds, to the histogram with the label values
+func (h *HistogramVec) ObserveDuration(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.header(w, "histogram")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	keys := map[string]bool{}
+	for key := range h.values {
+		keys[key] = true
+	}
+	for _, key := range sortedKeys(keys) {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, count := range hist.counts {
+			cumulative += count
+			bound := math.Inf(1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelString(key, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.labelString(key), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, h.labelString(key), hist.count)
+	}
+}
@@ -0,0 +1,55 @@
+package metrics_test
+
+import (
+	"bytes"
+	"store/metrics"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	requests := metrics.NewCounterVec("test_requests_total", "Requests by code", "code")
+	requests.Inc("200")
+	requests.Inc("200")
+	requests.Add(3, "404")
+	latency := metrics.NewHistogramVec("test_latency_seconds", "Latency", []float64{0.1, 1}, "code")
+	latency.Observe(0.05, "200")
+	latency.Observe(0.5, "200")
+	latency.Observe(5, "200")
+	metrics.NewGaugeFunc("test_queue_depth", "Queue depth", func() float64 { return 7 })
+
+	var buffer bytes.Buffer
+	if err := metrics.WriteText(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	output := buffer.String()
+	for _, want := range []string{
+		"# TYPE test_requests_total counter\n",
+		`test_requests_total{code="200"} 2` + "\n",
+		`test_requests_total{code="404"} 3` + "\n",
+		"# TYPE test_latency_seconds histogram\n",
+		`test_latency_seconds_bucket{code="200",le="0.1"} 1` + "\n",
+		`test_latency_seconds_bucket{code="200",le="1"} 2` + "\n",
+		`test_latency_seconds_bucket{code="200",le="+Inf"} 3` + "\n",
+		`test_latency_seconds_sum{code="200"} 5.55` + "\n",
+		`test_latency_seconds_count{code="200"} 3` + "\n",
+		"# TYPE test_queue_depth gauge\ntest_queue_depth 7\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected the output to contain %q, got\n%s", want, output)
+		}
+	}
+	if strings.Index(output, "test_latency_seconds") > strings.Index(output, "test_queue_depth") {
+		t.Error("expected metrics to be sorted by name")
+	}
+}
+
+func TestWrongLabelCount(t *testing.T) {
+	counter := metrics.NewCounterVec("test_labels_total", "Labels", "a", "b")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic when given the wrong number of label values")
+		}
+	}()
+	counter.Inc("only one")
+}
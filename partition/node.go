@@ -0,0 +1,364 @@
+package partition
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"store/KVStore"
+	"store/logging"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	//BatchSize is how many keys are moved from another node at a time
+	BatchSize = 1000
+	//RetryInterval is how long a node waits before trying again to move keys from a node it couldn't reach
+	RetryInterval = time.Second
+	//RingSyncInterval is how often a node checks whether the others have a newer ring, in case it missed a change
+	RingSyncInterval = 10 * time.Second
+)
+
+//Node is this server's place in a partitioned store
+type Node struct {
+	address      string
+	secret       string
+	virtualNodes int
+	store        Store
+	client       *http.Client
+
+	lock      sync.RWMutex
+	epoch     uint64
+	ring      *KVStore.Ring
+	history   []*KVStore.Ring //rings this node has had since it last finished moving keys, newest first
+	pending   map[string]bool //nodes that may still have keys this node owns
+	moved     int
+	lastError string
+	changed   chan struct{} //closed and replaced whenever the ring changes, to wake the migration up
+
+	move sync.Mutex //held while keys are moved here, so a request isn't handled for a key that is on its way
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+//NewNode creates a node on a ring of the nodes, which should be the same on every node. Start starts it keeping up with changes to the ring
+func NewNode(address string, nodes []string, secret string, virtualNodes int, store Store) *Node {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Node{
+		address:      strings.TrimRight(address, "/"),
+		secret:       secret,
+		virtualNodes: virtualNodes,
+		store:        store,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		ring:         KVStore.NewRing(virtualNodes, nodes...),
+		pending:      map[string]bool{},
+		changed:      make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+	}
+}
+
+//Start catches up with the other nodes' ring, in case it changed while this node was stopped, then keeps moving keys here in the background
+func (n *Node) Start() {
+	n.syncRing()
+	go n.run()
+}
+
+//Stop stops moving keys. Keys that haven't been moved yet stay where they are
+func (n *Node) Stop() {
+	n.cancel()
+	<-n.done
+}
+
+func (n *Node) Address() string {
+	return n.address
+}
+
+func (n *Node) Ring() *KVStore.Ring {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.ring
+}
+
+//Owner returns the node the key belongs to, or an empty string if the ring has no nodes yet
+func (n *Node) Owner(key string) string {
+	return n.Ring().Owner(key)
+}
+
+//Authentic checks if the request came from another node, e.g. a request passed on to this node because it owns the key
+func (n *Node) Authentic(r *http.Request) bool {
+	return checkSecret(r, n.secret)
+}
+
+func (n *Node) state() RingState {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return RingState{Epoch: n.epoch, Nodes: n.ring.Nodes()}
+}
+
+func (n *Node) Status() Status {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return Status{
+		Address:   n.address,
+		Epoch:     n.epoch,
+		Nodes:     n.ring.Nodes(),
+		Migrating: len(n.pending) > 0,
+		Pending:   sortedNodes(n.pending),
+		Moved:     n.moved,
+		LastError: n.lastError,
+	}
+}
+
+//adopt switches to the ring if it is newer than this node's, returning whether it did
+func (n *Node) adopt(state RingState) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.adoptLocked(state)
+}
+
+//adoptLocked switches to the ring if it is newer, and starts moving the keys this node now owns from every node that might have them.
+//Must be called with the lock held
+func (n *Node) adoptLocked(state RingState) bool {
+	if state.Epoch <= n.epoch {
+		return false
+	}
+	previous := n.ring
+	n.epoch = state.Epoch
+	n.ring = KVStore.NewRing(n.virtualNodes, state.Nodes...)
+	n.history = append([]*KVStore.Ring{previous}, n.history...)
+	if n.ring.Contains(n.address) {
+		//the nodes on the new ring are asked too, in case this node is new and its last ring was empty
+		for _, node := range append(previous.Nodes(), n.ring.Nodes()...) {
+			if node != n.address {
+				n.pending[node] = true
+			}
+		}
+	} else { //this node doesn't own anything any more, so has nothing to move
+		n.pending = map[string]bool{}
+		n.history = nil
+	}
+	close(n.changed)
+	n.changed = make(chan struct{})
+	logging.InfoLogger.Printf("partition ring is now at epoch %d with nodes %v\n", n.epoch, n.ring.Nodes())
+	return true
+}
+
+//AddNode puts a node on the ring, and tells every node about it. The new node must already be running, with the same secret
+func (n *Node) AddNode(ctx context.Context, address string) error {
+	address = strings.TrimRight(address, "/")
+	return n.change(ctx, func(ring *KVStore.Ring) (*KVStore.Ring, error) {
+		if ring.Contains(address) {
+			return nil, ErrAlreadyNode
+		}
+		return ring.With(address), nil
+	})
+}
+
+//RemoveNode takes a node off the ring, and tells every node about it. The node should be left running until the others have moved its keys
+func (n *Node) RemoveNode(ctx context.Context, address string) error {
+	address = strings.TrimRight(address, "/")
+	return n.change(ctx, func(ring *KVStore.Ring) (*KVStore.Ring, error) {
+		if !ring.Contains(address) {
+			return nil, ErrNotNode
+		}
+		if len(ring.Nodes()) == 1 {
+			return nil, ErrLastNode
+		}
+		return ring.Without(address), nil
+	})
+}
+
+//change makes a new ring from this node's, and sends it to every node on either ring.
+//Changes are made one at a time, so the keys from the last one have to have been moved here first
+func (n *Node) change(ctx context.Context, makeRing func(*KVStore.Ring) (*KVStore.Ring, error)) error {
+	n.lock.Lock()
+	if len(n.pending) > 0 {
+		n.lock.Unlock()
+		return ErrMigrating
+	}
+	ring, err := makeRing(n.ring)
+	if err != nil {
+		n.lock.Unlock()
+		return err
+	}
+	state := RingState{Epoch: n.epoch + 1, Nodes: ring.Nodes()}
+	everyNode := append(n.ring.Nodes(), state.Nodes...)
+	n.adoptLocked(state)
+	n.lock.Unlock()
+
+	//the nodes losing keys have to start passing requests for them on, and the nodes gaining them have to start moving them
+	told := map[string]bool{n.address: true}
+	unreachable := []string{}
+	for _, node := range everyNode {
+		if told[node] {
+			continue
+		}
+		told[node] = true
+		if err := n.pushRing(ctx, node, state); err != nil {
+			logging.WarningLogger.Println("unable to send the partition ring to", node, err)
+			unreachable = append(unreachable, node)
+		}
+	}
+	if len(unreachable) > 0 {
+		return &UnreachableError{Nodes: unreachable}
+	}
+	return nil
+}
+
+//Claim makes sure a key this node owns has been moved here, before a request for it is handled.
+//It only has anything to do while keys are still being moved after a change to the ring
+func (n *Node) Claim(ctx context.Context, key string) error {
+	n.lock.RLock()
+	sources := []string{}
+	for _, ring := range n.history {
+		owners := []string{ring.Owner(key)}
+		if owners[0] == "" { //this node didn't know where the key was, so it could be on any of them
+			owners = sortedNodes(n.pending)
+		}
+		for _, owner := range owners {
+			if owner != n.address && n.pending[owner] && !contains(sources, owner) {
+				sources = append(sources, owner)
+			}
+		}
+	}
+	n.lock.RUnlock()
+	for _, from := range sources {
+		if _, err := n.moveFrom(ctx, from, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//run moves keys here from the pending nodes whenever the ring changes, and checks for changes this node missed
+func (n *Node) run() {
+	defer close(n.done)
+	ringSync := time.NewTicker(RingSyncInterval)
+	defer ringSync.Stop()
+	for {
+		n.lock.RLock()
+		changed := n.changed
+		epoch := n.epoch
+		pending := sortedNodes(n.pending)
+		n.lock.RUnlock()
+
+		var retry <-chan time.Time
+		for _, from := range pending {
+			if err := n.moveAll(from, epoch); err != nil {
+				if n.ctx.Err() != nil {
+					return
+				}
+				logging.WarningLogger.Println("unable to move keys from", from, err)
+				n.setError(err)
+				retry = time.After(RetryInterval)
+			}
+		}
+		if len(pending) > 0 && retry == nil {
+			continue //check nothing changed while the keys were being moved
+		}
+
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-changed:
+		case <-retry:
+		case <-ringSync.C:
+			n.syncRing()
+		}
+	}
+}
+
+//moveAll moves every key this node owns from the node, a batch at a time, then stops waiting on it if the ring hasn't changed since
+func (n *Node) moveAll(from string, epoch uint64) error {
+	for {
+		count, err := n.moveFrom(n.ctx, from, "")
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			break
+		}
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.epoch != epoch {
+		return nil
+	}
+	delete(n.pending, from)
+	if len(n.pending) == 0 {
+		n.history = nil
+		n.lastError = ""
+		logging.InfoLogger.Printf("finished moving keys for partition ring epoch %d\n", epoch)
+	}
+	return nil
+}
+
+//moveFrom moves a batch of the keys this node owns from the node, returning how many it sent. If key is set only that key is moved.
+//The other node keeps the keys until they have been imported here, so they aren't lost if either node fails part way through
+func (n *Node) moveFrom(ctx context.Context, from, key string) (int, error) {
+	n.move.Lock()
+	defer n.move.Unlock()
+	keys, err := n.export(ctx, from, exportRequest{Ring: n.state(), To: n.address, Key: key, Limit: BatchSize})
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	imported, err := n.store.Import(keys)
+	if err != nil {
+		return 0, err
+	}
+	for i := range keys {
+		keys[i].Entry = nil //only the names are needed to release them
+	}
+	if err := n.release(ctx, from, releaseRequest{Keys: keys}); err != nil {
+		return 0, err
+	}
+	n.lock.Lock()
+	n.moved += imported
+	n.lock.Unlock()
+	logging.DebugLogger.Printf("moved %d keys from %s\n", len(keys), from)
+	return len(keys), nil
+}
+
+//syncRing switches to the newest ring any of the other nodes has
+func (n *Node) syncRing() {
+	for _, node := range n.Ring().Nodes() {
+		if node == n.address {
+			continue
+		}
+		state, err := n.fetchRing(n.ctx, node)
+		if err != nil {
+			logging.DebugLogger.Println("unable to fetch the partition ring from", node, err)
+			continue
+		}
+		n.adopt(state)
+	}
+}
+
+func (n *Node) setError(err error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.lastError = err.Error()
+}
+
+func sortedNodes(nodes map[string]bool) []string {
+	sorted := []string{}
+	for node := range nodes {
+		sorted = append(sorted, node)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+//Package partition shares the KV store out between nodes with a consistent hash ring, so the data set can outgrow any one node.
+//Every node knows the ring, so any of them can tell which node owns a key and pass requests for it on.
+//When a node is added or removed the new ring is sent to every node, and each one moves the keys it now owns from the nodes
+//that had them in the background. Until it has, a request for a key that hasn't been moved yet moves that key first
+package partition
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"store/KVStore"
+	"strings"
+)
+
+const (
+	//PathPrefix is where a node serves the other nodes
+	PathPrefix  = "/partition/"
+	RingPath    = PathPrefix + "ring"
+	ExportPath  = PathPrefix + "export"
+	ReleasePath = PathPrefix + "release"
+	//SecretHeader carries the secret shared by the nodes. Requests passed on to the owner of a key carry it too
+	SecretHeader = "X-Partition-Secret"
+)
+
+var (
+	ErrMigrating   = errors.New("keys are still being moved after the last change to the ring")
+	ErrAlreadyNode = errors.New("the node is already on the ring")
+	ErrNotNode     = errors.New("the node is not on the ring")
+	ErrLastNode    = errors.New("the last node on the ring can't be removed")
+	ErrForbidden   = errors.New("the node rejected the partition secret")
+	ErrStaleRing   = errors.New("the other node has a newer ring, so this node has switched to it")
+)
+
+//UnreachableError is returned when the ring has changed, but some of the nodes couldn't be told.
+//They pick the new ring up from the others within RingSyncInterval
+type UnreachableError struct {
+	Nodes []string
+}
+
+func (e *UnreachableError) Error() string {
+	return "the ring has changed, but these nodes couldn't be told yet: " + strings.Join(e.Nodes, ", ")
+}
+
+//Store is the store being partitioned
+type Store interface {
+	Export(selected func(key string) bool, limit int) ([]KVStore.Mutation, error)
+	Import(keys []KVStore.Mutation) (int, error)
+	Release(keys []KVStore.Mutation) (int, error)
+}
+
+//LocalStore is the KV store in this process
+type LocalStore struct{}
+
+func (LocalStore) Export(selected func(key string) bool, limit int) ([]KVStore.Mutation, error) {
+	return KVStore.Export(selected, limit)
+}
+
+func (LocalStore) Import(keys []KVStore.Mutation) (int, error) {
+	return KVStore.Import(keys)
+}
+
+func (LocalStore) Release(keys []KVStore.Mutation) (int, error) {
+	return KVStore.Release(keys)
+}
+
+//RingState is a version of the ring, as sent between nodes. Epoch goes up by one with every change, so the newest ring wins
+type RingState struct {
+	Epoch uint64   `json:"epoch"`
+	Nodes []string `json:"nodes"`
+}
+
+//Status describes a node, e.g. for an admin endpoint
+type Status struct {
+	Address   string   `json:"address"`
+	Epoch     uint64   `json:"epoch"`
+	Nodes     []string `json:"nodes"`
+	Migrating bool     `json:"migrating"`
+	Pending   []string `json:"pending,omitempty"` //nodes that may still have keys this node now owns
+	Moved     int      `json:"moved"`             //keys moved to this node since it started
+	LastError string   `json:"lastError,omitempty"`
+}
+
+//exportRequest asks a node for the keys that belong to To on Ring. If Key is set, only that key is wanted
+type exportRequest struct {
+	Ring  RingState `json:"ring"`
+	To    string    `json:"to"`
+	Key   string    `json:"key,omitempty"`
+	Limit int       `json:"limit"`
+}
+
+//releaseRequest tells a node that keys it exported have been imported, so it can remove them
+type releaseRequest struct {
+	Keys []KVStore.Mutation `json:"keys"`
+}
+
+//checkSecret compares the secret in constant time, so it can't be guessed a character at a time
+func checkSecret(r *http.Request, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(SecretHeader)), []byte(secret)) == 1
+}
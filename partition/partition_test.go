@@ -0,0 +1,268 @@
+package partition_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"store/KVStore"
+	"store/logging"
+	"store/partition"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logging.SetupLoggers("../info.log", "../htaccess.log", false)
+	defer logging.Shutdown()
+	partition.BatchSize = 7 //so keys are moved in several batches
+	partition.RetryInterval = 10 * time.Millisecond
+	partition.RingSyncInterval = 50 * time.Millisecond
+	m.Run()
+}
+
+//memoryStore is a store for a single test node, so several nodes can run in one process
+type memoryStore struct {
+	lock sync.Mutex
+	keys map[string]string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{keys: map[string]string{}}
+}
+
+func (s *memoryStore) Export(selected func(key string) bool, limit int) ([]KVStore.Mutation, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := []KVStore.Mutation{}
+	for key, value := range s.keys {
+		if len(keys) < limit && selected(key) {
+			keys = append(keys, KVStore.Mutation{Key: key, Entry: &KVStore.Entry{Value: value}})
+		}
+	}
+	return keys, nil
+}
+
+func (s *memoryStore) Import(keys []KVStore.Mutation) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	imported := 0
+	for _, mutation := range keys {
+		if _, present := s.keys[mutation.Key]; !present {
+			s.keys[mutation.Key] = mutation.Entry.Value
+			imported++
+		}
+	}
+	return imported, nil
+}
+
+func (s *memoryStore) Release(keys []KVStore.Mutation) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, mutation := range keys {
+		delete(s.keys, mutation.Key)
+	}
+	return len(keys), nil
+}
+
+func (s *memoryStore) has(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, present := s.keys[key]
+	return present
+}
+
+func (s *memoryStore) size() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.keys)
+}
+
+//testNode is a node and its store, served over loopback
+type testNode struct {
+	*partition.Node
+	store  *memoryStore
+	server *httptest.Server
+}
+
+//newTestNodes starts servers for the nodes first, as each node needs every node's address
+func newTestNodes(t *testing.T, count int) []*testNode {
+	nodes := make([]*testNode, count)
+	for i := range nodes {
+		n := &testNode{store: newMemoryStore()}
+		n.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { n.ServeHTTP(w, r) }))
+		t.Cleanup(n.server.Close)
+		nodes[i] = n
+	}
+	return nodes
+}
+
+//create puts the node on a ring of the addresses. Every node is created before any is started, as starting asks the others for their ring
+func (n *testNode) create(addresses []string) {
+	n.Node = partition.NewNode(n.server.URL, addresses, "secret", 64, n.store)
+}
+
+func (n *testNode) start(t *testing.T) {
+	n.Start()
+	t.Cleanup(n.Stop)
+}
+
+//fill puts every key on the node that owns it
+func fill(nodes []*testNode, keys int) {
+	for i := 0; i < keys; i++ {
+		key := "key" + strconv.Itoa(i)
+		for _, n := range nodes {
+			if n.Owner(key) == n.Address() {
+				n.store.keys[key] = "value" + strconv.Itoa(i)
+			}
+		}
+	}
+}
+
+//checkPlacement checks every key is on its owner, and nowhere else
+func checkPlacement(t *testing.T, nodes []*testNode, keys int) {
+	t.Helper()
+	for i := 0; i < keys; i++ {
+		key := "key" + strconv.Itoa(i)
+		for _, n := range nodes {
+			if owns := n.Owner(key) == n.Address(); owns != n.store.has(key) {
+				t.Fatalf("expected %s to be on %s only if it owns it (owns is %v)", key, n.Address(), owns)
+			}
+		}
+	}
+}
+
+func addresses(nodes []*testNode) []string {
+	out := []string{}
+	for _, n := range nodes {
+		out = append(out, n.server.URL)
+	}
+	return out
+}
+
+//waitFor waits for the condition to become true, failing the test if it takes too long
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", description)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func settled(nodes []*testNode) func() bool {
+	return func() bool {
+		for _, n := range nodes {
+			if n.Status().Migrating {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func TestAddAndRemoveNodes(t *testing.T) {
+	nodes := newTestNodes(t, 4)
+	for _, n := range nodes[:3] {
+		n.create(addresses(nodes[:3]))
+	}
+	nodes[3].create(nil) //joins once it has been added
+	for _, n := range nodes {
+		n.start(t)
+	}
+	fill(nodes[:3], 200)
+
+	if err := nodes[0].AddNode(context.Background(), nodes[3].server.URL+"/"); err != nil {
+		t.Fatal("unable to add a node", err)
+	}
+	waitFor(t, "the keys to move to the new node", settled(nodes))
+	if err := nodes[1].AddNode(context.Background(), nodes[3].server.URL); err != partition.ErrAlreadyNode {
+		t.Errorf("expected adding the node again to fail with %v, got %v", partition.ErrAlreadyNode, err)
+	}
+	checkPlacement(t, nodes, 200)
+	if status := nodes[3].Status(); status.Epoch != 1 || len(status.Nodes) != 4 || status.Moved == 0 || status.Moved != nodes[3].store.size() {
+		t.Errorf("expected the new node to have moved its keys to itself, got %+v", status)
+	}
+
+	//removing a node moves its keys to the others, from whichever node is asked
+	if err := nodes[3].RemoveNode(context.Background(), nodes[1].server.URL); err != nil {
+		t.Fatal("unable to remove a node", err)
+	}
+	waitFor(t, "the keys to move off the removed node", settled(nodes))
+	if nodes[1].store.size() != 0 {
+		t.Errorf("expected the removed node to have no keys left, has %d", nodes[1].store.size())
+	}
+	checkPlacement(t, append(nodes[:1:1], nodes[2:]...), 200)
+	if err := nodes[0].RemoveNode(context.Background(), nodes[1].server.URL); err != partition.ErrNotNode {
+		t.Errorf("expected removing the node again to fail with %v, got %v", partition.ErrNotNode, err)
+	}
+}
+
+func TestClaim(t *testing.T) {
+	nodes := newTestNodes(t, 2)
+	nodes[0].create(addresses(nodes[:1]))
+	nodes[1].create(nil) //never started, so never moves keys in the background
+	nodes[0].start(t)
+	fill(nodes[:1], 100)
+
+	if err := nodes[0].AddNode(context.Background(), nodes[1].server.URL); err != nil {
+		t.Fatal("unable to add a node", err)
+	}
+	status := nodes[1].Status()
+	if !status.Migrating || len(status.Pending) != 1 {
+		t.Fatalf("expected the new node to be waiting on keys from the first, got %+v", status)
+	}
+	if err := nodes[1].AddNode(context.Background(), "http://another:8080"); err != partition.ErrMigrating {
+		t.Errorf("expected changing the ring while keys are moving to fail with %v, got %v", partition.ErrMigrating, err)
+	}
+	var key string
+	for i := 0; key == ""; i++ {
+		if candidate := "key" + strconv.Itoa(i); nodes[1].Owner(candidate) == nodes[1].Address() {
+			key = candidate
+		}
+	}
+	if err := nodes[1].Claim(context.Background(), key); err != nil {
+		t.Fatal("unable to claim a key", err)
+	}
+	if !nodes[1].store.has(key) || nodes[0].store.has(key) || nodes[1].store.size() != 1 {
+		t.Errorf("expected only %s to have moved, the new node has %d keys", key, nodes[1].store.size())
+	}
+	if err := nodes[0].Claim(context.Background(), key); err != nil || !nodes[1].store.has(key) {
+		t.Errorf("expected claiming on a node with nothing to move to leave the key alone. Error is %v", err)
+	}
+}
+
+func TestRingSync(t *testing.T) {
+	nodes := newTestNodes(t, 3)
+	for _, n := range nodes[:2] {
+		n.create(addresses(nodes[:2]))
+	}
+	for _, n := range nodes[:2] {
+		n.start(t)
+	}
+	//the third node is down while it is added, so only hears about it from the others
+	nodes[2].server.Close()
+	err := nodes[0].AddNode(context.Background(), "http://"+nodes[2].server.Listener.Addr().String())
+	if unreachable, ok := err.(*partition.UnreachableError); !ok || len(unreachable.Nodes) != 1 {
+		t.Fatalf("expected the added node to be unreachable, got %v", err)
+	}
+	waitFor(t, "the ring to reach the other node", func() bool { return nodes[1].Status().Epoch == 1 })
+
+	restarted := partition.NewNode("http://restarted:8080", addresses(nodes[:2]), "secret", 64, newMemoryStore())
+	restarted.Start()
+	defer restarted.Stop()
+	if status := restarted.Status(); status.Epoch != 1 || len(status.Nodes) != 3 {
+		t.Errorf("expected a node starting with an old ring to switch to the newest one, got %+v", status)
+	}
+
+	wrongSecret := partition.NewNode("http://intruder:8080", addresses(nodes[:2]), "guess", 64, newMemoryStore())
+	if err := wrongSecret.AddNode(context.Background(), "http://intruder:8080"); err == nil {
+		t.Error("expected nodes to ignore a ring sent with the wrong secret")
+	}
+	if status := nodes[1].Status(); status.Epoch != 1 {
+		t.Errorf("expected the ring sent with the wrong secret to be rejected, got %+v", status)
+	}
+}
@@ -0,0 +1,165 @@
+package partition
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"store/KVStore"
+	"store/logging"
+	"strings"
+)
+
+//ServeHTTP serves the other nodes: their rings, and the keys they are moving from this node. Requests without the secret are rejected
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !n.Authentic(r) {
+		logging.Warning(r.Context()).Println("partition request with the wrong secret from", r.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.URL.Path == RingPath && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, n.state())
+	case r.URL.Path == RingPath && r.Method == http.MethodPut:
+		var state RingState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			http.Error(w, "unable to read the ring: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		n.adopt(state)
+		writeJSON(w, http.StatusOK, n.state())
+	case r.URL.Path == ExportPath && r.Method == http.MethodPost:
+		n.serveExport(w, r)
+	case r.URL.Path == ReleasePath && r.Method == http.MethodPost:
+		var request releaseRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "unable to read the keys: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ring := n.Ring()
+		moved := []KVStore.Mutation{}
+		for _, key := range request.Keys {
+			if ring.Owner(key.Key) != n.address { //in case the ring has changed back since, and the key belongs here again
+				moved = append(moved, key)
+			}
+		}
+		released, err := n.store.Release(moved)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		logging.Debug(r.Context()).Printf("released %d keys that have moved to another node\n", released)
+		writeJSON(w, http.StatusOK, struct{}{})
+	default:
+		http.Error(w, "invalid http method", http.StatusMethodNotAllowed)
+	}
+}
+
+//serveExport sends the keys another node now owns. If that node's ring is older than this one, it is sent this node's ring to switch to instead
+func (n *Node) serveExport(w http.ResponseWriter, r *http.Request) {
+	var request exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "unable to read the request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	n.adopt(request.Ring)
+	state := n.state()
+	if state.Epoch > request.Ring.Epoch {
+		writeJSON(w, http.StatusConflict, state)
+		return
+	}
+	limit := request.Limit
+	if limit <= 0 || limit > BatchSize {
+		limit = BatchSize
+	}
+	ring := n.Ring()
+	keys, err := n.store.Export(func(key string) bool {
+		return (request.Key == "" || key == request.Key) && ring.Owner(key) == request.To
+	}, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logging.ErrorLogger.Println("unable to write a partition response", err)
+	}
+}
+
+func (n *Node) fetchRing(ctx context.Context, node string) (RingState, error) {
+	var state RingState
+	err := n.call(ctx, http.MethodGet, node+RingPath, nil, &state)
+	return state, err
+}
+
+func (n *Node) pushRing(ctx context.Context, node string, state RingState) error {
+	var reply RingState
+	return n.call(ctx, http.MethodPut, node+RingPath, state, &reply)
+}
+
+func (n *Node) export(ctx context.Context, node string, request exportRequest) ([]KVStore.Mutation, error) {
+	var keys []KVStore.Mutation
+	err := n.call(ctx, http.MethodPost, node+ExportPath, request, &keys)
+	if conflict, ok := err.(*conflictError); ok { //the other node's ring is newer, so switch to it and try again
+		var state RingState
+		if json.Unmarshal(conflict.body, &state) == nil && n.adopt(state) {
+			return nil, ErrStaleRing
+		}
+	}
+	return keys, err
+}
+
+func (n *Node) release(ctx context.Context, node string, request releaseRequest) error {
+	var reply struct{}
+	return n.call(ctx, http.MethodPost, node+ReleasePath, request, &reply)
+}
+
+//conflictError is returned when a node replies 409 Conflict, along with the body, which has the node's ring
+type conflictError struct {
+	body []byte
+}
+
+func (e *conflictError) Error() string {
+	return "the node replied with a conflict: " + strings.TrimSpace(string(e.body))
+}
+
+func (n *Node) call(ctx context.Context, method, url string, args, reply interface{}) error {
+	var body io.Reader
+	if args != nil {
+		encoded, err := json.Marshal(args)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(SecretHeader, n.secret)
+	response, err := n.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(response.Body).Decode(reply)
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusConflict:
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1<<20))
+		return &conflictError{body: message}
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+	return fmt.Errorf("%s responded with %s: %s", url, response.Status, strings.TrimSpace(string(message)))
+}
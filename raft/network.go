@@ -0,0 +1,114 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrUnreachable = errors.New("the node can't be reached")
+
+//Network connects nodes running in the same process, e.g. for tests. It can be partitioned to see how a cluster copes
+//with nodes that can't reach each other, and heal again
+type Network struct {
+	lock        sync.Mutex
+	nodes       map[string]*Node
+	partitioned bool
+	groups      map[string]int //while partitioned, nodes can only reach nodes in the same group
+}
+
+func NewNetwork() *Network {
+	return &Network{nodes: map[string]*Node{}}
+}
+
+//Transport returns the transport a node uses to send RPCs over the network
+func (net *Network) Transport(from string) Transport {
+	return networkTransport{net: net, from: from}
+}
+
+//Add connects the node to the network, replacing any node with the same ID, e.g. when one is restarted
+func (net *Network) Add(node *Node) {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+	net.nodes[node.ID()] = node
+}
+
+//Partition splits the network so nodes can only reach the nodes in their own group. Nodes that aren't in any group can't reach anyone
+func (net *Network) Partition(groups ...[]string) {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+	net.partitioned = true
+	net.groups = map[string]int{}
+	for i, group := range groups {
+		for _, id := range group {
+			net.groups[id] = i
+		}
+	}
+}
+
+//Heal undoes any partition
+func (net *Network) Heal() {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+	net.partitioned = false
+}
+
+//reach returns the node if from can reach it
+func (net *Network) reach(from, to string) (*Node, error) {
+	net.lock.Lock()
+	defer net.lock.Unlock()
+	node, present := net.nodes[to]
+	if !present || node.isStopped() {
+		return nil, ErrUnreachable
+	}
+	if net.partitioned {
+		fromGroup, fromIn := net.groups[from]
+		toGroup, toIn := net.groups[to]
+		if !fromIn || !toIn || fromGroup != toGroup {
+			return nil, ErrUnreachable
+		}
+	}
+	return node, nil
+}
+
+//networkTransport delivers RPCs straight to the Handle methods. The reply is lost if the network is partitioned while the RPC is handled
+type networkTransport struct {
+	net  *Network
+	from string
+}
+
+func (t networkTransport) RequestVote(ctx context.Context, to string, args RequestVoteArgs) (RequestVoteReply, error) {
+	node, err := t.net.reach(t.from, to)
+	if err != nil {
+		return RequestVoteReply{}, err
+	}
+	reply := node.HandleRequestVote(args)
+	return reply, t.replied(ctx, to)
+}
+
+func (t networkTransport) AppendEntries(ctx context.Context, to string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	node, err := t.net.reach(t.from, to)
+	if err != nil {
+		return AppendEntriesReply{}, err
+	}
+	reply := node.HandleAppendEntries(args)
+	return reply, t.replied(ctx, to)
+}
+
+func (t networkTransport) InstallSnapshot(ctx context.Context, to string, args InstallSnapshotArgs) (InstallSnapshotReply, error) {
+	node, err := t.net.reach(t.from, to)
+	if err != nil {
+		return InstallSnapshotReply{}, err
+	}
+	reply := node.HandleInstallSnapshot(args)
+	return reply, t.replied(ctx, to)
+}
+
+//replied checks the reply can get back to the sender
+func (t networkTransport) replied(ctx context.Context, to string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := t.net.reach(to, t.from)
+	return err
+}
@@ -0,0 +1,994 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"store/logging"
+	"sync"
+	"time"
+)
+
+//maxBatch is the most entries sent to a follower in one AppendEntries
+const maxBatch = 256
+
+//Node is one member of a raft cluster
+type Node struct {
+	id                string
+	transport         Transport
+	machine           StateMachine
+	storage           Storage
+	electionTimeout   time.Duration
+	heartbeatInterval time.Duration
+	snapshotThreshold uint64
+	random            *rand.Rand //only used with the lock held
+
+	lock             sync.Mutex
+	changed          chan struct{} //closed and replaced whenever anything changes, to wake up whatever is waiting on it
+	role             Role
+	term             uint64
+	votedFor         string
+	leader           string
+	lastContact      time.Time //when this node last heard from the leader
+	electionDeadline time.Time
+	log              []Entry  //log[0] stands in for the last entry covered by the snapshot
+	snapshot         Snapshot //the latest snapshot, kept to send to followers that need it
+	members          []string //from the latest membership entry in the log. Changes take effect as soon as they are appended
+	membersIndex     uint64   //the index of that entry
+	commitIndex      uint64
+	lastApplied      uint64
+	pendingSnapshot  *Snapshot            //installed from the leader, waiting to be restored by the applier
+	proposals        map[uint64]*proposal //commands proposed by this node that are waiting to be applied
+
+	//only used by the leader
+	nextIndex      map[string]uint64
+	matchIndex     map[string]uint64
+	replicators    map[string]chan struct{} //wakes up the goroutine copying the log to each follower
+	heartbeatRound uint64                   //counts rounds of heartbeats, so reads can check the leader is still in charge
+	acked          map[string]uint64        //the latest round each follower has responded to
+	noOpIndex      uint64                   //the leader's first entry, which has to be committed before it knows what has been committed before
+
+	ctx     context.Context //cancelled when the node stops, to abandon the RPCs in flight
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	wg      sync.WaitGroup
+}
+
+//proposal is a command waiting to be applied
+type proposal struct {
+	term   uint64
+	done   bool
+	result interface{}
+	err    error
+}
+
+//NewNode creates a node, restoring whatever its storage has from a previous run. Start starts it taking part in the cluster
+func NewNode(config Config) (*Node, error) {
+	if config.ElectionTimeout == 0 {
+		config.ElectionTimeout = DefaultElectionTimeout
+	}
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if config.SnapshotThreshold == 0 {
+		config.SnapshotThreshold = DefaultSnapshotThreshold
+	}
+	if config.Storage == nil {
+		config.Storage = NewMemoryStorage()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Node{
+		id:                config.ID,
+		transport:         config.Transport,
+		machine:           config.StateMachine,
+		storage:           config.Storage,
+		electionTimeout:   config.ElectionTimeout,
+		heartbeatInterval: config.HeartbeatInterval,
+		snapshotThreshold: uint64(config.SnapshotThreshold),
+		random:            rand.New(rand.NewSource(time.Now().UnixNano())),
+		changed:           make(chan struct{}),
+		proposals:         map[uint64]*proposal{},
+		ctx:               ctx,
+		cancel:            cancel,
+		stopped:           make(chan struct{}),
+	}
+
+	state, err := n.storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	n.term = state.Term
+	n.votedFor = state.VotedFor
+	n.snapshot = state.Snapshot
+	n.log = append([]Entry{{Index: state.Snapshot.Index, Term: state.Snapshot.Term}}, state.Entries...)
+	if state.Snapshot.Index > 0 {
+		if err := n.machine.Restore(state.Snapshot.Data); err != nil {
+			return nil, err
+		}
+		n.commitIndex = state.Snapshot.Index
+		n.lastApplied = state.Snapshot.Index
+	}
+	if n.lastIndex() == 0 && len(config.Members) > 0 { //a brand new cluster, so every member starts with the same first entry
+		first, err := membersEntry(1, 0, config.Members)
+		if err != nil {
+			return nil, err
+		}
+		n.log = append(n.log, first)
+		if err := n.storage.Append([]Entry{first}); err != nil {
+			return nil, err
+		}
+	}
+	n.refreshMembers()
+	return n, nil
+}
+
+func membersEntry(index, term uint64, members []string) (Entry, error) {
+	sorted := append([]string{}, members...)
+	sort.Strings(sorted)
+	data, err := json.Marshal(sorted)
+	return Entry{Index: index, Term: term, Type: EntryMembers, Data: data}, err
+}
+
+//Start starts the node's election timer and the goroutine that applies committed entries
+func (n *Node) Start() {
+	n.lock.Lock()
+	n.resetElectionTimer()
+	n.lock.Unlock()
+	n.wg.Add(2)
+	go n.tick()
+	go n.applyCommitted()
+}
+
+//Stop stops the node taking part in the cluster. Anything waiting on it returns ErrStopped
+func (n *Node) Stop() {
+	n.lock.Lock()
+	select {
+	case <-n.stopped:
+		n.lock.Unlock()
+		return
+	default:
+	}
+	close(n.stopped)
+	n.cancel()
+	n.role = Follower
+	n.leader = ""
+	n.signal()
+	n.lock.Unlock()
+	n.wg.Wait()
+}
+
+func (n *Node) isStopped() bool {
+	select {
+	case <-n.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+//ID returns the node's ID
+func (n *Node) ID() string {
+	return n.id
+}
+
+//Leader returns the ID of the leader, or an empty string if this node doesn't know of one
+func (n *Node) Leader() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.leader
+}
+
+//IsLeader checks if this node is the leader
+func (n *Node) IsLeader() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.role == Leader
+}
+
+func (n *Node) Status() Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return Status{
+		ID:            n.id,
+		Role:          n.role.String(),
+		Term:          n.term,
+		Leader:        n.leader,
+		Members:       append([]string{}, n.members...),
+		LastIndex:     n.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		AppliedIndex:  n.lastApplied,
+		SnapshotIndex: n.snapshot.Index,
+	}
+}
+
+//Propose adds a command to the log and waits for it to be applied, returning the state machine's result.
+//Only the leader can propose commands, others return ErrNotLeader
+func (n *Node) Propose(ctx context.Context, command []byte) (interface{}, error) {
+	n.lock.Lock()
+	if n.role != Leader {
+		n.lock.Unlock()
+		return nil, ErrNotLeader
+	}
+	p := n.propose(EntryCommand, command)
+	n.lock.Unlock()
+	return n.wait(ctx, p)
+}
+
+//propose appends an entry and starts copying it to the followers. Must be called by the leader with the lock held
+func (n *Node) propose(entryType EntryType, data []byte) *proposal {
+	entry := n.appendEntry(Entry{Index: n.lastIndex() + 1, Term: n.term, Type: entryType, Data: data})
+	p := &proposal{term: n.term}
+	n.proposals[entry.Index] = p
+	n.triggerReplication()
+	n.advanceCommit()
+	return p
+}
+
+//wait waits for a proposal to be applied
+func (n *Node) wait(ctx context.Context, p *proposal) (interface{}, error) {
+	err := n.waitFor(ctx, func() (bool, error) { return p.done, nil })
+	if err != nil {
+		return nil, err
+	}
+	return p.result, p.err
+}
+
+//ReadIndex waits until it is safe to read the state machine on this node and see every command committed before it was called.
+//The leader checks it is still the leader with a round of heartbeats, rather than adding anything to the log.
+//Only the leader can serve reads, others return ErrNotLeader
+func (n *Node) ReadIndex(ctx context.Context) error {
+	term, err := n.waitForLeaderCommit(ctx)
+	if err != nil {
+		return err
+	}
+	n.lock.Lock()
+	readIndex := n.commitIndex
+	n.heartbeatRound++
+	round := n.heartbeatRound
+	n.triggerReplication()
+	n.lock.Unlock()
+
+	err = n.waitFor(ctx, func() (bool, error) {
+		if n.role != Leader || n.term != term {
+			return false, ErrNotLeader
+		}
+		acked := 0
+		for _, member := range n.members {
+			if member == n.id || n.acked[member] >= round {
+				acked++
+			}
+		}
+		return acked >= n.quorum(), nil
+	})
+	if err != nil {
+		return err
+	}
+	return n.waitFor(ctx, func() (bool, error) { return n.lastApplied >= readIndex, nil })
+}
+
+//waitForLeaderCommit waits for the leader's first entry to be committed, after which it knows everything committed by earlier leaders.
+//It returns the leader's term
+func (n *Node) waitForLeaderCommit(ctx context.Context) (uint64, error) {
+	n.lock.Lock()
+	if n.role != Leader {
+		n.lock.Unlock()
+		return 0, ErrNotLeader
+	}
+	term := n.term
+	n.lock.Unlock()
+	err := n.waitFor(ctx, func() (bool, error) {
+		if n.role != Leader || n.term != term {
+			return false, ErrNotLeader
+		}
+		return n.commitIndex >= n.noOpIndex, nil
+	})
+	return term, err
+}
+
+//AddMember adds a node to the cluster and waits for the change to be applied. The new node should already be running,
+//having been started without any members, and is sent everything it needs by the leader
+func (n *Node) AddMember(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, func(members []string) ([]string, error) {
+		for _, member := range members {
+			if member == id {
+				return nil, ErrAlreadyMember
+			}
+		}
+		return append(members, id), nil
+	})
+}
+
+//RemoveMember removes a node from the cluster and waits for the change to be applied. The leader can remove itself,
+//in which case it steps down once the change is committed
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, func(members []string) ([]string, error) {
+		kept := []string{}
+		for _, member := range members {
+			if member != id {
+				kept = append(kept, member)
+			}
+		}
+		if len(kept) == len(members) {
+			return nil, ErrNotMember
+		}
+		if len(kept) == 0 {
+			return nil, ErrLastMember
+		}
+		return kept, nil
+	})
+}
+
+//changeMembers changes the members by a single node, which keeps the old and new majorities overlapping.
+//Only one change can be in progress at a time
+func (n *Node) changeMembers(ctx context.Context, change func(members []string) ([]string, error)) error {
+	term, err := n.waitForLeaderCommit(ctx)
+	if err != nil {
+		return err
+	}
+	n.lock.Lock()
+	if n.role != Leader || n.term != term {
+		n.lock.Unlock()
+		return ErrNotLeader
+	}
+	if n.membersIndex > n.commitIndex {
+		n.lock.Unlock()
+		return ErrChangeInProgress
+	}
+	members, err := change(append([]string{}, n.members...))
+	if err != nil {
+		n.lock.Unlock()
+		return err
+	}
+	entry, err := membersEntry(0, 0, members)
+	if err != nil {
+		n.lock.Unlock()
+		return err
+	}
+	p := n.propose(EntryMembers, entry.Data)
+	n.lock.Unlock()
+	_, err = n.wait(ctx, p)
+	return err
+}
+
+//waitFor waits until the condition, which is checked with the lock held, is true or returns an error
+func (n *Node) waitFor(ctx context.Context, condition func() (bool, error)) error {
+	for {
+		n.lock.Lock()
+		if n.isStopped() {
+			n.lock.Unlock()
+			return ErrStopped
+		}
+		done, err := condition()
+		changed := n.changed
+		n.lock.Unlock()
+		if done || err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-n.stopped:
+			return ErrStopped
+		}
+	}
+}
+
+//signal wakes up everything waiting for a change. Must be called with the lock held
+func (n *Node) signal() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+//termAt returns the term of the entry at index, which must be in the log or be the last entry in the snapshot
+func (n *Node) termAt(index uint64) uint64 {
+	return n.log[index-n.log[0].Index].Term
+}
+
+//entriesBetween copies the entries from first to last inclusive, which must be in the log
+func (n *Node) entriesBetween(first, last uint64) []Entry {
+	if first > last {
+		return nil
+	}
+	base := n.log[0].Index
+	return append([]Entry{}, n.log[first-base:last-base+1]...)
+}
+
+//appendEntry adds an entry to the end of the log and stores it
+func (n *Node) appendEntry(entry Entry) Entry {
+	n.log = append(n.log, entry)
+	if err := n.storage.Append([]Entry{entry}); err != nil {
+		logging.ErrorLogger.Println("unable to store a raft log entry", err)
+	}
+	if entry.Type == EntryMembers {
+		n.refreshMembers()
+	}
+	return entry
+}
+
+//refreshMembers finds the latest membership entry, in the log or else the snapshot
+func (n *Node) refreshMembers() {
+	for i := len(n.log) - 1; i > 0; i-- {
+		if n.log[i].Type == EntryMembers {
+			var members []string
+			if err := json.Unmarshal(n.log[i].Data, &members); err != nil {
+				logging.ErrorLogger.Println("unable to read the members from the raft log", err)
+				continue
+			}
+			n.members = members
+			n.membersIndex = n.log[i].Index
+			n.startReplicators()
+			return
+		}
+	}
+	n.members = append([]string{}, n.snapshot.Members...)
+	n.membersIndex = n.snapshot.Index
+}
+
+//membersAt returns the members as of the entry at index
+func (n *Node) membersAt(index uint64) []string {
+	for i := int(index - n.log[0].Index); i > 0; i-- {
+		if n.log[i].Type == EntryMembers {
+			var members []string
+			if err := json.Unmarshal(n.log[i].Data, &members); err == nil {
+				return members
+			}
+		}
+	}
+	return append([]string{}, n.snapshot.Members...)
+}
+
+func (n *Node) isMember(id string) bool {
+	for _, member := range n.members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+//quorum is how many members make a majority
+func (n *Node) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+func (n *Node) persistState() {
+	if err := n.storage.SetState(n.term, n.votedFor); err != nil {
+		logging.ErrorLogger.Println("unable to store the raft term and vote", err)
+	}
+}
+
+func (n *Node) resetElectionTimer() {
+	n.electionDeadline = time.Now().Add(n.electionTimeout + time.Duration(n.random.Int63n(int64(n.electionTimeout))))
+}
+
+//tick starts an election whenever the leader hasn't been heard from for too long
+func (n *Node) tick() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.electionTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopped:
+			return
+		case <-ticker.C:
+		}
+		n.lock.Lock()
+		if n.role != Leader && time.Now().After(n.electionDeadline) && n.isMember(n.id) {
+			n.startElection()
+		}
+		n.lock.Unlock()
+	}
+}
+
+//startElection stands for election in the next term. Must be called with the lock held
+func (n *Node) startElection() {
+	n.role = Candidate
+	n.term++
+	n.votedFor = n.id
+	n.leader = ""
+	n.persistState()
+	n.resetElectionTimer()
+	n.signal()
+	logging.InfoLogger.Printf("raft node %s standing for election in term %d\n", n.id, n.term)
+
+	args := RequestVoteArgs{Term: n.term, Candidate: n.id, LastLogIndex: n.lastIndex(), LastLogTerm: n.lastTerm()}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, member := range n.members {
+		if member == n.id {
+			continue
+		}
+		go func(member string) {
+			ctx, cancel := context.WithTimeout(n.ctx, n.electionTimeout)
+			defer cancel()
+			reply, err := n.transport.RequestVote(ctx, member, args)
+			if err != nil {
+				return
+			}
+			n.lock.Lock()
+			defer n.lock.Unlock()
+			if reply.Term > n.term {
+				n.becomeFollower(reply.Term)
+				return
+			}
+			if n.role != Candidate || n.term != args.Term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(member)
+	}
+}
+
+//becomeFollower moves on to a later term, or stops being a candidate or leader. Must be called with the lock held
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+		n.persistState()
+	}
+	if n.role != Follower {
+		logging.InfoLogger.Printf("raft node %s is now a follower in term %d\n", n.id, n.term)
+	}
+	n.role = Follower
+	n.replicators = nil //the replicators notice they've been replaced and stop
+	n.signal()
+}
+
+//becomeLeader takes over as leader after winning an election. Must be called with the lock held
+func (n *Node) becomeLeader() {
+	logging.InfoLogger.Printf("raft node %s elected leader in term %d\n", n.id, n.term)
+	n.role = Leader
+	n.leader = n.id
+	n.nextIndex = map[string]uint64{}
+	n.matchIndex = map[string]uint64{}
+	n.acked = map[string]uint64{}
+	n.replicators = map[string]chan struct{}{}
+	n.noOpIndex = n.appendEntry(Entry{Index: n.lastIndex() + 1, Term: n.term, Type: EntryNoOp}).Index
+	n.startReplicators()
+	n.triggerReplication()
+	n.advanceCommit()
+	n.signal()
+}
+
+//startReplicators starts copying the log to any members that the leader isn't already copying it to
+func (n *Node) startReplicators() {
+	if n.role != Leader {
+		return
+	}
+	for _, member := range n.members {
+		if _, running := n.replicators[member]; running || member == n.id {
+			continue
+		}
+		trigger := make(chan struct{}, 1)
+		n.replicators[member] = trigger
+		n.nextIndex[member] = n.lastIndex() + 1
+		n.matchIndex[member] = 0
+		n.wg.Add(1)
+		go n.replicate(member, n.term, trigger)
+	}
+}
+
+//triggerReplication wakes up every replicator, to send new entries or a heartbeat straight away
+func (n *Node) triggerReplication() {
+	for _, trigger := range n.replicators {
+		select {
+		case trigger <- struct{}{}:
+		default: //already due to send
+		}
+	}
+}
+
+//replicate copies the log to a follower for as long as this node is leading the term and the follower is a member
+func (n *Node) replicate(peer string, term uint64, trigger chan struct{}) {
+	defer n.wg.Done()
+	heartbeat := time.NewTicker(n.heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		more, current := n.sendTo(peer, term, trigger)
+		if !current {
+			return
+		}
+		if more {
+			continue
+		}
+		select {
+		case <-n.stopped:
+			return
+		case <-trigger:
+		case <-heartbeat.C:
+		}
+	}
+}
+
+//stillReplicating checks if the replicator should carry on. Must be called with the lock held
+func (n *Node) stillReplicating(peer string, term uint64, trigger chan struct{}) bool {
+	if n.role != Leader || n.term != term || n.replicators[peer] != trigger {
+		return false
+	}
+	if !n.isMember(peer) {
+		delete(n.replicators, peer)
+		return false
+	}
+	return true
+}
+
+//sendTo sends the follower the entries it is missing, or a heartbeat if it isn't missing any, or a snapshot if they have been compacted.
+//more is true if there is more to send straight away, and current is false once the replicator should stop
+func (n *Node) sendTo(peer string, term uint64, trigger chan struct{}) (more bool, current bool) {
+	n.lock.Lock()
+	if !n.stillReplicating(peer, term, trigger) {
+		n.lock.Unlock()
+		return false, false
+	}
+	round := n.heartbeatRound
+	next := n.nextIndex[peer]
+	ctx, cancel := context.WithTimeout(n.ctx, n.electionTimeout)
+	defer cancel()
+
+	if next <= n.snapshot.Index {
+		args := InstallSnapshotArgs{Term: term, Leader: n.id, Snapshot: n.snapshot}
+		n.lock.Unlock()
+		reply, err := n.transport.InstallSnapshot(ctx, peer, args)
+		if err != nil {
+			return false, true //tried again on the next heartbeat
+		}
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		if reply.Term > n.term {
+			n.becomeFollower(reply.Term)
+			return false, false
+		}
+		if !n.stillReplicating(peer, term, trigger) {
+			return false, false
+		}
+		n.acknowledge(peer, round)
+		n.matched(peer, args.Snapshot.Index)
+		return n.nextIndex[peer] <= n.lastIndex(), true
+	}
+
+	last := n.lastIndex()
+	if last-next+1 > maxBatch {
+		last = next + maxBatch - 1
+	}
+	args := AppendEntriesArgs{
+		Term:         term,
+		Leader:       n.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.termAt(next - 1),
+		Entries:      n.entriesBetween(next, last),
+		LeaderCommit: n.commitIndex,
+	}
+	n.lock.Unlock()
+	reply, err := n.transport.AppendEntries(ctx, peer, args)
+	if err != nil {
+		return false, true
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if reply.Term > n.term {
+		n.becomeFollower(reply.Term)
+		return false, false
+	}
+	if !n.stillReplicating(peer, term, trigger) {
+		return false, false
+	}
+	n.acknowledge(peer, round)
+	if reply.Success {
+		n.matched(peer, args.PrevLogIndex+uint64(len(args.Entries)))
+	} else {
+		next := reply.ConflictIndex
+		if next <= n.matchIndex[peer] {
+			next = n.matchIndex[peer] + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[peer] = next
+	}
+	return n.nextIndex[peer] <= n.lastIndex(), true
+}
+
+//acknowledge records that the follower responded to a round of heartbeats, which tells waiting reads that this node is still the leader
+func (n *Node) acknowledge(peer string, round uint64) {
+	if round > n.acked[peer] {
+		n.acked[peer] = round
+		n.signal()
+	}
+}
+
+//matched records that the follower's log matches the leader's up to index
+func (n *Node) matched(peer string, index uint64) {
+	if index > n.matchIndex[peer] {
+		n.matchIndex[peer] = index
+	}
+	if index+1 > n.nextIndex[peer] {
+		n.nextIndex[peer] = index + 1
+	}
+	n.advanceCommit()
+}
+
+//advanceCommit commits the latest entry from this term that a majority of the members have. Must be called by the leader with the lock held
+func (n *Node) advanceCommit() {
+	if n.role != Leader {
+		return
+	}
+	for index := n.lastIndex(); index > n.commitIndex && n.termAt(index) == n.term; index-- {
+		count := 0
+		for _, member := range n.members {
+			if member == n.id || n.matchIndex[member] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.signal()
+			break
+		}
+	}
+	if !n.isMember(n.id) && n.commitIndex >= n.membersIndex { //this node has been removed, so leaves the rest to elect a new leader
+		logging.InfoLogger.Printf("raft node %s has been removed from the cluster, stepping down\n", n.id)
+		n.leader = ""
+		n.becomeFollower(n.term)
+	}
+}
+
+//heardFromLeader notes that the leader of the term is in contact. Must be called with the lock held, with a term that isn't out of date
+func (n *Node) heardFromLeader(term uint64, leader string) {
+	if term > n.term || n.role != Follower {
+		n.becomeFollower(term)
+	}
+	if n.leader != leader {
+		n.leader = leader
+		n.signal()
+	}
+	n.lastContact = time.Now()
+	n.resetElectionTimer()
+}
+
+//HandleRequestVote handles a candidate's request for this node's vote. Transports deliver RPCs from other nodes to the Handle methods
+func (n *Node) HandleRequestVote(args RequestVoteArgs) RequestVoteReply {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	//a node that has heard from a leader recently ignores candidates, so a node that has been removed,
+	//or that was cut off and has been standing for election on its own, can't force the cluster into a new election
+	if n.role == Leader || (n.leader != "" && time.Since(n.lastContact) < n.electionTimeout) {
+		return RequestVoteReply{Term: n.term}
+	}
+	if args.Term < n.term {
+		return RequestVoteReply{Term: n.term}
+	}
+	if args.Term > n.term {
+		n.becomeFollower(args.Term)
+	}
+	upToDate := args.LastLogTerm > n.lastTerm() || (args.LastLogTerm == n.lastTerm() && args.LastLogIndex >= n.lastIndex())
+	if (n.votedFor != "" && n.votedFor != args.Candidate) || !upToDate {
+		return RequestVoteReply{Term: n.term}
+	}
+	n.votedFor = args.Candidate
+	n.persistState()
+	n.resetElectionTimer()
+	return RequestVoteReply{Term: n.term, VoteGranted: true}
+}
+
+//HandleAppendEntries adds the leader's entries to this node's log, replacing any that conflict with them
+func (n *Node) HandleAppendEntries(args AppendEntriesArgs) AppendEntriesReply {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if args.Term < n.term {
+		return AppendEntriesReply{Term: n.term}
+	}
+	n.heardFromLeader(args.Term, args.Leader)
+
+	prev, prevTerm, entries := args.PrevLogIndex, args.PrevLogTerm, args.Entries
+	if prev < n.snapshot.Index { //the start has been compacted here, and compacted entries are always committed so must match
+		skip := n.snapshot.Index - prev
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		entries = entries[skip:]
+		prev, prevTerm = n.snapshot.Index, n.snapshot.Term
+	}
+	if prev > n.lastIndex() {
+		return AppendEntriesReply{Term: n.term, ConflictIndex: n.lastIndex() + 1}
+	}
+	if conflictTerm := n.termAt(prev); conflictTerm != prevTerm { //skip back over the whole term, rather than one entry at a time
+		index := prev
+		for index-1 > n.snapshot.Index && n.termAt(index-1) == conflictTerm {
+			index--
+		}
+		return AppendEntriesReply{Term: n.term, ConflictIndex: index}
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= n.lastIndex() {
+			if n.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			n.log = n.log[:entry.Index-n.log[0].Index]
+			if err := n.storage.TruncateFrom(entry.Index); err != nil {
+				logging.ErrorLogger.Println("unable to truncate the raft log", err)
+			}
+		}
+		n.log = append(n.log, entries[i:]...)
+		if err := n.storage.Append(entries[i:]); err != nil {
+			logging.ErrorLogger.Println("unable to store raft log entries", err)
+		}
+		n.refreshMembers()
+		break
+	}
+
+	if lastNew := prev + uint64(len(entries)); args.LeaderCommit > n.commitIndex && lastNew > n.commitIndex {
+		n.commitIndex = args.LeaderCommit
+		if lastNew < n.commitIndex {
+			n.commitIndex = lastNew
+		}
+		n.signal()
+	}
+	return AppendEntriesReply{Term: n.term, Success: true}
+}
+
+//HandleInstallSnapshot replaces this node's log with the leader's snapshot, keeping any entries after it that match
+func (n *Node) HandleInstallSnapshot(args InstallSnapshotArgs) InstallSnapshotReply {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if args.Term < n.term {
+		return InstallSnapshotReply{Term: n.term}
+	}
+	n.heardFromLeader(args.Term, args.Leader)
+	snapshot := args.Snapshot
+	if snapshot.Index <= n.commitIndex { //already has everything in it
+		return InstallSnapshotReply{Term: n.term}
+	}
+
+	dummy := Entry{Index: snapshot.Index, Term: snapshot.Term}
+	if snapshot.Index <= n.lastIndex() && n.termAt(snapshot.Index) == snapshot.Term {
+		n.log = append([]Entry{dummy}, n.log[snapshot.Index-n.log[0].Index+1:]...)
+	} else {
+		n.log = []Entry{dummy}
+		if err := n.storage.TruncateFrom(snapshot.Index + 1); err != nil {
+			logging.ErrorLogger.Println("unable to truncate the raft log", err)
+		}
+	}
+	if err := n.storage.SaveSnapshot(snapshot); err != nil {
+		logging.ErrorLogger.Println("unable to store a raft snapshot", err)
+	}
+	n.snapshot = snapshot
+	n.commitIndex = snapshot.Index
+	n.pendingSnapshot = &snapshot
+	n.refreshMembers()
+	n.signal()
+	logging.InfoLogger.Printf("raft node %s installed a snapshot from %s as of entry %d\n", n.id, args.Leader, snapshot.Index)
+	return InstallSnapshotReply{Term: n.term}
+}
+
+//applyCommitted applies committed entries to the state machine in order, and restores snapshots installed by the leader
+func (n *Node) applyCommitted() {
+	defer n.wg.Done()
+	for {
+		n.lock.Lock()
+		for n.pendingSnapshot == nil && n.lastApplied >= n.commitIndex {
+			changed := n.changed
+			n.lock.Unlock()
+			select {
+			case <-changed:
+			case <-n.stopped:
+				return
+			}
+			n.lock.Lock()
+		}
+
+		if snapshot := n.pendingSnapshot; snapshot != nil {
+			n.pendingSnapshot = nil
+			n.lock.Unlock()
+			err := n.machine.Restore(snapshot.Data)
+			n.lock.Lock()
+			if err != nil {
+				logging.ErrorLogger.Println("unable to restore a raft snapshot", err)
+			}
+			n.lastApplied = snapshot.Index
+			for index, p := range n.proposals { //whether these were committed is lost in the snapshot
+				if index <= snapshot.Index {
+					p.done, p.err = true, ErrLeadershipLost
+					delete(n.proposals, index)
+				}
+			}
+			n.signal()
+			n.lock.Unlock()
+			continue
+		}
+
+		entries := n.entriesBetween(n.lastApplied+1, n.commitIndex)
+		n.lock.Unlock()
+		for _, entry := range entries {
+			var result interface{}
+			if entry.Type == EntryCommand {
+				result = n.machine.Apply(entry.Data)
+			}
+			n.lock.Lock()
+			n.lastApplied = entry.Index
+			if p, waiting := n.proposals[entry.Index]; waiting {
+				p.done = true
+				if p.term == entry.Term {
+					p.result = result
+				} else { //another leader's entry replaced it
+					p.err = ErrLeadershipLost
+				}
+				delete(n.proposals, entry.Index)
+			}
+			n.signal()
+			n.lock.Unlock()
+		}
+		n.compact()
+	}
+}
+
+//compact replaces the applied entries with a snapshot once there are enough of them
+func (n *Node) compact() {
+	n.lock.Lock()
+	due := n.pendingSnapshot == nil && n.lastApplied >= n.snapshot.Index+n.snapshotThreshold
+	n.lock.Unlock()
+	if !due {
+		return
+	}
+	if err := n.snapshotApplied(); err != nil {
+		logging.ErrorLogger.Println("unable to compact the raft log into a snapshot", err)
+	}
+}
+
+//Snapshot replaces every applied entry with a snapshot, so they don't have to be replayed when the node restarts.
+//The node must have been stopped, otherwise entries could be applied while the state machine is being copied
+func (n *Node) Snapshot() error {
+	if !n.isStopped() {
+		return ErrNotStopped
+	}
+	return n.snapshotApplied()
+}
+
+//snapshotApplied replaces the applied entries with a snapshot of the state machine. Nothing else may apply entries while it runs
+func (n *Node) snapshotApplied() error {
+	n.lock.Lock()
+	if n.pendingSnapshot != nil || n.lastApplied <= n.snapshot.Index {
+		n.lock.Unlock()
+		return nil
+	}
+	index := n.lastApplied
+	snapshot := Snapshot{Index: index, Term: n.termAt(index), Members: n.membersAt(index)}
+	n.lock.Unlock()
+
+	//entries aren't being applied, so the state machine is still as of index
+	data, err := n.machine.Snapshot()
+	if err != nil {
+		return err
+	}
+	snapshot.Data = data
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if index <= n.snapshot.Index { //the leader sent a later snapshot in the meantime
+		return nil
+	}
+	if err := n.storage.SaveSnapshot(snapshot); err != nil {
+		return err
+	}
+	n.log = append([]Entry{{Index: index, Term: snapshot.Term}}, n.log[index-n.log[0].Index+1:]...)
+	n.snapshot = snapshot
+	logging.InfoLogger.Printf("raft node %s compacted its log into a snapshot as of entry %d\n", n.id, index)
+	return nil
+}
@@ -0,0 +1,159 @@
+//Package raft keeps a log of commands consistent across a cluster of nodes with the Raft consensus algorithm (https://raft.github.io/raft.pdf),
+//and applies the commands to a state machine on every node in the same order. A command is only applied once a majority of the nodes have it,
+//so the cluster carries on without losing anything as long as a majority of its nodes are up and can reach each other.
+//Members are added and removed one at a time, and the log is compacted into snapshots of the state machine as it grows
+package raft
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotLeader        = errors.New("this node is not the raft leader")
+	ErrLeadershipLost   = errors.New("leadership changed before the command was applied here, so it may or may not have been committed")
+	ErrStopped          = errors.New("the raft node has stopped")
+	ErrNotStopped       = errors.New("the raft node has to be stopped first")
+	ErrChangeInProgress = errors.New("another membership change is still being committed")
+	ErrAlreadyMember    = errors.New("the node is already a member of the cluster")
+	ErrNotMember        = errors.New("the node is not a member of the cluster")
+	ErrLastMember       = errors.New("the last member of the cluster can't be removed")
+)
+
+//Role is what a node is currently doing in the cluster
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "follower"
+}
+
+//EntryType says what an entry in the log is for
+type EntryType int
+
+const (
+	EntryCommand EntryType = iota //a command for the state machine
+	EntryNoOp                     //added by each new leader, so it can commit the entries from earlier terms
+	EntryMembers                  //the new members of the cluster, as a JSON list of node IDs
+)
+
+//Entry is a single entry in the log
+type Entry struct {
+	Index uint64    `json:"index"`
+	Term  uint64    `json:"term"`
+	Type  EntryType `json:"type"`
+	Data  []byte    `json:"data,omitempty"`
+}
+
+//Snapshot is the state machine as of a log entry, along with the members of the cluster at that point
+type Snapshot struct {
+	Index   uint64   `json:"index"`
+	Term    uint64   `json:"term"`
+	Members []string `json:"members"`
+	Data    []byte   `json:"data,omitempty"`
+}
+
+//StateMachine is what the log is applied to. Its methods are only ever called from one goroutine at a time
+type StateMachine interface {
+	//Apply applies a committed command. The result is returned by Propose on the node that proposed it
+	Apply(command []byte) interface{}
+	//Snapshot returns the whole state, as of the last command applied
+	Snapshot() ([]byte, error)
+	//Restore replaces the whole state with a snapshot
+	Restore(snapshot []byte) error
+}
+
+//RequestVoteArgs is sent by candidates to ask for votes
+type RequestVoteArgs struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+type RequestVoteReply struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"voteGranted"`
+}
+
+//AppendEntriesArgs is sent by the leader to copy its log to a follower. With no entries it is a heartbeat
+type AppendEntriesArgs struct {
+	Term         uint64  `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevLogIndex uint64  `json:"prevLogIndex"`
+	PrevLogTerm  uint64  `json:"prevLogTerm"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leaderCommit"`
+}
+
+type AppendEntriesReply struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	//ConflictIndex is where the leader should try next when the follower's log doesn't match, so it can skip a whole term at a time
+	ConflictIndex uint64 `json:"conflictIndex,omitempty"`
+}
+
+//InstallSnapshotArgs is sent by the leader to a follower that needs entries the leader has already compacted
+type InstallSnapshotArgs struct {
+	Term     uint64   `json:"term"`
+	Leader   string   `json:"leader"`
+	Snapshot Snapshot `json:"snapshot"`
+}
+
+type InstallSnapshotReply struct {
+	Term uint64 `json:"term"`
+}
+
+//Transport sends RPCs to other nodes, which are identified by their IDs
+type Transport interface {
+	RequestVote(ctx context.Context, to string, args RequestVoteArgs) (RequestVoteReply, error)
+	AppendEntries(ctx context.Context, to string, args AppendEntriesArgs) (AppendEntriesReply, error)
+	InstallSnapshot(ctx context.Context, to string, args InstallSnapshotArgs) (InstallSnapshotReply, error)
+}
+
+//Config configures a node. Zero durations and thresholds are replaced by the defaults
+type Config struct {
+	ID string //how the other nodes reach this one through the transport, e.g. its URL
+	//Members are the nodes in a new cluster, including this one. They are only used the first time the node starts,
+	//and can be left empty for a node that is going to be added to an existing cluster
+	Members      []string
+	Transport    Transport
+	StateMachine StateMachine
+	Storage      Storage //nil keeps everything in memory
+
+	//ElectionTimeout is how long a follower waits to hear from a leader before standing for election. It is randomised between it and twice it
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration //how often the leader sends heartbeats
+	SnapshotThreshold int           //entries applied before the log is compacted into a snapshot
+}
+
+const (
+	DefaultElectionTimeout   = time.Second
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+	DefaultSnapshotThreshold = 1000
+)
+
+//Status describes a node, e.g. for an admin endpoint
+type Status struct {
+	ID            string   `json:"id"`
+	Role          string   `json:"role"`
+	Term          uint64   `json:"term"`
+	Leader        string   `json:"leader"` //empty if there isn't one that this node knows about
+	Members       []string `json:"members"`
+	LastIndex     uint64   `json:"lastIndex"`
+	CommitIndex   uint64   `json:"commitIndex"`
+	AppliedIndex  uint64   `json:"appliedIndex"`
+	SnapshotIndex uint64   `json:"snapshotIndex"`
+}
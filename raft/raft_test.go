@@ -0,0 +1,471 @@
+package raft_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"store/logging"
+	"store/raft"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logging.SetupLoggers("../info.log", "../htaccess.log", false)
+	defer logging.Shutdown()
+	m.Run()
+}
+
+const (
+	electionTimeout   = 50 * time.Millisecond
+	heartbeatInterval = 10 * time.Millisecond
+)
+
+//machine is a state machine of keys and values. Commands are "key=value"
+type machine struct {
+	lock     sync.Mutex
+	keys     map[string]string
+	applied  []string //every command applied since the last restore
+	restores int
+}
+
+func newMachine() *machine {
+	return &machine{keys: map[string]string{}}
+}
+
+func (m *machine) Apply(command []byte) interface{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	parts := strings.SplitN(string(command), "=", 2)
+	old := m.keys[parts[0]]
+	m.keys[parts[0]] = parts[1]
+	m.applied = append(m.applied, string(command))
+	return old
+}
+
+func (m *machine) Snapshot() ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return json.Marshal(m.keys)
+}
+
+func (m *machine) Restore(snapshot []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.keys = map[string]string{}
+	m.applied = nil
+	m.restores++
+	return json.Unmarshal(snapshot, &m.keys)
+}
+
+func (m *machine) get(key string) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.keys[key]
+}
+
+func (m *machine) restored() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.restores
+}
+
+//cluster is a set of nodes on an in-process network
+type cluster struct {
+	t         *testing.T
+	network   *raft.Network
+	nodes     map[string]*raft.Node
+	machines  map[string]*machine
+	storages  map[string]raft.Storage
+	threshold int
+}
+
+func newCluster(t *testing.T, size int, threshold int) *cluster {
+	c := &cluster{
+		t:         t,
+		network:   raft.NewNetwork(),
+		nodes:     map[string]*raft.Node{},
+		machines:  map[string]*machine{},
+		storages:  map[string]raft.Storage{},
+		threshold: threshold,
+	}
+	members := []string{}
+	for i := 1; i <= size; i++ {
+		members = append(members, fmt.Sprintf("node%d", i))
+	}
+	for _, id := range members {
+		c.start(id, members, raft.NewMemoryStorage())
+	}
+	t.Cleanup(c.stopAll)
+	return c
+}
+
+//start starts a node with a new state machine, as if its process had just started
+func (c *cluster) start(id string, members []string, storage raft.Storage) {
+	m := newMachine()
+	node, err := raft.NewNode(raft.Config{
+		ID:                id,
+		Members:           members,
+		Transport:         c.network.Transport(id),
+		StateMachine:      m,
+		Storage:           storage,
+		ElectionTimeout:   electionTimeout,
+		HeartbeatInterval: heartbeatInterval,
+		SnapshotThreshold: c.threshold,
+	})
+	if err != nil {
+		c.t.Fatal("unable to create node", id, err)
+	}
+	c.nodes[id] = node
+	c.machines[id] = m
+	c.storages[id] = storage
+	c.network.Add(node)
+	node.Start()
+}
+
+func (c *cluster) stopAll() {
+	for _, node := range c.nodes {
+		node.Stop()
+	}
+}
+
+//leader waits for exactly one of the nodes to be leader, and for the others to know about it
+func (c *cluster) leader(among ...string) *raft.Node {
+	c.t.Helper()
+	if len(among) == 0 {
+		for id := range c.nodes {
+			among = append(among, id)
+		}
+	}
+	var leader *raft.Node
+	waitFor(c.t, "a leader to be elected", func() bool {
+		leader = nil
+		for _, id := range among {
+			if c.nodes[id].IsLeader() {
+				if leader != nil {
+					return false
+				}
+				leader = c.nodes[id]
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, id := range among {
+			if c.nodes[id].Leader() != leader.ID() {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+//propose sets a key through the leader
+func (c *cluster) propose(leader *raft.Node, key, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := leader.Propose(ctx, []byte(key+"="+value))
+	return err
+}
+
+//waitForValue waits for every one of the nodes to have the value
+func (c *cluster) waitForValue(key, value string, ids ...string) {
+	c.t.Helper()
+	for _, id := range ids {
+		waitFor(c.t, fmt.Sprintf("%s to have %s=%s", id, key, value), func() bool { return c.machines[id].get(key) == value })
+	}
+}
+
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", description)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestElection(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	leader := c.leader()
+	term := leader.Status().Term
+	time.Sleep(10 * electionTimeout)
+	if now := c.leader(); now != leader || now.Status().Term != term {
+		t.Errorf("expected the leader to stay in charge while it is healthy, %s in term %d became %s in term %d", leader.ID(), term, now.ID(), now.Status().Term)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	leader := c.leader()
+	for i := 0; i < 10; i++ {
+		if err := c.propose(leader, "k", fmt.Sprint(i)); err != nil {
+			t.Fatal("unable to propose", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	result, err := leader.Propose(ctx, []byte("k=last"))
+	if err != nil || result != "9" {
+		t.Errorf("expected Propose to return the state machine's result, got %v. Error is %v", result, err)
+	}
+	c.waitForValue("k", "last", "node1", "node2", "node3")
+	for id, m := range c.machines {
+		m.lock.Lock()
+		if len(m.applied) != 11 || m.applied[0] != "k=0" {
+			t.Errorf("expected %s to apply every command once in order, got %v", id, m.applied)
+		}
+		m.lock.Unlock()
+	}
+
+	for _, node := range c.nodes {
+		if node == leader {
+			continue
+		}
+		if _, err := node.Propose(ctx, []byte("k=follower")); err != raft.ErrNotLeader {
+			t.Errorf("expected a follower to refuse proposals, got %v", err)
+		}
+		if err := node.ReadIndex(ctx); err != raft.ErrNotLeader {
+			t.Errorf("expected a follower to refuse reads, got %v", err)
+		}
+	}
+}
+
+func TestLeaderFailure(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	leader := c.leader()
+	if err := c.propose(leader, "a", "1"); err != nil {
+		t.Fatal("unable to propose", err)
+	}
+	leader.Stop()
+
+	others := []string{}
+	for id := range c.nodes {
+		if id != leader.ID() {
+			others = append(others, id)
+		}
+	}
+	newLeader := c.leader(others...)
+	if err := c.propose(newLeader, "b", "2"); err != nil {
+		t.Fatal("unable to propose to the new leader", err)
+	}
+	c.waitForValue("a", "1", others...)
+	c.waitForValue("b", "2", others...)
+
+	//the old leader comes back with what it had stored, and catches up
+	c.start(leader.ID(), nil, c.storages[leader.ID()])
+	c.waitForValue("b", "2", leader.ID())
+	if c.machines[leader.ID()].get("a") != "1" {
+		t.Error("expected the restarted node to replay its log")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	c := newCluster(t, 5, 0)
+	oldLeader := c.leader()
+	if err := c.propose(oldLeader, "a", "1"); err != nil {
+		t.Fatal("unable to propose", err)
+	}
+
+	//cut the leader off with one follower, leaving the other three to carry on
+	minority := []string{oldLeader.ID()}
+	majority := []string{}
+	for id := range c.nodes {
+		if id == oldLeader.ID() {
+			continue
+		}
+		if len(minority) < 2 {
+			minority = append(minority, id)
+		} else {
+			majority = append(majority, id)
+		}
+	}
+	c.network.Partition(minority, majority)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*electionTimeout)
+	defer cancel()
+	if _, err := oldLeader.Propose(ctx, []byte("a=lost")); err != context.DeadlineExceeded {
+		t.Errorf("expected a leader without a majority to be unable to commit, got %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*electionTimeout)
+	defer cancel()
+	if err := oldLeader.ReadIndex(ctx); err == nil {
+		t.Error("expected a leader without a majority to be unable to serve linearizable reads")
+	}
+
+	newLeader := c.leader(majority...)
+	if err := c.propose(newLeader, "a", "2"); err != nil {
+		t.Fatal("unable to propose to the majority", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := newLeader.ReadIndex(ctx); err != nil || c.machines[newLeader.ID()].get("a") != "2" {
+		t.Errorf("expected a read on the new leader to see the latest write, got %q. Error is %v", c.machines[newLeader.ID()].get("a"), err)
+	}
+
+	//once healed the old leader steps down, and its uncommitted write is replaced
+	c.network.Heal()
+	if leader := c.leader(); leader != newLeader {
+		t.Errorf("expected %s to stay leader after the partition healed, got %s", newLeader.ID(), leader.ID())
+	}
+	c.waitForValue("a", "2", minority...)
+	for _, id := range minority {
+		m := c.machines[id]
+		m.lock.Lock()
+		for _, command := range m.applied {
+			if command == "a=lost" {
+				t.Errorf("expected %s to never apply the write that wasn't committed", id)
+			}
+		}
+		m.lock.Unlock()
+	}
+}
+
+func TestMembershipChanges(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	leader := c.leader()
+	if err := c.propose(leader, "a", "1"); err != nil {
+		t.Fatal("unable to propose", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	//a new node starts without any members and waits to be added
+	c.start("node4", nil, raft.NewMemoryStorage())
+	if err := leader.AddMember(ctx, "node4"); err != nil {
+		t.Fatal("unable to add a member", err)
+	}
+	if err := leader.AddMember(ctx, "node4"); err != raft.ErrAlreadyMember {
+		t.Errorf("expected adding a member twice to fail with %v, got %v", raft.ErrAlreadyMember, err)
+	}
+	c.waitForValue("a", "1", "node4")
+	if members := c.nodes["node4"].Status().Members; len(members) != 4 {
+		t.Errorf("expected the new node to know all 4 members, got %v", members)
+	}
+
+	//the leader removes itself, and the rest elect a new one
+	if err := leader.RemoveMember(ctx, leader.ID()); err != nil {
+		t.Fatal("unable to remove the leader", err)
+	}
+	remaining := []string{}
+	for id := range c.nodes {
+		if id != leader.ID() {
+			remaining = append(remaining, id)
+		}
+	}
+	newLeader := c.leader(remaining...)
+	if leader.IsLeader() {
+		t.Error("expected the removed leader to have stepped down")
+	}
+	if err := c.propose(newLeader, "b", "2"); err != nil {
+		t.Fatal("unable to propose after removing the leader", err)
+	}
+	c.waitForValue("b", "2", remaining...)
+	if members := newLeader.Status().Members; len(members) != 3 {
+		t.Errorf("expected 3 members to be left, got %v", members)
+	}
+	time.Sleep(10 * electionTimeout)
+	if now := c.leader(remaining...); now != newLeader {
+		t.Errorf("expected the removed node not to disrupt the cluster, but the leader changed to %s", now.ID())
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	c := newCluster(t, 3, 5)
+	leader := c.leader()
+	var behind string
+	for id := range c.nodes {
+		if id != leader.ID() {
+			behind = id
+			break
+		}
+	}
+	others := []string{}
+	for id := range c.nodes {
+		if id != behind {
+			others = append(others, id)
+		}
+	}
+	c.network.Partition(others)
+	for i := 0; i < 20; i++ {
+		if err := c.propose(leader, fmt.Sprint("k", i), fmt.Sprint(i)); err != nil {
+			t.Fatal("unable to propose", err)
+		}
+	}
+	waitFor(t, "the leader to compact its log", func() bool { return leader.Status().SnapshotIndex > 5 })
+
+	c.network.Heal()
+	c.waitForValue("k19", "19", behind)
+	if c.machines[behind].restored() == 0 {
+		t.Error("expected the node that fell behind to be sent a snapshot")
+	}
+	for i := 0; i < 20; i++ {
+		if value := c.machines[behind].get(fmt.Sprint("k", i)); value != fmt.Sprint(i) {
+			t.Errorf("expected k%d to be %d after the snapshot, got %q", i, i, value)
+		}
+	}
+}
+
+func TestSnapshotOnStop(t *testing.T) {
+	c := newCluster(t, 1, 100)
+	leader := c.leader()
+	for i := 0; i < 5; i++ {
+		if err := c.propose(leader, fmt.Sprint("k", i), fmt.Sprint(i)); err != nil {
+			t.Fatal("unable to propose", err)
+		}
+	}
+	if err := leader.Snapshot(); err != raft.ErrNotStopped {
+		t.Error("expected a running node to refuse to snapshot", err)
+	}
+	leader.Stop()
+	if err := leader.Snapshot(); err != nil {
+		t.Fatal("unable to snapshot a stopped node", err)
+	}
+	if status := leader.Status(); status.SnapshotIndex < 5 {
+		t.Errorf("expected the snapshot to cover every applied entry, got %+v", status)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	open := func() *raft.FileStorage {
+		storage, err := raft.NewFileStorage(dir)
+		if err != nil {
+			t.Fatal("unable to open the storage", err)
+		}
+		return storage
+	}
+
+	storage := open()
+	storage.SetState(3, "node2")
+	storage.Append([]raft.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 2}, {Index: 4, Term: 2}})
+	storage.TruncateFrom(4)
+	storage.SaveSnapshot(raft.Snapshot{Index: 2, Term: 1, Members: []string{"node1"}, Data: []byte("state")})
+	storage.Append([]raft.Entry{{Index: 4, Term: 3, Data: []byte("x=1")}})
+	storage.Close()
+
+	state, err := open().Load()
+	if err != nil {
+		t.Fatal("unable to load", err)
+	}
+	if state.Term != 3 || state.VotedFor != "node2" {
+		t.Errorf("expected term 3 and a vote for node2, got %d and %q", state.Term, state.VotedFor)
+	}
+	if state.Snapshot.Index != 2 || string(state.Snapshot.Data) != "state" {
+		t.Errorf("expected the snapshot to be as of entry 2, got %+v", state.Snapshot)
+	}
+	if len(state.Entries) != 2 || state.Entries[0].Index != 3 || state.Entries[1].Term != 3 || string(state.Entries[1].Data) != "x=1" {
+		t.Errorf("expected entries 3 and 4 after the snapshot, got %+v", state.Entries)
+	}
+}
@@ -0,0 +1,274 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"store/logging"
+	"sync"
+)
+
+//Storage keeps a node's term, vote, log and latest snapshot, so it can restart without forgetting them.
+//Each method must only return once the change is safely stored
+type Storage interface {
+	//Load returns everything that has been saved
+	Load() (State, error)
+	SetState(term uint64, votedFor string) error
+	//Append adds entries to the end of the log
+	Append(entries []Entry) error
+	//TruncateFrom removes the entry at index and every entry after it
+	TruncateFrom(index uint64) error
+	//SaveSnapshot saves the snapshot and discards the entries it covers
+	SaveSnapshot(snapshot Snapshot) error
+}
+
+//State is everything a node stores. The entries carry on from the snapshot
+type State struct {
+	Term     uint64   `json:"term"`
+	VotedFor string   `json:"votedFor"`
+	Snapshot Snapshot `json:"-"`
+	Entries  []Entry  `json:"-"`
+}
+
+//MemoryStorage keeps everything in memory, so it is lost when the process stops. It survives a node being stopped and started again,
+//which is enough for tests
+type MemoryStorage struct {
+	lock  sync.Mutex
+	state State
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (m *MemoryStorage) Load() (State, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	state := m.state
+	state.Entries = append([]Entry{}, m.state.Entries...)
+	return state, nil
+}
+
+func (m *MemoryStorage) SetState(term uint64, votedFor string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.state.Term = term
+	m.state.VotedFor = votedFor
+	return nil
+}
+
+func (m *MemoryStorage) Append(entries []Entry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.state.Entries = append(m.state.Entries, entries...)
+	return nil
+}
+
+func (m *MemoryStorage) TruncateFrom(index uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.truncateFrom(index)
+	return nil
+}
+
+func (m *MemoryStorage) truncateFrom(index uint64) {
+	for i, entry := range m.state.Entries {
+		if entry.Index >= index {
+			m.state.Entries = m.state.Entries[:i]
+			return
+		}
+	}
+}
+
+func (m *MemoryStorage) SaveSnapshot(snapshot Snapshot) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.saveSnapshot(snapshot)
+	return nil
+}
+
+func (m *MemoryStorage) saveSnapshot(snapshot Snapshot) {
+	m.state.Snapshot = snapshot
+	kept := []Entry{}
+	for _, entry := range m.state.Entries {
+		if entry.Index > snapshot.Index {
+			kept = append(kept, entry)
+		}
+	}
+	m.state.Entries = kept
+}
+
+const (
+	stateFile    = "state.json"
+	snapshotFile = "snapshot.json"
+	logFile      = "log.json" //one entry per line
+)
+
+//FileStorage keeps everything in files in a directory. The log is appended to as entries are added,
+//and only rewritten when it is truncated or compacted
+type FileStorage struct {
+	dir    string
+	memory MemoryStorage //a copy of what is in the files, so the log can be rewritten
+	log    *os.File
+}
+
+//NewFileStorage opens the storage in dir, creating it if needed
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f := &FileStorage{dir: dir}
+	if err := f.read(); err != nil {
+		return nil, err
+	}
+	var err error
+	f.log, err = os.OpenFile(filepath.Join(dir, logFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+//read loads the files into memory. A half written entry at the end of the log, from a crash part way through an append, is dropped
+func (f *FileStorage) read() error {
+	if contents, err := ioutil.ReadFile(filepath.Join(f.dir, stateFile)); err == nil {
+		if err := json.Unmarshal(contents, &f.memory.state); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if contents, err := ioutil.ReadFile(filepath.Join(f.dir, snapshotFile)); err == nil {
+		if err := json.Unmarshal(contents, &f.memory.state.Snapshot); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := os.Open(filepath.Join(f.dir, logFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		var entry Entry
+		if err := decoder.Decode(&entry); err != nil {
+			logging.WarningLogger.Println("dropping the end of the raft log, which is corrupt", err)
+			return f.rewriteLog()
+		}
+		if entry.Index > f.memory.state.Snapshot.Index {
+			f.memory.state.Entries = append(f.memory.state.Entries, entry)
+		}
+	}
+	return nil
+}
+
+func (f *FileStorage) Load() (State, error) {
+	return f.memory.Load()
+}
+
+func (f *FileStorage) SetState(term uint64, votedFor string) error {
+	f.memory.lock.Lock()
+	defer f.memory.lock.Unlock()
+	f.memory.state.Term = term
+	f.memory.state.VotedFor = votedFor
+	return f.writeJSON(stateFile, f.memory.state)
+}
+
+func (f *FileStorage) Append(entries []Entry) error {
+	f.memory.lock.Lock()
+	defer f.memory.lock.Unlock()
+	f.memory.state.Entries = append(f.memory.state.Entries, entries...)
+	writer := bufio.NewWriter(f.log)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return f.log.Sync()
+}
+
+func (f *FileStorage) TruncateFrom(index uint64) error {
+	f.memory.lock.Lock()
+	defer f.memory.lock.Unlock()
+	f.memory.truncateFrom(index)
+	return f.rewriteLog()
+}
+
+func (f *FileStorage) SaveSnapshot(snapshot Snapshot) error {
+	f.memory.lock.Lock()
+	defer f.memory.lock.Unlock()
+	if err := f.writeJSON(snapshotFile, snapshot); err != nil {
+		return err
+	}
+	f.memory.saveSnapshot(snapshot)
+	return f.rewriteLog()
+}
+
+//Close closes the log file
+func (f *FileStorage) Close() error {
+	f.memory.lock.Lock()
+	defer f.memory.lock.Unlock()
+	return f.log.Close()
+}
+
+//rewriteLog replaces the log file with the entries in memory
+func (f *FileStorage) rewriteLog() error {
+	var contents []byte
+	for _, entry := range f.memory.state.Entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		contents = append(append(contents, line...), '\n')
+	}
+	if err := writeFileSynced(filepath.Join(f.dir, logFile), contents); err != nil {
+		return err
+	}
+	if f.log == nil { //still loading
+		return nil
+	}
+	f.log.Close()
+	var err error
+	f.log, err = os.OpenFile(filepath.Join(f.dir, logFile), os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
+
+func (f *FileStorage) writeJSON(name string, value interface{}) error {
+	contents, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return writeFileSynced(filepath.Join(f.dir, name), contents)
+}
+
+//writeFileSynced replaces the file in one go, so a crash leaves either the old contents or the new ones
+func writeFileSynced(path string, contents []byte) error {
+	temp := path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(contents); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
@@ -0,0 +1,123 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	//PathPrefix is where Handler serves the RPCs
+	PathPrefix   = "/raft/"
+	VotePath     = PathPrefix + "vote"
+	AppendPath   = PathPrefix + "append"
+	SnapshotPath = PathPrefix + "snapshot"
+	//SecretHeader carries the secret shared by the nodes in a cluster
+	SecretHeader = "X-Cluster-Secret"
+)
+
+//HTTPTransport sends RPCs as JSON over HTTP, to nodes whose IDs are their base URLs, e.g. http://node1:8080
+type HTTPTransport struct {
+	Secret string
+	Client *http.Client
+}
+
+func NewHTTPTransport(secret string) *HTTPTransport {
+	return &HTTPTransport{Secret: secret, Client: &http.Client{}}
+}
+
+func (t *HTTPTransport) RequestVote(ctx context.Context, to string, args RequestVoteArgs) (RequestVoteReply, error) {
+	var reply RequestVoteReply
+	err := t.call(ctx, to+VotePath, args, &reply)
+	return reply, err
+}
+
+func (t *HTTPTransport) AppendEntries(ctx context.Context, to string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	var reply AppendEntriesReply
+	err := t.call(ctx, to+AppendPath, args, &reply)
+	return reply, err
+}
+
+func (t *HTTPTransport) InstallSnapshot(ctx context.Context, to string, args InstallSnapshotArgs) (InstallSnapshotReply, error) {
+	var reply InstallSnapshotReply
+	err := t.call(ctx, to+SnapshotPath, args, &reply)
+	return reply, err
+}
+
+func (t *HTTPTransport) call(ctx context.Context, url string, args, reply interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(SecretHeader, t.Secret)
+	response, err := t.Client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%s responded with %s: %s", url, response.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(response.Body).Decode(reply)
+}
+
+//Handler serves the RPCs sent to the node by other nodes' HTTPTransports. Requests without the secret are rejected
+func Handler(node *Node, secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(SecretHeader)), []byte(secret)) != 1 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid http method", http.StatusMethodNotAllowed)
+			return
+		}
+		if node.isStopped() {
+			http.Error(w, ErrStopped.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		var reply interface{}
+		var err error
+		decoder := json.NewDecoder(r.Body)
+		switch r.URL.Path {
+		case VotePath:
+			var args RequestVoteArgs
+			if err = decoder.Decode(&args); err == nil {
+				reply = node.HandleRequestVote(args)
+			}
+		case AppendPath:
+			var args AppendEntriesArgs
+			if err = decoder.Decode(&args); err == nil {
+				reply = node.HandleAppendEntries(args)
+			}
+		case SnapshotPath:
+			var args InstallSnapshotArgs
+			if err = decoder.Decode(&args); err == nil {
+				reply = node.HandleInstallSnapshot(args)
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "unable to read the request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(reply); err != nil {
+			http.Error(w, "unable to write the reply", http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,231 @@
+//Package rbac defines the roles and permissions used to decide what an authenticated user is allowed to do.
+//It has no dependencies on the rest of the store so that both the users and KVStore packages can share it.
+package rbac
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrUnknownRole       = errors.New("unknown role")
+	ErrUnknownPermission = errors.New("unknown permission")
+)
+
+//Permission is a bit set of the actions a user is allowed to perform
+type Permission uint
+
+const (
+	PermRead Permission = 1 << iota
+	PermWrite
+	PermDelete
+	PermList
+	PermShutdown
+	PermManageUsers
+
+	PermNone Permission = 0
+	PermAll             = PermRead | PermWrite | PermDelete | PermList | PermShutdown | PermManageUsers
+)
+
+var permissionNames = []struct {
+	perm Permission
+	name string
+}{
+	{PermRead, "read"},
+	{PermWrite, "write"},
+	{PermDelete, "delete"},
+	{PermList, "list"},
+	{PermShutdown, "shutdown"},
+	{PermManageUsers, "manage-users"},
+}
+
+//Has returns true if every permission in required is also in p
+func (p Permission) Has(required Permission) bool {
+	return p&required == required
+}
+
+//Names returns the names of every permission in the set, in a fixed order
+func (p Permission) Names() []string {
+	names := []string{}
+	for _, pn := range permissionNames {
+		if p.Has(pn.perm) {
+			names = append(names, pn.name)
+		}
+	}
+	return names
+}
+
+func (p Permission) String() string {
+	return strings.Join(p.Names(), ",")
+}
+
+//ParsePermission converts a single permission name (e.g. "read") into a Permission
+func ParsePermission(name string) (Permission, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, pn := range permissionNames {
+		if pn.name == name {
+			return pn.perm, nil
+		}
+	}
+	return PermNone, ErrUnknownPermission
+}
+
+//Role is a named set of permissions that can be assigned to a user
+type Role string
+
+const (
+	RoleAdmin    Role = "admin"
+	RoleWriter   Role = "writer"
+	RoleReader   Role = "reader"
+	RoleOperator Role = "operator"
+)
+
+var rolePermissions = map[Role]Permission{
+	RoleAdmin:    PermAll,
+	RoleWriter:   PermRead | PermWrite | PermDelete | PermList,
+	RoleReader:   PermRead | PermList,
+	RoleOperator: PermList | PermShutdown,
+}
+
+//Permissions returns the permissions granted by the role. Unknown roles grant nothing
+func (r Role) Permissions() Permission {
+	return rolePermissions[r]
+}
+
+//ParseRole converts a role name into a Role, checking that it is one of the known roles
+func ParseRole(name string) (Role, error) {
+	role := Role(strings.ToLower(strings.TrimSpace(name)))
+	if _, ok := rolePermissions[role]; !ok {
+		return "", ErrUnknownRole
+	}
+	return role, nil
+}
+
+//ParseRoles parses a list of role names separated by sep, ignoring empty entries
+func ParseRoles(names string, sep string) ([]Role, error) {
+	roles := []Role{}
+	for _, name := range strings.Split(names, sep) {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		role, err := ParseRole(name)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+//Roles returns all the known roles in alphabetical order
+func Roles() []Role {
+	roles := make([]Role, 0, len(rolePermissions))
+	for role := range rolePermissions {
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i] < roles[j] })
+	return roles
+}
+
+//Identity is an authenticated caller, along with the roles they have been assigned and the groups they belong to
+type Identity struct {
+	Username string
+	Roles    []Role
+	Groups   []string
+	Scope    *Scope //nil unless the caller authenticated with something narrower than a login, e.g. an API key
+}
+
+//Scope narrows down what an identity is allowed to do, whatever its roles say
+type Scope struct {
+	KeyPrefix   string     //only keys starting with this prefix can be used. Empty allows every key
+	Permissions Permission //the most the identity is allowed to do
+}
+
+func NewIdentity(username string, roles ...Role) Identity {
+	return Identity{Username: username, Roles: roles}
+}
+
+//Permissions returns the union of the permissions granted by each of the identity's roles, limited by its scope
+func (i Identity) Permissions() Permission {
+	perms := PermNone
+	for _, role := range i.Roles {
+		perms |= role.Permissions()
+	}
+	if i.Scope != nil {
+		perms &= i.Scope.Permissions
+	}
+	return perms
+}
+
+//CanAccessKey returns false if the identity's scope does not cover the key
+func (i Identity) CanAccessKey(key string) bool {
+	return i.Scope == nil || strings.HasPrefix(key, i.Scope.KeyPrefix)
+}
+
+//Can returns true if the identity has been granted the permission by at least one of its roles
+func (i Identity) Can(perm Permission) bool {
+	return i.Permissions().Has(perm)
+}
+
+//HasRole returns true if the identity has been assigned the role
+func (i Identity) HasRole(role Role) bool {
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+//IsAdmin returns true for identities that may act on any key regardless of who owns it.
+//A scoped identity, e.g. an API key, is never an admin, even if its owner is
+func (i Identity) IsAdmin() bool {
+	return i.Scope == nil && i.HasRole(RoleAdmin)
+}
+
+//RoleNames returns the identity's roles as strings, e.g. for putting in a JWT
+func (i Identity) RoleNames() []string {
+	names := make([]string, len(i.Roles))
+	for j, role := range i.Roles {
+		names[j] = string(role)
+	}
+	return names
+}
+
+const (
+	userPrincipalPrefix  = "user:"
+	groupPrincipalPrefix = "group:"
+)
+
+var ErrInvalidPrincipal = errors.New("principal must be of the form user:<name> or group:<name>")
+
+//UserPrincipal returns the principal used to refer to a single user in an access control list
+func UserPrincipal(username string) string {
+	return userPrincipalPrefix + username
+}
+
+//GroupPrincipal returns the principal used to refer to every member of a group in an access control list
+func GroupPrincipal(group string) string {
+	return groupPrincipalPrefix + group
+}
+
+//ParsePrincipal checks that the principal is a well formed user or group principal
+func ParsePrincipal(principal string) (string, error) {
+	principal = strings.TrimSpace(principal)
+	for _, prefix := range []string{userPrincipalPrefix, groupPrincipalPrefix} {
+		if strings.HasPrefix(principal, prefix) && len(principal) > len(prefix) {
+			return principal, nil
+		}
+	}
+	return "", ErrInvalidPrincipal
+}
+
+//Principals returns every principal that refers to the identity: the user itself and each of its groups
+func (i Identity) Principals() []string {
+	principals := []string{UserPrincipal(i.Username)}
+	for _, group := range i.Groups {
+		principals = append(principals, GroupPrincipal(group))
+	}
+	return principals
+}
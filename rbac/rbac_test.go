@@ -0,0 +1,81 @@
+package rbac_test
+
+import (
+	"store/rbac"
+	"testing"
+)
+
+func TestRolePermissions(t *testing.T) {
+	admin := rbac.NewIdentity("admin", rbac.RoleAdmin)
+	writer := rbac.NewIdentity("writer", rbac.RoleWriter)
+	reader := rbac.NewIdentity("reader", rbac.RoleReader)
+	operator := rbac.NewIdentity("operator", rbac.RoleOperator)
+
+	tests := []struct {
+		identity rbac.Identity
+		perm     rbac.Permission
+		expected bool
+	}{
+		{admin, rbac.PermAll, true},
+		{writer, rbac.PermWrite | rbac.PermDelete, true},
+		{writer, rbac.PermShutdown, false},
+		{reader, rbac.PermRead, true},
+		{reader, rbac.PermWrite, false},
+		{operator, rbac.PermShutdown, true},
+		{operator, rbac.PermRead, false},
+		{rbac.NewIdentity("nobody"), rbac.PermRead, false},
+	}
+	for _, test := range tests {
+		if test.identity.Can(test.perm) != test.expected {
+			t.Errorf("expected %s.Can(%s) to be %v\n", test.identity.Username, test.perm, test.expected)
+		}
+	}
+	if !admin.IsAdmin() || writer.IsAdmin() {
+		t.Error("only the admin role should be treated as an admin")
+	}
+}
+
+func TestMultipleRoles(t *testing.T) {
+	identity := rbac.NewIdentity("user", rbac.RoleReader, rbac.RoleOperator)
+	if !identity.Can(rbac.PermRead | rbac.PermShutdown) {
+		t.Error("permissions from multiple roles were not combined")
+	}
+	if identity.Can(rbac.PermWrite) {
+		t.Error("identity was granted a permission none of its roles have")
+	}
+}
+
+func TestParsing(t *testing.T) {
+	roles, err := rbac.ParseRoles("reader; Operator", ";")
+	if err != nil || len(roles) != 2 || roles[0] != rbac.RoleReader || roles[1] != rbac.RoleOperator {
+		t.Errorf("unable to parse roles. Got %v, error is %v\n", roles, err)
+	}
+	if _, err := rbac.ParseRoles("reader;superuser", ";"); err != rbac.ErrUnknownRole {
+		t.Error("able to parse an unknown role", err)
+	}
+	perm, err := rbac.ParsePermission("manage-users")
+	if err != nil || perm != rbac.PermManageUsers {
+		t.Errorf("unable to parse permission. Got %v, error is %v\n", perm, err)
+	}
+	if names := (rbac.PermRead | rbac.PermList).Names(); len(names) != 2 || names[0] != "read" || names[1] != "list" {
+		t.Errorf("unexpected permission names %v\n", names)
+	}
+}
+
+func TestScope(t *testing.T) {
+	identity := rbac.NewIdentity("user", rbac.RoleAdmin)
+	identity.Scope = &rbac.Scope{KeyPrefix: "batch_", Permissions: rbac.PermRead | rbac.PermList}
+
+	if !identity.Can(rbac.PermRead) || identity.Can(rbac.PermWrite) || identity.Can(rbac.PermShutdown) {
+		t.Errorf("scope did not limit permissions. Got %s\n", identity.Permissions())
+	}
+	if !identity.CanAccessKey("batch_job1") || identity.CanAccessKey("other") {
+		t.Error("scope did not limit keys to the prefix")
+	}
+	if !rbac.NewIdentity("user").CanAccessKey("anything") {
+		t.Error("identity without a scope was limited")
+	}
+	if identity.IsAdmin() {
+		t.Error("scoped identity was treated as an admin")
+	}
+}
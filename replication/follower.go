@@ -0,0 +1,290 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"store/KVStore"
+	"store/logging"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	//RetryInterval is how long a follower waits before reconnecting after losing the primary. It doubles up to MaxRetryInterval
+	RetryInterval    = 100 * time.Millisecond
+	MaxRetryInterval = 5 * time.Second
+	//SnapshotTimeout is how long a follower waits for the primary to send a snapshot
+	SnapshotTimeout = 30 * time.Second
+)
+
+//missedHeartbeats is how many heartbeats a follower can miss before it gives up on the stream and reconnects
+const missedHeartbeats = 5
+
+//Follower copies a primary into its store, and keeps track of how up to date it is
+type Follower struct {
+	primaryURL string
+	secret     string
+	store      Store
+	client     *http.Client
+
+	stop chan struct{}
+	done chan struct{}
+
+	lock       sync.Mutex
+	appliedSeq uint64
+	primarySeq uint64
+	startedAt  time.Time
+	syncedAt   time.Time //when the follower last knew it had everything the primary had
+	connected  bool
+	lastError  string
+	snapshots  int
+}
+
+//FollowerStatus is how up to date a follower is
+type FollowerStatus struct {
+	Primary    string  `json:"primary"`
+	AppliedSeq uint64  `json:"appliedSeq"`
+	PrimarySeq uint64  `json:"primarySeq"` //the latest mutation the follower has heard of
+	Connected  bool    `json:"connected"`
+	Staleness  float64 `json:"stalenessSeconds"`
+	Snapshots  int     `json:"snapshots"` //how many times the follower has had to start again from a snapshot
+	LastError  string  `json:"lastError,omitempty"`
+}
+
+//NewFollower creates a follower that copies the primary at primaryURL, e.g. http://primary:8080, into the store. Start starts it copying
+func NewFollower(primaryURL, secret string, store Store) *Follower {
+	return &Follower{
+		primaryURL: strings.TrimSuffix(primaryURL, "/"),
+		secret:     secret,
+		store:      store,
+		client:     &http.Client{},
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+//PrimaryURL returns the URL of the primary being followed
+func (f *Follower) PrimaryURL() string {
+	return f.primaryURL
+}
+
+//Start starts copying the primary in the background, reconnecting whenever the connection is lost
+func (f *Follower) Start() {
+	f.lock.Lock()
+	f.startedAt = time.Now()
+	f.lock.Unlock()
+	go f.run()
+}
+
+//Stop stops copying the primary and returns the sequence number of the last mutation applied, e.g. so the follower can be promoted
+func (f *Follower) Stop() uint64 {
+	select {
+	case <-f.stop:
+	default:
+		close(f.stop)
+	}
+	<-f.done
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.connected = false
+	return f.appliedSeq
+}
+
+//Staleness is how long it has been since the follower was known to have every mutation the primary had.
+//Before it first catches up this is the time since it started
+func (f *Follower) Staleness() time.Duration {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.syncedAt.IsZero() {
+		return time.Since(f.startedAt)
+	}
+	return time.Since(f.syncedAt)
+}
+
+func (f *Follower) Status() FollowerStatus {
+	staleness := f.Staleness()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return FollowerStatus{
+		Primary:    f.primaryURL,
+		AppliedSeq: f.appliedSeq,
+		PrimarySeq: f.primarySeq,
+		Connected:  f.connected,
+		Staleness:  staleness.Seconds(),
+		Snapshots:  f.snapshots,
+		LastError:  f.lastError,
+	}
+}
+
+func (f *Follower) setError(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.connected = false
+	f.lastError = err.Error()
+}
+
+func (f *Follower) run() {
+	defer close(f.done)
+	retry := RetryInterval
+	needSnapshot := false
+	for {
+		var err error
+		if needSnapshot {
+			err = f.restoreSnapshot()
+		}
+		if err == nil {
+			needSnapshot = false
+			err = f.stream()
+		}
+		select {
+		case <-f.stop:
+			return
+		default:
+		}
+
+		switch err {
+		case ErrGone, KVStore.ErrReplicationGap:
+			logging.InfoLogger.Println("follower needs a snapshot from the primary:", err)
+			needSnapshot = true
+			retry = RetryInterval
+			continue //no need to wait, the primary is there
+		case ErrStreamClosed:
+			retry = RetryInterval
+		}
+		if err != nil {
+			logging.WarningLogger.Printf("lost the replication stream from %s, retrying in %v: %v\n", f.primaryURL, retry, err)
+			f.setError(err)
+		}
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > MaxRetryInterval {
+			retry = MaxRetryInterval
+		}
+	}
+}
+
+//newRequest builds a request to the primary that is cancelled when the follower stops
+func (f *Follower) newRequest(ctx context.Context, path string) (*http.Request, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-f.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	request, err := http.NewRequest(http.MethodGet, f.primaryURL+path, nil)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	request.Header.Set(SecretHeader, f.secret)
+	return request.WithContext(ctx), cancel, nil
+}
+
+//checkResponse turns an unsuccessful response from the primary into an error
+func checkResponse(response *http.Response) error {
+	switch response.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusGone:
+		return ErrGone
+	case http.StatusForbidden:
+		return ErrForbidden
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+	return fmt.Errorf("primary responded with %s: %s", response.Status, strings.TrimSpace(string(body)))
+}
+
+func (f *Follower) restoreSnapshot() error {
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), SnapshotTimeout)
+	defer cancelTimeout()
+	request, cancel, err := f.newRequest(ctx, SnapshotPath)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	response, err := f.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := checkResponse(response); err != nil {
+		return err
+	}
+	var snapshot KVStore.Snapshot
+	if err := json.NewDecoder(response.Body).Decode(&snapshot); err != nil {
+		return err
+	}
+	if err := f.store.Restore(snapshot); err != nil {
+		return err
+	}
+	logging.InfoLogger.Printf("restored a snapshot of %d keys as of mutation %d from %s\n", len(snapshot.Keys), snapshot.Seq, f.primaryURL)
+	f.lock.Lock()
+	f.appliedSeq = snapshot.Seq
+	f.snapshots++
+	f.lock.Unlock()
+	return nil
+}
+
+//stream applies mutations from the primary until the stream breaks or the follower is stopped
+func (f *Follower) stream() error {
+	f.lock.Lock()
+	after := f.appliedSeq
+	f.lock.Unlock()
+	request, cancel, err := f.newRequest(context.Background(), StreamPath+"?after="+strconv.FormatUint(after, 10))
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	response, err := f.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := checkResponse(response); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	f.connected = true
+	f.lastError = ""
+	f.lock.Unlock()
+
+	//the primary sends heartbeats, so if it goes quiet for too long the connection has probably gone
+	idle := time.AfterFunc(missedHeartbeats*HeartbeatInterval, cancel)
+	defer idle.Stop()
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var msg message
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return ErrStreamClosed
+			}
+			return err
+		}
+		idle.Reset(missedHeartbeats * HeartbeatInterval)
+		if msg.Mutation != nil {
+			if err := f.store.Apply(*msg.Mutation); err != nil {
+				return err
+			}
+		}
+		f.lock.Lock()
+		if msg.Mutation != nil && msg.Mutation.Seq > f.appliedSeq {
+			f.appliedSeq = msg.Mutation.Seq
+		}
+		f.primarySeq = msg.PrimarySeq
+		if f.appliedSeq >= f.primarySeq {
+			f.syncedAt = time.Now()
+		}
+		f.lock.Unlock()
+	}
+}
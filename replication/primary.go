@@ -0,0 +1,231 @@
+package replication
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"store/KVStore"
+	"store/logging"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Primary keeps the log of recent mutations and serves it, and snapshots, to followers
+type Primary struct {
+	store  Store
+	secret string
+	size   int //how many mutations are kept in the log
+
+	lock      sync.Mutex
+	log       []KVStore.Mutation //oldest first
+	lastSeq   uint64
+	appended  chan struct{} //closed when a mutation is appended, then replaced, to wake up the streams
+	followers map[*FollowerInfo]struct{}
+	closed    chan struct{}
+}
+
+//FollowerInfo describes a follower that is currently streaming from the primary
+type FollowerInfo struct {
+	Address     string    `json:"address"`
+	Seq         uint64    `json:"seq"` //the last mutation sent to it
+	ConnectedAt time.Time `json:"connectedAt"`
+}
+
+//NewPrimary creates a primary for a store whose latest mutation is lastSeq. It keeps the last size mutations for followers.
+//Append has to be given every mutation from then on, e.g. by KVStore.SetMutationListener
+func NewPrimary(store Store, secret string, size int, lastSeq uint64) *Primary {
+	return &Primary{
+		store:     store,
+		secret:    secret,
+		size:      size,
+		lastSeq:   lastSeq,
+		appended:  make(chan struct{}),
+		followers: map[*FollowerInfo]struct{}{},
+		closed:    make(chan struct{}),
+	}
+}
+
+//Append adds a mutation to the log and sends it to the followers, dropping the oldest mutation once the log is full
+func (p *Primary) Append(mutation KVStore.Mutation) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if mutation.Seq != p.lastSeq+1 { //one has been missed, so the log can't be used to catch followers up any more
+		logging.WarningLogger.Printf("replication log expected mutation %d but got %d, followers that are behind will need a snapshot\n", p.lastSeq+1, mutation.Seq)
+		p.log = nil
+	}
+	p.log = append(p.log, mutation)
+	if len(p.log) > p.size {
+		p.log = append([]KVStore.Mutation{}, p.log[len(p.log)-p.size:]...) //copied so the dropped mutations can be freed
+	}
+	p.lastSeq = mutation.Seq
+	close(p.appended)
+	p.appended = make(chan struct{})
+}
+
+//LastSeq returns the sequence number of the latest mutation
+func (p *Primary) LastSeq() uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.lastSeq
+}
+
+//Followers lists the followers that are streaming from the primary, ordered by address
+func (p *Primary) Followers() []FollowerInfo {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	out := []FollowerInfo{}
+	for follower := range p.followers {
+		out = append(out, *follower)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out
+}
+
+//Close ends every stream, e.g. when the server is shutting down
+func (p *Primary) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	select {
+	case <-p.closed:
+	default:
+		close(p.closed)
+	}
+}
+
+//since returns the mutations after the given one, the latest sequence number and a channel that is closed when there are more.
+//ok is false if the log no longer goes back far enough, or the follower is somehow ahead of the primary
+func (p *Primary) since(after uint64) (mutations []KVStore.Mutation, lastSeq uint64, appended <-chan struct{}, ok bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if after > p.lastSeq {
+		return nil, p.lastSeq, p.appended, false
+	}
+	first := p.lastSeq + 1 //the oldest mutation in the log
+	if len(p.log) > 0 {
+		first = p.log[0].Seq
+	}
+	if after+1 < first {
+		return nil, p.lastSeq, p.appended, false
+	}
+	start := len(p.log) - int(p.lastSeq-after)
+	return append([]KVStore.Mutation{}, p.log[start:]...), p.lastSeq, p.appended, true
+}
+
+func (p *Primary) setFollowerSeq(follower *FollowerInfo, seq uint64) {
+	p.lock.Lock()
+	follower.Seq = seq
+	p.lock.Unlock()
+}
+
+//ServeStream streams the mutations after the one in the after query parameter, one JSON message per line, until the follower disconnects.
+//It responds with 410 Gone if the follower needs a snapshot first
+func (p *Primary) ServeStream(w http.ResponseWriter, r *http.Request) {
+	if !checkSecret(r, p.secret) {
+		logging.Warning(r.Context()).Println("replication stream requested with the wrong secret from", r.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "invalid http method", http.StatusMethodNotAllowed)
+		return
+	}
+	after, err := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+	if err != nil {
+		http.Error(w, "after must be a sequence number", http.StatusBadRequest)
+		return
+	}
+	flusher, canFlush := w.(http.Flusher)
+	if !canFlush {
+		logging.Error(r.Context()).Println("unable to stream replication, the response can't be flushed")
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	mutations, lastSeq, appended, ok := p.since(after)
+	if !ok {
+		logging.Info(r.Context()).Printf("follower %s asked for mutations after %d, which are no longer in the log\n", r.RemoteAddr, after)
+		http.Error(w, ErrGone.Error(), http.StatusGone)
+		return
+	}
+
+	follower := &FollowerInfo{Address: r.RemoteAddr, Seq: after, ConnectedAt: time.Now()}
+	p.lock.Lock()
+	p.followers[follower] = struct{}{}
+	p.lock.Unlock()
+	defer func() {
+		p.lock.Lock()
+		delete(p.followers, follower)
+		p.lock.Unlock()
+	}()
+	logging.Info(r.Context()).Printf("follower %s connected, streaming mutations after %d\n", r.RemoteAddr, after)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	heartbeat := time.NewTicker(HeartbeatInterval)
+	defer heartbeat.Stop()
+	beat := true //send one straight away, so the follower knows where it stands
+	for {
+		for i := range mutations {
+			if err := encoder.Encode(message{Mutation: &mutations[i], PrimarySeq: lastSeq}); err != nil {
+				return
+			}
+			after = mutations[i].Seq
+		}
+		if len(mutations) == 0 && beat {
+			if err := encoder.Encode(message{PrimarySeq: lastSeq}); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		p.setFollowerSeq(follower, after)
+
+		beat = false
+		select {
+		case <-r.Context().Done():
+			logging.Info(r.Context()).Printf("follower %s disconnected\n", r.RemoteAddr)
+			return
+		case <-p.closed:
+			return
+		case <-appended:
+		case <-heartbeat.C:
+			beat = true
+		}
+		mutations, lastSeq, appended, ok = p.since(after)
+		if !ok { //the follower has fallen too far behind, so it will have to reconnect and get a snapshot
+			logging.Warning(r.Context()).Printf("follower %s fell behind the replication log\n", r.RemoteAddr)
+			return
+		}
+	}
+}
+
+//ServeSnapshot sends a snapshot of the store, which a follower restores before streaming the mutations after it
+func (p *Primary) ServeSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !checkSecret(r, p.secret) {
+		logging.Warning(r.Context()).Println("replication snapshot requested with the wrong secret from", r.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "invalid http method", http.StatusMethodNotAllowed)
+		return
+	}
+	snapshot, err := p.store.Snapshot()
+	if err != nil {
+		logging.Error(r.Context()).Println("unable to take a snapshot for a follower", err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	output, err := json.Marshal(snapshot)
+	if err != nil {
+		logging.Error(r.Context()).Println("unable to marshal the snapshot", err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	logging.Info(r.Context()).Printf("sending a snapshot of %d keys as of mutation %d to %s\n", len(snapshot.Keys), snapshot.Seq, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(output); err != nil {
+		logging.Error(r.Context()).Println("error writing the snapshot", err)
+	}
+}
@@ -0,0 +1,61 @@
+//Package replication copies the KV store from a primary to any number of followers over HTTP.
+//The primary keeps a log of its most recent mutations and streams it to each follower, which applies it to its own store.
+//A new follower, or one that has fallen further behind than the log goes back, starts again from a snapshot
+package replication
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"store/KVStore"
+	"time"
+)
+
+const (
+	StreamPath   = "/replication/stream"
+	SnapshotPath = "/replication/snapshot"
+	//SecretHeader carries the shared secret followers use to read from the primary
+	SecretHeader = "X-Replication-Secret"
+)
+
+//HeartbeatInterval is how often the primary sends a heartbeat down a quiet stream, so followers know they are still up to date
+var HeartbeatInterval = time.Second
+
+var (
+	ErrGone         = errors.New("the primary no longer has the mutations the follower needs")
+	ErrForbidden    = errors.New("the primary rejected the replication secret")
+	ErrStreamClosed = errors.New("the primary closed the stream")
+)
+
+//Store is the store being replicated
+type Store interface {
+	Snapshot() (KVStore.Snapshot, error)
+	Restore(KVStore.Snapshot) error
+	Apply(KVStore.Mutation) error
+}
+
+//LocalStore is the KV store in this process
+type LocalStore struct{}
+
+func (LocalStore) Snapshot() (KVStore.Snapshot, error) {
+	return KVStore.TakeSnapshot()
+}
+
+func (LocalStore) Restore(snapshot KVStore.Snapshot) error {
+	return KVStore.Restore(snapshot)
+}
+
+func (LocalStore) Apply(mutation KVStore.Mutation) error {
+	return KVStore.Apply(mutation)
+}
+
+//message is a line of the stream. Heartbeats have no mutation
+type message struct {
+	Mutation   *KVStore.Mutation `json:"mutation,omitempty"`
+	PrimarySeq uint64            `json:"primarySeq"` //the latest mutation on the primary when the message was sent
+}
+
+//checkSecret compares the secret in constant time, so it can't be guessed a character at a time
+func checkSecret(r *http.Request, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(SecretHeader)), []byte(secret)) == 1
+}
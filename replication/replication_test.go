@@ -0,0 +1,251 @@
+package replication_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"store/KVStore"
+	"store/logging"
+	"store/replication"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logging.SetupLoggers("../info.log", "../htaccess.log", false)
+	defer logging.Shutdown()
+	replication.HeartbeatInterval = 20 * time.Millisecond
+	replication.RetryInterval = 10 * time.Millisecond
+	replication.MaxRetryInterval = 50 * time.Millisecond
+	m.Run()
+}
+
+//memoryStore is a store for a single test node, so several nodes can run in one process
+type memoryStore struct {
+	lock sync.Mutex
+	seq  uint64
+	keys map[string]string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{keys: map[string]string{}}
+}
+
+func (s *memoryStore) Snapshot() (KVStore.Snapshot, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	snapshot := KVStore.Snapshot{Seq: s.seq}
+	for key, value := range s.keys {
+		snapshot.Keys = append(snapshot.Keys, KVStore.Mutation{Seq: s.seq, Key: key, Entry: &KVStore.Entry{Value: value}})
+	}
+	return snapshot, nil
+}
+
+func (s *memoryStore) Restore(snapshot KVStore.Snapshot) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys = map[string]string{}
+	for _, mutation := range snapshot.Keys {
+		s.keys[mutation.Key] = mutation.Entry.Value
+	}
+	s.seq = snapshot.Seq
+	return nil
+}
+
+func (s *memoryStore) Apply(mutation KVStore.Mutation) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if mutation.Seq <= s.seq {
+		return nil
+	}
+	if mutation.Seq != s.seq+1 {
+		return KVStore.ErrReplicationGap
+	}
+	if mutation.Entry == nil {
+		delete(s.keys, mutation.Key)
+	} else {
+		s.keys[mutation.Key] = mutation.Entry.Value
+	}
+	s.seq = mutation.Seq
+	return nil
+}
+
+func (s *memoryStore) get(key string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	value, present := s.keys[key]
+	return value, present
+}
+
+//node is a primary and its store, served over loopback
+type node struct {
+	store   *memoryStore
+	primary *replication.Primary
+	server  *httptest.Server
+}
+
+func newPrimaryNode(t *testing.T, store *memoryStore, logSize int) *node {
+	n := &node{store: store, primary: replication.NewPrimary(store, "secret", logSize, store.seq)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(replication.StreamPath, n.primary.ServeStream)
+	mux.HandleFunc(replication.SnapshotPath, n.primary.ServeSnapshot)
+	n.server = httptest.NewServer(mux)
+	t.Cleanup(func() {
+		n.primary.Close()
+		n.server.Close()
+	})
+	return n
+}
+
+//set changes a key on the primary, the way the KV store does with its mutation listener
+func (n *node) set(key, value string) {
+	n.store.lock.Lock()
+	n.store.seq++
+	mutation := KVStore.Mutation{Seq: n.store.seq, Key: key}
+	if value == "" {
+		delete(n.store.keys, key)
+	} else {
+		n.store.keys[key] = value
+		mutation.Entry = &KVStore.Entry{Value: value}
+	}
+	n.store.lock.Unlock()
+	n.primary.Append(mutation)
+}
+
+func startFollower(t *testing.T, primaryURL, secret string) (*replication.Follower, *memoryStore) {
+	store := newMemoryStore()
+	follower := replication.NewFollower(primaryURL, secret, store)
+	follower.Start()
+	t.Cleanup(func() { follower.Stop() })
+	return follower, store
+}
+
+//waitFor waits for the condition to become true, failing the test if it takes too long
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", description)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	primary := newPrimaryNode(t, newMemoryStore(), 100)
+	primary.set("a", "1")
+	primary.set("b", "2")
+
+	followers := []*replication.Follower{}
+	stores := []*memoryStore{}
+	for i := 0; i < 2; i++ {
+		follower, store := startFollower(t, primary.server.URL, "secret")
+		followers = append(followers, follower)
+		stores = append(stores, store)
+	}
+	primary.set("a", "3")
+	primary.set("b", "")
+	primary.set("c", "4")
+
+	for i, follower := range followers {
+		waitFor(t, "the follower to catch up", func() bool { return follower.Status().AppliedSeq == 5 })
+		if value, _ := stores[i].get("a"); value != "3" {
+			t.Errorf("expected a to be 3 on follower %d, got %s", i, value)
+		}
+		if _, present := stores[i].get("b"); present {
+			t.Errorf("expected b to be deleted on follower %d", i)
+		}
+		status := follower.Status()
+		if status.Snapshots != 0 || !status.Connected || status.PrimarySeq != 5 {
+			t.Errorf("expected follower %d to have streamed everything without a snapshot, got %+v", i, status)
+		}
+	}
+	waitFor(t, "the primary to list both followers", func() bool {
+		infos := primary.primary.Followers()
+		return len(infos) == 2 && infos[0].Seq == 5 && infos[1].Seq == 5
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	primary := newPrimaryNode(t, newMemoryStore(), 2)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		primary.set(key, key)
+	}
+	follower, store := startFollower(t, primary.server.URL, "secret")
+	waitFor(t, "the follower to restore a snapshot", func() bool { return follower.Status().AppliedSeq == 5 })
+	if follower.Status().Snapshots != 1 {
+		t.Errorf("expected the follower to need a snapshot, got %+v", follower.Status())
+	}
+	primary.set("f", "f")
+	waitFor(t, "the follower to stream after the snapshot", func() bool {
+		value, _ := store.get("f")
+		return value == "f"
+	})
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if value, _ := store.get(key); value != key {
+			t.Errorf("expected %s to have been copied by the snapshot, got %q", key, value)
+		}
+	}
+}
+
+func TestStaleness(t *testing.T) {
+	primary := newPrimaryNode(t, newMemoryStore(), 100)
+	follower, _ := startFollower(t, primary.server.URL, "secret")
+	waitFor(t, "the follower to connect", func() bool { return follower.Status().Connected })
+	time.Sleep(10 * replication.HeartbeatInterval)
+	if staleness := follower.Staleness(); staleness > 5*replication.HeartbeatInterval {
+		t.Errorf("expected heartbeats to keep the follower fresh, staleness is %v", staleness)
+	}
+
+	//once the primary has gone the follower gets staler, and notices it has lost the connection
+	primary.primary.Close()
+	primary.server.Close()
+	waitFor(t, "the follower to notice the primary has gone", func() bool { return !follower.Status().Connected })
+	time.Sleep(10 * replication.HeartbeatInterval)
+	if staleness := follower.Staleness(); staleness < 5*replication.HeartbeatInterval {
+		t.Errorf("expected the follower to be stale without a primary, staleness is %v", staleness)
+	}
+}
+
+func TestWrongSecret(t *testing.T) {
+	primary := newPrimaryNode(t, newMemoryStore(), 100)
+	primary.set("a", "1")
+	follower, store := startFollower(t, primary.server.URL, "guess")
+	waitFor(t, "the follower to be rejected", func() bool { return follower.Status().LastError == replication.ErrForbidden.Error() })
+	if _, present := store.get("a"); present {
+		t.Error("expected nothing to be copied with the wrong secret")
+	}
+}
+
+func TestPromotion(t *testing.T) {
+	primary := newPrimaryNode(t, newMemoryStore(), 100)
+	primary.set("a", "1")
+	primary.set("b", "2")
+	follower, store := startFollower(t, primary.server.URL, "secret")
+	waitFor(t, "the follower to catch up", func() bool { return follower.Status().AppliedSeq == 2 })
+
+	//the primary fails, so the follower takes over and carries on numbering from where it was
+	primary.primary.Close()
+	primary.server.Close()
+	seq := follower.Stop()
+	if seq != 2 {
+		t.Fatalf("expected the follower to have applied 2 mutations, got %d", seq)
+	}
+	promoted := newPrimaryNode(t, store, 100)
+	promoted.set("c", "3")
+	if promoted.primary.LastSeq() != 3 {
+		t.Errorf("expected the promoted primary to carry on from mutation 2, got %d", promoted.primary.LastSeq())
+	}
+
+	newFollower, newStore := startFollower(t, promoted.server.URL, "secret")
+	waitFor(t, "a new follower to copy the promoted primary", func() bool { return newFollower.Status().AppliedSeq == 3 })
+	for key, want := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		if value, _ := newStore.get(key); value != want {
+			t.Errorf("expected %s to be %s on the new follower, got %q", key, want, value)
+		}
+	}
+	if newFollower.Status().Snapshots != 1 {
+		t.Error("expected the new follower to start from a snapshot, as the promoted primary's log starts at mutation 3")
+	}
+}
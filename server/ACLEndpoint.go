@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"store/KVStore"
+	"store/logging"
+	"store/rbac"
+	"strings"
+)
+
+//ACLEndpoint lets the owner of a key (or an admin) share it with other users and groups.
+//GET /acl/{key} returns the access control list, PUT /acl/{key} with a KVStore.ACLEntry body replaces a principal's permissions,
+//DELETE /acl/{key}?principal=user:bob removes a principal and PUT /acl/{key}/owner with the new owner as the body transfers ownership.
+//In namespaced mode ?namespace=user can be used to manage a key in somebody else's namespace
+func ACLEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	//check for shutdown and either return or add self to waitgroup
+	select {
+	case <-ShutdownChannel:
+		logging.Warning(r.Context()).Println("attempted to access the acl endpoint after a shutdown")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "Server is shutting down", "acl")
+		return
+	default:
+		endpointWaitGroup.Add(1)
+		defer endpointWaitGroup.Done()
+	}
+
+	//extract the key, and whether the owner is being changed
+	pathArgString := strings.TrimPrefix(r.URL.Path, "/acl")
+	trimmedPathArgString := strings.Trim(pathArgString, "/ ")
+	pathArgs := strings.Split(trimmedPathArgString, "/")
+	key := pathArgs[0]
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteWithError(w, "must provide a key in the url path", "acl")
+		return
+	}
+	changeOwner := len(pathArgs) > 1 && pathArgs[1] == "owner"
+
+	//login with associated error handling
+	caller, errUsername := GetAuthorisation(r)
+	if errUsername != nil {
+		if errUsername == ErrInvalidAuth {
+			w.WriteHeader(http.StatusForbidden)
+			WriteWithError(w, "Forbidden", "acl")
+			return
+		} else if errUsername == ErrUnauthorised {
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "acl")
+			return
+		} else {
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errUsername)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something has gone wrong", "acl")
+			return
+		}
+	}
+
+	namespace := KVStore.DefaultNamespace(caller)
+	if requested := r.URL.Query().Get("namespace"); requested != "" {
+		namespace = requested
+	}
+
+	//interact with the KV store (actor modelling is handled by the KVStore package)
+	var responseErr error
+	var storeResponse []byte
+	switch {
+	case r.Method == http.MethodGet && !changeOwner:
+		storeResponse, responseErr = KVStore.WithContext(r.Context()).GetACLIn(namespace, key, caller)
+	case r.Method == http.MethodPut && changeOwner:
+		newOwner, err := readBody(r)
+		if err != nil || strings.TrimSpace(newOwner) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteWithError(w, "must provide the new owner in the body", "acl")
+			return
+		}
+		responseErr = KVStore.WithContext(r.Context()).TransferOwnershipIn(namespace, key, caller, strings.TrimSpace(newOwner))
+		if responseErr == nil {
+			logging.Info(r.Context()).Printf("user %s transferred ownership of key %s to %s\n", caller.Username, key, newOwner)
+		}
+	case r.Method == http.MethodPut:
+		body, err := readBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteWithError(w, "must provide a body", "acl")
+			return
+		}
+		var entry KVStore.ACLEntry
+		if err := json.Unmarshal([]byte(body), &entry); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteWithError(w, "body must be a JSON acl entry", "acl")
+			return
+		}
+		perm := rbac.PermNone
+		for _, name := range entry.Permissions {
+			p, err := rbac.ParsePermission(name)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				WriteWithError(w, "unknown permission "+name, "acl")
+				return
+			}
+			perm |= p
+		}
+		responseErr = KVStore.WithContext(r.Context()).SetACLIn(namespace, key, caller, entry.Principal, perm)
+	case r.Method == http.MethodDelete && !changeOwner:
+		responseErr = KVStore.WithContext(r.Context()).SetACLIn(namespace, key, caller, r.URL.Query().Get("principal"), rbac.PermNone)
+	default:
+		logging.Warning(r.Context()).Println("received bad request on the acl endpoint. Method was", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "acl")
+		return
+	}
+
+	//handle any error returned from the KV store
+	switch responseErr {
+	case KVStore.ErrShutdown:
+		logging.Warning(r.Context()).Println("Server entered shutdown routine. Unable to Process request")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "Server is shutting down", "acl")
+		return
+	case KVStore.ErrKeyNotPresent:
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "404 key not found", "acl")
+		return
+	case KVStore.ErrNotLeader, KVStore.ErrClusterUnavailable:
+		writeClusterUnavailable(w, responseErr, "acl")
+		return
+	case KVStore.ErrUnauthorized:
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "acl")
+		return
+	case KVStore.ErrKeyExists, KVStore.ErrNamespaceFull:
+		w.WriteHeader(http.StatusConflict)
+		WriteWithError(w, responseErr.Error(), "acl")
+		return
+	case rbac.ErrInvalidPrincipal, KVStore.ErrBadPermission, KVStore.ErrBadRequest, KVStore.ErrNamespacesDisabled:
+		w.WriteHeader(http.StatusBadRequest)
+		WriteWithError(w, responseErr.Error(), "acl")
+		return
+	case nil:
+		if storeResponse != nil {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			_, err := w.Write(storeResponse)
+			if err != nil {
+				logging.Error(r.Context()).Println("error writing in the acl endpoint.", err)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		WriteWithError(w, "OK", "acl")
+		return
+	default:
+		logging.Error(r.Context()).Println("unexpected error from the acl interface", responseErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		WriteWithError(w, "something went wrong", "acl")
+		return
+	}
+}
+
+//readBody reads the whole of the request body and closes it
+func readBody(r *http.Request) (string, error) {
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			logging.Error(r.Context()).Println("Unable to close the request body")
+		}
+	}(r.Body)
+	value, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logging.Warning(r.Context()).Println("failed to read the body of a request", err)
+		return "", err
+	}
+	return string(value), nil
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"store/audit"
+	"store/logging"
+	"store/rbac"
+	"store/users"
+	"strings"
+	"time"
+)
+
+//mintRequest is the body expected when minting a new API key
+type mintRequest struct {
+	Owner     string `json:"owner"`
+	KeyPrefix string `json:"keyPrefix"`
+	ReadOnly  bool   `json:"readOnly"`
+	ExpiresIn string `json:"expiresIn"` //a Go duration, e.g. "720h". Empty means the key never expires
+}
+
+//mintResponse is returned after minting an API key. This is the only time the plain key is available
+type mintResponse struct {
+	Key    string        `json:"key"`
+	APIKey *users.APIKey `json:"apiKey"`
+}
+
+//APIKeyEndpoint lets admins manage API keys. GET /admin/apikeys lists the keys, POST /admin/apikeys with a mintRequest body mints one
+//and DELETE /admin/apikeys/{id} revokes one. Requires the manage-users permission
+func APIKeyEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	//check for shutdown and either return or add self to waitgroup
+	select {
+	case <-ShutdownChannel:
+		logging.Warning(r.Context()).Println("attempted to access the apikeys endpoint after a shutdown")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "Server is shutting down", "apikeys")
+		return
+	default:
+		endpointWaitGroup.Add(1)
+		defer endpointWaitGroup.Done()
+	}
+
+	//extract the key id, which is only needed for revoking
+	pathArgString := strings.TrimPrefix(r.URL.Path, "/admin/apikeys")
+	trimmedPathArgString := strings.Trim(pathArgString, "/ ")
+	pathArgs := strings.Split(trimmedPathArgString, "/")
+	id := pathArgs[0]
+
+	//login with associated error handling
+	caller, errUsername := GetAuthorisation(r)
+	if errUsername != nil {
+		if errUsername == ErrInvalidAuth {
+			w.WriteHeader(http.StatusForbidden)
+			WriteWithError(w, "Forbidden", "apikeys")
+			return
+		} else if errUsername == ErrUnauthorised {
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "apikeys")
+			return
+		} else {
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errUsername)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something has gone wrong", "apikeys")
+			return
+		}
+	}
+
+	if !caller.Can(rbac.PermManageUsers) {
+		logging.Warning(r.Context()).Printf("user %s tried to manage API keys without the manage-users permission\n", caller.Username)
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "apikeys")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, users.ListAPIKeys(), "apikeys")
+	case r.Method == http.MethodPost && id == "":
+		body, err := readBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteWithError(w, "must provide a body", "apikeys")
+			return
+		}
+		var request mintRequest
+		if err := json.Unmarshal([]byte(body), &request); err != nil || request.Owner == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteWithError(w, "body must be JSON with at least an owner", "apikeys")
+			return
+		}
+		var ttl time.Duration
+		if request.ExpiresIn != "" {
+			ttl, err = time.ParseDuration(request.ExpiresIn)
+			if err != nil || ttl <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				WriteWithError(w, "expiresIn must be a positive duration, e.g. 720h", "apikeys")
+				return
+			}
+		}
+		plainKey, key, err := users.MintAPIKey(request.Owner, request.KeyPrefix, request.ReadOnly, ttl, caller.Username)
+		if err != nil {
+			logging.Error(r.Context()).Println("unable to mint API key", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something went wrong", "apikeys")
+			return
+		}
+		recordAudit(r, audit.Event{Action: audit.ActionMintAPIKey, User: caller.Username, Detail: "id " + key.ID + " for " + key.Owner})
+		writeJSON(w, http.StatusCreated, mintResponse{Key: plainKey, APIKey: key}, "apikeys")
+	case r.Method == http.MethodDelete && id != "":
+		err := users.RevokeAPIKey(id)
+		switch err {
+		case nil:
+			logging.Info(r.Context()).Printf("user %s revoked API key %s\n", caller.Username, id)
+			recordAudit(r, audit.Event{Action: audit.ActionRevokeAPIKey, User: caller.Username, Detail: "id " + id})
+			w.WriteHeader(http.StatusOK)
+			WriteWithError(w, "OK", "apikeys")
+		case users.ErrAPIKeyNotFound:
+			w.WriteHeader(http.StatusNotFound)
+			WriteWithError(w, "404 API key not found", "apikeys")
+		default:
+			logging.Error(r.Context()).Println("unable to revoke API key", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something went wrong", "apikeys")
+		}
+	default:
+		logging.Warning(r.Context()).Println("received bad request on the apikeys endpoint. Method was", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "apikeys")
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net/http"
+	"store/audit"
+	"store/logging"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//AuditEndpoint lets admins read the audit log. GET /admin/audit returns the events, filtered by the optional query parameters
+//user, key, action, from and to (RFC 3339 times) and limit. GET /admin/audit/verify checks the log's hash chain
+func AuditEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	//check for shutdown and either return or add self to waitgroup
+	select {
+	case <-ShutdownChannel:
+		logging.Warning(r.Context()).Println("attempted to access the audit endpoint after a shutdown")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "Server is shutting down", "audit")
+		return
+	default:
+		endpointWaitGroup.Add(1)
+		defer endpointWaitGroup.Done()
+	}
+
+	//login with associated error handling
+	caller, errUsername := GetAuthorisation(r)
+	if errUsername != nil {
+		if errUsername == ErrInvalidAuth {
+			w.WriteHeader(http.StatusForbidden)
+			WriteWithError(w, "Forbidden", "audit")
+			return
+		} else if errUsername == ErrUnauthorised {
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "audit")
+			return
+		} else {
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errUsername)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something has gone wrong", "audit")
+			return
+		}
+	}
+
+	if !caller.IsAdmin() {
+		logging.Warning(r.Context()).Printf("user %s tried to read the audit log without being an admin\n", caller.Username)
+		recordAudit(r, audit.Event{Action: audit.ActionQueryAuditLog, User: caller.Username, Outcome: audit.OutcomeDenied})
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "audit")
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		logging.Warning(r.Context()).Println("received bad request on the audit endpoint. Method was", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "audit")
+		return
+	}
+
+	if strings.TrimSuffix(r.URL.Path, "/") == "/admin/audit/verify" {
+		result, err := audit.Verify()
+		if err != nil {
+			writeAuditError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result, "audit")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := audit.Filter{
+		User:   query.Get("user"),
+		Key:    query.Get("key"),
+		Action: query.Get("action"),
+	}
+	for name, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				WriteWithError(w, name+" must be an RFC 3339 time, e.g. 2022-03-14T12:00:00Z", "audit")
+				return
+			}
+			*target = parsed
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteWithError(w, "limit must be a positive number", "audit")
+			return
+		}
+		filter.Limit = limit
+	}
+
+	events, err := audit.Query(filter)
+	if err != nil {
+		writeAuditError(w, err)
+		return
+	}
+	recordAudit(r, audit.Event{Action: audit.ActionQueryAuditLog, User: caller.Username, Detail: r.URL.RawQuery})
+	writeJSON(w, http.StatusOK, events, "audit")
+}
+
+func writeAuditError(w http.ResponseWriter, err error) {
+	if err == audit.ErrNotOpen {
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "the audit log is not enabled", "audit")
+		return
+	}
+	logging.ErrorLogger.Println("unable to read the audit log", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	WriteWithError(w, "something went wrong", "audit")
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"store/KVStore"
+	"store/audit"
+	"store/logging"
+	"store/raft"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ClusterOptions configures cluster mode
+type ClusterOptions struct {
+	Address           string   //the URL other nodes reach this one on, which is also its ID
+	Peers             []string //every node in a new cluster, including this one. Empty when joining an existing cluster
+	Secret            string   //shared by every node in the cluster
+	DataDir           string   //where the Raft log and snapshots are kept. Empty keeps them in memory
+	SnapshotThreshold int
+	ElectionTimeout   time.Duration
+}
+
+//ClusterLeaderHeader is set on redirects and conflicts to say which node is the leader
+const ClusterLeaderHeader = "X-Cluster-Leader"
+
+var (
+	clusterLock    sync.RWMutex
+	clusterNode    *raft.Node        //nil unless the server is in cluster mode
+	clusterStorage *raft.FileStorage //nil unless the Raft log is kept on disk
+)
+
+//ConfigureCluster starts this server's node in the cluster, and sends every change to the store through the cluster's log.
+//Must be called after Setup, with KVStore.Clustered set before it
+func ConfigureCluster(options ClusterOptions) error {
+	clusterLock.Lock()
+	defer clusterLock.Unlock()
+	var storage raft.Storage
+	if options.DataDir != "" {
+		fileStorage, err := raft.NewFileStorage(options.DataDir)
+		if err != nil {
+			return err
+		}
+		storage, clusterStorage = fileStorage, fileStorage
+	}
+	node, err := raft.NewNode(raft.Config{
+		ID:                strings.TrimRight(options.Address, "/"),
+		Members:           options.Peers,
+		Transport:         raft.NewHTTPTransport(options.Secret),
+		StateMachine:      KVStore.ClusterStateMachine{},
+		Storage:           storage,
+		ElectionTimeout:   options.ElectionTimeout,
+		SnapshotThreshold: options.SnapshotThreshold,
+	})
+	if err != nil {
+		if clusterStorage != nil {
+			clusterStorage.Close()
+			clusterStorage = nil
+		}
+		return err
+	}
+	clusterNode = node
+	KVStore.SetConsensus(clusterConsensus{node: node})
+	node.Start()
+	logging.InfoLogger.Printf("started cluster node %s with members %v\n", node.ID(), node.Status().Members)
+
+	http.Handle(raft.PathPrefix, raft.Handler(node, options.Secret))
+	http.HandleFunc("/admin/cluster", ClusterEndpoint)
+	http.HandleFunc("/admin/cluster/members", ClusterEndpoint)
+	return nil
+}
+
+//stopCluster stops taking part in the cluster when the server shuts down. The store has to still be running, as the node may be applying entries to it
+func stopCluster() {
+	clusterLock.Lock()
+	defer clusterLock.Unlock()
+	if clusterNode == nil {
+		return
+	}
+	clusterNode.Stop()
+	if clusterStorage != nil {
+		//a final snapshot of the store, so the node doesn't have to replay its whole log when it restarts
+		if err := clusterNode.Snapshot(); err != nil {
+			logging.ErrorLogger.Println("unable to take a final snapshot of the store", err)
+		}
+	}
+	KVStore.SetConsensus(nil)
+	if clusterStorage != nil {
+		if err := clusterStorage.Close(); err != nil {
+			logging.ErrorLogger.Println("unable to close the cluster's log", err)
+		}
+	}
+}
+
+func currentClusterNode() *raft.Node {
+	clusterLock.RLock()
+	defer clusterLock.RUnlock()
+	return clusterNode
+}
+
+//clusterConsensus commits the store's writes through the node
+type clusterConsensus struct {
+	node *raft.Node
+}
+
+func (c clusterConsensus) Propose(ctx context.Context, command []byte) (interface{}, error) {
+	result, err := c.node.Propose(ctx, command)
+	return result, clusterError(err)
+}
+
+func (c clusterConsensus) ReadIndex(ctx context.Context) error {
+	return clusterError(c.node.ReadIndex(ctx))
+}
+
+//clusterError translates the node's errors into the store's, so the endpoints can handle them like any other
+func clusterError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case raft.ErrNotLeader:
+		return KVStore.ErrNotLeader
+	case raft.ErrStopped:
+		return KVStore.ErrShutdown
+	}
+	logging.WarningLogger.Println("the cluster was unable to commit a request", err)
+	return KVStore.ErrClusterUnavailable
+}
+
+//writeClusterUnavailable tells the client to try again once the cluster has a leader that can commit its request
+func writeClusterUnavailable(w http.ResponseWriter, err error, endpointName string) {
+	if node := currentClusterNode(); node != nil && node.Leader() != "" {
+		w.Header().Set(ClusterLeaderHeader, node.Leader())
+	}
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	WriteWithError(w, err.Error(), endpointName)
+}
+
+//ClusterEndpoint lets admins see the node's view of the cluster with GET /admin/cluster,
+//add a node with POST /admin/cluster/members?address=<url> and remove one with DELETE /admin/cluster/members?address=<url>.
+//Membership changes have to be sent to the leader, and are made one at a time
+func ClusterEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	//check for shutdown and either return or add self to waitgroup
+	select {
+	case <-ShutdownChannel:
+		logging.Warning(r.Context()).Println("attempted to access the cluster endpoint after a shutdown")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "Server is shutting down", "cluster")
+		return
+	default:
+		endpointWaitGroup.Add(1)
+		defer endpointWaitGroup.Done()
+	}
+
+	//login with associated error handling
+	caller, errUsername := GetAuthorisation(r)
+	if errUsername != nil {
+		if errUsername == ErrInvalidAuth {
+			w.WriteHeader(http.StatusForbidden)
+			WriteWithError(w, "Forbidden", "cluster")
+			return
+		} else if errUsername == ErrUnauthorised {
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "cluster")
+			return
+		} else {
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errUsername)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something has gone wrong", "cluster")
+			return
+		}
+	}
+
+	if !caller.IsAdmin() {
+		logging.Warning(r.Context()).Printf("user %s tried to use the cluster endpoint without being an admin\n", caller.Username)
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "cluster")
+		return
+	}
+
+	node := currentClusterNode()
+	switch {
+	case r.URL.Path == "/admin/cluster" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, node.Status(), "cluster")
+		return
+	case r.URL.Path == "/admin/cluster/members" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+	default:
+		logging.Warning(r.Context()).Println("received bad request on the cluster endpoint. Method was", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "cluster")
+		return
+	}
+
+	address := strings.TrimRight(r.URL.Query().Get("address"), "/")
+	if u, err := url.Parse(address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteWithError(w, "address must be the http or https URL of the node", "cluster")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), KVStore.ClusterTimeout)
+	defer cancel()
+	action, change := audit.ActionAddMember, node.AddMember
+	if r.Method == http.MethodDelete {
+		action, change = audit.ActionRemoveMember, node.RemoveMember
+	}
+	err := change(ctx, address)
+	switch err {
+	case nil:
+		logging.Info(r.Context()).Printf("user %s changed the cluster's members with %s %s\n", caller.Username, action, address)
+		recordAudit(r, audit.Event{Action: action, User: caller.Username, Detail: address})
+		writeJSON(w, http.StatusOK, node.Status(), "cluster")
+	case raft.ErrNotLeader, raft.ErrChangeInProgress, raft.ErrAlreadyMember, raft.ErrLastMember:
+		if leader := node.Leader(); leader != "" {
+			w.Header().Set(ClusterLeaderHeader, leader)
+		}
+		w.WriteHeader(http.StatusConflict)
+		WriteWithError(w, err.Error(), "cluster")
+	case raft.ErrNotMember:
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, err.Error(), "cluster")
+	default:
+		logging.Warning(r.Context()).Printf("unable to %s %s. %v\n", action, address, err)
+		recordAudit(r, audit.Event{Action: action, User: caller.Username, Outcome: audit.OutcomeFailure, Detail: address + ": " + err.Error()})
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		WriteWithError(w, err.Error(), "cluster")
+	}
+}
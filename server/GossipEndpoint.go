@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"store/gossip"
+	"store/logging"
+	"strings"
+	"sync"
+	"time"
+)
+
+//GossipOptions configures gossip membership
+type GossipOptions struct {
+	Address          string   //the URL other nodes reach this one on, which is also its ID
+	Seeds            []string //nodes to join through
+	Secret           string   //shared by every node in the cluster
+	Meta             map[string]string
+	ProbeInterval    time.Duration
+	SuspicionTimeout time.Duration
+}
+
+//gossipLeaveTimeout is how long a node shutting down spends telling the others it is leaving
+const gossipLeaveTimeout = 2 * time.Second
+
+var (
+	gossipLock sync.RWMutex
+	gossipNode *gossip.Node //nil unless the server is gossiping
+)
+
+//ConfigureGossip starts this server gossiping with the other nodes, so it finds them and notices when they fail.
+//Must be called after Setup
+func ConfigureGossip(options GossipOptions) error {
+	gossipLock.Lock()
+	defer gossipLock.Unlock()
+	node, err := gossip.NewNode(gossip.Config{
+		ID:               strings.TrimRight(options.Address, "/"),
+		Seeds:            options.Seeds,
+		Meta:             options.Meta,
+		Transport:        gossip.NewHTTPTransport(options.Secret),
+		ProbeInterval:    options.ProbeInterval,
+		SuspicionTimeout: options.SuspicionTimeout,
+	})
+	if err != nil {
+		return err
+	}
+	gossipNode = node
+	node.Start()
+	logging.InfoLogger.Printf("started gossiping as %s with seeds %v\n", node.ID(), options.Seeds)
+
+	http.Handle(gossip.PathPrefix, gossip.Handler(node, options.Secret))
+	http.HandleFunc("/cluster/members", GossipEndpoint)
+	return nil
+}
+
+//stopGossip tells the other nodes this one is leaving when the server shuts down, so they don't have to detect it
+func stopGossip() {
+	gossipLock.Lock()
+	defer gossipLock.Unlock()
+	if gossipNode == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gossipLeaveTimeout)
+	defer cancel()
+	if err := gossipNode.Leave(ctx); err != nil {
+		logging.WarningLogger.Println("unable to tell the other nodes this one is leaving", err)
+	}
+}
+
+//SetGossipMeta changes the metadata spread to the other nodes, e.g. when the configuration is reloaded. It does nothing if the server isn't gossiping
+func SetGossipMeta(meta map[string]string) {
+	if node := currentGossipNode(); node != nil {
+		node.SetMeta(meta)
+	}
+}
+
+func currentGossipNode() *gossip.Node {
+	gossipLock.RLock()
+	defer gossipLock.RUnlock()
+	return gossipNode
+}
+
+//GossipEndpoint lets admins see every member this node knows about with GET /cluster/members, along with their state and metadata
+func GossipEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	//check for shutdown and either return or add self to waitgroup
+	select {
+	case <-ShutdownChannel:
+		logging.Warning(r.Context()).Println("attempted to access the cluster members endpoint after a shutdown")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "Server is shutting down", "members")
+		return
+	default:
+		endpointWaitGroup.Add(1)
+		defer endpointWaitGroup.Done()
+	}
+
+	if r.Method != http.MethodGet {
+		logging.Warning(r.Context()).Println("received bad request on the cluster members endpoint. Method was", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "members")
+		return
+	}
+
+	//login with associated error handling
+	caller, errUsername := GetAuthorisation(r)
+	if errUsername != nil {
+		if errUsername == ErrInvalidAuth {
+			w.WriteHeader(http.StatusForbidden)
+			WriteWithError(w, "Forbidden", "members")
+			return
+		} else if errUsername == ErrUnauthorised {
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "members")
+			return
+		} else {
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errUsername)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something has gone wrong", "members")
+			return
+		}
+	}
+
+	if !caller.IsAdmin() {
+		logging.Warning(r.Context()).Printf("user %s tried to list the cluster members without being an admin\n", caller.Username)
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "members")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, currentGossipNode().Status(), "members")
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net/http"
+	"store/KVStore"
+	"store/logging"
+	"time"
+)
+
+//ReadinessTimeout is how long /readyz waits for the store actor to answer before reporting it as not ready
+var ReadinessTimeout = 2 * time.Second
+
+const (
+	checkOK     = "ok"
+	checkFailed = "failed"
+)
+
+//Check is the result of one component check done by /readyz
+type Check struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latencyMs,omitempty"`
+}
+
+//Readiness is the body returned by /readyz
+type Readiness struct {
+	Status string           `json:"status"` //ready or not ready
+	Checks map[string]Check `json:"checks"`
+}
+
+//HealthEndpoint is the liveness check. It answers as long as the process can serve HTTP, even while shutting down,
+//so orchestrators don't restart a server that is only draining
+func HealthEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		logging.Warning(r.Context()).Println("attempted to access healthz endpoint with method", r.Method)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "healthz")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "alive"}, "healthz")
+}
+
+//ReadyEndpoint is the readiness check. It returns 503 Service Unavailable while the store is starting up, after a
+//shutdown has begun or if a no-op request doesn't make it through the store actor within ReadinessTimeout.
+//The body breaks down which checks passed
+func ReadyEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		logging.Warning(r.Context()).Println("attempted to access readyz endpoint with method", r.Method)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "readyz")
+		return
+	}
+
+	readiness := Readiness{Status: "ready", Checks: map[string]Check{}}
+	fail := func(name, reason string) {
+		readiness.Status = "not ready"
+		readiness.Checks[name] = Check{Status: checkFailed, Error: reason}
+	}
+
+	select {
+	case <-ShutdownChannel:
+		fail("shutdown", "the server is shutting down")
+	default:
+		readiness.Checks["shutdown"] = Check{Status: checkOK}
+	}
+
+	if !KVStore.Ready() {
+		fail("startup", "the store has not finished starting up")
+		fail("store", "not checked until the store has started")
+	} else {
+		readiness.Checks["startup"] = Check{Status: checkOK}
+		start := time.Now()
+		if err := KVStore.Ping(ReadinessTimeout); err != nil {
+			logging.Warning(r.Context()).Println("store actor failed the readiness check", err)
+			fail("store", err.Error())
+		} else {
+			readiness.Checks["store"] = Check{Status: checkOK, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+		}
+	}
+
+	status := http.StatusOK
+	if readiness.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, readiness, "readyz")
+}
@@ -0,0 +1,111 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"store/KVStore"
+	"store/server"
+	"testing"
+	"time"
+)
+
+//checkHealth calls the endpoint directly, so the tests can change the server's state without racing its goroutines
+func checkHealth(t *testing.T, endpoint http.HandlerFunc, path string) (int, server.Readiness) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	endpoint(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	var readiness server.Readiness
+	if err := json.Unmarshal(recorder.Body.Bytes(), &readiness); err != nil {
+		t.Fatalf("%s did not return JSON %q %v\n", path, recorder.Body.String(), err)
+	}
+	return recorder.Code, readiness
+}
+
+//expectChecks checks the status of each named check
+func expectChecks(t *testing.T, readiness server.Readiness, statuses map[string]string) {
+	t.Helper()
+	if len(readiness.Checks) != len(statuses) {
+		t.Errorf("expected the checks %v, got %+v\n", statuses, readiness.Checks)
+	}
+	for name, status := range statuses {
+		if check := readiness.Checks[name]; check.Status != status {
+			t.Errorf("expected the %s check to be %s, got %+v\n", name, status, check)
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	response, body := request(t, http.MethodGet, "/healthz", "", nil)
+	if response.StatusCode != http.StatusOK || body != `{"status":"alive"}` {
+		t.Errorf("expected the server to be alive, got %d %s\n", response.StatusCode, body)
+	}
+	response, body = request(t, http.MethodGet, "/readyz", "", nil)
+	var readiness server.Readiness
+	if response.StatusCode != http.StatusOK || json.Unmarshal([]byte(body), &readiness) != nil || readiness.Status != "ready" {
+		t.Fatalf("expected the server to be ready, got %d %s\n", response.StatusCode, body)
+	}
+	expectChecks(t, readiness, map[string]string{"shutdown": "ok", "startup": "ok", "store": "ok"})
+	if response, _ := request(t, http.MethodPost, "/readyz", "", nil); response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected POST to be refused, got %d\n", response.StatusCode)
+	}
+}
+
+func TestNotReadyWhileActorHung(t *testing.T) {
+	oldTimeout := server.ReadinessTimeout
+	server.ReadinessTimeout = 50 * time.Millisecond
+	defer func() { server.ReadinessTimeout = oldTimeout }()
+
+	resume := KVStore.Pause()
+	status, readiness := checkHealth(t, server.ReadyEndpoint, "/readyz")
+	if status != http.StatusServiceUnavailable || readiness.Status != "not ready" {
+		t.Errorf("expected a hung store actor to make the server not ready, got %d %+v\n", status, readiness)
+	}
+	expectChecks(t, readiness, map[string]string{"shutdown": "ok", "startup": "ok", "store": "failed"})
+	if readiness.Checks["store"].Error != KVStore.ErrPingTimeout.Error() {
+		t.Errorf("expected the store check to have timed out, got %+v\n", readiness.Checks["store"])
+	}
+	if status, _ := checkHealth(t, server.HealthEndpoint, "/healthz"); status != http.StatusOK {
+		t.Errorf("expected the server to still be alive, got %d\n", status)
+	}
+
+	resume()
+	if status, _ := checkHealth(t, server.ReadyEndpoint, "/readyz"); status != http.StatusOK {
+		t.Errorf("expected the server to be ready once the actor carried on, got %d\n", status)
+	}
+}
+
+func TestNotReadyWhileShuttingDown(t *testing.T) {
+	oldShutdown := server.ShutdownChannel
+	shuttingDown := make(chan struct{})
+	close(shuttingDown)
+	server.ShutdownChannel = shuttingDown
+	defer func() { server.ShutdownChannel = oldShutdown }()
+
+	status, readiness := checkHealth(t, server.ReadyEndpoint, "/readyz")
+	if status != http.StatusServiceUnavailable || readiness.Status != "not ready" {
+		t.Errorf("expected a server that is shutting down not to be ready, got %d %+v\n", status, readiness)
+	}
+	expectChecks(t, readiness, map[string]string{"shutdown": "failed", "startup": "ok", "store": "ok"})
+	//orchestrators shouldn't restart a server that is only draining
+	if status, _ := checkHealth(t, server.HealthEndpoint, "/healthz"); status != http.StatusOK {
+		t.Errorf("expected the server to still be alive while shutting down, got %d\n", status)
+	}
+}
+
+func TestNotReadyUntilStarted(t *testing.T) {
+	if err := KVStore.Shutdown(); err != nil {
+		t.Fatal("unable to stop the store", err)
+	}
+	status, readiness := checkHealth(t, server.ReadyEndpoint, "/readyz")
+	if err := KVStore.Startup(100, 100); err != nil {
+		t.Fatal("unable to start the store again", err)
+	}
+	if status != http.StatusServiceUnavailable || readiness.Status != "not ready" {
+		t.Errorf("expected the server not to be ready before the store has started, got %d %+v\n", status, readiness)
+	}
+	expectChecks(t, readiness, map[string]string{"shutdown": "ok", "startup": "failed", "store": "failed"})
+	if status, _ := checkHealth(t, server.ReadyEndpoint, "/readyz"); status != http.StatusOK {
+		t.Errorf("expected the server to be ready once the store has started, got %d\n", status)
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"net/http"
+	"store/logging"
+	"store/users"
+	"strings"
+)
+
+//introspectResponse follows RFC 7662. Only Active is set for tokens that are invalid, expired or unknown
+type introspectResponse struct {
+	Active    bool     `json:"active"`
+	Username  string   `json:"username,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Scope     string   `json:"scope,omitempty"` //space separated permissions
+	Roles     []string `json:"roles,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	KeyPrefix string   `json:"key_prefix,omitempty"` //only set for API keys limited to a prefix
+	EnrolOnly bool     `json:"enrol_only,omitempty"` //the token can only be used to set up two factor authentication
+}
+
+//inspectToken checks a bearer token or an API key and describes it
+func inspectToken(token string) introspectResponse {
+	key, errKey := users.ValidateAPIKey(token)
+	if errKey == users.ErrAPIKeyExpired {
+		return introspectResponse{Active: false}
+	}
+	if errKey == nil {
+		identity, errIdentity := key.Identity()
+		if errIdentity != nil {
+			return introspectResponse{Active: false} //the owner has been removed
+		}
+		response := introspectResponse{
+			Active:    true,
+			Username:  identity.Username,
+			Subject:   identity.Username,
+			Scope:     strings.Join(identity.Permissions().Names(), " "),
+			Roles:     identity.RoleNames(),
+			Groups:    identity.Groups,
+			TokenType: AuthMethodAPIKey,
+			IssuedAt:  key.CreatedAt.Unix(),
+			Issuer:    "KieranKVStore",
+			KeyPrefix: key.KeyPrefix,
+		}
+		if !key.ExpiresAt.IsZero() {
+			response.ExpiresAt = key.ExpiresAt.Unix()
+		}
+		return response
+	}
+
+	claims, ok := users.ParseJWT(token)
+	if !ok {
+		return introspectResponse{Active: false}
+	}
+	identity, errIdentity := claims.Identity()
+	if errIdentity != nil {
+		return introspectResponse{Active: false}
+	}
+	scope := strings.Join(identity.Permissions().Names(), " ")
+	if claims.EnrolOnly {
+		scope = "" //the token can only be used to enrol in two factor authentication
+	}
+	return introspectResponse{
+		Active:    true,
+		Username:  claims.Username,
+		Subject:   claims.Username,
+		Scope:     scope,
+		Roles:     identity.RoleNames(),
+		Groups:    identity.Groups,
+		TokenType: "Bearer",
+		IssuedAt:  claims.IssuedAt,
+		ExpiresAt: claims.ExpiresAt,
+		Issuer:    claims.Issuer,
+		EnrolOnly: claims.EnrolOnly,
+	}
+}
+
+//IntrospectEndpoint lets other services check a token, in the style of RFC 7662. The token to check is sent as the
+//"token" form field of a POST, and can be a bearer token or an API key. Only admins may use it
+func IntrospectEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.Method != http.MethodPost {
+		logging.Warning(r.Context()).Println("attempted to access introspect endpoint with method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "introspect")
+		return
+	}
+
+	caller, errUsername := GetAuthorisation(r)
+	if errUsername != nil {
+		if errUsername == ErrInvalidAuth {
+			w.WriteHeader(http.StatusForbidden)
+			WriteWithError(w, "Forbidden", "introspect")
+			return
+		} else if errUsername == ErrUnauthorised {
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "introspect")
+			return
+		} else {
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errUsername)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something has gone wrong", "introspect")
+			return
+		}
+	}
+	if !caller.IsAdmin() {
+		logging.Warning(r.Context()).Printf("user %s tried to introspect a token without being an admin\n", caller.Username)
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "introspect")
+		return
+	}
+
+	token := strings.TrimSpace(r.PostFormValue("token"))
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteWithError(w, "must provide a token", "introspect")
+		return
+	}
+	writeJSON(w, http.StatusOK, inspectToken(token), "introspect")
+}
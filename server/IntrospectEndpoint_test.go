@@ -0,0 +1,117 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"store/rbac"
+	"store/server"
+	"store/users"
+	"strings"
+	"testing"
+	"time"
+)
+
+//introspection is the body returned by /introspect
+type introspection struct {
+	Active    bool     `json:"active"`
+	Username  string   `json:"username"`
+	Scope     string   `json:"scope"`
+	Roles     []string `json:"roles"`
+	TokenType string   `json:"token_type"`
+	ExpiresAt int64    `json:"exp"`
+	KeyPrefix string   `json:"key_prefix"`
+	EnrolOnly bool     `json:"enrol_only"`
+}
+
+//introspect asks the server about the token, as the caller with the given token
+func introspect(t *testing.T, callerToken, token string) (int, introspection) {
+	t.Helper()
+	headers := bearer(callerToken)
+	headers["Content-Type"] = "application/x-www-form-urlencoded"
+	response, body := request(t, http.MethodPost, "/introspect", url.Values{"token": {token}}.Encode(), headers)
+	var result introspection
+	if response.StatusCode == http.StatusOK && json.Unmarshal([]byte(body), &result) != nil {
+		t.Fatalf("introspect did not return JSON %s\n", body)
+	}
+	return response.StatusCode, result
+}
+
+func TestIntrospect(t *testing.T) {
+	useLockoutPolicy(t, users.DefaultLockoutPolicy)
+	//a full admin token, as logging in would need a one time code
+	adminToken, err := users.IssueJWT("admin", users.BackendLocal, false)
+	if err != nil {
+		t.Fatal("unable to issue an admin token", err)
+	}
+	_, userToken := login(t, "user_a", "passwordA", nil)
+
+	status, result := introspect(t, adminToken, userToken)
+	writerScope := strings.Join(rbac.RoleWriter.Permissions().Names(), " ")
+	if status != http.StatusOK || !result.Active || result.Username != "user_a" || result.Scope != writerScope || result.TokenType != "Bearer" {
+		t.Errorf("expected an active token for user_a with a writer's scope, got %d %+v\n", status, result)
+	}
+	if result.ExpiresAt == 0 || result.EnrolOnly {
+		t.Errorf("expected a full token with an expiry, got %+v\n", result)
+	}
+
+	//only admins can look at other people's tokens
+	if status, _ := introspect(t, userToken, adminToken); status != http.StatusForbidden {
+		t.Errorf("expected a non-admin to be forbidden, got %d\n", status)
+	}
+	if status, _ := introspect(t, adminToken, ""); status != http.StatusBadRequest {
+		t.Errorf("expected a missing token to be a bad request, got %d\n", status)
+	}
+	if status, result := introspect(t, adminToken, userToken+"x"); status != http.StatusOK || result.Active {
+		t.Errorf("expected a tampered token to be inactive, got %d %+v\n", status, result)
+	}
+}
+
+func TestIntrospectScopedAPIKey(t *testing.T) {
+	adminToken, err := users.IssueJWT("admin", users.BackendLocal, false)
+	if err != nil {
+		t.Fatal("unable to issue an admin token", err)
+	}
+	defer users.WipeAPIKeys()
+	apiKey, key, err := users.MintAPIKey("user_a", "batch_", true, time.Hour, "admin")
+	if err != nil {
+		t.Fatal("unable to mint an API key", err)
+	}
+	status, result := introspect(t, adminToken, apiKey)
+	readOnlyScope := strings.Join(key.Scope().Permissions.Names(), " ")
+	if status != http.StatusOK || !result.Active || result.Username != "user_a" || result.TokenType != server.AuthMethodAPIKey {
+		t.Errorf("expected an active API key for user_a, got %d %+v\n", status, result)
+	}
+	if result.Scope != readOnlyScope || result.KeyPrefix != "batch_" || result.ExpiresAt != key.ExpiresAt.Unix() {
+		t.Errorf("expected the key's reduced scope, prefix and expiry, got %+v\n", result)
+	}
+	//an admin's API key still can't introspect, as scoped identities are never admins
+	adminKey, _, err := users.MintAPIKey("admin", "", false, time.Hour, "admin")
+	if err != nil {
+		t.Fatal("unable to mint an API key", err)
+	}
+	response, _ := request(t, http.MethodPost, "/introspect", url.Values{"token": {apiKey}}.Encode(), map[string]string{
+		"X-API-Key":    adminKey,
+		"Content-Type": "application/x-www-form-urlencoded",
+	})
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("expected an admin's API key to be forbidden, got %d\n", response.StatusCode)
+	}
+}
+
+func TestIntrospectEnrolOnlyToken(t *testing.T) {
+	useLockoutPolicy(t, users.DefaultLockoutPolicy)
+	adminToken, err := users.IssueJWT("admin", users.BackendLocal, false)
+	if err != nil {
+		t.Fatal("unable to issue an admin token", err)
+	}
+	_, enrolToken := login(t, "admin", "Password1", nil)
+	status, result := introspect(t, adminToken, enrolToken)
+	if status != http.StatusOK || !result.Active || !result.EnrolOnly || result.Scope != "" {
+		t.Errorf("expected an enrolment token to be flagged and have no scope, got %d %+v\n", status, result)
+	}
+	//and it can't be used to introspect either
+	if status, _ := introspect(t, enrolToken, adminToken); status != http.StatusUnauthorized {
+		t.Errorf("expected an enrolment token to be unauthorised, got %d\n", status)
+	}
+}
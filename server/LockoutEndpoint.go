@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http"
+	"store/audit"
+	"store/logging"
+	"store/rbac"
+	"store/users"
+)
+
+//LockoutEndpoint lets admins see which usernames and IPs have failed logins recorded against them,
+//and clear them with DELETE /admin/lockouts?user=name or ?ip=address. Requires the manage-users permission
+func LockoutEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	//check for shutdown and either return or add self to waitgroup
+	select {
+	case <-ShutdownChannel:
+		logging.Warning(r.Context()).Println("attempted to access the lockouts endpoint after a shutdown")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "Server is shutting down", "lockouts")
+		return
+	default:
+		endpointWaitGroup.Add(1)
+		defer endpointWaitGroup.Done()
+	}
+
+	//login with associated error handling
+	caller, errUsername := GetAuthorisation(r)
+	if errUsername != nil {
+		if errUsername == ErrInvalidAuth {
+			w.WriteHeader(http.StatusForbidden)
+			WriteWithError(w, "Forbidden", "lockouts")
+			return
+		} else if errUsername == ErrUnauthorised {
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "lockouts")
+			return
+		} else {
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errUsername)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something has gone wrong", "lockouts")
+			return
+		}
+	}
+
+	if !caller.Can(rbac.PermManageUsers) {
+		logging.Warning(r.Context()).Printf("user %s tried to manage lockouts without the manage-users permission\n", caller.Username)
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "lockouts")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, users.LoginGuard.Lockouts(), "lockouts")
+	case http.MethodDelete:
+		kind, subject := users.LockoutUser, r.URL.Query().Get("user")
+		if subject == "" {
+			kind, subject = users.LockoutIP, r.URL.Query().Get("ip")
+		}
+		if subject == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteWithError(w, "must provide a user or ip to clear", "lockouts")
+			return
+		}
+		if !users.LoginGuard.Clear(kind, subject) {
+			w.WriteHeader(http.StatusNotFound)
+			WriteWithError(w, "404 lockout not found", "lockouts")
+			return
+		}
+		logging.Info(r.Context()).Printf("user %s cleared the lockout on %s %s\n", caller.Username, kind, subject)
+		recordAudit(r, audit.Event{Action: audit.ActionClearLockout, User: caller.Username, Detail: kind + " " + subject})
+		w.WriteHeader(http.StatusOK)
+		WriteWithError(w, "OK", "lockouts")
+	default:
+		logging.Warning(r.Context()).Println("received bad request on the lockouts endpoint. Method was", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "lockouts")
+	}
+}
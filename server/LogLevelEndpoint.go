@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"store/logging"
+	"strings"
+)
+
+//LogLevelEndpoint lets admins see and change the minimum log level while the server is running.
+//GET /admin/loglevel returns the current level and PUT /admin/loglevel with a level (debug, info, warning or error) as the body changes it
+func LogLevelEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	//login with associated error handling
+	caller, errUsername := GetAuthorisation(r)
+	if errUsername != nil {
+		if errUsername == ErrInvalidAuth {
+			w.WriteHeader(http.StatusForbidden)
+			WriteWithError(w, "Forbidden", "loglevel")
+			return
+		} else if errUsername == ErrUnauthorised {
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "loglevel")
+			return
+		} else {
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errUsername)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something has gone wrong", "loglevel")
+			return
+		}
+	}
+
+	if !caller.IsAdmin() {
+		logging.Warning(r.Context()).Printf("user %s tried to change the log level without being an admin\n", caller.Username)
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "loglevel")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.WriteHeader(http.StatusOK)
+		WriteWithError(w, strings.ToLower(logging.GetLevel().String()), "loglevel")
+	case http.MethodPut:
+		body, err := readBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteWithError(w, "must provide a level", "loglevel")
+			return
+		}
+		level, err := logging.ParseLevel(strings.TrimSpace(body))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			WriteWithError(w, "level must be one of debug, info, warning or error", "loglevel")
+			return
+		}
+		logging.SetLevel(level)
+		logging.Info(r.Context()).Printf("user %s set the log level to %s\n", caller.Username, level)
+		w.WriteHeader(http.StatusOK)
+		WriteWithError(w, "OK", "loglevel")
+	default:
+		logging.Warning(r.Context()).Println("received bad request on the loglevel endpoint. Method was", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "loglevel")
+	}
+}
@@ -1,37 +1,92 @@
-package server
-
-import (
-	"net/http"
-	"store/logging"
-	"store/users"
-)
-
-func LoginEndpoint(w http.ResponseWriter, r *http.Request) {
-	logging.LogAccessRequest(r)
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	if r.Method != http.MethodGet {
-		logging.WarningLogger.Println("attempted to access login endpoint with method", r.Method)
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		WriteWithError(w, "invalid http method", "login")
-		return
-	}
-	user, password, ok := r.BasicAuth()
-	if !ok {
-		logging.WarningLogger.Println("tried to login without providing basic auth")
-		w.WriteHeader(http.StatusBadRequest)
-		WriteWithError(w, "Must provide basic auth", "login")
-		return
-	}
-	token, err := users.GenerateJWT(user, password) //this includes a password check
-	if err != nil {
-		logging.WarningLogger.Println("attempt to login with invalid details")
-		w.WriteHeader(http.StatusUnauthorized)
-		WriteWithError(w, "Unauthorised", "login")
-		return
-	}
-	// should I add it as a cookie?
-	logging.InfoLogger.Printf("user %s successfully logged in\n", user)
-	output := "Bearer " + token
-	w.WriteHeader(http.StatusOK)
-	WriteWithError(w, output, "login")
-}
+package server
+
+import (
+	"math"
+	"net/http"
+	"store/audit"
+	"store/logging"
+	"store/users"
+	"strconv"
+)
+
+func LoginEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.Method != http.MethodGet {
+		logging.Warning(r.Context()).Println("attempted to access login endpoint with method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "login")
+		return
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		logging.Warning(r.Context()).Println("tried to login without providing basic auth")
+		w.WriteHeader(http.StatusBadRequest)
+		WriteWithError(w, "Must provide basic auth", "login")
+		return
+	}
+	//check for too many failed attempts before doing any expensive password hashing. If the login may go ahead the attempt is
+	//reserved, so it has to end with Failure, Success or Release
+	ip := clientIP(r)
+	if wait := users.LoginGuard.Check(user, ip); wait > 0 {
+		logging.Warning(r.Context()).Printf("rejected login for user %s from %s, too many failed attempts\n", user, ip)
+		recordAudit(r, audit.Event{Action: audit.ActionLogin, User: user, Outcome: audit.OutcomeDenied, Detail: "too many failed attempts"})
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		WriteWithError(w, "Too many failed login attempts", "login")
+		return
+	}
+	backend, ok := users.AuthenticateUser(user, password)
+	if !ok {
+		logging.Warning(r.Context()).Println("attempt to login with invalid details")
+		recordAudit(r, audit.Event{Action: audit.ActionLogin, User: user, Outcome: audit.OutcomeFailure, Detail: "invalid password"})
+		users.LoginGuard.Failure(user, ip)
+		w.WriteHeader(http.StatusUnauthorized)
+		WriteWithError(w, "Unauthorised", "login")
+		return
+	}
+	enrolOnly := false
+	if users.TOTPEnrolled(user) {
+		code := r.Header.Get(TOTPHeader)
+		if code == "" {
+			logging.Info(r.Context()).Printf("user %s needs a one time code to log in\n", user)
+			users.LoginGuard.Release(user, ip)
+			w.Header().Set(TOTPHeader, "required")
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "One time code required", "login")
+			return
+		}
+		if !users.CheckSecondFactor(user, code) {
+			logging.Warning(r.Context()).Printf("user %s gave an invalid one time code\n", user)
+			recordAudit(r, audit.Event{Action: audit.ActionLogin, User: user, Outcome: audit.OutcomeFailure, Detail: "invalid one time code"})
+			users.LoginGuard.Failure(user, ip)
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "login")
+			return
+		}
+	} else if identity, _ := users.IdentityFor(user, backend); users.TOTPRequiredFor(identity) {
+		//the user may only set up two factor authentication until they have done so
+		logging.Warning(r.Context()).Printf("user %s must enrol in two factor authentication\n", user)
+		w.Header().Set(TOTPHeader, "enrol")
+		enrolOnly = true
+	}
+	token, err := users.IssueJWT(user, backend, enrolOnly)
+	if err != nil {
+		logging.Error(r.Context()).Println("unable to create token", err)
+		users.LoginGuard.Release(user, ip)
+		w.WriteHeader(http.StatusInternalServerError)
+		WriteWithError(w, "something went wrong", "login")
+		return
+	}
+	users.LoginGuard.Success(user, ip)
+	setAccessUser(r, user)
+	if enrolOnly {
+		recordAudit(r, audit.Event{Action: audit.ActionLogin, User: user, Detail: "enrolment only"})
+	} else {
+		recordAudit(r, audit.Event{Action: audit.ActionLogin, User: user})
+	}
+	// should I add it as a cookie?
+	logging.Info(r.Context()).Printf("user %s successfully logged in\n", user)
+	output := "Bearer " + token
+	w.WriteHeader(http.StatusOK)
+	WriteWithError(w, output, "login")
+}
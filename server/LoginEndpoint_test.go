@@ -0,0 +1,165 @@
+package server_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"store/server"
+	"store/users"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogin(t *testing.T) {
+	clock := useLockoutPolicy(t, users.DefaultLockoutPolicy)
+	if response, _ := login(t, "user_a", "wrong", nil); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a wrong password to be unauthorised, got %d\n", response.StatusCode)
+	}
+	clock.Add(users.DefaultLockoutPolicy.BaseDelay) //wait out the back off after the failure
+
+	response, token := login(t, "user_a", "passwordA", nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unable to log in, got %d\n", response.StatusCode)
+	}
+	if response, body := request(t, http.MethodPut, "/store/login_test", "value", bearer(token)); response.StatusCode != http.StatusOK {
+		t.Errorf("unable to use the token, got %d %s\n", response.StatusCode, body)
+	}
+	if response, _ := request(t, http.MethodGet, "/store/login_test", "", bearer(token+"x")); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a tampered token to be unauthorised, got %d\n", response.StatusCode)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	clock := useLockoutPolicy(t, users.LockoutPolicy{
+		UserThreshold:   2,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Second,
+		LockoutDuration: time.Minute,
+		ResetAfter:      time.Hour,
+	})
+
+	if response, _ := login(t, "user_b", "wrong", nil); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a wrong password to be unauthorised, got %d\n", response.StatusCode)
+	}
+	//trying again straight away has to back off, even with the right password
+	response, _ := login(t, "user_b", "passwordB", nil)
+	if response.StatusCode != http.StatusTooManyRequests || response.Header.Get("Retry-After") != "1" {
+		t.Errorf("expected to be told to retry after 1s, got %d with Retry-After %q\n", response.StatusCode, response.Header.Get("Retry-After"))
+	}
+
+	clock.Add(time.Second)
+	login(t, "user_b", "wrong", nil)
+	response, _ = login(t, "user_b", "passwordB", nil)
+	if response.StatusCode != http.StatusTooManyRequests || response.Header.Get("Retry-After") != "60" {
+		t.Errorf("expected to be locked out for a minute, got %d with Retry-After %q\n", response.StatusCode, response.Header.Get("Retry-After"))
+	}
+
+	clock.Add(time.Minute)
+	if response, _ := login(t, "user_b", "passwordB", nil); response.StatusCode != http.StatusOK {
+		t.Errorf("unable to log in once the lockout was over, got %d\n", response.StatusCode)
+	}
+}
+
+func TestConcurrentGuesses(t *testing.T) {
+	clock := useLockoutPolicy(t, users.LockoutPolicy{
+		UserThreshold:   3,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Second,
+		LockoutDuration: time.Minute,
+		ResetAfter:      time.Hour,
+	})
+	//guesses sent at the same time can't all get past the lockout check while the first ones are still hashing passwords
+	statuses := make(chan int, 20)
+	var wait sync.WaitGroup
+	for i := 0; i < cap(statuses); i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			response, _ := login(t, "user_c", "wrong", nil)
+			statuses <- response.StatusCode
+		}()
+	}
+	wait.Wait()
+	close(statuses)
+	checked := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusUnauthorized:
+			checked++
+		case http.StatusTooManyRequests:
+		default:
+			t.Errorf("expected guesses to be unauthorised or throttled, got %d\n", status)
+		}
+	}
+	if checked == 0 || checked > 3 {
+		t.Errorf("expected at most the threshold of 3 guesses to be checked, %d were\n", checked)
+	}
+
+	//none of the attempts are left reserved once they have finished
+	clock.Add(time.Minute)
+	if response, _ := login(t, "user_c", "passwordC", nil); response.StatusCode != http.StatusOK {
+		t.Errorf("unable to log in once the guesses were over, got %d\n", response.StatusCode)
+	}
+}
+
+func TestTrustedProxy(t *testing.T) {
+	clock := useLockoutPolicy(t, users.LockoutPolicy{
+		UserThreshold:   100,
+		IPThreshold:     2,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Second,
+		LockoutDuration: time.Minute,
+		ResetAfter:      time.Hour,
+	})
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	server.TrustedProxies = []*net.IPNet{loopback}
+	defer func() { server.TrustedProxies = nil }()
+
+	//failures from one client behind the proxy lock out that client, not everyone coming through the proxy
+	for _, username := range []string{"user_a", "user_b"} {
+		login(t, username, "wrong", map[string]string{"X-Forwarded-For": "198.51.100.1"})
+		clock.Add(time.Second)
+	}
+	if response, _ := login(t, "user_c", "passwordC", map[string]string{"X-Forwarded-For": "198.51.100.1"}); response.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected the client to be locked out, got %d\n", response.StatusCode)
+	}
+	//addresses the client added itself are ignored, as only the last one was added by the proxy
+	if response, _ := login(t, "user_c", "passwordC", map[string]string{"X-Forwarded-For": "198.51.100.2, 198.51.100.1"}); response.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected the client to be locked out whatever it put in X-Forwarded-For, got %d\n", response.StatusCode)
+	}
+	if response, _ := login(t, "user_c", "passwordC", map[string]string{"X-Forwarded-For": "198.51.100.2"}); response.StatusCode != http.StatusOK {
+		t.Errorf("expected a different client behind the proxy to be able to log in, got %d\n", response.StatusCode)
+	}
+}
+
+func TestRemovedUser(t *testing.T) {
+	useLockoutPolicy(t, users.DefaultLockoutPolicy)
+	response, token := login(t, "user_c", "passwordC", nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unable to log in, got %d\n", response.StatusCode)
+	}
+	apiKey, _, err := users.MintAPIKey("user_c", "", true, time.Hour, "admin")
+	if err != nil {
+		t.Fatal("unable to mint an API key", err)
+	}
+	defer users.WipeAPIKeys()
+
+	path := filepath.Join(t.TempDir(), "users.csv")
+	if err := ioutil.WriteFile(path, []byte("user_a,passwordA,writer\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.ReloadUserDB(path); err != nil {
+		t.Fatal("unable to reload the users", err)
+	}
+	defer users.ReloadUserDB("../users/users.csv")
+
+	//a user removed from the users file can't carry on with a token or API key they already had
+	if response, _ := request(t, http.MethodGet, "/store/login_test", "", bearer(token)); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the removed user's token to be unauthorised, got %d\n", response.StatusCode)
+	}
+	if response, _ := request(t, http.MethodGet, "/store/login_test", "", map[string]string{"X-API-Key": apiKey}); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the removed user's API key to be unauthorised, got %d\n", response.StatusCode)
+	}
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"net/http"
+	"store/logging"
+	"store/metrics"
+)
+
+//MetricsEndpoint serves the server's metrics in the Prometheus text format. Like /ping it doesn't need a login,
+//so it can be scraped, and only exposes counts and timings rather than anything from the store
+func MetricsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		logging.Warning(r.Context()).Println("attempted to access metrics endpoint with method", r.Method)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "metrics")
+		return
+	}
+	w.Header().Set("Content-Type", metrics.ContentType)
+	w.WriteHeader(http.StatusOK)
+	if err := metrics.WriteText(w); err != nil {
+		logging.Error(r.Context()).Println("unable to write metrics", err)
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net/http"
+	"store/KVStore"
+	"store/logging"
+	"store/rbac"
+	"strings"
+)
+
+//NamespaceEndpoint gives access to keys in a specific user's namespace, for keys that have been shared or for admins.
+//Requests to /ns/{user}/{key} behave like /store/{key}, and GET /ns/{user}/ lists the keys in the namespace that the caller can see.
+//Only registered when the KV store is running in namespaced mode
+func NamespaceEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	//check for shutdown and either return or add self to waitgroup
+	select {
+	case <-ShutdownChannel:
+		logging.Warning(r.Context()).Println("attempted to access the ns endpoint after a shutdown")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "Server is shutting down", "ns")
+		return
+	default:
+		endpointWaitGroup.Add(1)
+		defer endpointWaitGroup.Done()
+	}
+
+	//extract the namespace and key. Any further path arguments are ignored
+	pathArgString := strings.TrimPrefix(r.URL.Path, "/ns")
+	trimmedPathArgString := strings.Trim(pathArgString, "/ ")
+	pathArgs := strings.Split(trimmedPathArgString, "/")
+	namespace := pathArgs[0]
+	if namespace == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteWithError(w, "must provide a namespace in the url path", "ns")
+		return
+	}
+	key := ""
+	if len(pathArgs) > 1 {
+		key = pathArgs[1]
+	}
+
+	//login with associated error handling
+	caller, errUsername := GetAuthorisation(r)
+	if errUsername != nil {
+		if errUsername == ErrInvalidAuth {
+			w.WriteHeader(http.StatusForbidden)
+			WriteWithError(w, "Forbidden", "ns")
+			return
+		} else if errUsername == ErrUnauthorised {
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "ns")
+			return
+		} else {
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errUsername)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something has gone wrong", "ns")
+			return
+		}
+	}
+
+	if key != "" {
+		serveKey(w, r, caller, namespace, key, "ns")
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		logging.Warning(r.Context()).Println("attempted to list a namespace with method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "ns")
+		return
+	}
+	if !caller.Can(rbac.PermList) {
+		logging.Warning(r.Context()).Printf("user %s tried to list a namespace without the list permission\n", caller.Username)
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "ns")
+		return
+	}
+
+	storeResponse, storeErr := KVStore.WithContext(r.Context()).ListNamespace(namespace, caller)
+	switch storeErr {
+	case KVStore.ErrShutdown:
+		logging.Warning(r.Context()).Println("Server entered shutdown routine. Unable to Process request")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "Server is shutting down", "ns")
+		return
+	case KVStore.ErrNotLeader, KVStore.ErrClusterUnavailable:
+		writeClusterUnavailable(w, storeErr, "ns")
+		return
+	case KVStore.ErrUnauthorized:
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "ns")
+		return
+	case nil:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, err := w.Write(storeResponse)
+		if err != nil {
+			logging.Error(r.Context()).Println("error writing in the ns endpoint.", err)
+		}
+		return
+	default:
+		logging.Error(r.Context()).Println("unexpected error from the list interface", storeErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		WriteWithError(w, "something went wrong", "ns")
+		return
+	}
+}
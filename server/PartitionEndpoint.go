@@ -0,0 +1,349 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"store/audit"
+	"store/logging"
+	"store/partition"
+	"store/tracing"
+	"strings"
+	"sync"
+	"time"
+)
+
+//PartitionOptions configures partition mode
+type PartitionOptions struct {
+	Address      string   //the URL other nodes reach this one on
+	Nodes        []string //the nodes on the ring. A new node is given the existing ones, then added through /admin/partition/nodes
+	Secret       string   //shared by every node on the ring
+	VirtualNodes int
+}
+
+//PartitionOwnerHeader is set on responses for a key to say which node owns it
+const PartitionOwnerHeader = "X-Partition-Owner"
+
+//partitionTimeout is how long a request waits for its key to be moved here, or a change to the ring waits for the other nodes
+const partitionTimeout = 5 * time.Second
+
+var (
+	partitionLock   sync.RWMutex
+	partitionNode   *partition.Node //nil unless the server is in partition mode
+	partitionSecret string
+	partitionClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+//ConfigurePartitioning puts this server on the ring, so requests for keys other nodes own are passed on to them,
+//and starts moving the keys this node owns here. Must be called after Setup
+func ConfigurePartitioning(options PartitionOptions) error {
+	partitionLock.Lock()
+	defer partitionLock.Unlock()
+	node := partition.NewNode(options.Address, options.Nodes, options.Secret, options.VirtualNodes, partition.LocalStore{})
+	node.Start()
+	partitionNode, partitionSecret = node, options.Secret
+	logging.InfoLogger.Printf("started partition node %s with nodes %v\n", node.Address(), node.Ring().Nodes())
+
+	http.Handle(partition.PathPrefix, node)
+	http.HandleFunc("/admin/partition", PartitionEndpoint)
+	http.HandleFunc("/admin/partition/nodes", PartitionEndpoint)
+	return nil
+}
+
+//stopPartitioning stops moving keys here when the server shuts down. The store has to still be running, as a batch may be being imported
+func stopPartitioning() {
+	partitionLock.Lock()
+	defer partitionLock.Unlock()
+	if partitionNode == nil {
+		return
+	}
+	partitionNode.Stop()
+}
+
+func currentPartitionNode() *partition.Node {
+	partitionLock.RLock()
+	defer partitionLock.RUnlock()
+	return partitionNode
+}
+
+//partitionKey works out which key a request is for. routed is false for requests that aren't for the store, or are missing
+//a key the endpoint needs, which are handled here. An empty key with routed set is a listing, which needs every node's keys
+func partitionKey(r *http.Request) (key string, routed bool) {
+	for _, prefix := range []string{"/store", "/acl", "/list"} {
+		if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			continue
+		}
+		key = strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/ "), "/")[0]
+		return key, key != "" || prefix == "/list"
+	}
+	if strings.HasPrefix(r.URL.Path, "/ns/") {
+		pathArgs := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/ns"), "/ "), "/")
+		if len(pathArgs) > 1 && pathArgs[1] != "" {
+			return pathArgs[1], true
+		}
+		return "", pathArgs[0] != "" && r.Method == http.MethodGet
+	}
+	return "", false
+}
+
+//setPartitionHeaders marks a request passed on to another node as coming from this one, so it is handled there,
+//and carries the request ID and trace along with it
+func setPartitionHeaders(ctx context.Context, r *http.Request) {
+	partitionLock.RLock()
+	r.Header.Set(partition.SecretHeader, partitionSecret)
+	partitionLock.RUnlock()
+	r.Header.Set(RequestIDHeader, logging.RequestID(ctx))
+	if span := tracing.SpanFromContext(ctx).SpanContext(); span.IsValid() {
+		r.Header.Set(tracing.TraceparentHeader, span.Traceparent())
+	}
+}
+
+//proxyToOwner passes the request on to the node that owns its key, and sends back whatever it replies
+func proxyToOwner(w http.ResponseWriter, r *http.Request, owner string) {
+	target, err := url.Parse(owner)
+	if err != nil {
+		logging.Error(r.Context()).Println("the partition ring has an invalid node", owner, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		WriteWithError(w, "something has gone wrong", "partition")
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL.Scheme, out.URL.Host, out.Host = target.Scheme, target.Host, target.Host
+			setPartitionHeaders(r.Context(), out)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logging.Warning(r.Context()).Println("unable to pass a request on to", owner, err)
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusBadGateway)
+			WriteWithError(w, "unable to reach the node that owns the key", "partition")
+		},
+	}
+	logging.Debug(r.Context()).Println("passing a request on to the key's owner", owner)
+	proxy.ServeHTTP(w, r)
+}
+
+//nodeReply is one node's response to a listing
+type nodeReply struct {
+	status      int
+	contentType string
+	body        []byte
+	err         error
+}
+
+//bufferedResponse keeps this node's response to a listing, so it can be combined with the others'
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(data)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+//listEveryNode sends a listing to every node on the ring, and replies with all of their keys together.
+//If any node refuses it, e.g. because the caller isn't allowed to list, that node's reply is sent instead
+func listEveryNode(w http.ResponseWriter, r *http.Request, node *partition.Node, local http.Handler) {
+	nodes := node.Ring().Nodes()
+	replies := make([]nodeReply, len(nodes))
+	var wg sync.WaitGroup
+	for i, address := range nodes {
+		wg.Add(1)
+		go func(reply *nodeReply, address string) {
+			defer wg.Done()
+			if address == node.Address() {
+				buffered := &bufferedResponse{header: http.Header{}}
+				local.ServeHTTP(buffered, r)
+				*reply = nodeReply{status: buffered.status, contentType: buffered.header.Get("Content-Type"), body: buffered.body.Bytes()}
+				return
+			}
+			*reply = listNode(r, address)
+		}(&replies[i], address)
+	}
+	wg.Wait()
+
+	keys := []json.RawMessage{}
+	for i, reply := range replies {
+		if reply.err != nil {
+			logging.Warning(r.Context()).Println("unable to list the keys on", nodes[i], reply.err)
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusBadGateway)
+			WriteWithError(w, "unable to reach every node", "partition")
+			return
+		}
+		if reply.status != http.StatusOK {
+			w.Header().Set("Content-Type", reply.contentType)
+			w.WriteHeader(reply.status)
+			if _, err := w.Write(reply.body); err != nil {
+				logging.Error(r.Context()).Println("error writing a listing from", nodes[i], err)
+			}
+			return
+		}
+		var nodeKeys []json.RawMessage
+		if err := json.Unmarshal(reply.body, &nodeKeys); err != nil {
+			logging.Error(r.Context()).Println("unable to read the keys listed by", nodes[i], err)
+			w.WriteHeader(http.StatusBadGateway)
+			WriteWithError(w, "a node sent an invalid listing", "partition")
+			return
+		}
+		keys = append(keys, nodeKeys...)
+	}
+	writeJSON(w, http.StatusOK, keys, "list")
+}
+
+//listNode sends the listing to another node
+func listNode(r *http.Request, address string) nodeReply {
+	request, err := http.NewRequest(http.MethodGet, address+r.URL.RequestURI(), nil)
+	if err != nil {
+		return nodeReply{err: err}
+	}
+	request.Header = r.Header.Clone()
+	setPartitionHeaders(r.Context(), request)
+	response, err := partitionClient.Do(request.WithContext(r.Context()))
+	if err != nil {
+		return nodeReply{err: err}
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 512<<20))
+	return nodeReply{status: response.StatusCode, contentType: response.Header.Get("Content-Type"), body: body, err: err}
+}
+
+//PartitionEndpoint lets admins see the node's view of the ring with GET /admin/partition,
+//add a node with POST /admin/partition/nodes?address=<url> and remove one with DELETE /admin/partition/nodes?address=<url>.
+//Changes can be sent to any node, and are made one at a time once the keys from the last one have been moved
+func PartitionEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	//check for shutdown and either return or add self to waitgroup
+	select {
+	case <-ShutdownChannel:
+		logging.Warning(r.Context()).Println("attempted to access the partition endpoint after a shutdown")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "Server is shutting down", "partition")
+		return
+	default:
+		endpointWaitGroup.Add(1)
+		defer endpointWaitGroup.Done()
+	}
+
+	//login with associated error handling
+	caller, errUsername := GetAuthorisation(r)
+	if errUsername != nil {
+		if errUsername == ErrInvalidAuth {
+			w.WriteHeader(http.StatusForbidden)
+			WriteWithError(w, "Forbidden", "partition")
+			return
+		} else if errUsername == ErrUnauthorised {
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "partition")
+			return
+		} else {
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errUsername)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something has gone wrong", "partition")
+			return
+		}
+	}
+
+	if !caller.IsAdmin() {
+		logging.Warning(r.Context()).Printf("user %s tried to use the partition endpoint without being an admin\n", caller.Username)
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "partition")
+		return
+	}
+
+	node := currentPartitionNode()
+	switch {
+	case r.URL.Path == "/admin/partition" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, node.Status(), "partition")
+		return
+	case r.URL.Path == "/admin/partition/nodes" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+	default:
+		logging.Warning(r.Context()).Println("received bad request on the partition endpoint. Method was", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "partition")
+		return
+	}
+
+	address := strings.TrimRight(r.URL.Query().Get("address"), "/")
+	if u, err := url.Parse(address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		WriteWithError(w, "address must be the http or https URL of the node", "partition")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), partitionTimeout)
+	defer cancel()
+	action, change := audit.ActionAddMember, node.AddNode
+	if r.Method == http.MethodDelete {
+		action, change = audit.ActionRemoveMember, node.RemoveNode
+	}
+	err := change(ctx, address)
+	if unreachable, ok := err.(*partition.UnreachableError); ok {
+		//the ring has changed, and the nodes that weren't told pick it up from the others, so this isn't a failure
+		logging.Warning(r.Context()).Println(unreachable)
+		logging.Info(r.Context()).Printf("user %s changed the partition ring with %s %s\n", caller.Username, action, address)
+		recordAudit(r, audit.Event{Action: action, User: caller.Username, Detail: address + ". " + unreachable.Error()})
+		writeJSON(w, http.StatusAccepted, struct {
+			partition.Status
+			Unreachable []string `json:"unreachable"`
+		}{node.Status(), unreachable.Nodes}, "partition")
+		return
+	}
+	switch err {
+	case nil:
+		logging.Info(r.Context()).Printf("user %s changed the partition ring with %s %s\n", caller.Username, action, address)
+		recordAudit(r, audit.Event{Action: action, User: caller.Username, Detail: address})
+		writeJSON(w, http.StatusOK, node.Status(), "partition")
+	case partition.ErrMigrating, partition.ErrAlreadyNode, partition.ErrLastNode:
+		w.WriteHeader(http.StatusConflict)
+		WriteWithError(w, err.Error(), "partition")
+	case partition.ErrNotNode:
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, err.Error(), "partition")
+	default:
+		logging.Warning(r.Context()).Printf("unable to %s %s. %v\n", action, address, err)
+		recordAudit(r, audit.Event{Action: action, User: caller.Username, Outcome: audit.OutcomeFailure, Detail: address + ": " + err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		WriteWithError(w, err.Error(), "partition")
+	}
+}
+
+//writePartitionUnavailable tells the client to try again once the key has been moved to the node that now owns it
+func writePartitionUnavailable(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	WriteWithError(w, "the key is being moved to this node: "+err.Error(), "partition")
+}
+
+//servePartitioned handles a request for a key on the node that owns it, once the key has been moved here
+func servePartitioned(w http.ResponseWriter, r *http.Request, node *partition.Node, key string, next http.Handler) {
+	ctx, cancel := context.WithTimeout(r.Context(), partitionTimeout)
+	err := node.Claim(ctx, key)
+	cancel()
+	if err != nil {
+		logging.Warning(r.Context()).Printf("unable to move %s here before handling a request for it. %v\n", key, err)
+		writePartitionUnavailable(w, err)
+		return
+	}
+	next.ServeHTTP(w, r)
+}
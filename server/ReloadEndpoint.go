@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"store/audit"
+	"store/config"
+	"store/logging"
+	"strings"
+)
+
+//ReloadReport says what reloading the configuration changed
+type ReloadReport struct {
+	Applied         []config.Change `json:"applied"`
+	RestartRequired []config.Change `json:"restartRequired"` //changed, but only take effect after a restart
+	Failed          []config.Change `json:"failed"`          //couldn't be applied, so the old setting is still in use
+	Evicted         int             `json:"evicted"`         //keys evicted because the depth was lowered
+}
+
+//ErrReloadFailed is returned with the report when some changes couldn't be applied
+var ErrReloadFailed = errors.New("some settings could not be applied")
+
+//Reloader re-reads the configuration and applies what it can without a restart. It is set by main, which loads the configuration
+var Reloader func() (ReloadReport, error)
+
+//ReloadEndpoint lets admins reload the configuration with POST /admin/reload, the same as sending the process SIGHUP.
+//The response lists the settings that were applied, those that need a restart and any that failed
+func ReloadEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	//check for shutdown and either return or add self to waitgroup
+	select {
+	case <-ShutdownChannel:
+		logging.Warning(r.Context()).Println("attempted to access the reload endpoint after a shutdown")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "Server is shutting down", "reload")
+		return
+	default:
+		endpointWaitGroup.Add(1)
+		defer endpointWaitGroup.Done()
+	}
+
+	//login with associated error handling
+	caller, errUsername := GetAuthorisation(r)
+	if errUsername != nil {
+		if errUsername == ErrInvalidAuth {
+			w.WriteHeader(http.StatusForbidden)
+			WriteWithError(w, "Forbidden", "reload")
+			return
+		} else if errUsername == ErrUnauthorised {
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "reload")
+			return
+		} else {
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errUsername)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something has gone wrong", "reload")
+			return
+		}
+	}
+
+	if !caller.IsAdmin() {
+		logging.Warning(r.Context()).Printf("user %s tried to reload the configuration without being an admin\n", caller.Username)
+		recordAudit(r, audit.Event{Action: audit.ActionReload, User: caller.Username, Outcome: audit.OutcomeDenied})
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "reload")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		logging.Warning(r.Context()).Println("received bad request on the reload endpoint. Method was", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "reload")
+		return
+	}
+
+	if Reloader == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		WriteWithError(w, "configuration reloading is not available", "reload")
+		return
+	}
+
+	logging.Info(r.Context()).Printf("user %s is reloading the configuration\n", caller.Username)
+	report, err := Reloader()
+	switch err.(type) {
+	case nil:
+		recordAudit(r, audit.Event{Action: audit.ActionReload, User: caller.Username, Detail: reloadSummary(report)})
+		writeJSON(w, http.StatusOK, report, "reload")
+	case *config.ValidationError: //nothing has been changed
+		recordAudit(r, audit.Event{Action: audit.ActionReload, User: caller.Username, Outcome: audit.OutcomeFailure, Detail: "invalid configuration"})
+		w.WriteHeader(http.StatusBadRequest)
+		WriteWithError(w, err.Error(), "reload")
+	default:
+		recordAudit(r, audit.Event{Action: audit.ActionReload, User: caller.Username, Outcome: audit.OutcomeFailure, Detail: reloadSummary(report)})
+		writeJSON(w, http.StatusInternalServerError, report, "reload")
+	}
+}
+
+//reloadSummary lists the settings a reload applied and failed to apply, for the audit log
+func reloadSummary(report ReloadReport) string {
+	parts := []string{}
+	for _, change := range report.Applied {
+		parts = append(parts, "applied "+change.Setting)
+	}
+	for _, change := range report.Failed {
+		parts = append(parts, "failed "+change.Setting)
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"store/KVStore"
+	"store/audit"
+	"store/logging"
+	"store/replication"
+	"strings"
+	"sync"
+)
+
+//ReplicationOptions configures replication. Role is none, primary or follower
+type ReplicationOptions struct {
+	Role       string
+	PrimaryURL string //the primary a follower copies
+	Secret     string //shared by the primary and its followers
+	LogSize    int    //mutations a primary keeps for followers that fall behind
+}
+
+//headers set on every response from a follower
+const (
+	ReplicationRoleHeader      = "X-Replication-Role"
+	ReplicationStalenessHeader = "X-Replication-Staleness" //seconds since the follower was last known to have everything the primary had
+	ReplicationSeqHeader       = "X-Replication-Seq"       //the last mutation the follower has applied
+)
+
+var ErrNotFollower = errors.New("this server is not a replication follower")
+
+var (
+	replicationLock    sync.RWMutex
+	replicationOptions ReplicationOptions
+	primary            *replication.Primary  //nil unless this server is a primary
+	follower           *replication.Follower //nil unless this server is a follower
+)
+
+//ReplicationStatus is returned by GET /admin/replication
+type ReplicationStatus struct {
+	Role      string                      `json:"role"`
+	Seq       uint64                      `json:"seq"`                 //the latest mutation in this server's store
+	Followers []replication.FollowerInfo  `json:"followers,omitempty"` //only for a primary
+	Follower  *replication.FollowerStatus `json:"follower,omitempty"`  //only for a follower
+}
+
+//ConfigureReplication makes the server a replication primary or follower. Must be called after Setup
+func ConfigureReplication(options ReplicationOptions) error {
+	replicationLock.Lock()
+	defer replicationLock.Unlock()
+	switch strings.ToLower(options.Role) {
+	case "", "none":
+		return nil
+	case "primary":
+		startPrimary(options)
+	case "follower":
+		follower = replication.NewFollower(options.PrimaryURL, options.Secret, replication.LocalStore{})
+		follower.Start()
+		logging.InfoLogger.Println("replicating from", options.PrimaryURL)
+	default:
+		return errors.New("replication role must be none, primary or follower")
+	}
+	replicationOptions = options
+
+	http.HandleFunc(replication.StreamPath, ReplicationStreamEndpoint)
+	http.HandleFunc(replication.SnapshotPath, ReplicationStreamEndpoint)
+	http.HandleFunc("/admin/replication", ReplicationEndpoint)
+	http.HandleFunc("/admin/replication/promote", ReplicationEndpoint)
+	return nil
+}
+
+//startPrimary starts keeping the replication log. Must be called with replicationLock held
+func startPrimary(options ReplicationOptions) {
+	primary = replication.NewPrimary(replication.LocalStore{}, options.Secret, options.LogSize, KVStore.LastMutation())
+	KVStore.SetMutationListener(primary.Append)
+	logging.InfoLogger.Println("serving replication to followers from mutation", KVStore.LastMutation())
+}
+
+//promote stops following the primary and starts serving followers instead, carrying on from the last mutation copied
+func promote() error {
+	replicationLock.Lock()
+	defer replicationLock.Unlock()
+	if follower == nil {
+		return ErrNotFollower
+	}
+	seq := follower.Stop()
+	follower = nil
+	startPrimary(replicationOptions)
+	logging.InfoLogger.Println("promoted to primary after copying mutations up to", seq)
+	return nil
+}
+
+//stopReplication ends the streams to followers, or stops following the primary, when the server shuts down
+func stopReplication() {
+	replicationLock.Lock()
+	defer replicationLock.Unlock()
+	if primary != nil {
+		primary.Close()
+	}
+	if follower != nil {
+		follower.Stop()
+	}
+}
+
+func currentFollower() *replication.Follower {
+	replicationLock.RLock()
+	defer replicationLock.RUnlock()
+	return follower
+}
+
+func replicationStatus() ReplicationStatus {
+	replicationLock.RLock()
+	defer replicationLock.RUnlock()
+	status := ReplicationStatus{Role: "none", Seq: KVStore.LastMutation()}
+	if primary != nil {
+		status.Role = "primary"
+		status.Followers = primary.Followers()
+	}
+	if follower != nil {
+		followerStatus := follower.Status()
+		status.Role = "follower"
+		status.Follower = &followerStatus
+	}
+	return status
+}
+
+//ReplicationStreamEndpoint serves the replication stream and snapshots to followers. They authenticate with the replication secret rather than as a user
+func ReplicationStreamEndpoint(w http.ResponseWriter, r *http.Request) {
+	replicationLock.RLock()
+	current := primary
+	replicationLock.RUnlock()
+	if current == nil {
+		logging.Warning(r.Context()).Println("replication requested from a server that isn't a primary by", r.RemoteAddr)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "not a replication primary", "replication")
+		return
+	}
+	if r.URL.Path == replication.SnapshotPath {
+		current.ServeSnapshot(w, r)
+	} else {
+		current.ServeStream(w, r)
+	}
+}
+
+//ReplicationEndpoint lets admins see the replication status with GET /admin/replication,
+//and fail over by promoting a follower to primary with POST /admin/replication/promote
+func ReplicationEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	//check for shutdown and either return or add self to waitgroup
+	select {
+	case <-ShutdownChannel:
+		logging.Warning(r.Context()).Println("attempted to access the replication endpoint after a shutdown")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "Server is shutting down", "replication")
+		return
+	default:
+		endpointWaitGroup.Add(1)
+		defer endpointWaitGroup.Done()
+	}
+
+	//login with associated error handling
+	caller, errUsername := GetAuthorisation(r)
+	if errUsername != nil {
+		if errUsername == ErrInvalidAuth {
+			w.WriteHeader(http.StatusForbidden)
+			WriteWithError(w, "Forbidden", "replication")
+			return
+		} else if errUsername == ErrUnauthorised {
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "replication")
+			return
+		} else {
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errUsername)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something has gone wrong", "replication")
+			return
+		}
+	}
+
+	if !caller.IsAdmin() {
+		logging.Warning(r.Context()).Printf("user %s tried to use the replication endpoint without being an admin\n", caller.Username)
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "replication")
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/admin/replication" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, replicationStatus(), "replication")
+	case r.URL.Path == "/admin/replication/promote" && r.Method == http.MethodPost:
+		if err := promote(); err != nil {
+			w.WriteHeader(http.StatusConflict)
+			WriteWithError(w, err.Error(), "replication")
+			return
+		}
+		logging.Info(r.Context()).Printf("user %s promoted this server to replication primary\n", caller.Username)
+		recordAudit(r, audit.Event{Action: audit.ActionPromote, User: caller.Username})
+		writeJSON(w, http.StatusOK, replicationStatus(), "replication")
+	default:
+		logging.Warning(r.Context()).Println("received bad request on the replication endpoint. Method was", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "replication")
+	}
+}
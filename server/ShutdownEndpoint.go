@@ -5,11 +5,28 @@ import (
 	"fmt"
 	"net/http"
 	"store/KVStore"
+	"store/audit"
 	"store/logging"
+	"store/rbac"
 	"time"
 )
 
-const timeoutTime = 10 * time.Second
+//ShutdownGracePeriod is how long in-flight requests get to finish once a shutdown starts
+var ShutdownGracePeriod = 10 * time.Second
+
+//DataFile is the file the store is saved to once the server has shut down. Empty to only keep the store in memory
+var DataFile string
+
+//shutdownDone is closed once shutdownRoutine has finished, so Start can wait for it
+var shutdownDone chan struct{}
+
+//Shutdown shuts the server down the same way as the /shutdown endpoint. Used when the process is asked to stop by a signal.
+//It returns straight away, and Start returns once the shutdown has finished
+func Shutdown(reason string) {
+	logging.InfoLogger.Println("Starting shutdown routine:", reason)
+	audit.Record(audit.Event{Action: audit.ActionShutdown, Detail: reason})
+	go shutdownRoutine()
+}
 
 func shutdownRoutine() {
 	chanCloseErr := SafeClose(ShutdownChannel) //this could be replaced by a sync.once
@@ -17,29 +34,51 @@ func shutdownRoutine() {
 		logging.WarningLogger.Println("attempted to close the shutdown channel more than once")
 		return
 	}
+	defer close(shutdownDone)
+	deadline := time.Now().Add(ShutdownGracePeriod)
+	stopReplication() //the replication streams never finish by themselves, so end them before waiting for requests to finish
 
-	err := KVStore.Shutdown() //this will block until the store channel has been drained
-	if err != nil {
-		logging.ErrorLogger.Println("Error shutting down the KV store", err)
-	}
-
-	WaitWithTimeout(endpointWaitGroup, timeoutTime) //include timeout here in case one of the endpoints has crashed
-
-	ctx, _ := context.WithTimeout(context.Background(), timeoutTime)
+	//stop accepting connections, and let the requests already being handled finish while the store is still up
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
 	errServer := server.Shutdown(ctx) //will attempt to shut down the server gracefully, but includes a timeout in case something's gone wrong
 	if errServer != nil {
 		logging.ErrorLogger.Println("unable to shut down server", errServer)
 	}
+	if !WaitWithTimeout(endpointWaitGroup, time.Until(deadline)) { //include timeout here in case one of the endpoints has crashed
+		logging.WarningLogger.Println("gave up waiting for endpoints to finish after", ShutdownGracePeriod)
+	}
+
+	//after the endpoints, which may be waiting on the cluster, and before the store, which the node applies entries to.
+	//With cluster-data-dir set this also flushes a final snapshot of the store to disk
+	stopCluster()
+
+	//likewise, as keys may be being imported into the store
+	stopPartitioning()
+	stopGossip()
+
+	//otherwise the store is only held in memory, so save it now nothing else can change it
+	if DataFile != "" {
+		saved, errSave := KVStore.SaveToFile(DataFile)
+		if errSave != nil {
+			logging.ErrorLogger.Println("unable to save the store to", DataFile, errSave)
+		} else {
+			logging.InfoLogger.Printf("saved %d keys to %s\n", saved, DataFile)
+		}
+	}
+	err := KVStore.Shutdown() //this will block until the store channel has been drained
+	if err != nil {
+		logging.ErrorLogger.Println("Error shutting down the KV store", err)
+	}
 }
 
 func ShutdownEndpoint(w http.ResponseWriter, r *http.Request) {
-	logging.LogAccessRequest(r)
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 
 	//check for shutdown and either return or add self to waitgroup
 	select {
 	case <-ShutdownChannel:
-		logging.WarningLogger.Println("attempted to access the shutdown endpoint after a shutdown")
+		logging.Warning(r.Context()).Println("attempted to access the shutdown endpoint after a shutdown")
 		w.WriteHeader(http.StatusNotFound)
 		WriteWithError(w, "Server is shutting down", "shutdown")
 		return
@@ -49,7 +88,7 @@ func ShutdownEndpoint(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//login with associated error handling
-	username, errUsername := GetAuthorisation(r)
+	caller, errUsername := GetAuthorisation(r)
 	if errUsername != nil {
 		if errUsername == ErrInvalidAuth {
 			w.WriteHeader(http.StatusForbidden)
@@ -60,15 +99,16 @@ func ShutdownEndpoint(w http.ResponseWriter, r *http.Request) {
 			WriteWithError(w, "Unauthorised", "shutdown")
 			return
 		} else {
-			logging.ErrorLogger.Println("unexpected error in authorisation", errUsername)
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errUsername)
 			w.WriteHeader(http.StatusInternalServerError)
 			WriteWithError(w, "something has gone wrong", "shutdown")
 			return
 		}
 	}
 
-	if username != "admin" {
-		logging.WarningLogger.Println("tried to shutdown without admin privileges")
+	if !caller.Can(rbac.PermShutdown) {
+		logging.Warning(r.Context()).Printf("user %s tried to shutdown without the shutdown permission\n", caller.Username)
+		recordAudit(r, audit.Event{Action: audit.ActionShutdown, User: caller.Username, Outcome: audit.OutcomeDenied})
 		w.WriteHeader(http.StatusForbidden)
 		WriteWithError(w, "Forbidden", "shutdown")
 		return
@@ -77,11 +117,12 @@ func ShutdownEndpoint(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		w.WriteHeader(http.StatusOK)
 		WriteWithError(w, "OK", "shutdown")
-		logging.InfoLogger.Println("Starting shutdown routine")
+		logging.Info(r.Context()).Println("Starting shutdown routine")
+		recordAudit(r, audit.Event{Action: audit.ActionShutdown, User: caller.Username})
 		fmt.Println("Shutting down server")
 		go shutdownRoutine()
 	} else {
-		logging.WarningLogger.Println("attempted to access shutdown endpoint with method", r.Method)
+		logging.Warning(r.Context()).Println("attempted to access shutdown endpoint with method", r.Method)
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		WriteWithError(w, "invalid http method", "shutdown")
 		return
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"store/KVStore"
+	"store/logging"
+)
+
+//StatsEndpoint lets admins see the internals of the store and its supervisor with GET /admin/stats,
+//e.g. the key count, hit ratio, queue depth and monitor restarts
+func StatsEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	//check for shutdown and either return or add self to waitgroup
+	select {
+	case <-ShutdownChannel:
+		logging.Warning(r.Context()).Println("attempted to access the stats endpoint after a shutdown")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "Server is shutting down", "stats")
+		return
+	default:
+		endpointWaitGroup.Add(1)
+		defer endpointWaitGroup.Done()
+	}
+
+	//login with associated error handling
+	caller, errUsername := GetAuthorisation(r)
+	if errUsername != nil {
+		if errUsername == ErrInvalidAuth {
+			w.WriteHeader(http.StatusForbidden)
+			WriteWithError(w, "Forbidden", "stats")
+			return
+		} else if errUsername == ErrUnauthorised {
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "stats")
+			return
+		} else {
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errUsername)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something has gone wrong", "stats")
+			return
+		}
+	}
+
+	if !caller.IsAdmin() {
+		logging.Warning(r.Context()).Printf("user %s tried to read the store stats without being an admin\n", caller.Username)
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "stats")
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		logging.Warning(r.Context()).Println("received bad request on the stats endpoint. Method was", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "stats")
+		return
+	}
+
+	stats, storeErr := KVStore.WithContext(r.Context()).GetStats(caller)
+	switch storeErr {
+	case KVStore.ErrShutdown:
+		logging.Warning(r.Context()).Println("Server entered shutdown routine. Unable to Process request")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "Server is shutting down", "stats")
+	case KVStore.ErrUnauthorized:
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "stats")
+	case nil:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(stats); err != nil {
+			logging.Error(r.Context()).Println("error writing in the stats endpoint.", err)
+		}
+	default:
+		logging.Error(r.Context()).Println("unexpected error from the stats interface", storeErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		WriteWithError(w, "something went wrong", "stats")
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"net/http"
+	"store/audit"
+	"store/logging"
+	"store/users"
+	"strings"
+)
+
+//TOTPHeader carries the one time code when logging in. The login endpoint also sets it on the response,
+//to "required" when a code is needed and to "enrol" when the user must set up two factor authentication
+const TOTPHeader = "X-TOTP-Code"
+
+//enrolResponse is returned when starting two factor enrolment
+type enrolResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"` //otpauth URI, for showing as a QR code
+}
+
+//TwoFactorEndpoint manages the caller's own two factor authentication.
+//POST /2fa/enrol starts enrolment and returns a secret, POST /2fa/confirm with a one time code as the body finishes it and returns
+//recovery codes, and POST /2fa/disable with a one time code or recovery code as the body turns it off
+func TwoFactorEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	//check for shutdown and either return or add self to waitgroup
+	select {
+	case <-ShutdownChannel:
+		logging.Warning(r.Context()).Println("attempted to access the 2fa endpoint after a shutdown")
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "Server is shutting down", "2fa")
+		return
+	default:
+		endpointWaitGroup.Add(1)
+		defer endpointWaitGroup.Done()
+	}
+
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/2fa"), "/ ")
+
+	//enrol only tokens are accepted here, since this is how those users get a full token
+	caller, errUsername := GetEnrolmentAuthorisation(r)
+	if errUsername != nil {
+		if errUsername == ErrInvalidAuth {
+			w.WriteHeader(http.StatusForbidden)
+			WriteWithError(w, "Forbidden", "2fa")
+			return
+		} else if errUsername == ErrUnauthorised {
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "2fa")
+			return
+		} else {
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errUsername)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something has gone wrong", "2fa")
+			return
+		}
+	}
+	if r.Header.Get("X-API-Key") != "" {
+		//an API key acts for a service, not a person, so it can't manage the owner's second factor
+		w.WriteHeader(http.StatusForbidden)
+		WriteWithError(w, "Forbidden", "2fa")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		logging.Warning(r.Context()).Println("received bad request on the 2fa endpoint. Method was", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "2fa")
+		return
+	}
+
+	var err error
+	defer func() {
+		auditAction := map[string]string{"enrol": audit.ActionEnrolTOTP, "confirm": audit.ActionConfirmTOTP, "disable": audit.ActionDisableTOTP}[action]
+		if auditAction == "" {
+			return
+		}
+		event := audit.Event{Action: auditAction, User: caller.Username}
+		if err == users.ErrTOTPInvalidCode {
+			event.Outcome = audit.OutcomeDenied
+		} else if err != nil {
+			event.Outcome = audit.OutcomeFailure
+			event.Detail = err.Error()
+		}
+		recordAudit(r, event)
+	}()
+	switch action {
+	case "enrol":
+		var secret, uri string
+		secret, uri, err = users.EnrolTOTP(caller.Username)
+		if err == nil {
+			logging.Info(r.Context()).Printf("user %s started two factor enrolment\n", caller.Username)
+			writeJSON(w, http.StatusOK, enrolResponse{Secret: secret, URI: uri}, "2fa")
+			return
+		}
+	case "confirm":
+		var recoveryCodes []string
+		code, _ := readBody(r)
+		recoveryCodes, err = users.ConfirmTOTP(caller.Username, code)
+		if err == nil {
+			writeJSON(w, http.StatusOK, recoveryCodes, "2fa")
+			return
+		}
+	case "disable":
+		code, _ := readBody(r)
+		err = users.DisableTOTP(caller.Username, code)
+		if err == nil {
+			w.WriteHeader(http.StatusOK)
+			WriteWithError(w, "OK", "2fa")
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		WriteWithError(w, "404 not found", "2fa")
+		return
+	}
+
+	switch err {
+	case users.ErrTOTPInvalidCode:
+		logging.Warning(r.Context()).Printf("user %s gave an invalid one time code\n", caller.Username)
+		w.WriteHeader(http.StatusUnauthorized)
+		WriteWithError(w, "Invalid one time code", "2fa")
+	case users.ErrTOTPNotEnrolled, users.ErrTOTPAlreadyEnrolled:
+		w.WriteHeader(http.StatusConflict)
+		WriteWithError(w, err.Error(), "2fa")
+	default:
+		logging.Error(r.Context()).Println("error in the 2fa endpoint", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		WriteWithError(w, "something went wrong", "2fa")
+	}
+}
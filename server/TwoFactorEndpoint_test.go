@@ -0,0 +1,65 @@
+package server_test
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"store/server"
+	"store/users"
+	"testing"
+	"time"
+)
+
+func TestEnrolOnlyLogin(t *testing.T) {
+	clock := useLockoutPolicy(t, users.DefaultLockoutPolicy)
+
+	//admins have to use two factor authentication, so one who hasn't enrolled can only log in to enrol
+	response, enrolToken := login(t, "admin", "Password1", nil)
+	if response.StatusCode != http.StatusOK || response.Header.Get(server.TOTPHeader) != "enrol" {
+		t.Fatalf("expected an enrolment token, got %d with %s %q\n", response.StatusCode, server.TOTPHeader, response.Header.Get(server.TOTPHeader))
+	}
+	if response, _ := request(t, http.MethodGet, "/admin/stats", "", bearer(enrolToken)); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected an enrolment token to be rejected by the admin endpoints, got %d\n", response.StatusCode)
+	}
+	if response, _ := request(t, http.MethodPut, "/store/two_factor_test", "value", bearer(enrolToken)); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected an enrolment token to be rejected by the store, got %d\n", response.StatusCode)
+	}
+
+	response, body := request(t, http.MethodPost, "/2fa/enrol", "", bearer(enrolToken))
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unable to enrol with an enrolment token, got %d %s\n", response.StatusCode, body)
+	}
+	var enrolment struct {
+		Secret string `json:"secret"`
+	}
+	if err := json.Unmarshal([]byte(body), &enrolment); err != nil {
+		t.Fatal("unable to read the enrolment", err)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrolment.Secret)
+	if err != nil {
+		t.Fatal("secret is not valid base32", err)
+	}
+	response, body = request(t, http.MethodPost, "/2fa/confirm", users.TOTPCode(secret, time.Now()), bearer(enrolToken))
+	var recoveryCodes []string
+	if response.StatusCode != http.StatusOK || json.Unmarshal([]byte(body), &recoveryCodes) != nil || len(recoveryCodes) == 0 {
+		t.Fatalf("unable to confirm enrolment, got %d %s\n", response.StatusCode, body)
+	}
+	t.Cleanup(func() { users.DisableTOTP("admin", recoveryCodes[0]) })
+
+	//once enrolled a one time code is needed to log in, which then gives a full token
+	if response, _ := login(t, "admin", "Password1", nil); response.StatusCode != http.StatusUnauthorized || response.Header.Get(server.TOTPHeader) != "required" {
+		t.Errorf("expected to be asked for a one time code, got %d with %s %q\n", response.StatusCode, server.TOTPHeader, response.Header.Get(server.TOTPHeader))
+	}
+	if response, _ := login(t, "admin", "Password1", map[string]string{server.TOTPHeader: "000000x"}); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a wrong one time code to be unauthorised, got %d\n", response.StatusCode)
+	}
+	clock.Add(users.DefaultLockoutPolicy.BaseDelay)
+	code := users.TOTPCode(secret, time.Now().Add(30*time.Second)) //the confirmation used up the current code
+	response, token := login(t, "admin", "Password1", map[string]string{server.TOTPHeader: code})
+	if response.StatusCode != http.StatusOK || response.Header.Get(server.TOTPHeader) != "" {
+		t.Fatalf("unable to log in with a one time code, got %d\n", response.StatusCode)
+	}
+	if response, body := request(t, http.MethodGet, "/admin/stats", "", bearer(token)); response.StatusCode != http.StatusOK {
+		t.Errorf("expected a full token to be accepted by the admin endpoints, got %d %s\n", response.StatusCode, body)
+	}
+}
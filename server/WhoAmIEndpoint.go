@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"store/logging"
+	"time"
+)
+
+//whoamiResponse describes the caller and the credential they used
+type whoamiResponse struct {
+	Username    string     `json:"username"`
+	Roles       []string   `json:"roles"`
+	Groups      []string   `json:"groups,omitempty"`
+	Permissions []string   `json:"permissions"` //after any API key scope has been applied
+	KeyPrefix   string     `json:"keyPrefix,omitempty"`
+	AuthMethod  string     `json:"authMethod"`
+	IssuedAt    *time.Time `json:"issuedAt,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	EnrolOnly   bool       `json:"enrolOnly,omitempty"`
+}
+
+//optionalTime returns nil for the zero time so it is left out of the JSON
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+//WhoAmIEndpoint returns who the caller is authenticated as, their roles and permissions, and when their credential expires
+func WhoAmIEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.Method != http.MethodGet {
+		logging.Warning(r.Context()).Println("attempted to access whoami endpoint with method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		WriteWithError(w, "invalid http method", "whoami")
+		return
+	}
+
+	//enrol only tokens are accepted so users can find out that they need to set up two factor authentication
+	cred, errAuth := authenticate(r, true)
+	if errAuth != nil {
+		if errAuth == ErrInvalidAuth {
+			w.WriteHeader(http.StatusForbidden)
+			WriteWithError(w, "Forbidden", "whoami")
+			return
+		} else if errAuth == ErrUnauthorised {
+			w.WriteHeader(http.StatusUnauthorized)
+			WriteWithError(w, "Unauthorised", "whoami")
+			return
+		} else {
+			logging.Error(r.Context()).Println("unexpected error in authorisation", errAuth)
+			w.WriteHeader(http.StatusInternalServerError)
+			WriteWithError(w, "something has gone wrong", "whoami")
+			return
+		}
+	}
+
+	response := whoamiResponse{
+		Username:    cred.Identity.Username,
+		Roles:       cred.Identity.RoleNames(),
+		Groups:      cred.Identity.Groups,
+		Permissions: cred.Identity.Permissions().Names(),
+		AuthMethod:  cred.Method,
+		IssuedAt:    optionalTime(cred.IssuedAt),
+		ExpiresAt:   optionalTime(cred.ExpiresAt),
+		EnrolOnly:   cred.EnrolOnly,
+	}
+	if cred.EnrolOnly {
+		response.Permissions = []string{} //the token can only be used to enrol, whatever the user's roles
+	}
+	if cred.Identity.Scope != nil {
+		response.KeyPrefix = cred.Identity.Scope.KeyPrefix
+	}
+	writeJSON(w, http.StatusOK, response, "whoami")
+}
@@ -0,0 +1,95 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"store/rbac"
+	"store/server"
+	"store/users"
+	"strings"
+	"testing"
+	"time"
+)
+
+//whoami is the body returned by /whoami
+type whoami struct {
+	Username    string     `json:"username"`
+	Roles       []string   `json:"roles"`
+	Groups      []string   `json:"groups"`
+	Permissions []string   `json:"permissions"`
+	KeyPrefix   string     `json:"keyPrefix"`
+	AuthMethod  string     `json:"authMethod"`
+	IssuedAt    *time.Time `json:"issuedAt"`
+	ExpiresAt   *time.Time `json:"expiresAt"`
+	EnrolOnly   bool       `json:"enrolOnly"`
+}
+
+func getWhoAmI(t *testing.T, headers map[string]string) whoami {
+	t.Helper()
+	response, body := request(t, http.MethodGet, "/whoami", "", headers)
+	var caller whoami
+	if response.StatusCode != http.StatusOK || json.Unmarshal([]byte(body), &caller) != nil {
+		t.Fatalf("unable to find out who the caller is, got %d %s\n", response.StatusCode, body)
+	}
+	return caller
+}
+
+func TestWhoAmI(t *testing.T) {
+	useLockoutPolicy(t, users.DefaultLockoutPolicy)
+	_, token := login(t, "user_a", "passwordA", nil)
+	caller := getWhoAmI(t, bearer(token))
+	writerPermissions := strings.Join(rbac.RoleWriter.Permissions().Names(), ",")
+	if caller.Username != "user_a" || strings.Join(caller.Roles, ",") != "writer" || strings.Join(caller.Groups, ",") != "devs" {
+		t.Errorf("expected user_a, a writer in devs, got %+v\n", caller)
+	}
+	if strings.Join(caller.Permissions, ",") != writerPermissions || caller.AuthMethod != server.AuthMethodToken || caller.EnrolOnly {
+		t.Errorf("expected a writer's permissions from a full token, got %+v\n", caller)
+	}
+	if caller.IssuedAt == nil || caller.ExpiresAt == nil || !caller.ExpiresAt.After(*caller.IssuedAt) {
+		t.Errorf("expected the token's lifetime, got %v to %v\n", caller.IssuedAt, caller.ExpiresAt)
+	}
+
+	if response, _ := request(t, http.MethodGet, "/whoami", "", nil); response.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a request without credentials to be forbidden, got %d\n", response.StatusCode)
+	}
+	if response, _ := request(t, http.MethodPost, "/whoami", "", bearer(token)); response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected POST to be refused, got %d\n", response.StatusCode)
+	}
+}
+
+func TestWhoAmIWithScopedAPIKey(t *testing.T) {
+	defer users.WipeAPIKeys()
+	apiKey, key, err := users.MintAPIKey("user_a", "batch_", true, time.Hour, "admin")
+	if err != nil {
+		t.Fatal("unable to mint an API key", err)
+	}
+	caller := getWhoAmI(t, map[string]string{"X-API-Key": apiKey})
+	//the key keeps the owner's roles, but only has the permissions its scope allows
+	if caller.Username != "user_a" || strings.Join(caller.Roles, ",") != "writer" || caller.AuthMethod != server.AuthMethodAPIKey {
+		t.Errorf("expected the key to act as its owner, got %+v\n", caller)
+	}
+	if strings.Join(caller.Permissions, ",") != strings.Join(key.Scope().Permissions.Names(), ",") || caller.KeyPrefix != "batch_" {
+		t.Errorf("expected a read only key limited to batch_, got %v %q\n", caller.Permissions, caller.KeyPrefix)
+	}
+	for _, permission := range caller.Permissions {
+		if permission == "write" || permission == "delete" {
+			t.Errorf("expected a read only key not to be able to %s\n", permission)
+		}
+	}
+	if caller.ExpiresAt == nil || !caller.ExpiresAt.Equal(key.ExpiresAt) {
+		t.Errorf("expected the key's expiry %v, got %v\n", key.ExpiresAt, caller.ExpiresAt)
+	}
+}
+
+func TestWhoAmIWithEnrolOnlyToken(t *testing.T) {
+	useLockoutPolicy(t, users.DefaultLockoutPolicy)
+	//admins have to use two factor authentication, so one who hasn't enrolled gets a token that can only be used to enrol
+	response, token := login(t, "admin", "Password1", nil)
+	if response.StatusCode != http.StatusOK || response.Header.Get(server.TOTPHeader) != "enrol" {
+		t.Fatalf("expected an enrolment token, got %d\n", response.StatusCode)
+	}
+	caller := getWhoAmI(t, bearer(token))
+	if !caller.EnrolOnly || len(caller.Permissions) != 0 || caller.Username != "admin" {
+		t.Errorf("expected an enrolment token to be flagged and have no permissions, got %+v\n", caller)
+	}
+}
@@ -1,65 +1,238 @@
-package server
-
-import (
-	"errors"
-	"net/http"
-	"store/logging"
-	"store/users"
-	"strings"
-	"sync"
-	"time"
-)
-
-var ErrInvalidAuth = errors.New("invalid authorisation token")
-var ErrUnauthorised = errors.New("unauthorised")
-
-//logging.ErrorLogger.Println("store guardian received a bad request command", storeRequest.command)
-
-func GetAuthorisation(r *http.Request) (username string, err error) {
-	reqToken := r.Header.Get("Authorization")
-	splitToken := strings.Split(reqToken, "Bearer")
-	if len(splitToken) != 2 {
-		logging.ErrorLogger.Println("token not in required format", reqToken)
-		return "", ErrInvalidAuth
-	}
-	tokenString := strings.TrimSpace(splitToken[1])
-	username, ok := users.ValidateJWT(tokenString)
-	if !ok {
-		return "", ErrUnauthorised
-	} else {
-		return username, nil
-	}
-}
-
-func WriteWithError(w http.ResponseWriter, value string, endpointName string) {
-	_, err := w.Write([]byte(value))
-	if err != nil {
-		logging.ErrorLogger.Printf("error writing in the %s endpoint. %v\n", endpointName, err)
-	}
-}
-
-func WaitWithTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
-	waitChan := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(waitChan)
-	}()
-	select {
-	case <-waitChan:
-		return true
-	case <-time.After(timeout):
-		return false
-	}
-}
-
-//SafeClose normally closes a channel and returns nil.
-//But if the channel is already closed it will recover from the panic and return an error.
-func SafeClose(channel chan struct{}) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New("channel is closed")
-		}
-	}()
-	close(channel)
-	return nil
-}
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"store/audit"
+	"store/logging"
+	"store/rbac"
+	"store/tracing"
+	"store/users"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidAuth = errors.New("invalid authorisation token")
+var ErrUnauthorised = errors.New("unauthorised")
+
+//logging.ErrorLogger.Println("store guardian received a bad request command", storeRequest.command)
+
+//GetAuthorisation validates the bearer token and returns the identity of the caller, including their roles.
+//Services can instead send an API key in the X-API-Key header, in which case the identity is limited to the key's scope
+func GetAuthorisation(r *http.Request) (identity rbac.Identity, err error) {
+	return getAuthorisation(r, false)
+}
+
+//GetEnrolmentAuthorisation is like GetAuthorisation, but also accepts the restricted tokens given to users
+//who have to set up two factor authentication before they can do anything else
+func GetEnrolmentAuthorisation(r *http.Request) (identity rbac.Identity, err error) {
+	return getAuthorisation(r, true)
+}
+
+func getAuthorisation(r *http.Request, allowEnrolOnly bool) (identity rbac.Identity, err error) {
+	cred, err := authenticate(r, allowEnrolOnly)
+	return cred.Identity, err
+}
+
+const (
+	AuthMethodToken      = "token"
+	AuthMethodAPIKey     = "apikey"
+	AuthMethodClientCert = "clientcert"
+)
+
+//credential describes how the caller authenticated. IssuedAt and ExpiresAt are zero when the credential doesn't have them
+type credential struct {
+	Identity  rbac.Identity
+	Method    string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	EnrolOnly bool
+}
+
+//authenticate works out who the caller is from, in order, an API key, a verified client certificate or a bearer token.
+//The user is noted for the access log
+func authenticate(r *http.Request, allowEnrolOnly bool) (credential, error) {
+	_, span := tracing.Start(r.Context(), "auth")
+	defer span.End()
+	cred, err := checkCredentials(r, allowEnrolOnly)
+	if err == nil {
+		setAccessUser(r, cred.Identity.Username)
+		span.SetAttribute("auth.method", cred.Method)
+		span.SetAttribute("auth.user", cred.Identity.Username)
+	}
+	span.SetError(err)
+	return cred, err
+}
+
+func checkCredentials(r *http.Request, allowEnrolOnly bool) (credential, error) {
+	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+		//API keys skip two factor authentication too, but are limited by their scope and never act as an admin
+		key, errKey := users.ValidateAPIKey(apiKey)
+		if errKey != nil {
+			logging.Warning(r.Context()).Println("rejected API key", errKey)
+			return credential{}, ErrUnauthorised
+		}
+		identity, errIdentity := key.Identity()
+		if errIdentity != nil {
+			logging.Warning(r.Context()).Printf("rejected API key %s for user %s: %v\n", key.ID, key.Owner, errIdentity)
+			return credential{}, ErrUnauthorised
+		}
+		return credential{Identity: identity, Method: AuthMethodAPIKey, IssuedAt: key.CreatedAt, ExpiresAt: key.ExpiresAt}, nil
+	}
+	reqToken := r.Header.Get("Authorization")
+	if reqToken == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		//a verified client certificate mapped to a user is enough on its own, so mTLS clients don't need to log in. Two factor
+		//authentication isn't asked for, as the certificate's private key is already something the user has
+		cert := r.TLS.VerifiedChains[0][0]
+		username, errCert := users.ClientCertUsername(cert)
+		if errCert != nil {
+			logging.Warning(r.Context()).Println("rejected client certificate", cert.Subject, errCert)
+			return credential{}, ErrUnauthorised
+		}
+		identity, errIdentity := users.IdentityFor(username, users.BackendLocal)
+		if errIdentity != nil {
+			logging.Warning(r.Context()).Printf("rejected client certificate %s for user %s: %v\n", cert.Subject, username, errIdentity)
+			return credential{}, ErrUnauthorised
+		}
+		return credential{Identity: identity, Method: AuthMethodClientCert, IssuedAt: cert.NotBefore, ExpiresAt: cert.NotAfter}, nil
+	}
+	splitToken := strings.Split(reqToken, "Bearer")
+	if len(splitToken) != 2 {
+		logging.Error(r.Context()).Println("token not in required format", reqToken)
+		return credential{}, ErrInvalidAuth
+	}
+	tokenString := strings.TrimSpace(splitToken[1])
+	claims, ok := users.ParseJWT(tokenString)
+	if !ok {
+		return credential{}, ErrUnauthorised
+	}
+	identity, errIdentity := claims.Identity()
+	if errIdentity != nil {
+		logging.Warning(r.Context()).Printf("rejected token for user %s: %v\n", claims.Username, errIdentity)
+		return credential{}, ErrUnauthorised
+	}
+	if claims.EnrolOnly && !allowEnrolOnly {
+		logging.Warning(r.Context()).Printf("user %s must set up two factor authentication before using the store\n", claims.Username)
+		return credential{}, ErrUnauthorised
+	}
+	return credential{
+		Identity:  identity,
+		Method:    AuthMethodToken,
+		IssuedAt:  unixTime(claims.IssuedAt),
+		ExpiresAt: unixTime(claims.ExpiresAt),
+		EnrolOnly: claims.EnrolOnly,
+	}, nil
+}
+
+//unixTime converts a JWT timestamp, treating a missing one as the zero time
+func unixTime(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+//recordAudit adds an event to the audit log, noting where the request came from
+func recordAudit(r *http.Request, event audit.Event) {
+	event.Source = clientIP(r)
+	event.RequestID = logging.RequestID(r.Context())
+	audit.Record(event)
+}
+
+//TrustedProxies are the networks of proxies, e.g. load balancers, whose X-Forwarded-For header is believed. Must be set before Start
+var TrustedProxies []*net.IPNet
+
+//clientIP returns the IP address the request came from, without the port. For a request passed on by a trusted proxy this is
+//the last address in X-Forwarded-For that isn't another trusted proxy, as anything before it could have been made up by the client
+func clientIP(r *http.Request) string {
+	ip := clientIPFromAddr(r.RemoteAddr)
+	if !trustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func clientIPFromAddr(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+//writeJSON marshals the value and writes it with the given status code
+func writeJSON(w http.ResponseWriter, status int, value interface{}, endpointName string) {
+	output, err := json.Marshal(value)
+	if err != nil {
+		logging.ErrorLogger.Printf("unable to marshal the response in the %s endpoint. %v\n", endpointName, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		WriteWithError(w, "something went wrong", endpointName)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, err = w.Write(output)
+	if err != nil {
+		logging.ErrorLogger.Printf("error writing in the %s endpoint. %v\n", endpointName, err)
+	}
+}
+
+func WriteWithError(w http.ResponseWriter, value string, endpointName string) {
+	_, err := w.Write([]byte(value))
+	if err != nil {
+		logging.ErrorLogger.Printf("error writing in the %s endpoint. %v\n", endpointName, err)
+	}
+}
+
+func WaitWithTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	waitChan := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(waitChan)
+	}()
+	select {
+	case <-waitChan:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+//SafeClose normally closes a channel and returns nil.
+//But if the channel is already closed it will recover from the panic and return an error.
+func SafeClose(channel chan struct{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("channel is closed")
+		}
+	}()
+	close(channel)
+	return nil
+}
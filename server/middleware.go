@@ -0,0 +1,400 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"store/KVStore"
+	"store/gossip"
+	"store/logging"
+	"store/metrics"
+	"store/partition"
+	"store/raft"
+	"store/tracing"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//RequestIDHeader is read from incoming requests, so a request can be followed across services, and always set on the response
+const RequestIDHeader = "X-Request-ID"
+
+//validRequestID accepts IDs from clients as long as they are a sensible length and can't be used to inject anything into the logs
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		logging.ErrorLogger.Println("unable to generate a request ID", err)
+		return "unknown"
+	}
+	return hex.EncodeToString(bytes)
+}
+
+//withRequestID gives every request an ID, taken from the X-Request-ID header if the client sent a valid one.
+//The ID is echoed in the response and carried in the request's context, so it is added to the logs and passed on to the KV store
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), requestID)))
+	})
+}
+
+const (
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+var ErrUnknownAccessLogFormat = errors.New("access log format must be combined or json")
+
+//AccessLogFormat selects how completed requests are written to the access log
+var AccessLogFormat = AccessLogCombined
+
+//ParseAccessLogFormat checks the name of an access log format
+func ParseAccessLogFormat(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case AccessLogCombined:
+		return AccessLogCombined, nil
+	case AccessLogJSON:
+		return AccessLogJSON, nil
+	}
+	return "", ErrUnknownAccessLogFormat
+}
+
+//accessRecorder wraps the ResponseWriter to capture the status and size of the response
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (a *accessRecorder) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *accessRecorder) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(b)
+	a.bytes += n
+	return n, err
+}
+
+//Flush lets endpoints that stream, like the replication stream, send what they have written so far
+func (a *accessRecorder) Flush() {
+	if flusher, ok := a.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//accessUser is filled in once the endpoint knows who the caller is
+type accessUser struct {
+	username string
+}
+
+type accessUserKey struct{}
+
+//setAccessUser records the authenticated user so it appears in the request's access log line
+func setAccessUser(r *http.Request, username string) {
+	if user, ok := r.Context().Value(accessUserKey{}).(*accessUser); ok {
+		user.username = username
+	}
+}
+
+//accessEntry is a completed request, as written to the access log in JSON format
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remoteAddr"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	DurationMs float64   `json:"durationMs"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	RequestID  string    `json:"requestId,omitempty"`
+}
+
+//orDash returns "-", which is what the Apache formats use for missing values
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+//combined formats the entry in Apache Combined Log Format, followed by the duration in microseconds and the request ID
+func (e accessEntry) combined() string {
+	bytes := "-" //%b in Apache's format, which is "-" rather than 0 for an empty body
+	if e.Bytes > 0 {
+		bytes = strconv.Itoa(e.Bytes)
+	}
+	return strings.Join([]string{
+		clientIPFromAddr(e.RemoteAddr),
+		"-",
+		orDash(e.User),
+		"[" + e.Time.Format("02/Jan/2006:15:04:05 -0700") + "]",
+		strconv.Quote(e.Method + " " + e.URI + " " + e.Proto),
+		strconv.Itoa(e.Status),
+		bytes,
+		strconv.Quote(orDash(e.Referer)),
+		strconv.Quote(orDash(e.UserAgent)),
+		strconv.FormatInt(int64(e.DurationMs*1000), 10),
+		strconv.Quote(orDash(e.RequestID)),
+	}, " ")
+}
+
+//isClusterRPC checks if the request is from another node in the cluster, on the partition ring or gossiping.
+//Nodes send several a second, so they are left out of the access log and traces
+func isClusterRPC(r *http.Request) bool {
+	for _, prefix := range []string{raft.PathPrefix, partition.PathPrefix, gossip.PathPrefix} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+//withAccessLog writes a line to the access log once each request has completed, including the status, size, time taken and user
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isClusterRPC(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		recorder := &accessRecorder{ResponseWriter: w}
+		user := &accessUser{}
+		r = r.WithContext(context.WithValue(r.Context(), accessUserKey{}, user))
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 { //nothing was written, which net/http sends as a 200
+			recorder.status = http.StatusOK
+		}
+		entry := accessEntry{
+			Time:       start,
+			RemoteAddr: r.RemoteAddr,
+			User:       user.username,
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			Proto:      r.Proto,
+			Status:     recorder.status,
+			Bytes:      recorder.bytes,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			RequestID:  logging.RequestID(r.Context()),
+		}
+		if AccessLogFormat == AccessLogJSON {
+			line, err := json.Marshal(entry)
+			if err != nil {
+				logging.ErrorLogger.Println("unable to marshal access log entry", err)
+				return
+			}
+			logging.AccessLogger.Println(string(line))
+			return
+		}
+		logging.AccessLogger.Println(entry.combined())
+	})
+}
+
+var (
+	requestsTotal = metrics.NewCounterVec("http_requests_total",
+		"HTTP requests handled, by endpoint, method and status", "endpoint", "method", "status")
+	requestDuration = metrics.NewHistogramVec("http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by endpoint and status", metrics.DefaultBuckets, "endpoint", "status")
+)
+
+//endpointFor returns the pattern of the endpoint that handles the request, so /store/a and /store/b are both /store/
+func endpointFor(r *http.Request) string {
+	_, endpoint := http.DefaultServeMux.Handler(r)
+	if endpoint == "" {
+		return "unmatched" //keeps the number of label values and span names bounded, whatever paths people try
+	}
+	return endpoint
+}
+
+//withMetrics counts each request and how long it took against the endpoint that handled it
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &accessRecorder{ResponseWriter: w}
+		endpoint := endpointFor(r)
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		status := strconv.Itoa(recorder.status)
+		requestsTotal.Inc(endpoint, metricsMethod(r.Method), status)
+		requestDuration.ObserveDuration(start, endpoint, status)
+	})
+}
+
+//metricsMethod returns the method, or "other" for anything non-standard so clients can't create endless label values
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+//withTracing starts a server span for each request, continuing the trace from the caller's traceparent header if there is one.
+//The span is in the request's context, so auth and store spans become its children
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tracing.Enabled() || isClusterRPC(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if parent, ok := tracing.ParseTraceparent(r.Header.Get(tracing.TraceparentHeader)); ok {
+			ctx = tracing.ContextWithRemoteParent(ctx, parent)
+		}
+		endpoint := endpointFor(r)
+		ctx, span := tracing.StartKind(ctx, r.Method+" "+endpoint, tracing.KindServer)
+		defer span.End()
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", endpoint)
+		span.SetAttribute("http.target", r.URL.Path)
+		span.SetAttribute("request_id", logging.RequestID(ctx))
+
+		recorder := &accessRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		span.SetAttribute("http.status_code", strconv.Itoa(recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetError(errors.New(http.StatusText(recorder.status)))
+		}
+	})
+}
+
+//replicatedPaths are the endpoints that can change the store, so a follower redirects writes to them to its primary
+var replicatedPaths = []string{"/store/", "/acl/", "/ns/"}
+
+//clusteredPaths are the endpoints that use the store, so a node that isn't the cluster's leader redirects every request to them to the leader
+var clusteredPaths = []string{"/store/", "/acl/", "/ns/", "/list/"}
+
+//isReplicatedWrite checks if the request would change the store
+func isReplicatedWrite(r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+		return false
+	}
+	for _, path := range replicatedPaths {
+		if strings.HasPrefix(r.URL.Path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+//withReplication tells clients of a follower how stale its reads might be, and redirects writes to the primary.
+//307 is used so the client sends the same method and body again
+func withReplication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := currentFollower()
+		if current == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set(ReplicationRoleHeader, "follower")
+		w.Header().Set(ReplicationStalenessHeader, strconv.FormatFloat(current.Staleness().Seconds(), 'f', 3, 64))
+		w.Header().Set(ReplicationSeqHeader, strconv.FormatUint(KVStore.LastMutation(), 10))
+		if isReplicatedWrite(r) {
+			logging.Debug(r.Context()).Println("redirecting a write to the primary", current.PrimaryURL())
+			http.Redirect(w, r, current.PrimaryURL()+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//withCluster redirects requests for the store to the cluster's leader, as only it can commit writes or be sure a read is up to date.
+//307 is used so the client sends the same method and body again
+func withCluster(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node := currentClusterNode()
+		if node == nil || node.IsLeader() || !isClusteredPath(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		leader := node.Leader()
+		if leader == "" {
+			logging.Debug(r.Context()).Println("no cluster leader to redirect to")
+			writeClusterUnavailable(w, KVStore.ErrNotLeader, "cluster")
+			return
+		}
+		logging.Debug(r.Context()).Println("redirecting a request to the cluster leader", leader)
+		w.Header().Set(ClusterLeaderHeader, leader)
+		http.Redirect(w, r, leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
+
+func isClusteredPath(r *http.Request) bool {
+	for _, path := range clusteredPaths {
+		if strings.HasPrefix(r.URL.Path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+//withPartitioning passes requests for keys other nodes own on to them, and makes sure keys this node owns have been moved here
+//before handling requests for them. Listings are sent to every node. Requests passed on from another node are always handled here,
+//so nodes that briefly disagree about the ring can't pass a request back and forth
+func withPartitioning(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node := currentPartitionNode()
+		if node == nil || strings.HasPrefix(r.URL.Path, partition.PathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		forwarded := node.Authentic(r)
+		r.Header.Del(partition.SecretHeader)
+		key, routed := partitionKey(r)
+		switch {
+		case !routed:
+			next.ServeHTTP(w, r)
+		case key == "" && forwarded:
+			next.ServeHTTP(w, r)
+		case key == "":
+			listEveryNode(w, r, node, next)
+		case forwarded:
+			servePartitioned(w, r, node, key, next)
+		default:
+			owner := node.Owner(key)
+			w.Header().Set(PartitionOwnerHeader, owner)
+			if owner != node.Address() {
+				proxyToOwner(w, r, owner)
+				return
+			}
+			servePartitioned(w, r, node, key, next)
+		}
+	})
+}
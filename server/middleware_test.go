@@ -0,0 +1,183 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"store/logging"
+	"store/raft"
+	"store/server"
+	"store/users"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//lockedBuffer collects the lines the server's goroutines write to the access log
+type lockedBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.Write(p)
+}
+
+//lines waits for at least n lines to be written, then returns every line so far
+func (b *lockedBuffer) lines(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b.lock.Lock()
+		output := strings.Split(strings.TrimSuffix(b.buffer.String(), "\n"), "\n")
+		if b.buffer.Len() == 0 {
+			output = nil
+		}
+		b.lock.Unlock()
+		if len(output) >= n {
+			return output
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d access log lines, got %q\n", n, output)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+//captureAccessLog writes the access log to a buffer in the format for the rest of the test
+func captureAccessLog(t *testing.T, format string) *lockedBuffer {
+	output := &lockedBuffer{}
+	oldLogger, oldFormat := logging.AccessLogger, server.AccessLogFormat
+	logging.AccessLogger = log.New(output, "", 0)
+	server.AccessLogFormat = format
+	t.Cleanup(func() {
+		logging.AccessLogger = oldLogger
+		server.AccessLogFormat = oldFormat
+	})
+	return output
+}
+
+//basicAuth returns the headers for a login as the user
+func basicAuth(username, password string) map[string]string {
+	return map[string]string{
+		"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)),
+		"User-Agent":    "middleware-test",
+	}
+}
+
+//combinedLine matches a combined format line, given everything before the time, between it and the duration, and after the duration
+func combinedLine(t *testing.T, line, beforeTime, beforeDuration, afterDuration string, start time.Time) {
+	t.Helper()
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(beforeTime+"[") + `([^\]]+)` + regexp.QuoteMeta("] "+beforeDuration+" ") + `(\d+)` + regexp.QuoteMeta(" "+afterDuration) + "$")
+	match := pattern.FindStringSubmatch(line)
+	if match == nil {
+		t.Errorf("expected an access log line like %q [time] %q duration %q, got %q\n", beforeTime, beforeDuration, afterDuration, line)
+		return
+	}
+	logged, err := time.Parse("02/Jan/2006:15:04:05 -0700", match[1])
+	if err != nil || logged.Before(start.Truncate(time.Second)) || logged.After(time.Now()) {
+		t.Errorf("expected the time the request started, got %s %v\n", match[1], err)
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	useLockoutPolicy(t, users.DefaultLockoutPolicy)
+	output := captureAccessLog(t, server.AccessLogCombined)
+	start := time.Now()
+
+	request(t, http.MethodGet, "/ping?check=1", "", map[string]string{
+		server.RequestIDHeader: "test-request-1",
+		"Referer":              "http://example.com/",
+		"User-Agent":           "middleware-test",
+	})
+	//the user is filled in once the endpoint knows who they are
+	response, token := request(t, http.MethodGet, "/login", "", basicAuth("user_a", "passwordA"))
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unable to log in, got %d\n", response.StatusCode)
+	}
+	//a request ID that could be used to forge log lines is replaced with a new one
+	response, _ = request(t, http.MethodGet, "/store/access_log_test", "", map[string]string{server.RequestIDHeader: `bad" id`})
+	requestID := response.Header.Get(server.RequestIDHeader)
+	if !regexp.MustCompile("^[0-9a-f]{32}$").MatchString(requestID) {
+		t.Errorf("expected a new request ID to be generated, got %q\n", requestID)
+	}
+
+	lines := output.lines(t, 3)
+	if len(lines) != 3 {
+		t.Fatalf("expected one line per request, got %q\n", lines)
+	}
+	combinedLine(t, lines[0], "127.0.0.1 - - ", `"GET /ping?check=1 HTTP/1.1" 200 4 "http://example.com/" "middleware-test"`, `"test-request-1"`, start)
+	loginID := regexp.MustCompile(`"([0-9a-f]{32})"$`).FindStringSubmatch(lines[1])
+	if loginID == nil {
+		t.Fatalf("expected the login to have a generated request ID, got %q\n", lines[1])
+	}
+	combinedLine(t, lines[1], "127.0.0.1 - user_a ", `"GET /login HTTP/1.1" 200 `+strconv.Itoa(len(token))+` "-" "middleware-test"`, strconv.Quote(loginID[1]), start)
+	combinedLine(t, lines[2], "127.0.0.1 - - ", `"GET /store/access_log_test HTTP/1.1" 403 9 "-" "Go-http-client/1.1"`, strconv.Quote(requestID), start)
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	useLockoutPolicy(t, users.DefaultLockoutPolicy)
+	output := captureAccessLog(t, server.AccessLogJSON)
+	start := time.Now()
+	headers := basicAuth("user_a", "passwordA")
+	headers[server.RequestIDHeader] = "test-request-2"
+	response, token := request(t, http.MethodGet, "/login?from=test", "", headers)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unable to log in, got %d\n", response.StatusCode)
+	}
+
+	lines := output.lines(t, 1)
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("access log line is not JSON %q %v\n", lines[0], err)
+	}
+	logged, errTime := time.Parse(time.RFC3339Nano, entry["time"].(string))
+	if errTime != nil || logged.Before(start) || logged.After(time.Now()) {
+		t.Errorf("expected the time the request started, got %v %v\n", entry["time"], errTime)
+	}
+	if duration, ok := entry["durationMs"].(float64); !ok || duration < 0 {
+		t.Errorf("expected a duration, got %v\n", entry["durationMs"])
+	}
+	if remoteAddr, _ := entry["remoteAddr"].(string); !strings.HasPrefix(remoteAddr, "127.0.0.1:") {
+		t.Errorf("expected the client's address, got %v\n", entry["remoteAddr"])
+	}
+	delete(entry, "time")
+	delete(entry, "durationMs")
+	delete(entry, "remoteAddr")
+	expected := map[string]interface{}{
+		"user":      "user_a",
+		"method":    "GET",
+		"uri":       "/login?from=test",
+		"proto":     "HTTP/1.1",
+		"status":    float64(http.StatusOK),
+		"bytes":     float64(len(token)),
+		"userAgent": "middleware-test",
+		"requestId": "test-request-2",
+	}
+	if len(entry) != len(expected) {
+		t.Errorf("expected the fields %v, got %v\n", expected, entry)
+	}
+	for field, want := range expected {
+		if entry[field] != want {
+			t.Errorf("expected %s to be %v, got %v\n", field, want, entry[field])
+		}
+	}
+}
+
+func TestAccessLogSkipsClusterRPCs(t *testing.T) {
+	output := captureAccessLog(t, server.AccessLogCombined)
+	request(t, http.MethodPost, raft.VotePath, "{}", nil)
+	request(t, http.MethodGet, "/ping", "", map[string]string{server.RequestIDHeader: "after-rpc"})
+	//lines are written before the response is finished, so the vote would have been logged by now
+	lines := output.lines(t, 1)
+	if len(lines) != 1 || !strings.Contains(lines[0], `"GET /ping HTTP/1.1"`) {
+		t.Errorf("expected only the ping to be logged, got %q\n", lines)
+	}
+}
@@ -1,58 +1,107 @@
-package server
-
-import (
-	"fmt"
-	"net/http"
-	"store/KVStore"
-	"store/logging"
-	"strconv"
-	"sync"
-)
-
-var (
-	ConnHost string
-	ConnPort string
-)
-
-var server *http.Server
-
-var ShutdownChannel chan struct{}
-var endpointWaitGroup *sync.WaitGroup
-
-//Setup creates the server, initialises the KV store and registers all the endpoints
-func Setup(port int, host string, storeBufferSize int, storeDepth int) error {
-	ConnPort = ":" + strconv.Itoa(port)
-	ConnHost = host
-
-	//initialise the KV Store
-	err := KVStore.Startup(storeBufferSize, storeDepth)
-	if err != nil {
-		return err
-	}
-
-	//initialise server
-	server = &http.Server{
-		Addr: ConnPort,
-	}
-
-	//initialise shutdown channel and endpoint waitgroup
-	ShutdownChannel = make(chan struct{})
-	endpointWaitGroup = &sync.WaitGroup{}
-
-	//setup endpoints
-	http.HandleFunc("/ping", PingEndpoint)
-	http.HandleFunc("/shutdown", ShutdownEndpoint)
-	http.HandleFunc("/store/", StoreEndpoint)
-	http.HandleFunc("/list/", ListEndpoint)
-	http.HandleFunc("/login", LoginEndpoint)
-	return nil
-}
-
-//Start starts the server. Will block until the server is shutdown
-func Start() error {
-	//start server
-	fmt.Println("Starting Server - see", ConnHost+ConnPort)
-	logging.InfoLogger.Println("Starting server on port", ConnPort)
-	err := server.ListenAndServe()
-	return err
-}
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"store/KVStore"
+	"store/audit"
+	"store/logging"
+	"store/users"
+	"strconv"
+	"sync"
+)
+
+var (
+	ConnHost string
+	ConnPort string
+)
+
+var server *http.Server
+
+var ShutdownChannel chan struct{}
+var endpointWaitGroup *sync.WaitGroup
+
+//Setup creates the server, initialises the KV store and registers all the endpoints
+//If namespaced is set every user gets their own keyspace, and the /ns/ endpoint is registered to reach other users' keys
+func Setup(port int, host string, storeBufferSize int, storeDepth int, namespaced bool) error {
+	ConnPort = ":" + strconv.Itoa(port)
+	ConnHost = host
+
+	//initialise the KV Store
+	KVStore.Namespaced = namespaced
+	err := KVStore.Startup(storeBufferSize, storeDepth)
+	if err != nil {
+		return err
+	}
+
+	//initialise server
+	server = &http.Server{
+		Addr:    ConnPort,
+		Handler: withRequestID(withAccessLog(withTracing(withMetrics(withReplication(withCluster(withPartitioning(http.DefaultServeMux))))))),
+	}
+
+	//initialise shutdown channel and endpoint waitgroup
+	ShutdownChannel = make(chan struct{})
+	shutdownDone = make(chan struct{})
+	endpointWaitGroup = &sync.WaitGroup{}
+
+	//record lockouts in the audit log as they happen
+	users.LoginGuard.OnLockout = func(lockout users.Lockout) {
+		event := audit.Event{Action: audit.ActionLockout, Outcome: audit.OutcomeDenied, Detail: lockout.Kind + " " + lockout.Subject}
+		if lockout.Kind == users.LockoutUser {
+			event.User = lockout.Subject
+		} else {
+			event.Source = lockout.Subject
+		}
+		audit.Record(event)
+	}
+
+	//setup endpoints
+	http.HandleFunc("/ping", PingEndpoint)
+	http.HandleFunc("/shutdown", ShutdownEndpoint)
+	http.HandleFunc("/store/", StoreEndpoint)
+	http.HandleFunc("/list/", ListEndpoint)
+	http.HandleFunc("/acl/", ACLEndpoint)
+	if namespaced {
+		http.HandleFunc("/ns/", NamespaceEndpoint)
+	}
+	http.HandleFunc("/login", LoginEndpoint)
+	http.HandleFunc("/admin/apikeys", APIKeyEndpoint)
+	http.HandleFunc("/admin/apikeys/", APIKeyEndpoint)
+	http.HandleFunc("/admin/lockouts", LockoutEndpoint)
+	http.HandleFunc("/2fa/", TwoFactorEndpoint)
+	http.HandleFunc("/whoami", WhoAmIEndpoint)
+	http.HandleFunc("/introspect", IntrospectEndpoint)
+	http.HandleFunc("/admin/audit", AuditEndpoint)
+	http.HandleFunc("/admin/audit/verify", AuditEndpoint)
+	http.HandleFunc("/admin/loglevel", LogLevelEndpoint)
+	http.HandleFunc("/metrics", MetricsEndpoint)
+	http.HandleFunc("/admin/stats", StatsEndpoint)
+	http.HandleFunc("/admin/reload", ReloadEndpoint)
+	http.HandleFunc("/healthz", HealthEndpoint)
+	http.HandleFunc("/readyz", ReadyEndpoint)
+	return nil
+}
+
+//Handler returns the endpoints wrapped in every middleware, as served by Start. Must be called after Setup, e.g. to test with httptest
+func Handler() http.Handler {
+	return server.Handler
+}
+
+//Start starts the server. Will block until the server is shutdown
+func Start() error {
+	//start server
+	fmt.Println("Starting Server - see", ConnHost+ConnPort)
+	logging.InfoLogger.Println("Starting server on port", ConnPort)
+	var err error
+	if server.TLSConfig != nil {
+		//the certificate comes from TLSConfig.GetCertificate so it can be reloaded, hence no files here
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed { //the listener closes as soon as a shutdown starts, so wait for the rest of it
+		<-shutdownDone
+	}
+	return err
+}
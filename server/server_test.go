@@ -0,0 +1,118 @@
+package server_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"store/KVStore"
+	"store/logging"
+	"store/server"
+	"store/users"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testServer serves every endpoint and middleware, as set up once by TestMain
+var testServer *httptest.Server
+
+func TestMain(m *testing.M) {
+	logging.SetupLoggers("../info.log", "../htaccess.log", false)
+	defer logging.Shutdown()
+	users.FillUserDB("../users/users.csv")
+	if err := server.Setup(0, "localhost", 100, 100, false); err != nil {
+		logging.ErrorLogger.Println("unable to set up the server", err)
+		os.Exit(1)
+	}
+	testServer = httptest.NewServer(server.Handler())
+	defer KVStore.Shutdown()
+	defer testServer.Close()
+	m.Run()
+}
+
+//request sends a request to the test server, returning the response and its body
+func request(t *testing.T, method, path string, body string, headers map[string]string) (*http.Response, string) {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	r, err := http.NewRequest(method, testServer.URL+path, reader)
+	if err != nil {
+		t.Fatal("unable to create request", err)
+	}
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	response, err := testServer.Client().Do(r)
+	if err != nil {
+		t.Fatal("request failed", err)
+	}
+	defer response.Body.Close()
+	output, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal("unable to read response", err)
+	}
+	return response, string(output)
+}
+
+//login logs in with basic auth and any extra headers, returning the response and the token if there was one
+func login(t *testing.T, username, password string, headers map[string]string) (*http.Response, string) {
+	t.Helper()
+	r, err := http.NewRequest(http.MethodGet, testServer.URL+"/login", nil)
+	if err != nil {
+		t.Fatal("unable to create request", err)
+	}
+	r.SetBasicAuth(username, password)
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	response, err := testServer.Client().Do(r)
+	if err != nil {
+		t.Fatal("request failed", err)
+	}
+	defer response.Body.Close()
+	output, _ := ioutil.ReadAll(response.Body)
+	return response, strings.TrimPrefix(string(output), "Bearer ")
+}
+
+func bearer(token string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+//fakeClock lets the tests move the login tracker's time forward without sleeping
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+//useLockoutPolicy replaces the login tracker's policy and clock for the rest of the test, forgetting any failures afterwards
+func useLockoutPolicy(t *testing.T, policy users.LockoutPolicy) *fakeClock {
+	clock := &fakeClock{now: time.Now()}
+	oldPolicy, oldClock := users.LoginGuard.Policy, users.LoginGuard.Clock
+	users.LoginGuard.Policy = policy
+	users.LoginGuard.Clock = clock.Now
+	t.Cleanup(func() {
+		for _, lockout := range users.LoginGuard.Lockouts() {
+			users.LoginGuard.Clear(lockout.Kind, lockout.Subject)
+		}
+		users.LoginGuard.Policy = oldPolicy
+		users.LoginGuard.Clock = oldClock
+	})
+	return clock
+}
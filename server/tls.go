@@ -0,0 +1,201 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"store/logging"
+	"sync"
+	"time"
+)
+
+//defaultCertReloadInterval is how often the certificate files are checked for changes, unless TLSOptions says otherwise
+const defaultCertReloadInterval = 10 * time.Second
+
+//certificates is the reloader serving the certificate, nil if TLS isn't configured
+var certificates *certReloader
+
+//TLSOptions configures native TLS. CertFile and KeyFile are required; ClientCAFile turns on client certificate verification
+type TLSOptions struct {
+	CertFile          string
+	KeyFile           string
+	ClientCAFile      string        //PEM bundle of CAs trusted to sign client certificates
+	RequireClientCert bool          //reject connections without a valid client certificate, rather than falling back to tokens
+	ReloadInterval    time.Duration //how often to check the certificate files for changes. Defaults to every 10 seconds
+}
+
+//certReloader holds the current server certificate and swaps it when the files on disk change,
+//so certificates can be renewed without restarting the server
+type certReloader struct {
+	certFile string
+	keyFile  string
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	stop     chan struct{} //closed to stop watching, when ConfigureTLS replaces the reloader
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{stop: make(chan struct{})}
+	if err := reloader.loadFrom(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+//files returns the certificate and key files currently in use
+func (c *certReloader) files() (certFile, keyFile string) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.certFile, c.keyFile
+}
+
+//latestModTime returns the most recent modification time of the certificate and key files
+func latestModTime(certFile, keyFile string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{certFile, keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+//loadFrom loads the certificate from the files, and uses those files from then on. If they can't be loaded the old certificate is kept
+func (c *certReloader) loadFrom(certFile, keyFile string) error {
+	modTime, err := latestModTime(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.certFile = certFile
+	c.keyFile = keyFile
+	c.cert = &cert
+	c.modTime = modTime
+	c.lock.Unlock()
+	return nil
+}
+
+//reloadIfChanged loads the certificate again if either file has changed. A broken new certificate is logged
+//and the old one kept, since it is better to carry on serving than to fail every handshake
+func (c *certReloader) reloadIfChanged() {
+	certFile, keyFile := c.files()
+	modTime, err := latestModTime(certFile, keyFile)
+	if err != nil {
+		logging.ErrorLogger.Println("unable to check TLS certificate files", err)
+		return
+	}
+	c.lock.RLock()
+	changed := modTime.After(c.modTime)
+	c.lock.RUnlock()
+	if !changed {
+		return
+	}
+	if err := c.loadFrom(certFile, keyFile); err != nil {
+		logging.ErrorLogger.Println("unable to reload TLS certificate, keeping the old one", err)
+		return
+	}
+	logging.InfoLogger.Println("reloaded TLS certificate from", certFile)
+}
+
+//watch checks the files for changes until the server shuts down or the reloader is replaced
+func (c *certReloader) watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.reloadIfChanged()
+		}
+	}
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+//ConfigureTLS makes Start serve HTTPS, replacing any earlier configuration. Must be called after Setup
+func ConfigureTLS(options TLSOptions) error {
+	if server == nil {
+		return errors.New("server has not been set up")
+	}
+	if options.CertFile == "" || options.KeyFile == "" {
+		return errors.New("TLS needs both a certificate and a key file")
+	}
+	if options.RequireClientCert && options.ClientCAFile == "" {
+		return errors.New("requiring client certificates needs a client CA file")
+	}
+	reloader, err := newCertReloader(options.CertFile, options.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if options.ClientCAFile != "" {
+		caPEM, err := ioutil.ReadFile(options.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return errors.New("no certificates found in the client CA file")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if options.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	interval := options.ReloadInterval
+	if interval <= 0 {
+		interval = defaultCertReloadInterval
+	}
+	if certificates != nil {
+		close(certificates.stop)
+	}
+	server.TLSConfig = config
+	certificates = reloader
+	go reloader.watch(interval, ShutdownChannel)
+	logging.InfoLogger.Println("TLS enabled with certificate", options.CertFile)
+	return nil
+}
+
+//TLSConfig returns the TLS configuration set up by ConfigureTLS, or nil if TLS isn't configured.
+//The certificate comes from its GetCertificate, so serving with it picks up reloaded certificates
+func TLSConfig() *tls.Config {
+	if server == nil {
+		return nil
+	}
+	return server.TLSConfig
+}
+
+//ReloadTLS loads the server certificate from the files straight away, rather than waiting for the next check for changes.
+//The files can be different to the ones the server started with. TLS can't be turned on or off without a restart
+func ReloadTLS(certFile, keyFile string) error {
+	if certificates == nil {
+		return errors.New("TLS is not enabled")
+	}
+	if err := certificates.loadFrom(certFile, keyFile); err != nil {
+		return err
+	}
+	logging.InfoLogger.Println("reloaded TLS certificate from", certFile)
+	return nil
+}
@@ -0,0 +1,236 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"store/server"
+	"store/users"
+	"testing"
+	"time"
+)
+
+//testCA signs the server and client certificates used by the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var serial int64
+
+func newTestCA(t *testing.T) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("unable to generate a key", err)
+	}
+	serial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("unable to create the CA certificate", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+//issue creates a certificate for the subject, signed by the CA, returning the certificate and key as PEM
+func (ca testCA) issue(t *testing.T, subject pkix.Name, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("unable to generate a key", err)
+	}
+	serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal("unable to create a certificate", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal("unable to marshal a key", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+//writeFile writes the contents to the named file in dir, returning its path
+func writeFile(t *testing.T, dir, name string, contents []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		t.Fatal("unable to write", path, err)
+	}
+	return path
+}
+
+//serveTLS serves every endpoint over TLS using the configuration from ConfigureTLS, returning the address
+func serveTLS(t *testing.T) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server.TLSConfig())
+	if err != nil {
+		t.Fatal("unable to listen", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	tlsServer := &http.Server{Handler: server.Handler(), ErrorLog: log.New(ioutil.Discard, "", 0)} //failed handshakes are expected
+	go tlsServer.Serve(listener)
+	return listener.Addr().String()
+}
+
+//servedName connects to the address and returns the common name of the certificate the server gives
+func servedName(t *testing.T, address string, roots *x509.CertPool) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal("unable to connect", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	certPEM, keyPEM := ca.issue(t, pkix.Name{CommonName: "first"}, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := writeFile(t, dir, "server.crt", certPEM), writeFile(t, dir, "server.key", keyPEM)
+	if err := server.ConfigureTLS(server.TLSOptions{CertFile: certFile, KeyFile: keyFile, ReloadInterval: 10 * time.Millisecond}); err != nil {
+		t.Fatal("unable to configure TLS", err)
+	}
+	address := serveTLS(t)
+	if name := servedName(t, address, roots); name != "first" {
+		t.Fatalf("expected the first certificate to be served, got %q\n", name)
+	}
+
+	//renewing the certificate in place is picked up without a restart
+	certPEM, keyPEM = ca.issue(t, pkix.Name{CommonName: "renewed"}, x509.ExtKeyUsageServerAuth)
+	writeFile(t, dir, "server.crt", certPEM)
+	writeFile(t, dir, "server.key", keyPEM)
+	later := time.Now().Add(time.Minute) //make sure the change is seen even if the file system only keeps whole seconds
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal("unable to change the modification time", err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for servedName(t, address, roots) != "renewed" {
+		if time.Now().After(deadline) {
+			t.Fatal("renewed certificate was not served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//a broken certificate is ignored, keeping the one that works
+	writeFile(t, dir, "server.crt", []byte("not a certificate"))
+	if err := os.Chtimes(certFile, later.Add(time.Minute), later.Add(time.Minute)); err != nil {
+		t.Fatal("unable to change the modification time", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if name := servedName(t, address, roots); name != "renewed" {
+		t.Errorf("expected a broken certificate to be ignored, got %q\n", name)
+	}
+
+	//ReloadTLS can switch to different files straight away
+	certPEM, keyPEM = ca.issue(t, pkix.Name{CommonName: "moved"}, x509.ExtKeyUsageServerAuth)
+	if err := server.ReloadTLS(writeFile(t, dir, "moved.crt", certPEM), writeFile(t, dir, "moved.key", keyPEM)); err != nil {
+		t.Fatal("unable to reload TLS", err)
+	}
+	if name := servedName(t, address, roots); name != "moved" {
+		t.Errorf("expected the certificate from the new files to be served, got %q\n", name)
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	serverCert, serverKey := ca.issue(t, pkix.Name{CommonName: "server"}, x509.ExtKeyUsageServerAuth)
+	batchCert, batchKey := ca.issue(t, pkix.Name{CommonName: "batch", Organization: []string{"Example"}}, x509.ExtKeyUsageClientAuth)
+	adminCert, adminKey := ca.issue(t, pkix.Name{CommonName: "admin"}, x509.ExtKeyUsageClientAuth)
+	err := server.ConfigureTLS(server.TLSOptions{
+		CertFile:     writeFile(t, dir, "server.crt", serverCert),
+		KeyFile:      writeFile(t, dir, "server.key", serverKey),
+		ClientCAFile: writeFile(t, dir, "ca.crt", ca.pem),
+	})
+	if err != nil {
+		t.Fatal("unable to configure TLS", err)
+	}
+	if err := users.LoadCertUsers(writeFile(t, dir, "certusers.csv", []byte("\"CN=batch,O=Example\",user_a\n"))); err != nil {
+		t.Fatal("unable to load the certificate users", err)
+	}
+	defer users.WipeCertUsers()
+	address := serveTLS(t)
+
+	//whoami sends a client certificate, if there is one, and returns the status and who the server thinks the caller is
+	whoami := func(certificates ...tls.Certificate) (int, string, string) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates}}}
+		defer client.CloseIdleConnections()
+		response, err := client.Get("https://" + address + "/whoami")
+		if err != nil {
+			return 0, "", ""
+		}
+		defer response.Body.Close()
+		var body struct {
+			Username   string `json:"username"`
+			AuthMethod string `json:"authMethod"`
+		}
+		json.NewDecoder(response.Body).Decode(&body)
+		return response.StatusCode, body.Username, body.AuthMethod
+	}
+	keyPair := func(certPEM, keyPEM []byte) tls.Certificate {
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal("unable to load a key pair", err)
+		}
+		return pair
+	}
+
+	if status, username, method := whoami(keyPair(batchCert, batchKey)); status != http.StatusOK || username != "user_a" || method != server.AuthMethodClientCert {
+		t.Errorf("expected a mapped certificate to authenticate as user_a, got %d %s %s\n", status, username, method)
+	}
+	//the common name isn't enough on its own, so a certificate for admin that isn't in the mapping gets nothing
+	if status, _, _ := whoami(keyPair(adminCert, adminKey)); status != http.StatusUnauthorized {
+		t.Errorf("expected an unmapped certificate to be unauthorised, got %d\n", status)
+	}
+	users.WipeCertUsers()
+	if status, _, _ := whoami(keyPair(batchCert, batchKey)); status != http.StatusUnauthorized {
+		t.Errorf("expected certificates to be refused without a mapping, got %d\n", status)
+	}
+
+	//a certificate from another CA fails the handshake
+	otherCert, otherKey := newTestCA(t).issue(t, pkix.Name{CommonName: "batch", Organization: []string{"Example"}}, x509.ExtKeyUsageClientAuth)
+	if status, _, _ := whoami(keyPair(otherCert, otherKey)); status != 0 {
+		t.Errorf("expected a certificate from an untrusted CA to be rejected, got %d\n", status)
+	}
+}
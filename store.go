@@ -3,68 +3,205 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"store/KVStore"
+	"store/audit"
+	"store/config"
 	"store/logging"
+	"store/rbac"
 	"store/server"
+	"store/tracing"
 	"store/users"
 	"strconv"
 	"strings"
-)
-
-const (
-	ConnHost = "localhost"
+	"sync"
+	"syscall"
 )
 
 func main() {
-	logLocation := os.Getenv("LOG_LOCATION")
-	cloudLogs := strings.ToLower(logLocation) == "cloud"
+	cfg, options, errConfig := config.Load(os.Args[1:], os.Stderr)
+	if errConfig == flag.ErrHelp {
+		return
+	}
+	if errConfig == nil {
+		errConfig = cfg.Validate()
+	}
+	if options.PrintConfig { //printed even if it isn't valid, as that's often why it's being looked at
+		cfg.WriteYAML(os.Stdout)
+	}
+	if errConfig != nil {
+		fmt.Println(errConfig)
+		os.Exit(-1)
+	}
+	if options.PrintConfig {
+		return
+	}
+	currentConfig = cfg
 
 	//initialise loggers
-	logging.SetupLoggers("info.log", "htaccess.log", cloudLogs) //pass in the log files so they can be closed at the end of the main function
+	logging.SetupLoggers(cfg.LogFile, cfg.AccessLogFile, cfg.CloudLogging()) //pass in the log files so they can be closed at the end of the main function
 	defer logging.Shutdown()
-
-	//read command line flags
-	portPtr := flag.Int("port", 0, "Port number to run on")
-	depthPtr := flag.Int("depth", 1000, "Maximum size of the KV store")
-	bufferPtr := flag.Int("buffer", 100, "KV store buffer")
-
-	flag.Parse()
-	if *portPtr <= 0 { //Todo, distinguish between no port received and port set to 0
-		portString, portInEnv := os.LookupEnv("PORT")
-		portInt, convErr := strconv.Atoi(portString)
-		if !portInEnv || (convErr != nil) {
-			logging.WarningLogger.Println("no port received")
-			fmt.Println("Port is required")
-			os.Exit(-1)
-		}
-		portPtr = &portInt
-
+	if options.File != "" {
+		logging.InfoLogger.Println("loaded configuration from", options.File)
 	}
 
-	if *depthPtr <= 0 {
-		logging.WarningLogger.Println("invalid store depth received", *depthPtr)
-		fmt.Println("Invalid store depth")
-		os.Exit(-1)
-	}
+	logLevel, _ := logging.ParseLevel(cfg.LogLevel) //already validated
+	logging.SetLevel(logLevel)
+	logging.SetRotationPolicy(rotationPolicy(cfg))
+	go reloadOnHangup()
 
-	if *bufferPtr < 0 {
-		logging.WarningLogger.Println("invalid store buffer received", *bufferPtr)
-		fmt.Println("Invalid store buffer")
+	traceExporter, errTrace := setupTraceExporter(cfg.TraceExporter, cfg.TraceFile, cfg.OTLPEndpoint)
+	if errTrace != nil {
+		fmt.Println("Unable to set up tracing:", errTrace)
 		os.Exit(-1)
 	}
+	tracing.SetExporter(traceExporter)
+	defer tracing.Shutdown()
+
+	server.AccessLogFormat, _ = server.ParseAccessLogFormat(cfg.AccessLogFormat)
 
 	//Fill the users database
-	errUser := users.FillUserDB("users/users.csv")
+	errUser := users.FillUserDB(cfg.UsersFile)
 	if errUser != nil {
 		logging.ErrorLogger.Println("Unable to fill the users database", errUser)
 		os.Exit(-1)
 	}
+	users.TokenLifetime = cfg.TokenLifetime
+	users.SetJWTKey([]byte(cfg.JWTSecret))
+
+	authenticator, errAuth := setupAuthenticator(cfg.Auth, cfg.Htpasswd, cfg.LDAPURL, cfg.LDAPBindDN)
+	if errAuth != nil {
+		logging.ErrorLogger.Println("Unable to set up authentication", errAuth)
+		fmt.Println("Invalid authentication configuration:", errAuth)
+		os.Exit(-1)
+	}
+	users.SetAuthenticator(authenticator)
+
+	users.LoginGuard.Policy.UserThreshold = cfg.LockoutThreshold
+	users.LoginGuard.Policy.IPThreshold = cfg.LockoutIPThreshold
+	server.TrustedProxies, _ = cfg.TrustedProxyNetworks()
+	users.LoginGuard.Policy.LockoutDuration = cfg.LockoutDuration
+
+	users.TOTPRequiredRoles, _ = rbac.ParseRoles(cfg.Require2FA, ",")
+	if cfg.TOTPFile != "" {
+		errTOTP := users.LoadTOTP(cfg.TOTPFile)
+		if errTOTP != nil {
+			logging.ErrorLogger.Println("Unable to load two factor enrolments", errTOTP)
+			os.Exit(-1)
+		}
+	}
+
+	if cfg.APIKeys != "" {
+		errKeys := users.LoadAPIKeys(cfg.APIKeys)
+		if errKeys != nil {
+			logging.ErrorLogger.Println("Unable to load API keys", errKeys)
+			os.Exit(-1)
+		}
+	}
+
+	if cfg.AuditLog != "" {
+		errAudit := audit.Open(cfg.AuditLog)
+		if errAudit != nil {
+			logging.ErrorLogger.Println("Unable to open the audit log", errAudit)
+			os.Exit(-1)
+		}
+		defer audit.Close()
+	}
 
-	errSetupServer := server.Setup(*portPtr, ConnHost, *bufferPtr, *depthPtr)
+	KVStore.StewardTimeout = cfg.Steward
+	KVStore.Clustered = cfg.Cluster
+	errSetupServer := server.Setup(cfg.Port, cfg.Host, cfg.Buffer, cfg.Depth, cfg.Namespaced)
 	if errSetupServer != nil {
 		logging.ErrorLogger.Println("problem setting up server", errSetupServer)
 	}
+	if cfg.DataFile != "" {
+		loaded, errLoad := KVStore.LoadFromFile(cfg.DataFile)
+		if errLoad != nil {
+			logging.ErrorLogger.Println("Unable to load the store from", cfg.DataFile, errLoad)
+			os.Exit(-1)
+		}
+		KVStore.Resize(cfg.Depth) //in case depth has been lowered since the store was saved
+		logging.InfoLogger.Printf("loaded %d keys from %s\n", loaded, cfg.DataFile)
+		server.DataFile = cfg.DataFile
+	}
+
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		errTLS := server.ConfigureTLS(server.TLSOptions{
+			CertFile:          cfg.TLSCert,
+			KeyFile:           cfg.TLSKey,
+			ClientCAFile:      cfg.ClientCA,
+			RequireClientCert: cfg.RequireClientCert,
+		})
+		if errTLS != nil {
+			logging.ErrorLogger.Println("Unable to set up TLS", errTLS)
+			os.Exit(-1)
+		}
+	}
+	if cfg.CertUsers != "" {
+		errCertUsers := users.LoadCertUsers(cfg.CertUsers)
+		if errCertUsers != nil {
+			logging.ErrorLogger.Println("Unable to load client certificate users", errCertUsers)
+			os.Exit(-1)
+		}
+	}
+
+	errReplication := server.ConfigureReplication(server.ReplicationOptions{
+		Role:       cfg.Replication,
+		PrimaryURL: cfg.ReplicaOf,
+		Secret:     cfg.ReplicationSecret,
+		LogSize:    cfg.ReplicationLogSize,
+	})
+	if errReplication != nil {
+		logging.ErrorLogger.Println("Unable to set up replication", errReplication)
+		os.Exit(-1)
+	}
+	if cfg.Cluster {
+		errCluster := server.ConfigureCluster(server.ClusterOptions{
+			Address:           cfg.ClusterAddress,
+			Peers:             cfg.ClusterMembers(),
+			Secret:            cfg.ClusterSecret,
+			DataDir:           cfg.ClusterDataDir,
+			SnapshotThreshold: cfg.ClusterSnapshotThreshold,
+			ElectionTimeout:   cfg.ClusterElectionTimeout,
+		})
+		if errCluster != nil {
+			logging.ErrorLogger.Println("Unable to set up the cluster", errCluster)
+			os.Exit(-1)
+		}
+	}
+	if cfg.Partition {
+		errPartition := server.ConfigurePartitioning(server.PartitionOptions{
+			Address:      cfg.PartitionAddress,
+			Nodes:        cfg.PartitionMembers(),
+			Secret:       cfg.PartitionSecret,
+			VirtualNodes: cfg.PartitionVirtualNodes,
+		})
+		if errPartition != nil {
+			logging.ErrorLogger.Println("Unable to set up partitioning", errPartition)
+			os.Exit(-1)
+		}
+	}
+	if cfg.Gossip {
+		errGossip := server.ConfigureGossip(server.GossipOptions{
+			Address:          cfg.GossipAddress,
+			Seeds:            cfg.GossipSeedList(),
+			Secret:           cfg.GossipSecret,
+			Meta:             gossipMeta(cfg),
+			ProbeInterval:    cfg.GossipProbeInterval,
+			SuspicionTimeout: cfg.GossipSuspicionTimeout,
+		})
+		if errGossip != nil {
+			logging.ErrorLogger.Println("Unable to start gossiping", errGossip)
+			os.Exit(-1)
+		}
+	}
+
+	server.ShutdownGracePeriod = cfg.Grace
+	server.Reloader = reloadConfig
+	go shutdownOnSignal()
 
 	err := server.Start()
 	if err != nil {
@@ -79,3 +216,192 @@ func main() {
 
 	fmt.Println("Done")
 }
+
+//reloadOnHangup reopens the log files and reloads the configuration whenever the process receives SIGHUP.
+//Reopening the logs is how logrotate tells us it has moved them
+func reloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := logging.Reopen(); err != nil {
+			logging.ErrorLogger.Println("unable to reopen log files", err)
+		} else {
+			logging.InfoLogger.Println("reopened log files after SIGHUP")
+		}
+		event := audit.Event{Action: audit.ActionReload, Detail: "received SIGHUP"}
+		report, err := reloadConfig()
+		if err != nil {
+			logging.ErrorLogger.Println("unable to reload the configuration after SIGHUP", err)
+			event.Outcome = audit.OutcomeFailure
+		}
+		audit.Record(event)
+		for _, change := range report.RestartRequired {
+			logging.WarningLogger.Printf("%s has changed from %s to %s, but needs a restart to take effect\n", change.Setting, change.Old, change.New)
+		}
+	}
+}
+
+var (
+	//currentConfig is the configuration in use, which is updated as reloads apply changes
+	currentConfig config.Config
+	reloadLock    sync.Mutex
+)
+
+//reloadConfig loads the configuration again from the same file, environment variables and flags,
+//and applies the settings that can be changed while the server is running. Settings that need a restart are reported but left alone.
+//If the new configuration isn't valid nothing is changed
+func reloadConfig() (server.ReloadReport, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	report := server.ReloadReport{Applied: []config.Change{}, RestartRequired: []config.Change{}, Failed: []config.Change{}}
+	next, _, err := config.Load(os.Args[1:], ioutil.Discard)
+	if err == nil {
+		err = next.Validate()
+	}
+	if err != nil {
+		return report, err
+	}
+
+	//TLS can only be turned on or off by a restart, but while it's on the certificate is always reloaded, so renewed certificates are picked up
+	tlsLive := currentConfig.TLSCert != "" && next.TLSCert != ""
+	var errTLS error
+	if tlsLive {
+		errTLS = server.ReloadTLS(next.TLSCert, next.TLSKey)
+	}
+	tlsReported := false
+	//likewise the users file is always read again, so edits to it apply without its path changing
+	errUsers := users.ReloadUserDB(next.UsersFile)
+	usersReported := false
+
+	for _, change := range currentConfig.Diff(next) {
+		if !change.Live {
+			report.RestartRequired = append(report.RestartRequired, change)
+			continue
+		}
+		var errApply error
+		switch change.Setting {
+		case "depth":
+			report.Evicted, errApply = KVStore.Resize(next.Depth)
+		case "users-file":
+			errApply = errUsers
+			usersReported = true
+		case "tls-cert", "tls-key":
+			if !tlsLive {
+				report.RestartRequired = append(report.RestartRequired, change)
+				continue
+			}
+			errApply = errTLS
+			tlsReported = true
+		case "log-level":
+			level, _ := logging.ParseLevel(next.LogLevel) //already validated
+			logging.SetLevel(level)
+		case "log-max-size", "log-rotate-interval", "log-max-backups", "log-max-age", "log-compress":
+			logging.SetRotationPolicy(rotationPolicy(next))
+		case "gossip-meta":
+			server.SetGossipMeta(gossipMeta(next))
+		}
+		if errApply != nil {
+			change.Error = errApply.Error()
+			report.Failed = append(report.Failed, change)
+			continue
+		}
+		currentConfig.Set(change.Setting, change.New)
+		report.Applied = append(report.Applied, change)
+	}
+	if errTLS != nil && !tlsReported {
+		report.Failed = append(report.Failed, config.Change{Setting: "tls-cert", Old: currentConfig.TLSCert, New: next.TLSCert, Error: errTLS.Error()})
+	}
+	if !usersReported {
+		change := config.Change{Setting: "users-file", Old: currentConfig.UsersFile, New: next.UsersFile}
+		if errUsers != nil {
+			change.Error = errUsers.Error()
+			report.Failed = append(report.Failed, change)
+		} else {
+			report.Applied = append(report.Applied, change)
+		}
+	}
+
+	logging.InfoLogger.Printf("reloaded configuration: %d settings applied, %d need a restart, %d failed\n", len(report.Applied), len(report.RestartRequired), len(report.Failed))
+	if len(report.Failed) > 0 {
+		return report, server.ErrReloadFailed
+	}
+	return report, nil
+}
+
+//rotationPolicy builds the log rotation policy from the configuration
+func rotationPolicy(cfg config.Config) logging.RotationPolicy {
+	return logging.RotationPolicy{
+		MaxSize:    int64(cfg.LogMaxSize) * 1024 * 1024,
+		Interval:   cfg.LogRotateInterval,
+		MaxBackups: cfg.LogMaxBackups,
+		MaxAge:     cfg.LogMaxAge,
+		Compress:   cfg.LogCompress,
+	}
+}
+
+//gossipMeta is the metadata spread to the other nodes: the node's role in replication, clustering and partitioning, along with gossip-meta
+func gossipMeta(cfg config.Config) map[string]string {
+	meta, _ := cfg.GossipMetadata() //already validated
+	meta["replication"] = strings.ToLower(cfg.Replication)
+	meta["cluster"] = strconv.FormatBool(cfg.Cluster)
+	meta["partition"] = strconv.FormatBool(cfg.Partition)
+	return meta
+}
+
+//shutdownOnSignal shuts the server down gracefully on SIGTERM or SIGINT, the same way as /shutdown.
+//A second signal stops the process straight away, for when draining is taking too long
+func shutdownOnSignal() {
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	received := <-stop
+	fmt.Println("Shutting down server")
+	server.Shutdown("received " + received.String())
+	received = <-stop
+	logging.WarningLogger.Println("received", received, "while shutting down, stopping without waiting")
+	logging.Shutdown()
+	os.Exit(1)
+}
+
+//setupTraceExporter creates the exporter named by the -trace-exporter flag. It returns nil, turning tracing off, for none
+func setupTraceExporter(name, file, otlpEndpoint string) (tracing.Exporter, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return nil, nil
+	case "stdout":
+		return tracing.NewWriterExporter(os.Stdout), nil
+	case "file":
+		return tracing.NewFileExporter(file)
+	case "otlp":
+		return tracing.NewOTLPExporter(otlpEndpoint), nil
+	}
+	return nil, fmt.Errorf("unknown trace exporter %q, expected none, stdout, file or otlp", name)
+}
+
+//setupAuthenticator builds the chain of authentication backends named in the comma separated backends list
+func setupAuthenticator(backends, htpasswdFile, ldapURL, ldapBindDN string) (users.Authenticator, error) {
+	var chain []users.Authenticator
+	for _, name := range strings.Split(backends, ",") {
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "local":
+			chain = append(chain, users.LocalAuthenticator{})
+		case "htpasswd":
+			htpasswd, err := users.NewHtpasswdAuthenticator(htpasswdFile)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, htpasswd)
+		case "ldap":
+			ldap, err := users.NewLDAPAuthenticator(ldapURL, ldapBindDN)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, ldap)
+		default:
+			return nil, fmt.Errorf("unknown authentication backend %q", name)
+		}
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return users.NewChainAuthenticator(chain...), nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"store/KVStore"
+	"store/config"
+	"store/logging"
+	"store/server"
+	"store/users"
+	"testing"
+)
+
+var testServer *httptest.Server
+
+func TestMain(m *testing.M) {
+	logging.SetupLoggers("info.log", "htaccess.log", false)
+	defer logging.Shutdown()
+	if err := server.Setup(0, "localhost", 100, 100, false); err != nil {
+		logging.ErrorLogger.Println("unable to set up the server", err)
+		os.Exit(1)
+	}
+	server.Reloader = reloadConfig
+	testServer = httptest.NewServer(server.Handler())
+	defer KVStore.Shutdown()
+	defer testServer.Close()
+	m.Run()
+}
+
+//writeConfig writes the config file the test server reloads from
+func writeConfig(t *testing.T, path, usersFile, depth, logLevel string) {
+	t.Helper()
+	contents := "port: 8080\n" +
+		"depth: " + depth + "\n" +
+		"users-file: " + usersFile + "\n" +
+		"jwt-secret: reload-test-secret-that-is-long-enough\n" +
+		"log-level: " + logLevel + "\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal("unable to write the config file", err)
+	}
+}
+
+//reload asks the server to reload its configuration as the admin
+func reload(t *testing.T, token string) (int, server.ReloadReport) {
+	t.Helper()
+	request, _ := http.NewRequest(http.MethodPost, testServer.URL+"/admin/reload", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := testServer.Client().Do(request)
+	if err != nil {
+		t.Fatal("unable to reach the server", err)
+	}
+	defer response.Body.Close()
+	var report server.ReloadReport
+	if response.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(response.Body).Decode(&report); err != nil {
+			t.Fatal("reload did not return a report", err)
+		}
+	}
+	return response.StatusCode, report
+}
+
+//applied finds the named setting in the changes the reload applied
+func applied(report server.ReloadReport, setting string) (config.Change, bool) {
+	for _, change := range report.Applied {
+		if change.Setting == setting {
+			return change, true
+		}
+	}
+	return config.Change{}, false
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	usersFile := filepath.Join(dir, "users.csv")
+	if err := ioutil.WriteFile(usersFile, []byte("admin,Password1,admin\nuser_a,passwordA,writer\nuser_b,passwordB,reader\n"), 0600); err != nil {
+		t.Fatal("unable to write the users file", err)
+	}
+	configFile := filepath.Join(dir, "config.yaml")
+	writeConfig(t, configFile, usersFile, "100", "info")
+
+	oldArgs, oldLevel := os.Args, logging.GetLevel()
+	os.Args = []string{"store", "-config", configFile}
+	defer func() {
+		os.Args = oldArgs
+		logging.SetLevel(oldLevel)
+		users.ReloadUserDB("users/users.csv")
+	}()
+	cfg, _, err := config.Load(os.Args[1:], ioutil.Discard)
+	if err != nil {
+		t.Fatal("unable to load the config file", err)
+	}
+	currentConfig = cfg
+	if err := users.FillUserDB(usersFile); err != nil {
+		t.Fatal("unable to fill the users database", err)
+	}
+	token, err := users.IssueJWT("admin", users.BackendLocal, false)
+	if err != nil {
+		t.Fatal("unable to issue an admin token", err)
+	}
+
+	//edit the users file in place and change two live settings
+	if err := ioutil.WriteFile(usersFile, []byte("admin,Password1,admin\nuser_a,newPasswordA,writer\nuser_d,passwordD,reader\n"), 0600); err != nil {
+		t.Fatal("unable to write the users file", err)
+	}
+	writeConfig(t, configFile, usersFile, "50", "debug")
+	status, report := reload(t, token)
+	if status != http.StatusOK {
+		t.Fatalf("expected the reload to succeed, got %d\n", status)
+	}
+	if change, ok := applied(report, "depth"); !ok || change.Old != "100" || change.New != "50" {
+		t.Errorf("expected depth to be applied, got %+v\n", report.Applied)
+	}
+	if change, ok := applied(report, "log-level"); !ok || change.Old != "info" || change.New != "debug" {
+		t.Errorf("expected log-level to be applied, got %+v\n", report.Applied)
+	}
+	if change, ok := applied(report, "users-file"); !ok || change.Old != usersFile || change.New != usersFile {
+		t.Errorf("expected the users file to be reported as reloaded, got %+v\n", report.Applied)
+	}
+	if len(report.Applied) != 3 || len(report.RestartRequired) != 0 || len(report.Failed) != 0 {
+		t.Errorf("expected only the three changes, got %+v\n", report)
+	}
+
+	if KVStore.MaxDepth != 50 || logging.GetLevel() != logging.LevelDebug || currentConfig.Depth != 50 {
+		t.Errorf("expected the new depth and log level to be in use, got %d %v %d\n", KVStore.MaxDepth, logging.GetLevel(), currentConfig.Depth)
+	}
+	if users.CheckUserPassword("user_a", "passwordA") || !users.CheckUserPassword("user_a", "newPasswordA") {
+		t.Error("expected user_a's new password to be in use")
+	}
+	if users.CheckUserPassword("user_b", "passwordB") || !users.CheckUserPassword("user_d", "passwordD") {
+		t.Error("expected user_b to be removed and user_d to be added")
+	}
+
+	//an invalid file changes nothing
+	writeConfig(t, configFile, usersFile, "0", "info")
+	if status, _ := reload(t, token); status != http.StatusBadRequest {
+		t.Errorf("expected an invalid config to be a bad request, got %d\n", status)
+	}
+	if KVStore.MaxDepth != 50 || logging.GetLevel() != logging.LevelDebug || currentConfig.Depth != 50 {
+		t.Errorf("expected the settings to be unchanged, got %d %v %d\n", KVStore.MaxDepth, logging.GetLevel(), currentConfig.Depth)
+	}
+}
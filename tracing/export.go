@@ -0,0 +1,332 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"store/logging"
+	"store/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ServiceName is reported to the collector as the service.name resource attribute
+var ServiceName = "kv-store"
+
+const (
+	batchSize     = 512
+	queueSize     = 4096
+	flushInterval = time.Second
+)
+
+//Exporter sends finished spans somewhere, e.g. a file or an OpenTelemetry collector
+type Exporter interface {
+	Export(spans []SpanData) error
+	Shutdown() error
+}
+
+//processor batches finished spans and hands them to the exporter from a single goroutine,
+//so ending a span never waits on the exporter
+type processor struct {
+	exporter Exporter
+	lock     sync.RWMutex //held for writing only to close the queue, so a span is never sent on a closed queue
+	closed   bool
+	queue    chan SpanData
+	flush    chan chan struct{}
+	done     chan struct{}
+}
+
+var droppedSpans = metrics.NewCounterVec("tracing_dropped_spans_total",
+	"Spans dropped because the export queue was full")
+
+var (
+	active     *processor
+	activeLock sync.RWMutex
+)
+
+func currentProcessor() *processor {
+	activeLock.RLock()
+	defer activeLock.RUnlock()
+	return active
+}
+
+//Enabled checks if spans are being recorded
+func Enabled() bool {
+	return currentProcessor() != nil
+}
+
+//SetExporter starts recording spans and sending them to the exporter. Any previous exporter is shut down first.
+//A nil exporter turns tracing off
+func SetExporter(exporter Exporter) {
+	Shutdown()
+	if exporter == nil {
+		return
+	}
+	p := &processor{
+		exporter: exporter,
+		queue:    make(chan SpanData, queueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	activeLock.Lock()
+	active = p
+	activeLock.Unlock()
+}
+
+//Flush exports every span that has ended so far
+func Flush() {
+	p := currentProcessor()
+	if p == nil {
+		return
+	}
+	flushed := make(chan struct{})
+	select {
+	case p.flush <- flushed:
+		<-flushed
+	case <-p.done:
+	}
+}
+
+//Shutdown exports any remaining spans, stops recording and shuts the exporter down
+func Shutdown() {
+	activeLock.Lock()
+	p := active
+	active = nil
+	activeLock.Unlock()
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	p.closed = true
+	close(p.queue)
+	p.lock.Unlock()
+	<-p.done
+	if err := p.exporter.Shutdown(); err != nil {
+		logging.ErrorLogger.Println("problem shutting down the trace exporter", err)
+	}
+}
+
+func (p *processor) enqueue(span SpanData) {
+	if p == nil {
+		return
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed { //tracing was turned off while the span was running
+		return
+	}
+	select {
+	case p.queue <- span:
+	default:
+		droppedSpans.Inc()
+	}
+}
+
+func (p *processor) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	batch := make([]SpanData, 0, batchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := p.exporter.Export(batch); err != nil {
+			logging.ErrorLogger.Println("unable to export spans", err)
+		}
+		batch = make([]SpanData, 0, batchSize)
+	}
+	for {
+		select {
+		case span, open := <-p.queue:
+			if !open {
+				export()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				export()
+			}
+		case flushed := <-p.flush:
+			for drained := false; !drained; { //take everything already queued, so spans ended before Flush are included
+				select {
+				case span, open := <-p.queue:
+					if !open {
+						drained = true
+						break
+					}
+					batch = append(batch, span)
+				default:
+					drained = true
+				}
+			}
+			export()
+			close(flushed)
+		case <-ticker.C:
+			export()
+		}
+	}
+}
+
+//WriterExporter writes each span as a JSON line, e.g. to stdout or a file
+type WriterExporter struct {
+	writer io.Writer
+	closer io.Closer
+}
+
+//NewWriterExporter writes spans to w
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{writer: w}
+}
+
+//NewFileExporter appends spans to the file, creating it if needed
+func NewFileExporter(path string) (*WriterExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterExporter{writer: file, closer: file}, nil
+}
+
+func (e *WriterExporter) Export(spans []SpanData) error {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, span := range spans {
+		if err := encoder.Encode(span); err != nil {
+			return err
+		}
+	}
+	_, err := e.writer.Write(buffer.Bytes())
+	return err
+}
+
+func (e *WriterExporter) Shutdown() error {
+	if e.closer != nil {
+		return e.closer.Close()
+	}
+	return nil
+}
+
+var ErrCollectorRejected = errors.New("the collector rejected the spans")
+
+//OTLPExporter sends spans to an OpenTelemetry collector using OTLP over HTTP, with the JSON encoding
+type OTLPExporter struct {
+	url    string
+	client *http.Client
+}
+
+//NewOTLPExporter sends spans to the collector at endpoint, e.g. http://localhost:4318. The path /v1/traces is added
+//unless the endpoint already has it
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	return &OTLPExporter{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+//the parts of the OTLP trace request used here. IDs are hex and times are nanoseconds in strings, as the OTLP JSON mapping asks
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              Kind            `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` //0 is unset, 2 is an error
+	Message string `json:"message,omitempty"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
+
+func (e *OTLPExporter) Export(spans []SpanData) error {
+	converted := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		out := otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentID,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		for key, value := range span.Attributes {
+			out.Attributes = append(out.Attributes, stringAttribute(key, value))
+		}
+		if span.Error != "" {
+			out.Status = otlpStatus{Code: 2, Message: span.Error}
+		}
+		converted = append(converted, out)
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{stringAttribute("service.name", ServiceName)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "store"}, Spans: converted}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	response, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("%w: %s", ErrCollectorRejected, response.Status)
+	}
+	return nil
+}
+
+func (e *OTLPExporter) Shutdown() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
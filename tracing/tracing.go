@@ -0,0 +1,228 @@
+//Package tracing records spans for requests as they pass through the server and the store actor, following the
+//OpenTelemetry data model. The trace is picked up from, and can be passed on with, a W3C traceparent header.
+//Nothing is recorded until an exporter is set with SetExporter
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+//TraceparentHeader is the W3C trace context header
+const TraceparentHeader = "traceparent"
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (t TraceID) valid() bool {
+	return t != TraceID{}
+}
+
+func (s SpanID) valid() bool {
+	return s != SpanID{}
+}
+
+//SpanContext identifies a span within a trace, and is what gets passed between services in the traceparent header
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+//IsValid checks that both IDs are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.valid() && sc.SpanID.valid()
+}
+
+//Traceparent formats the span context as a version 00 traceparent header, e.g. 00-<trace id>-<span id>-01
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+//ParseTraceparent reads a traceparent header. Unknown future versions are read as version 00, as the spec asks
+func ParseTraceparent(header string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+	var sc SpanContext
+	version, errVersion := hex.DecodeString(parts[0])
+	traceID, errTrace := hex.DecodeString(parts[1])
+	spanID, errSpan := hex.DecodeString(parts[2])
+	flags, errFlags := hex.DecodeString(parts[3])
+	if errVersion != nil || errTrace != nil || errSpan != nil || errFlags != nil ||
+		len(version) != 1 || len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 ||
+		strings.ToLower(parts[1]) != parts[1] || strings.ToLower(parts[2]) != parts[2] {
+		return SpanContext{}, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	return sc, true
+}
+
+//Kind says whether a span is the server side of a remote call or internal to the process
+type Kind int
+
+//the values used by OpenTelemetry
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+)
+
+//SpanData is a finished span, as handed to the exporter
+type SpanData struct {
+	Name       string            `json:"name"`
+	Kind       Kind              `json:"kind"`
+	TraceID    string            `json:"traceId"`
+	SpanID     string            `json:"spanId"`
+	ParentID   string            `json:"parentSpanId,omitempty"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+//Span is an operation being timed. A nil span is valid and does nothing, which is what Start returns when tracing is off,
+//so callers never need to check
+type Span struct {
+	lock    sync.Mutex
+	context SpanContext
+	data    SpanData
+	ended   bool
+}
+
+//SpanContext returns the IDs of the span, e.g. to pass on in a traceparent header
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+//SetAttribute adds a key value pair to the span
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = map[string]string{}
+	}
+	s.data.Attributes[key] = value
+}
+
+//SetError marks the span as failed. A nil error does nothing
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Error = err.Error()
+}
+
+//End finishes the span and queues it for export. Only the first call does anything
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.lock.Unlock()
+	currentProcessor().enqueue(data)
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+//SpanFromContext returns the span carried by the context, or nil if there isn't one
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+//ContextWithRemoteParent returns a copy of the context carrying a span context from another service, which becomes
+//the parent of the next span started
+func ContextWithRemoteParent(ctx context.Context, parent SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, parent)
+}
+
+//Start begins an internal span as a child of the span in the context, and returns a context carrying the new span
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return StartKind(ctx, name, KindInternal)
+}
+
+//StartKind is Start, for spans of a particular kind
+func StartKind(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if !Enabled() {
+		return ctx, nil
+	}
+	var parent SpanContext
+	if span := SpanFromContext(ctx); span != nil {
+		parent = span.context
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = remote
+		if !remote.Sampled { //the caller decided not to trace this request, so neither do we
+			return ctx, nil
+		}
+	}
+
+	span := &Span{context: SpanContext{TraceID: parent.TraceID, SpanID: newSpanID(), Sampled: true}}
+	if !span.context.TraceID.valid() {
+		rand.Read(span.context.TraceID[:])
+	}
+	span.data = SpanData{
+		Name:    name,
+		Kind:    kind,
+		TraceID: span.context.TraceID.String(),
+		SpanID:  span.context.SpanID.String(),
+		Start:   time.Now(),
+	}
+	if parent.SpanID.valid() {
+		span.data.ParentID = parent.SpanID.String()
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.valid() {
+		rand.Read(id[:])
+	}
+	return id
+}
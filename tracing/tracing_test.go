@@ -0,0 +1,169 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"store/logging"
+	"store/tracing"
+	"sync"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logging.SetupLoggers("../info.log", "../htaccess.log", false)
+	defer logging.Shutdown()
+	m.Run()
+}
+
+//memoryExporter keeps every exported span so tests can look at them
+type memoryExporter struct {
+	lock  sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (e *memoryExporter) Export(spans []tracing.SpanData) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *memoryExporter) Shutdown() error {
+	return nil
+}
+
+func (e *memoryExporter) byName() map[string]tracing.SpanData {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	spans := map[string]tracing.SpanData{}
+	for _, span := range e.spans {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func TestTraceparent(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := tracing.ParseTraceparent(header)
+	if !ok || !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Fatalf("unable to parse %s, got %+v\n", header, sc)
+	}
+	if sc.Traceparent() != header {
+		t.Errorf("expected %s to format back to itself, got %s\n", header, sc.Traceparent())
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",           //no flags
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",        //zero trace ID
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",        //zero span ID
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",        //upper case
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",        //forbidden version
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",  //version 00 has exactly four parts
+		"zz-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",        //not hex
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",          //short trace ID
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1",         //short flags
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-",       //trailing dash
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 extras", //rubbish after the flags
+	} {
+		if _, ok := tracing.ParseTraceparent(bad); ok {
+			t.Errorf("expected %q to be rejected\n", bad)
+		}
+	}
+	if _, ok := tracing.ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future"); !ok {
+		t.Error("expected later versions with extra fields to be accepted")
+	}
+}
+
+func TestSpans(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracing.SetExporter(exporter)
+	defer tracing.SetExporter(nil)
+
+	parent, _ := tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := tracing.ContextWithRemoteParent(context.Background(), parent)
+	ctx, server := tracing.StartKind(ctx, "GET /store/", tracing.KindServer)
+	_, child := tracing.Start(ctx, "auth")
+	child.SetAttribute("auth.user", "user_a")
+	child.SetError(errors.New("unauthorised"))
+	child.End()
+	server.End()
+	tracing.Flush()
+
+	spans := exporter.byName()
+	if spans["GET /store/"].TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || spans["GET /store/"].ParentID != "00f067aa0ba902b7" {
+		t.Errorf("expected the server span to continue the incoming trace, got %+v\n", spans["GET /store/"])
+	}
+	if spans["auth"].ParentID != spans["GET /store/"].SpanID || spans["auth"].TraceID != spans["GET /store/"].TraceID {
+		t.Errorf("expected auth to be a child of the server span, got %+v\n", spans["auth"])
+	}
+	if spans["auth"].Attributes["auth.user"] != "user_a" || spans["auth"].Error != "unauthorised" {
+		t.Errorf("expected the attribute and error to be recorded, got %+v\n", spans["auth"])
+	}
+
+	unsampled, _ := tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if _, span := tracing.Start(tracing.ContextWithRemoteParent(context.Background(), unsampled), "skipped"); span != nil {
+		t.Error("expected no span when the caller didn't sample the trace")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	tracing.SetExporter(nil)
+	ctx, span := tracing.Start(context.Background(), "nothing")
+	if span != nil || tracing.SpanFromContext(ctx) != nil {
+		t.Error("expected no span while tracing is off")
+	}
+	span.SetAttribute("key", "value") //a nil span must be safe to use
+	span.End()
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var lock sync.Mutex
+	var received []map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var request map[string]interface{}
+		if err := json.Unmarshal(body, &request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		received = append(received, request)
+		lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	tracing.SetExporter(tracing.NewOTLPExporter(collector.URL))
+	_, span := tracing.Start(context.Background(), "kvstore put")
+	span.SetError(errors.New("key not present"))
+	span.End()
+	tracing.SetExporter(nil) //shutting down exports what's left
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(received) != 1 {
+		t.Fatalf("expected the collector to receive one request, got %d\n", len(received))
+	}
+	resource := received[0]["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	service := resource["resource"].(map[string]interface{})["attributes"].([]interface{})[0].(map[string]interface{})
+	if service["key"] != "service.name" || service["value"].(map[string]interface{})["stringValue"] != tracing.ServiceName {
+		t.Errorf("expected the service name as a resource attribute, got %v\n", service)
+	}
+	spans := resource["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	exported := spans[0].(map[string]interface{})
+	if exported["name"] != "kvstore put" || len(exported["traceId"].(string)) != 32 || len(exported["spanId"].(string)) != 16 {
+		t.Errorf("unexpected span %v\n", exported)
+	}
+	if status := exported["status"].(map[string]interface{}); status["code"] != float64(2) || status["message"] != "key not present" {
+		t.Errorf("expected an error status, got %v\n", status)
+	}
+}
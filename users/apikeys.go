@@ -0,0 +1,241 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"store/logging"
+	"store/rbac"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAPIKeyInvalid  = errors.New("invalid API key")
+	ErrAPIKeyExpired  = errors.New("API key has expired")
+	ErrAPIKeyNotFound = errors.New("API key not found")
+)
+
+const apiKeyPrefix = "kvs"
+
+//APIKey is a long lived credential that lets a service act as a user without logging in.
+//Only a hash of the secret part of the key is kept, so the plain key is only ever seen when it is minted
+type APIKey struct {
+	ID         string    `json:"id"`
+	Owner      string    `json:"owner"`     //the user the key acts as
+	KeyPrefix  string    `json:"keyPrefix"` //only keys starting with this prefix can be used
+	ReadOnly   bool      `json:"readOnly"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	CreatedBy  string    `json:"createdBy"`
+	CreatedAt  time.Time `json:"createdAt"`
+	secretHash string
+}
+
+//storedAPIKey is the format the keys are saved to disk in, which unlike the APIKey JSON includes the hash
+type storedAPIKey struct {
+	APIKey
+	SecretHash string `json:"secretHash"`
+}
+
+//Expired returns true once the key is past its expiry time. Keys with a zero expiry never expire
+func (k APIKey) Expired() bool {
+	return !k.ExpiresAt.IsZero() && time.Now().After(k.ExpiresAt)
+}
+
+//Scope returns the restrictions on what the key is allowed to do
+func (k APIKey) Scope() *rbac.Scope {
+	perms := rbac.PermRead | rbac.PermList
+	if !k.ReadOnly {
+		perms |= rbac.PermWrite | rbac.PermDelete
+	}
+	return &rbac.Scope{KeyPrefix: k.KeyPrefix, Permissions: perms}
+}
+
+//Identity returns the identity used for requests made with the key: the owner's roles and groups, limited to the key's scope.
+//Gives ErrUnknownUser if the owner is no longer in the users file
+func (k APIKey) Identity() (rbac.Identity, error) {
+	identity, err := IdentityFor(k.Owner, BackendLocal)
+	identity.Scope = k.Scope()
+	return identity, err
+}
+
+var (
+	apiKeys     = map[string]*APIKey{} //id -> key
+	apiKeysFile string                 //if set, keys are saved here whenever they change
+	apiKeysLock sync.RWMutex
+)
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret)) //the secret is random, so a fast hash is enough (unlike for passwords)
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+//MintAPIKey creates a new API key for owner and returns it in plain text. This is the only time the plain key is available.
+//A ttl of zero creates a key that never expires
+func MintAPIKey(owner, keyPrefix string, readOnly bool, ttl time.Duration, createdBy string) (string, *APIKey, error) {
+	if owner == "" {
+		return "", nil, errors.New("API key must have an owner")
+	}
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, err
+	}
+	id := hex.EncodeToString(idBytes)
+	secret, err := randomString(32)
+	if err != nil {
+		return "", nil, err
+	}
+	key := &APIKey{
+		ID:         id,
+		Owner:      owner,
+		KeyPrefix:  keyPrefix,
+		ReadOnly:   readOnly,
+		CreatedBy:  createdBy,
+		CreatedAt:  time.Now(),
+		secretHash: hashSecret(secret),
+	}
+	if ttl > 0 {
+		key.ExpiresAt = key.CreatedAt.Add(ttl)
+	}
+
+	apiKeysLock.Lock()
+	apiKeys[id] = key
+	errSave := saveAPIKeys()
+	if errSave != nil {
+		delete(apiKeys, id) //the caller is told it failed, so the key mustn't work either
+	}
+	apiKeysLock.Unlock()
+	if errSave != nil {
+		return "", nil, errSave
+	}
+	logging.InfoLogger.Printf("user %s minted API key %s for user %s\n", createdBy, id, owner)
+	return strings.Join([]string{apiKeyPrefix, id, secret}, "_"), key, nil
+}
+
+//RevokeAPIKey deletes the key with the given ID so it can no longer be used. If the change can't be saved the key is kept,
+//rather than working again after a restart
+func RevokeAPIKey(id string) error {
+	apiKeysLock.Lock()
+	defer apiKeysLock.Unlock()
+	key, present := apiKeys[id]
+	if !present {
+		return ErrAPIKeyNotFound
+	}
+	delete(apiKeys, id)
+	if err := saveAPIKeys(); err != nil {
+		apiKeys[id] = key
+		return err
+	}
+	return nil
+}
+
+//ListAPIKeys returns every API key, without their hashes, oldest first
+func ListAPIKeys() []APIKey {
+	apiKeysLock.RLock()
+	defer apiKeysLock.RUnlock()
+	output := make([]APIKey, 0, len(apiKeys))
+	for _, key := range apiKeys {
+		output = append(output, *key)
+	}
+	sort.Slice(output, func(i, j int) bool { return output[i].CreatedAt.Before(output[j].CreatedAt) })
+	return output
+}
+
+//ValidateAPIKey checks a plain text API key and returns its details if it is valid and has not expired
+func ValidateAPIKey(plainKey string) (*APIKey, error) {
+	parts := strings.SplitN(plainKey, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyPrefix {
+		return nil, ErrAPIKeyInvalid
+	}
+	apiKeysLock.RLock()
+	key, present := apiKeys[parts[1]]
+	apiKeysLock.RUnlock()
+	if !present {
+		hashSecret(parts[2]) //keep the timing the same as for a real key
+		return nil, ErrAPIKeyInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(parts[2])), []byte(key.secretHash)) != 1 {
+		return nil, ErrAPIKeyInvalid
+	}
+	if key.Expired() {
+		return nil, ErrAPIKeyExpired
+	}
+	return key, nil
+}
+
+//LoadAPIKeys reads previously minted keys from the file, and saves any future changes back to it.
+//A missing file is not an error, since no keys have been minted yet
+func LoadAPIKeys(path string) error {
+	apiKeysLock.Lock()
+	defer apiKeysLock.Unlock()
+	apiKeysFile = path
+	apiKeys = map[string]*APIKey{}
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var stored []storedAPIKey
+	if err := json.Unmarshal(contents, &stored); err != nil {
+		logging.ErrorLogger.Println("Unable to parse API keys file "+path, err)
+		return errors.New("invalid API keys file")
+	}
+	for _, s := range stored {
+		key := s.APIKey
+		key.secretHash = s.SecretHash
+		apiKeys[key.ID] = &key
+	}
+	logging.InfoLogger.Printf("loaded %d API keys\n", len(apiKeys))
+	return nil
+}
+
+//saveAPIKeys writes the keys to apiKeysFile, if there is one. Must be called with apiKeysLock held
+func saveAPIKeys() error {
+	if apiKeysFile == "" {
+		return nil
+	}
+	stored := make([]storedAPIKey, 0, len(apiKeys))
+	for _, key := range apiKeys {
+		stored = append(stored, storedAPIKey{APIKey: *key, SecretHash: key.secretHash})
+	}
+	contents, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(apiKeysFile, contents)
+}
+
+//writeFileAtomic writes to a temporary file then renames it, so a crash can't leave a half written file.
+//The file is only readable by the owner since it holds credentials
+func writeFileAtomic(path string, contents []byte) error {
+	tmpFile := path + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, contents, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
+
+//WipeAPIKeys removes every API key and stops saving them to disk. Used for testing
+func WipeAPIKeys() {
+	apiKeysLock.Lock()
+	defer apiKeysLock.Unlock()
+	apiKeys = map[string]*APIKey{}
+	apiKeysFile = ""
+}
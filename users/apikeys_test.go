@@ -0,0 +1,133 @@
+package users_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"store/rbac"
+	"store/users"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeys(t *testing.T) {
+	defer users.WipeAPIKeys()
+	plainKey, key, err := users.MintAPIKey("user_a", "batch_", true, time.Hour, "admin")
+	if err != nil {
+		t.Fatal("unable to mint an API key", err)
+	}
+
+	validated, err := users.ValidateAPIKey(plainKey)
+	if err != nil || validated.ID != key.ID {
+		t.Fatal("unable to validate a freshly minted API key", err)
+	}
+	identity, err := validated.Identity()
+	if err != nil {
+		t.Fatal("unable to get the API key's identity", err)
+	}
+	if identity.Username != "user_a" || !identity.Can(rbac.PermRead) || identity.Can(rbac.PermWrite) {
+		t.Errorf("read only API key has the wrong permissions %s\n", identity.Permissions())
+	}
+	if !identity.CanAccessKey("batch_1") || identity.CanAccessKey("other") {
+		t.Error("API key is not limited to its prefix")
+	}
+
+	if _, err := users.ValidateAPIKey(plainKey + "x"); err != users.ErrAPIKeyInvalid {
+		t.Error("able to validate a tampered API key", err)
+	}
+	if err := users.RevokeAPIKey(key.ID); err != nil {
+		t.Error("unable to revoke an API key", err)
+	}
+	if _, err := users.ValidateAPIKey(plainKey); err != users.ErrAPIKeyInvalid {
+		t.Error("able to use a revoked API key", err)
+	}
+}
+
+func TestAPIKeyUnknownOwner(t *testing.T) {
+	defer users.WipeAPIKeys()
+	_, key, err := users.MintAPIKey("nobody", "", false, time.Hour, "admin")
+	if err != nil {
+		t.Fatal("unable to mint an API key", err)
+	}
+	if identity, err := key.Identity(); err != users.ErrUnknownUser || len(identity.Roles) != 0 {
+		t.Errorf("expected a key whose owner isn't a user to have no roles, got %v %v\n", identity.Roles, err)
+	}
+}
+
+func TestAPIKeyExpiry(t *testing.T) {
+	defer users.WipeAPIKeys()
+	plainKey, _, err := users.MintAPIKey("user_a", "", false, time.Millisecond, "admin")
+	if err != nil {
+		t.Fatal("unable to mint an API key", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := users.ValidateAPIKey(plainKey); err != users.ErrAPIKeyExpired {
+		t.Error("able to use an expired API key", err)
+	}
+}
+
+func TestAPIKeysPersisted(t *testing.T) {
+	defer users.WipeAPIKeys()
+	dir, err := ioutil.TempDir("", "apikeys")
+	if err != nil {
+		t.Fatal("unable to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "apikeys.json")
+
+	if err := users.LoadAPIKeys(path); err != nil {
+		t.Fatal("unable to start with a missing API keys file", err)
+	}
+	plainKey, _, err := users.MintAPIKey("user_b", "", false, 0, "admin")
+	if err != nil {
+		t.Fatal("unable to mint an API key", err)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("API keys were not saved", err)
+	}
+	secret := strings.SplitN(plainKey, "_", 3)[2]
+	if strings.Contains(string(contents), secret) {
+		t.Error("API key secret was saved in plain text")
+	}
+
+	users.WipeAPIKeys()
+	if err := users.LoadAPIKeys(path); err != nil {
+		t.Fatal("unable to reload API keys", err)
+	}
+	if _, err := users.ValidateAPIKey(plainKey); err != nil {
+		t.Error("API key was not valid after reloading from disk", err)
+	}
+}
+
+func TestAPIKeySaveFailure(t *testing.T) {
+	defer users.WipeAPIKeys()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "apikeys.json")
+	if err := users.LoadAPIKeys(path); err != nil {
+		t.Fatal("unable to start with a missing API keys file", err)
+	}
+	plainKey, key, err := users.MintAPIKey("user_a", "", false, 0, "admin")
+	if err != nil {
+		t.Fatal("unable to mint an API key", err)
+	}
+
+	//a directory in the way of the temporary file stops the keys being saved
+	if err := os.Mkdir(path+".tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := users.MintAPIKey("user_a", "", false, 0, "admin"); err == nil {
+		t.Fatal("expected minting to fail when the keys can't be saved")
+	}
+	if keys := users.ListAPIKeys(); len(keys) != 1 || keys[0].ID != key.ID {
+		t.Errorf("a key that couldn't be saved was kept %+v\n", keys)
+	}
+	if err := users.RevokeAPIKey(key.ID); err == nil {
+		t.Fatal("expected revoking to fail when the keys can't be saved")
+	}
+	if _, err := users.ValidateAPIKey(plainKey); err != nil {
+		t.Error("a key whose revocation couldn't be saved should still work, as it would after a restart", err)
+	}
+}
@@ -0,0 +1,105 @@
+package users
+
+import (
+	"errors"
+	"store/logging"
+)
+
+var ErrBackendUnavailable = errors.New("authentication backend unavailable")
+
+//Authenticator is implemented by anything that is able to check a username and password.
+//A false result with a nil error means the credentials were checked and rejected.
+//A non-nil error means the backend was unable to make a decision (e.g. the LDAP server is down)
+type Authenticator interface {
+	Authenticate(username, password string) (bool, error)
+	Name() string
+}
+
+//authenticator is the backend used by CheckUserPassword. Defaults to the local users file
+var authenticator Authenticator = LocalAuthenticator{}
+
+//SetAuthenticator replaces the backend used to check passwords. Passing nil restores the local users file
+func SetAuthenticator(a Authenticator) {
+	if a == nil {
+		a = LocalAuthenticator{}
+	}
+	authenticator = a
+}
+
+//BackendLocal is the name of the LocalAuthenticator. Only users it authenticates get the roles and groups in the users file
+const BackendLocal = "local"
+
+//LocalAuthenticator checks passwords against the in memory user database filled by FillUserDB
+type LocalAuthenticator struct{}
+
+func (LocalAuthenticator) Name() string {
+	return BackendLocal
+}
+
+func (LocalAuthenticator) Authenticate(username, password string) (bool, error) {
+	user, present := lookupUser(username)
+	if !present {
+		fakeUser.CheckPassword("fakePassword") //perform a fake hashing check to make login constant time
+		return false, nil
+	}
+	return user.CheckPassword(password), nil
+}
+
+//ChainAuthenticator tries each of its backends in order, succeeding as soon as one of them accepts the credentials.
+//A backend that errors is logged and skipped so that one broken backend does not lock everybody out
+type ChainAuthenticator struct {
+	backends []Authenticator
+}
+
+func NewChainAuthenticator(backends ...Authenticator) *ChainAuthenticator {
+	return &ChainAuthenticator{backends: backends}
+}
+
+func (c *ChainAuthenticator) Name() string {
+	name := "chain("
+	for i, backend := range c.backends {
+		if i > 0 {
+			name += ","
+		}
+		name += backend.Name()
+	}
+	return name + ")"
+}
+
+func (c *ChainAuthenticator) Authenticate(username, password string) (bool, error) {
+	_, ok, err := c.accepting(username, password)
+	return ok, err
+}
+
+//accepting is like Authenticate, but also returns the name of the backend that accepted the credentials
+func (c *ChainAuthenticator) accepting(username, password string) (string, bool, error) {
+	var lastErr error
+	for _, backend := range c.backends {
+		name, ok, err := authenticateWith(backend, username, password)
+		if err != nil {
+			logging.WarningLogger.Printf("authentication backend %s failed: %v\n", backend.Name(), err)
+			lastErr = err
+			continue
+		}
+		if ok {
+			return name, true, nil
+		}
+	}
+	if lastErr != nil {
+		return "", false, lastErr
+	}
+	return "", false, nil
+}
+
+//authenticateWith checks the credentials using the backend, returning the name of the backend that accepted them.
+//For a chain this is the backend within the chain, since that decides where the user's roles come from
+func authenticateWith(a Authenticator, username, password string) (string, bool, error) {
+	if chain, isChain := a.(*ChainAuthenticator); isChain {
+		return chain.accepting(username, password)
+	}
+	ok, err := a.Authenticate(username, password)
+	if !ok || err != nil {
+		return "", false, err
+	}
+	return a.Name(), true, nil
+}
@@ -0,0 +1,190 @@
+package users_test
+
+import (
+	"encoding/asn1"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"store/users"
+	"testing"
+)
+
+//htpasswd entries for the password "secret"
+const htpasswdFile = `# test file
+bcrypt_user:$2y$04$FoEp4nzO/DUcFqvHxYTwX.a9duqHlO7NxMKupCx/x8Cw4eI8Z.MMy
+apr1_user:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/
+sha_user:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+admin:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+`
+
+func writeHtpasswd(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal("unable to create temp dir", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, ".htpasswd")
+	if err := ioutil.WriteFile(path, []byte(htpasswdFile), 0600); err != nil {
+		t.Fatal("unable to write htpasswd file", err)
+	}
+	return path
+}
+
+func TestHtpasswd(t *testing.T) {
+	auth, err := users.NewHtpasswdAuthenticator(writeHtpasswd(t))
+	if err != nil {
+		t.Fatal("unable to read htpasswd file", err)
+	}
+	for _, username := range []string{"bcrypt_user", "apr1_user", "sha_user"} {
+		if ok, err := auth.Authenticate(username, "secret"); !ok || err != nil {
+			t.Errorf("unable to log in as %s. Error is %v\n", username, err)
+		}
+		if ok, _ := auth.Authenticate(username, "wrong"); ok {
+			t.Errorf("able to log in as %s with the wrong password\n", username)
+		}
+	}
+	if ok, _ := auth.Authenticate("nobody", "secret"); ok {
+		t.Error("able to log in as a user that is not in the htpasswd file")
+	}
+}
+
+//fakeLDAPServer answers simple bind requests, accepting only the DN/password pairs in its directory
+func fakeLDAPServer(t *testing.T, directory map[string]string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unable to start fake LDAP server", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	type bindRequest struct {
+		Version int
+		Name    []byte
+		Simple  []byte `asn1:"tag:0"`
+	}
+	type bindResponse struct {
+		ResultCode        asn1.Enumerated
+		MatchedDN         []byte
+		DiagnosticMessage []byte
+	}
+	type message struct {
+		MessageID  int
+		ProtocolOp asn1.RawValue
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				packet := make([]byte, 4096)
+				n, err := conn.Read(packet)
+				if err != nil && err != io.EOF {
+					return
+				}
+				var request message
+				if _, err := asn1.Unmarshal(packet[:n], &request); err != nil {
+					return
+				}
+				var bind bindRequest
+				if _, err := asn1.UnmarshalWithParams(request.ProtocolOp.FullBytes, &bind, "application,tag:0"); err != nil {
+					return
+				}
+				code := asn1.Enumerated(49)
+				if password, ok := directory[string(bind.Name)]; ok && password == string(bind.Simple) {
+					code = 0
+				}
+				op, _ := asn1.MarshalWithParams(bindResponse{ResultCode: code, MatchedDN: []byte{}, DiagnosticMessage: []byte{}}, "application,tag:1")
+				response, _ := asn1.Marshal(message{MessageID: request.MessageID, ProtocolOp: asn1.RawValue{FullBytes: op}})
+				conn.Write(response)
+			}(conn)
+		}
+	}()
+	return "ldap://" + listener.Addr().String()
+}
+
+func TestLDAP(t *testing.T) {
+	url := fakeLDAPServer(t, map[string]string{
+		"uid=ldap_user,ou=people,dc=example,dc=com": "ldapPassword",
+	})
+	auth, err := users.NewLDAPAuthenticator(url, "uid=%s,ou=people,dc=example,dc=com")
+	if err != nil {
+		t.Fatal("unable to create LDAP authenticator", err)
+	}
+
+	if ok, err := auth.Authenticate("ldap_user", "ldapPassword"); !ok || err != nil {
+		t.Error("unable to bind as ldap_user", err)
+	}
+	if ok, err := auth.Authenticate("ldap_user", "wrong"); ok || err != nil {
+		t.Error("able to bind as ldap_user with the wrong password", err)
+	}
+	if ok, _ := auth.Authenticate("ldap_user", ""); ok {
+		t.Error("an empty password was accepted as an anonymous bind")
+	}
+	if ok, _ := auth.Authenticate("x,ou=people,dc=example,dc=com", "ldapPassword"); ok {
+		t.Error("able to inject extra components into the bind DN")
+	}
+}
+
+func TestLDAPUnavailable(t *testing.T) {
+	auth, err := users.NewLDAPAuthenticator("ldap://127.0.0.1:1", "uid=%s,dc=example,dc=com")
+	if err != nil {
+		t.Fatal("unable to create LDAP authenticator", err)
+	}
+	if ok, err := auth.Authenticate("ldap_user", "ldapPassword"); ok || err == nil {
+		t.Error("expected an error from an unreachable LDAP server")
+	}
+}
+
+func TestChain(t *testing.T) {
+	defer users.SetAuthenticator(nil)
+	url := fakeLDAPServer(t, map[string]string{"uid=ldap_user,dc=example,dc=com": "ldapPassword"})
+	ldap, _ := users.NewLDAPAuthenticator(url, "uid=%s,dc=example,dc=com")
+	broken, _ := users.NewLDAPAuthenticator("ldap://127.0.0.1:1", "uid=%s,dc=example,dc=com")
+	htpasswd, err := users.NewHtpasswdAuthenticator(writeHtpasswd(t))
+	if err != nil {
+		t.Fatal("unable to read htpasswd file", err)
+	}
+	users.SetAuthenticator(users.NewChainAuthenticator(users.LocalAuthenticator{}, broken, htpasswd, ldap))
+
+	logins := []TestUser{
+		testUsers[0],
+		{username: "sha_user", password: "secret"},
+		{username: "ldap_user", password: "ldapPassword"},
+	}
+	for _, user := range logins {
+		if !users.CheckUserPassword(user.username, user.password) {
+			t.Errorf("chain rejected user %s with password %s\n", user.username, user.password)
+		}
+	}
+	if users.CheckUserPassword("ldap_user", "secret") {
+		t.Error("chain accepted a password belonging to a different backend")
+	}
+
+	//roles only come from the users file for local users, so an external user can't take on a local admin's roles
+	if backend, ok := users.AuthenticateUser("admin", "Password1"); !ok || backend != users.BackendLocal {
+		t.Errorf("expected the local admin to be authenticated locally, got %s %v\n", backend, ok)
+	}
+	backend, ok := users.AuthenticateUser("admin", "secret")
+	if !ok || backend != "htpasswd" {
+		t.Fatalf("expected the htpasswd admin to be authenticated by htpasswd, got %s %v\n", backend, ok)
+	}
+	if identity, _ := users.IdentityFor("admin", backend); identity.IsAdmin() || len(identity.Groups) != 0 {
+		t.Errorf("expected an external user to get the default roles, got %v %v\n", identity.Roles, identity.Groups)
+	}
+	token, err := users.GenerateJWT("admin", "secret")
+	if err != nil {
+		t.Fatal("unable to generate a token", err)
+	}
+	claims, ok := users.ParseJWT(token)
+	if !ok {
+		t.Fatal("token from an external backend was invalid")
+	}
+	if identity, err := claims.Identity(); err != nil || claims.Backend != "htpasswd" || identity.IsAdmin() {
+		t.Errorf("expected the token to record the backend and not be an admin token, got %+v %v\n", claims, err)
+	}
+}
@@ -0,0 +1,73 @@
+package users
+
+import (
+	"crypto/x509"
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"store/logging"
+	"strings"
+	"sync"
+)
+
+var ErrUnknownCertificate = errors.New("client certificate is not mapped to a user")
+
+var (
+	certUsers     map[string]string //certificate subject -> username. Certificates aren't accepted until it has been loaded
+	certUsersLock sync.RWMutex
+)
+
+//ClientCertUsername returns the user that a verified client certificate authenticates as. The certificate's subject must be
+//in the mapping from LoadCertUsers: the common name is never trusted on its own, as anyone the client CA signs for could
+//otherwise pick any user, e.g. admin
+func ClientCertUsername(cert *x509.Certificate) (string, error) {
+	certUsersLock.RLock()
+	defer certUsersLock.RUnlock()
+	username, present := certUsers[cert.Subject.String()]
+	if !present {
+		return "", ErrUnknownCertificate
+	}
+	return username, nil
+}
+
+//LoadCertUsers reads a csv file mapping certificate subjects to usernames. Each line is the subject in RFC 2253 form
+//(e.g. "CN=batch,O=Example") followed by the username. Subjects contain commas, so must be quoted
+func LoadCertUsers(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	mapping := map[string]string{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logging.ErrorLogger.Println("Unable to parse certificate users file "+path, err)
+			return errors.New("invalid certificate users file")
+		}
+		if len(record) != 2 {
+			return errors.New("invalid certificate users file, each line must be a subject and a username")
+		}
+		mapping[strings.TrimSpace(record[0])] = strings.TrimSpace(record[1])
+	}
+
+	certUsersLock.Lock()
+	certUsers = mapping
+	certUsersLock.Unlock()
+	logging.InfoLogger.Printf("loaded %d client certificate users\n", len(mapping))
+	return nil
+}
+
+//WipeCertUsers forgets the mapping, so no client certificate is accepted. Used for testing
+func WipeCertUsers() {
+	certUsersLock.Lock()
+	defer certUsersLock.Unlock()
+	certUsers = nil
+}
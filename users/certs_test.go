@@ -0,0 +1,45 @@
+package users_test
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"store/users"
+	"testing"
+)
+
+func TestClientCertUsername(t *testing.T) {
+	defer users.WipeCertUsers()
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "batch", Organization: []string{"Example"}}}
+	if _, err := users.ClientCertUsername(cert); err != users.ErrUnknownCertificate {
+		t.Error("certificate was accepted without a mapping", err)
+	}
+	admin := &x509.Certificate{Subject: pkix.Name{CommonName: "admin"}}
+	if _, err := users.ClientCertUsername(admin); err != users.ErrUnknownCertificate {
+		t.Error("the common name alone was enough to act as admin", err)
+	}
+
+	dir, err := ioutil.TempDir("", "certusers")
+	if err != nil {
+		t.Fatal("unable to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "certusers.csv")
+	contents := "# subject,username\n\"CN=batch,O=Example\",user_a\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal("unable to write mapping file", err)
+	}
+	if err := users.LoadCertUsers(path); err != nil {
+		t.Fatal("unable to load mapping file", err)
+	}
+
+	if username, err := users.ClientCertUsername(cert); err != nil || username != "user_a" {
+		t.Errorf("expected the mapped user, got %s %v\n", username, err)
+	}
+	other := &x509.Certificate{Subject: pkix.Name{CommonName: "intruder"}}
+	if _, err := users.ClientCertUsername(other); err != users.ErrUnknownCertificate {
+		t.Error("unmapped certificate was accepted", err)
+	}
+}
@@ -0,0 +1,152 @@
+package users
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"os"
+	"store/logging"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnsupportedHash = errors.New("unsupported htpasswd hash format")
+
+//HtpasswdAuthenticator checks passwords against an Apache style htpasswd file.
+//bcrypt ($2y$), apr1 ($apr1$) and SHA1 ({SHA}) hashes are supported
+type HtpasswdAuthenticator struct {
+	path   string
+	hashes map[string]string
+}
+
+func NewHtpasswdAuthenticator(path string) (*HtpasswdAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New("unable to read htpasswd file")
+	}
+	defer f.Close()
+
+	hashes := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			logging.WarningLogger.Println("skipping malformed line in htpasswd file", path)
+			continue
+		}
+		hashes[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	logging.InfoLogger.Printf("loaded %d users from htpasswd file %s\n", len(hashes), path)
+	return &HtpasswdAuthenticator{path: path, hashes: hashes}, nil
+}
+
+func (h *HtpasswdAuthenticator) Name() string {
+	return "htpasswd"
+}
+
+func (h *HtpasswdAuthenticator) Authenticate(username, password string) (bool, error) {
+	hash, present := h.hashes[username]
+	if !present {
+		fakeUser.CheckPassword("fakePassword") //keep unknown users constant time, as for the local store
+		return false, nil
+	}
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.Split(hash, "$") //"", "apr1", salt, checksum
+		if len(parts) != 4 {
+			return false, ErrUnsupportedHash
+		}
+		computed := apr1(password, parts[2])
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, nil
+	default:
+		logging.WarningLogger.Printf("user %s has an unsupported hash in %s\n", username, h.path)
+		return false, ErrUnsupportedHash
+	}
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+//apr1 implements the Apache variant of the md5crypt algorithm, returning the full "$apr1$salt$checksum" string
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	pw := []byte(password)
+
+	alternate := md5.New()
+	alternate.Write(pw)
+	alternate.Write([]byte(salt))
+	alternate.Write(pw)
+	altSum := alternate.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ { //deliberately slow things down
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(magic + salt + "$")
+	encode := func(value uint, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(apr1Alphabet[value&0x3f])
+			value >>= 6
+		}
+	}
+	groups := [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}}
+	for _, g := range groups {
+		encode(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+	return out.String()
+}
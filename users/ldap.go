@@ -0,0 +1,205 @@
+package users
+
+import (
+	"crypto/tls"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var ErrLDAPProtocol = errors.New("unexpected LDAP response")
+
+const (
+	ldapResultSuccess            = 0
+	ldapResultInvalidCredentials = 49
+)
+
+//LDAPAuthenticator checks passwords by performing an LDAP simple bind as the user.
+//The bind DN is built by substituting the (escaped) username into BindDNTemplate, e.g. "uid=%s,ou=people,dc=example,dc=com"
+type LDAPAuthenticator struct {
+	URL            string //ldap://host:389 or ldaps://host:636
+	BindDNTemplate string
+	Timeout        time.Duration
+	TLSConfig      *tls.Config //only used for ldaps
+
+	messageID int32
+}
+
+func NewLDAPAuthenticator(ldapURL, bindDNTemplate string) (*LDAPAuthenticator, error) {
+	u, err := url.Parse(ldapURL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, errors.New("invalid LDAP url " + ldapURL)
+	}
+	if strings.Count(bindDNTemplate, "%s") != 1 {
+		return nil, errors.New("LDAP bind DN template must contain exactly one %s")
+	}
+	return &LDAPAuthenticator{
+		URL:            ldapURL,
+		BindDNTemplate: bindDNTemplate,
+		Timeout:        5 * time.Second,
+	}, nil
+}
+
+func (l *LDAPAuthenticator) Name() string {
+	return "ldap"
+}
+
+func (l *LDAPAuthenticator) Authenticate(username, password string) (bool, error) {
+	if username == "" || password == "" {
+		return false, nil //an empty password is an anonymous bind in LDAP, which would always succeed
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrBackendUnavailable, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(l.Timeout))
+
+	bindDN := fmt.Sprintf(l.BindDNTemplate, escapeDN(username))
+	id := int(atomic.AddInt32(&l.messageID, 1))
+	packet, err := encodeBindRequest(id, bindDN, password)
+	if err != nil {
+		return false, err
+	}
+	if _, err := conn.Write(packet); err != nil {
+		return false, fmt.Errorf("%w: %v", ErrBackendUnavailable, err)
+	}
+	response, err := readBERPacket(conn)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrBackendUnavailable, err)
+	}
+	responseID, resultCode, err := decodeBindResponse(response)
+	if err != nil {
+		return false, err
+	}
+	if responseID != id {
+		return false, ErrLDAPProtocol
+	}
+	_, _ = conn.Write(encodeUnbindRequest(id + 1)) //polite, but the connection is being closed either way
+
+	switch resultCode {
+	case ldapResultSuccess:
+		return true, nil
+	case ldapResultInvalidCredentials:
+		return false, nil
+	default:
+		return false, fmt.Errorf("LDAP bind failed with result code %d", resultCode)
+	}
+}
+
+func (l *LDAPAuthenticator) dial() (net.Conn, error) {
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: l.Timeout}
+	if u.Scheme == "ldaps" {
+		config := l.TLSConfig
+		if config == nil {
+			config = &tls.Config{ServerName: u.Hostname()}
+		}
+		return tls.DialWithDialer(dialer, "tcp", u.Host, config)
+	}
+	return dialer.Dial("tcp", u.Host)
+}
+
+//escapeDN escapes the special characters of an attribute value as described in RFC 4514
+//so a username cannot be used to inject extra components into the bind DN
+func escapeDN(value string) string {
+	var out strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			(c == '#' || c == ' ') && i == 0,
+			c == ' ' && i == len(value)-1:
+			out.WriteByte('\\')
+			out.WriteByte(c)
+		case c == 0:
+			out.WriteString(`\00`)
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
+
+type ldapBindRequest struct {
+	Version int
+	Name    []byte
+	Simple  []byte `asn1:"tag:0"`
+}
+
+type ldapBindResponse struct {
+	ResultCode        asn1.Enumerated
+	MatchedDN         []byte
+	DiagnosticMessage []byte
+}
+
+type ldapMessage struct {
+	MessageID  int
+	ProtocolOp asn1.RawValue
+}
+
+func encodeBindRequest(id int, bindDN, password string) ([]byte, error) {
+	op, err := asn1.MarshalWithParams(ldapBindRequest{Version: 3, Name: []byte(bindDN), Simple: []byte(password)}, "application,tag:0")
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ldapMessage{MessageID: id, ProtocolOp: asn1.RawValue{FullBytes: op}})
+}
+
+func encodeUnbindRequest(id int) []byte {
+	packet, _ := asn1.Marshal(ldapMessage{MessageID: id, ProtocolOp: asn1.RawValue{FullBytes: []byte{0x42, 0x00}}})
+	return packet
+}
+
+func decodeBindResponse(packet []byte) (int, int, error) {
+	var message ldapMessage
+	if _, err := asn1.Unmarshal(packet, &message); err != nil {
+		return 0, 0, ErrLDAPProtocol
+	}
+	var response ldapBindResponse
+	if _, err := asn1.UnmarshalWithParams(message.ProtocolOp.FullBytes, &response, "application,tag:1"); err != nil {
+		return 0, 0, ErrLDAPProtocol
+	}
+	return message.MessageID, int(response.ResultCode), nil
+}
+
+//readBERPacket reads a single BER encoded element (tag, length and contents) from the reader
+func readBERPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 { //long form, the low bits give the number of length bytes
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return nil, ErrLDAPProtocol
+		}
+		lengthBytes := make([]byte, n)
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return nil, err
+		}
+		header = append(header, lengthBytes...)
+		length = 0
+		for _, b := range lengthBytes {
+			length = length<<8 | int(b)
+		}
+	}
+	if length > 1<<20 {
+		return nil, ErrLDAPProtocol
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return append(header, body...), nil
+}
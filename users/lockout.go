@@ -0,0 +1,280 @@
+package users
+
+import (
+	"sort"
+	"store/logging"
+	"sync"
+	"time"
+)
+
+//LockoutPolicy controls how failed logins are throttled. After each failure the next attempt has to wait BaseDelay,
+//doubling with every further failure up to MaxDelay. Once Threshold failures have built up the subject is locked out for LockoutDuration
+type LockoutPolicy struct {
+	UserThreshold   int           //failures for a single username before it is locked out
+	IPThreshold     int           //failures from a single source IP before it is locked out, higher since many users may share an IP. 0 turns IP lockouts off
+	BaseDelay       time.Duration //delay after the first failure
+	MaxDelay        time.Duration //the delay never grows beyond this
+	LockoutDuration time.Duration
+	ResetAfter      time.Duration //failures are forgotten after this long without another one
+}
+
+var DefaultLockoutPolicy = LockoutPolicy{
+	UserThreshold:   5,
+	IPThreshold:     20,
+	BaseDelay:       time.Second,
+	MaxDelay:        30 * time.Second,
+	LockoutDuration: 15 * time.Minute,
+	ResetAfter:      time.Hour,
+}
+
+const (
+	LockoutUser = "user"
+	LockoutIP   = "ip"
+)
+
+//pendingWait is how long a caller is told to wait when the attempts already in progress could use up the rest of the threshold
+const pendingWait = time.Second
+
+//Lockout describes a username or IP address that currently has failed logins recorded against it
+type Lockout struct {
+	Kind         string    `json:"kind"` //LockoutUser or LockoutIP
+	Subject      string    `json:"subject"`
+	Failures     int       `json:"failures"`
+	LastFailure  time.Time `json:"lastFailure"`
+	BlockedUntil time.Time `json:"blockedUntil"`
+	LockedOut    bool      `json:"lockedOut"` //true once the threshold has been reached, rather than just backing off
+}
+
+type attemptRecord struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	lockedOut    bool
+	pending      int //attempts allowed by Check that haven't finished yet
+}
+
+//LoginTracker counts failed logins by username and by source IP. It is safe for concurrent use
+type LoginTracker struct {
+	Policy LockoutPolicy
+	Clock  func() time.Time //defaults to time.Now, can be replaced for testing
+	//OnLockout is called whenever a username or IP reaches its threshold and is locked out
+	OnLockout func(lockout Lockout)
+
+	lock    sync.Mutex
+	records map[string]map[string]*attemptRecord //kind -> subject -> record
+}
+
+func NewLoginTracker(policy LockoutPolicy) *LoginTracker {
+	return &LoginTracker{
+		Policy: policy,
+		Clock:  time.Now,
+		records: map[string]map[string]*attemptRecord{
+			LockoutUser: {},
+			LockoutIP:   {},
+		},
+	}
+}
+
+//LoginGuard is the tracker used by the login endpoint
+var LoginGuard = NewLoginTracker(DefaultLockoutPolicy)
+
+//current returns the record for the subject, dropping it first if it has gone stale. Must be called with the lock held
+func (t *LoginTracker) current(kind, subject string, now time.Time) *attemptRecord {
+	record, present := t.records[kind][subject]
+	if !present {
+		return nil
+	}
+	expired := now.Sub(record.lastFailure) > t.Policy.ResetAfter
+	if record.lockedOut {
+		expired = !now.Before(record.blockedUntil) //a finished lockout starts the count again
+	}
+	if expired {
+		if record.pending > 0 { //the attempts in progress keep their reservations
+			*record = attemptRecord{pending: record.pending}
+			return record
+		}
+		delete(t.records[kind], subject)
+		return nil
+	}
+	return record
+}
+
+//threshold is the number of failures before a username or IP is locked out, 0 if they never are
+func (t *LoginTracker) threshold(kind string) int {
+	if kind == LockoutIP {
+		return t.Policy.IPThreshold
+	}
+	return t.Policy.UserThreshold
+}
+
+//release gives back an attempt reserved by Check, dropping the record if nothing else is left in it. Must be called with the lock held
+func (t *LoginTracker) release(kind, subject string) {
+	record, present := t.records[kind][subject]
+	if !present {
+		return
+	}
+	if record.pending > 0 {
+		record.pending--
+	}
+	if record.pending == 0 && record.failures == 0 {
+		delete(t.records[kind], subject)
+	}
+}
+
+//Check returns how long the caller must wait before trying to log in as username from ip. Zero means they may try now,
+//and the attempt is reserved until Failure, Success or Release is called. Attempts in progress count towards the thresholds,
+//so concurrent guesses can't all get past Check before the first of them has failed
+func (t *LoginTracker) Check(username, ip string) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.Clock()
+	subjects := map[string]string{LockoutUser: username, LockoutIP: ip}
+	var wait time.Duration
+	for kind, subject := range subjects {
+		threshold := t.threshold(kind)
+		record := t.current(kind, subject, now)
+		if threshold <= 0 || record == nil {
+			continue
+		}
+		remaining := record.blockedUntil.Sub(now)
+		if remaining <= 0 && record.failures+record.pending >= threshold {
+			remaining = pendingWait
+		}
+		if remaining > wait {
+			wait = remaining
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for kind, subject := range subjects {
+		if t.threshold(kind) <= 0 {
+			continue
+		}
+		record := t.current(kind, subject, now)
+		if record == nil {
+			record = &attemptRecord{}
+			t.records[kind][subject] = record
+		}
+		record.pending++
+	}
+	return 0
+}
+
+//Failure records a failed login as username from ip, backing off or locking out both as needed. It uses up the attempt reserved by Check
+func (t *LoginTracker) Failure(username, ip string) {
+	t.lock.Lock()
+	now := t.Clock()
+	var lockouts []Lockout
+	for kind, subject := range map[string]string{LockoutUser: username, LockoutIP: ip} {
+		threshold := t.threshold(kind)
+		if threshold <= 0 {
+			continue
+		}
+		record := t.current(kind, subject, now)
+		if record == nil {
+			record = &attemptRecord{}
+			t.records[kind][subject] = record
+		}
+		if record.pending > 0 { //the reservation from Check becomes a failure
+			record.pending--
+		}
+		record.failures++
+		record.lastFailure = now
+		if record.failures >= threshold {
+			record.blockedUntil = now.Add(t.Policy.LockoutDuration)
+			if !record.lockedOut {
+				record.lockedOut = true
+				lockouts = append(lockouts, record.toLockout(kind, subject))
+			}
+			continue
+		}
+		delay := t.Policy.BaseDelay << uint(record.failures-1) //exponential backoff
+		if delay > t.Policy.MaxDelay || delay <= 0 {
+			delay = t.Policy.MaxDelay
+		}
+		record.blockedUntil = now.Add(delay)
+	}
+	onLockout := t.OnLockout
+	t.lock.Unlock()
+
+	for _, lockout := range lockouts {
+		logging.WarningLogger.Printf("%s %s locked out until %s after %d failed logins\n", lockout.Kind, lockout.Subject, lockout.BlockedUntil.Format(time.RFC3339), lockout.Failures)
+		if onLockout != nil {
+			onLockout(lockout)
+		}
+	}
+}
+
+//Success clears the failures recorded against the username and gives back the attempt reserved by Check. The IP's failures are left alone,
+//otherwise an attacker with one valid account could use it to reset their IP's count
+func (t *LoginTracker) Success(username, ip string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if record, present := t.records[LockoutUser][username]; present {
+		*record = attemptRecord{pending: record.pending} //other attempts still in progress keep their reservations
+	}
+	t.release(LockoutUser, username)
+	t.release(LockoutIP, ip)
+}
+
+//Release gives back the attempt reserved by Check when a login ends without succeeding or failing, such as when a one time code is still needed
+func (t *LoginTracker) Release(username, ip string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.release(LockoutUser, username)
+	t.release(LockoutIP, ip)
+}
+
+func (r *attemptRecord) toLockout(kind, subject string) Lockout {
+	return Lockout{
+		Kind:         kind,
+		Subject:      subject,
+		Failures:     r.failures,
+		LastFailure:  r.lastFailure,
+		BlockedUntil: r.blockedUntil,
+		LockedOut:    r.lockedOut,
+	}
+}
+
+//Lockouts returns every username and IP that currently has failed logins recorded against it
+func (t *LoginTracker) Lockouts() []Lockout {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.Clock()
+	output := []Lockout{}
+	for kind, subjects := range t.records {
+		for subject := range subjects {
+			if record := t.current(kind, subject, now); record != nil && record.failures > 0 {
+				output = append(output, record.toLockout(kind, subject))
+			}
+		}
+	}
+	sort.Slice(output, func(i, j int) bool {
+		if output[i].Kind != output[j].Kind {
+			return output[i].Kind < output[j].Kind
+		}
+		return output[i].Subject < output[j].Subject
+	})
+	return output
+}
+
+//Clear forgets the failures recorded against a username or IP, returning false if there weren't any
+func (t *LoginTracker) Clear(kind, subject string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	subjects, ok := t.records[kind]
+	if !ok {
+		return false
+	}
+	record, present := subjects[subject]
+	if !present || record.failures == 0 {
+		return false
+	}
+	if record.pending > 0 { //logins in progress keep their reservations
+		*record = attemptRecord{pending: record.pending}
+		return true
+	}
+	delete(subjects, subject)
+	return true
+}
@@ -0,0 +1,188 @@
+package users_test
+
+import (
+	"store/users"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeClock lets the tests move time forward without sleeping
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestTracker() (*users.LoginTracker, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2022, 3, 14, 12, 0, 0, 0, time.UTC)}
+	tracker := users.NewLoginTracker(users.LockoutPolicy{
+		UserThreshold:   3,
+		IPThreshold:     5,
+		BaseDelay:       time.Second,
+		MaxDelay:        10 * time.Second,
+		LockoutDuration: time.Minute,
+		ResetAfter:      time.Hour,
+	})
+	tracker.Clock = clock.Now
+	return tracker, clock
+}
+
+func TestBackoff(t *testing.T) {
+	tracker, clock := newTestTracker()
+	if wait := tracker.Check("user_a", "1.2.3.4"); wait != 0 {
+		t.Errorf("had to wait %v before the first attempt\n", wait)
+	}
+
+	tracker.Failure("user_a", "1.2.3.4")
+	if wait := tracker.Check("user_a", "1.2.3.4"); wait != time.Second {
+		t.Errorf("expected to wait 1s after one failure, got %v\n", wait)
+	}
+	clock.now = clock.now.Add(time.Second)
+	tracker.Failure("user_a", "1.2.3.4")
+	if wait := tracker.Check("user_a", "5.6.7.8"); wait != 2*time.Second {
+		t.Errorf("expected the username to wait 2s after two failures, got %v\n", wait)
+	}
+	if wait := tracker.Check("user_b", "1.2.3.4"); wait != 2*time.Second {
+		t.Errorf("expected the IP to wait 2s after two failures, got %v\n", wait)
+	}
+	if wait := tracker.Check("user_b", "5.6.7.8"); wait != 0 {
+		t.Errorf("unrelated login had to wait %v\n", wait)
+	}
+
+	tracker.Success("user_a", "1.2.3.4")
+	clock.now = clock.now.Add(2 * time.Second)
+	if wait := tracker.Check("user_a", "5.6.7.8"); wait != 0 {
+		t.Errorf("still had to wait %v after a successful login\n", wait)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	tracker, clock := newTestTracker()
+	var lockouts []users.Lockout
+	tracker.OnLockout = func(lockout users.Lockout) {
+		lockouts = append(lockouts, lockout)
+	}
+
+	for i := 0; i < 3; i++ {
+		tracker.Failure("user_a", "1.2.3.4")
+		clock.now = clock.now.Add(10 * time.Second)
+	}
+	if len(lockouts) != 1 || lockouts[0].Kind != users.LockoutUser || lockouts[0].Subject != "user_a" {
+		t.Fatalf("expected user_a to be locked out, got %v\n", lockouts)
+	}
+	if wait := tracker.Check("user_a", "5.6.7.8"); wait != 50*time.Second {
+		t.Errorf("expected to wait out the rest of the lockout, got %v\n", wait)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	if wait := tracker.Check("user_a", "5.6.7.8"); wait != 0 {
+		t.Errorf("still locked out after the lockout expired, had to wait %v\n", wait)
+	}
+}
+
+func TestClearLockout(t *testing.T) {
+	tracker, _ := newTestTracker()
+	for i := 0; i < 5; i++ {
+		tracker.Failure("user_a", "1.2.3.4")
+	}
+	if got := len(tracker.Lockouts()); got != 2 {
+		t.Fatalf("expected both the user and the ip to be listed, got %d lockouts\n", got)
+	}
+	if !tracker.Clear(users.LockoutUser, "user_a") {
+		t.Error("unable to clear a user lockout")
+	}
+	if !tracker.Clear(users.LockoutIP, "1.2.3.4") {
+		t.Error("unable to clear an ip lockout")
+	}
+	if wait := tracker.Check("user_a", "1.2.3.4"); wait != 0 {
+		t.Errorf("still had to wait %v after clearing the lockouts\n", wait)
+	}
+	if tracker.Clear(users.LockoutUser, "user_a") {
+		t.Error("cleared a lockout that no longer exists")
+	}
+}
+
+func TestIPLockoutsOff(t *testing.T) {
+	tracker, _ := newTestTracker()
+	tracker.Policy.IPThreshold = 0
+	for _, username := range []string{"user_a", "user_b", "user_c", "user_d", "user_e", "user_f"} {
+		tracker.Failure(username, "1.2.3.4")
+	}
+	if wait := tracker.Check("user_g", "1.2.3.4"); wait != 0 {
+		t.Errorf("expected IPs not to be throttled with a threshold of 0, had to wait %v\n", wait)
+	}
+	for _, lockout := range tracker.Lockouts() {
+		if lockout.Kind == users.LockoutIP {
+			t.Errorf("expected no failures to be recorded against IPs, got %+v\n", lockout)
+		}
+	}
+}
+
+func TestAttemptsInProgress(t *testing.T) {
+	tracker, clock := newTestTracker()
+	//logins that have got past Check but not finished count towards the threshold
+	for i := 0; i < 3; i++ {
+		if wait := tracker.Check("user_a", "1.2.3.4"); wait != 0 {
+			t.Fatalf("expected attempt %d to go ahead, had to wait %v\n", i+1, wait)
+		}
+	}
+	if wait := tracker.Check("user_a", "5.6.7.8"); wait != time.Second {
+		t.Errorf("expected to wait for the attempts in progress, got %v\n", wait)
+	}
+	if lockouts := tracker.Lockouts(); len(lockouts) != 0 {
+		t.Errorf("expected attempts in progress not to be listed as failures, got %+v\n", lockouts)
+	}
+
+	//one ends without a result, one succeeds and one fails
+	tracker.Release("user_a", "1.2.3.4")
+	tracker.Success("user_a", "1.2.3.4")
+	tracker.Failure("user_a", "1.2.3.4")
+	lockouts := tracker.Lockouts()
+	if len(lockouts) != 2 || lockouts[0].Failures != 1 || lockouts[1].Failures != 1 {
+		t.Errorf("expected one failure against the user and the IP, got %+v\n", lockouts)
+	}
+	clock.now = clock.now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		if wait := tracker.Check("user_a", "1.2.3.4"); wait != 0 {
+			t.Errorf("expected the released attempts to be available again, had to wait %v\n", wait)
+		}
+	}
+	if wait := tracker.Check("user_a", "1.2.3.4"); wait != time.Second {
+		t.Errorf("expected the failure and attempts in progress to use up the threshold, got %v\n", wait)
+	}
+	tracker.Release("user_a", "1.2.3.4")
+	tracker.Release("user_a", "1.2.3.4")
+}
+
+func TestConcurrentGuesses(t *testing.T) {
+	tracker, _ := newTestTracker()
+	var wait sync.WaitGroup
+	var lock sync.Mutex
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if tracker.Check("user_a", "1.2.3.4") > 0 {
+				return
+			}
+			lock.Lock()
+			allowed++
+			lock.Unlock()
+			time.Sleep(time.Millisecond) //checking the password
+			tracker.Failure("user_a", "1.2.3.4")
+		}()
+	}
+	wait.Wait()
+	if allowed == 0 || allowed > 3 {
+		t.Errorf("expected at most the threshold of 3 guesses to be checked, %d were\n", allowed)
+	}
+	for _, lockout := range tracker.Lockouts() {
+		if lockout.Failures > 3 {
+			t.Errorf("expected at most 3 failures to be recorded, got %+v\n", lockout)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"store/logging"
+	"store/rbac"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTOTPNotEnrolled     = errors.New("two factor authentication is not enabled for this user")
+	ErrTOTPAlreadyEnrolled = errors.New("two factor authentication is already enabled for this user")
+	ErrTOTPInvalidCode     = errors.New("invalid one time code")
+)
+
+const (
+	totpIssuer        = "KieranKVStore"
+	totpPeriod        = 30 //seconds
+	totpDigits        = 6
+	totpSkew          = 1 //accept codes from this many periods either side, to allow for clock drift
+	recoveryCodeCount = 10
+)
+
+//TOTPRequiredRoles lists the roles that must use two factor authentication. Users with one of these roles who have not enrolled
+//can only log in to enrol. It only applies to logging in with a password: a client certificate's private key already acts as a
+//second factor, and API keys are scoped so never act as an admin
+var TOTPRequiredRoles = []rbac.Role{rbac.RoleAdmin}
+
+type totpRecord struct {
+	Secret         string   `json:"secret"` //base32, as shown to the user
+	Confirmed      bool     `json:"confirmed"`
+	RecoveryHashes []string `json:"recoveryHashes"`
+	LastStep       int64    `json:"lastStep"` //the last time step a code was accepted for, so a code cannot be used twice
+}
+
+var (
+	totpRecords = map[string]*totpRecord{} //username -> record
+	totpFile    string                     //if set, records are saved here whenever they change
+	totpLock    sync.Mutex
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//TOTPCode computes the RFC 6238 one time code for the secret at time t
+func TOTPCode(secret []byte, t time.Time) string {
+	return totpCodeForStep(secret, t.Unix()/totpPeriod)
+}
+
+func totpCodeForStep(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f //dynamic truncation, RFC 4226 section 5.3
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+//matchTOTP returns the time step the code is valid for, or -1 if it doesn't match any step within the allowed skew
+func matchTOTP(secret []byte, code string, t time.Time) int64 {
+	step := t.Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		if subtle.ConstantTimeCompare([]byte(totpCodeForStep(secret, step+int64(i))), []byte(code)) == 1 {
+			return step + int64(i)
+		}
+	}
+	return -1
+}
+
+//TOTPURI builds the otpauth URI that authenticator apps use to set up an account, usually shown as a QR code
+func TOTPURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", totpIssuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(totpDigits))
+	values.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+//TOTPEnrolled returns true if the user has confirmed their two factor enrolment
+func TOTPEnrolled(username string) bool {
+	totpLock.Lock()
+	defer totpLock.Unlock()
+	record, present := totpRecords[username]
+	return present && record.Confirmed
+}
+
+//TOTPRequired returns true if the local user has a role that must use two factor authentication
+func TOTPRequired(username string) bool {
+	identity, _ := IdentityFor(username, BackendLocal) //unknown users have no roles, so never need it
+	return TOTPRequiredFor(identity)
+}
+
+//TOTPRequiredFor returns true if the identity has a role that must use two factor authentication
+func TOTPRequiredFor(identity rbac.Identity) bool {
+	for _, role := range TOTPRequiredRoles {
+		if identity.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+//EnrolTOTP starts two factor enrolment by generating a new secret. Enrolment is not complete until ConfirmTOTP is called with a valid code
+func EnrolTOTP(username string) (secret string, uri string, err error) {
+	secretBytes := make([]byte, 20)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", "", err
+	}
+	secret = base32NoPadding.EncodeToString(secretBytes)
+
+	totpLock.Lock()
+	defer totpLock.Unlock()
+	previous, present := totpRecords[username]
+	if present && previous.Confirmed {
+		return "", "", ErrTOTPAlreadyEnrolled
+	}
+	totpRecords[username] = &totpRecord{Secret: secret}
+	if err := saveTOTP(); err != nil {
+		//keep memory the same as the file, which is what the user will have after a restart
+		if present {
+			totpRecords[username] = previous
+		} else {
+			delete(totpRecords, username)
+		}
+		return "", "", err
+	}
+	return secret, TOTPURI(username, secret), nil
+}
+
+//ConfirmTOTP completes enrolment once the user has shown they can generate codes, returning their single use recovery codes
+func ConfirmTOTP(username, code string) ([]string, error) {
+	totpLock.Lock()
+	defer totpLock.Unlock()
+	record, present := totpRecords[username]
+	if !present {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if record.Confirmed {
+		return nil, ErrTOTPAlreadyEnrolled
+	}
+	if !record.useCode(code) {
+		return nil, ErrTOTPInvalidCode
+	}
+
+	recoveryCodes := make([]string, recoveryCodeCount)
+	record.RecoveryHashes = make([]string, recoveryCodeCount)
+	for i := range recoveryCodes {
+		codeBytes := make([]byte, 5)
+		if _, err := rand.Read(codeBytes); err != nil {
+			return nil, err
+		}
+		recoveryCodes[i] = strings.ToLower(base32NoPadding.EncodeToString(codeBytes))
+		record.RecoveryHashes[i] = hashSecret(recoveryCodes[i])
+	}
+	record.Confirmed = true
+	if err := saveTOTP(); err != nil {
+		record.Confirmed = false //the user never sees the recovery codes, so they have to confirm again
+		record.RecoveryHashes = nil
+		return nil, err
+	}
+	logging.InfoLogger.Printf("user %s enabled two factor authentication\n", username)
+	return recoveryCodes, nil
+}
+
+//DisableTOTP turns two factor authentication off. A valid code or recovery code is needed so a stolen token is not enough
+func DisableTOTP(username, code string) error {
+	totpLock.Lock()
+	defer totpLock.Unlock()
+	record, present := totpRecords[username]
+	if !present || !record.Confirmed {
+		return ErrTOTPNotEnrolled
+	}
+	if !record.useCode(code) && !record.useRecoveryCode(code) {
+		return ErrTOTPInvalidCode
+	}
+	delete(totpRecords, username)
+	if err := saveTOTP(); err != nil {
+		totpRecords[username] = record //otherwise it would be off until a restart turned it back on
+		return err
+	}
+	logging.InfoLogger.Printf("user %s disabled two factor authentication\n", username)
+	return nil
+}
+
+//CheckSecondFactor checks a one time code, or failing that a recovery code, for an enrolled user. Each code only works once
+func CheckSecondFactor(username, code string) bool {
+	totpLock.Lock()
+	defer totpLock.Unlock()
+	record, present := totpRecords[username]
+	if !present || !record.Confirmed {
+		return false
+	}
+	ok := record.useCode(code) || record.useRecoveryCode(code)
+	if ok {
+		if err := saveTOTP(); err != nil {
+			logging.ErrorLogger.Println("unable to save two factor records", err)
+		}
+	}
+	return ok
+}
+
+//useCode checks a one time code and stops it (and any earlier codes) being used again. Must be called with totpLock held
+func (r *totpRecord) useCode(code string) bool {
+	secret, err := base32NoPadding.DecodeString(r.Secret)
+	if err != nil {
+		return false
+	}
+	step := matchTOTP(secret, strings.TrimSpace(code), time.Now())
+	if step < 0 || step <= r.LastStep {
+		return false
+	}
+	r.LastStep = step
+	return true
+}
+
+//useRecoveryCode checks and consumes a recovery code. Must be called with totpLock held
+func (r *totpRecord) useRecoveryCode(code string) bool {
+	hash := hashSecret(strings.ToLower(strings.TrimSpace(code)))
+	for i, recoveryHash := range r.RecoveryHashes {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(recoveryHash)) == 1 {
+			r.RecoveryHashes = append(r.RecoveryHashes[:i], r.RecoveryHashes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+//LoadTOTP reads two factor enrolments from the file, and saves any future changes back to it.
+//The file contains the TOTP secrets, so it must be kept private
+func LoadTOTP(path string) error {
+	totpLock.Lock()
+	defer totpLock.Unlock()
+	totpFile = path
+	totpRecords = map[string]*totpRecord{}
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(contents, &totpRecords); err != nil {
+		logging.ErrorLogger.Println("Unable to parse two factor file "+path, err)
+		return errors.New("invalid two factor file")
+	}
+	return nil
+}
+
+//saveTOTP writes the records to totpFile, if there is one. Must be called with totpLock held
+func saveTOTP() error {
+	if totpFile == "" {
+		return nil
+	}
+	contents, err := json.MarshalIndent(totpRecords, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(totpFile, contents)
+}
+
+//WipeTOTP removes every two factor enrolment and stops saving them to disk. Used for testing
+func WipeTOTP() {
+	totpLock.Lock()
+	defer totpLock.Unlock()
+	totpRecords = map[string]*totpRecord{}
+	totpFile = ""
+}
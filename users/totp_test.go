@@ -0,0 +1,144 @@
+package users_test
+
+import (
+	"encoding/base32"
+	"os"
+	"path/filepath"
+	"store/users"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	//test vectors from RFC 6238 appendix B, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	cases := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range cases {
+		if code := users.TOTPCode(secret, time.Unix(unix, 0)); code != expected {
+			t.Errorf("wrong code at %d, expected %s got %s\n", unix, expected, code)
+		}
+	}
+}
+
+func TestTOTPEnrolment(t *testing.T) {
+	defer users.WipeTOTP()
+	secret, uri, err := users.EnrolTOTP("user_a")
+	if err != nil {
+		t.Fatal("unable to enrol", err)
+	}
+	if !strings.HasPrefix(uri, "otpauth://totp/") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("bad otpauth uri %s\n", uri)
+	}
+	if users.TOTPEnrolled("user_a") {
+		t.Error("user counted as enrolled before confirming")
+	}
+	secretBytes, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal("secret is not valid base32", err)
+	}
+
+	if _, err := users.ConfirmTOTP("user_a", "000000x"); err != users.ErrTOTPInvalidCode {
+		t.Error("confirmed with an invalid code", err)
+	}
+	code := users.TOTPCode(secretBytes, time.Now())
+	recoveryCodes, err := users.ConfirmTOTP("user_a", code)
+	if err != nil {
+		t.Fatal("unable to confirm enrolment", err)
+	}
+	if !users.TOTPEnrolled("user_a") {
+		t.Fatal("user not enrolled after confirming")
+	}
+	if _, _, err := users.EnrolTOTP("user_a"); err != users.ErrTOTPAlreadyEnrolled {
+		t.Error("able to enrol twice", err)
+	}
+	if _, err := users.GenerateJWT("user_a", "passwordA"); err != users.ErrSecondFactorRequired {
+		t.Error("able to get a token with just a password after enrolling", err)
+	}
+
+	if users.CheckSecondFactor("user_a", code) {
+		t.Error("able to reuse a one time code")
+	}
+	if !users.CheckSecondFactor("user_a", users.TOTPCode(secretBytes, time.Now().Add(30*time.Second))) {
+		t.Error("valid one time code rejected")
+	}
+	if !users.CheckSecondFactor("user_a", recoveryCodes[0]) {
+		t.Error("recovery code rejected")
+	}
+	if users.CheckSecondFactor("user_a", recoveryCodes[0]) {
+		t.Error("able to reuse a recovery code")
+	}
+
+	if err := users.DisableTOTP("user_a", recoveryCodes[1]); err != nil {
+		t.Error("unable to disable with a recovery code", err)
+	}
+	if users.TOTPEnrolled("user_a") {
+		t.Error("user still enrolled after disabling")
+	}
+}
+
+func TestTOTPSaveFailure(t *testing.T) {
+	defer users.WipeTOTP()
+	path := filepath.Join(t.TempDir(), "totp.json")
+	if err := users.LoadTOTP(path); err != nil {
+		t.Fatal("unable to start with a missing two factor file", err)
+	}
+	enrol := func(username string) []byte {
+		secret, _, err := users.EnrolTOTP(username)
+		if err != nil {
+			t.Fatal("unable to enrol", err)
+		}
+		secretBytes, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+		return secretBytes
+	}
+	secretA := enrol("user_a")
+	recoveryCodes, err := users.ConfirmTOTP("user_a", users.TOTPCode(secretA, time.Now()))
+	if err != nil {
+		t.Fatal("unable to confirm enrolment", err)
+	}
+	secretB := enrol("user_b")
+
+	//a directory in the way of the temporary file stops the records being saved, and nothing should change in memory either
+	if err := os.Mkdir(path+".tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.DisableTOTP("user_a", recoveryCodes[0]); err == nil {
+		t.Error("expected disabling to fail when the records can't be saved")
+	}
+	if !users.TOTPEnrolled("user_a") {
+		t.Error("two factor authentication was turned off even though that couldn't be saved")
+	}
+	if _, err := users.ConfirmTOTP("user_b", users.TOTPCode(secretB, time.Now())); err == nil {
+		t.Error("expected confirming to fail when the records can't be saved")
+	}
+	if users.TOTPEnrolled("user_b") {
+		t.Error("enrolment was confirmed even though that couldn't be saved")
+	}
+	if _, _, err := users.EnrolTOTP("user_c"); err == nil {
+		t.Error("expected enrolling to fail when the records can't be saved")
+	}
+	if _, err := users.ConfirmTOTP("user_c", "000000"); err != users.ErrTOTPNotEnrolled {
+		t.Error("enrolment was started even though it couldn't be saved", err)
+	}
+}
+
+func TestTOTPRequired(t *testing.T) {
+	if !users.TOTPRequired("admin") {
+		t.Error("two factor authentication not required for admins")
+	}
+	if users.TOTPRequired("user_a") {
+		t.Error("two factor authentication required for a writer")
+	}
+	token, err := users.GenerateJWT("admin", "Password1")
+	if err != nil {
+		t.Fatal("unable to generate a token", err)
+	}
+	if claims, ok := users.ParseJWT(token); !ok || !claims.EnrolOnly {
+		t.Error("expected an admin who hasn't enrolled to only get an enrolment token")
+	}
+}
@@ -1,10 +1,14 @@
 package users
 
 import (
+	"crypto/rand"
 	"encoding/csv"
 	"errors"
 	"os"
 	"store/logging"
+	"store/rbac"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -12,15 +16,47 @@ import (
 )
 
 type Claims struct {
-	Username string `json:"username"`
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"` //for clients to read. The server looks the roles up again, see Identity
+	Groups   []string `json:"groups,omitempty"`
+	Backend  string   `json:"backend,omitempty"` //the authentication backend that checked the user's password
+	//EnrolOnly tokens are given to users who must set up two factor authentication before they can do anything else
+	EnrolOnly bool `json:"enrolOnly,omitempty"`
 	jwt.StandardClaims
 }
 
-var jwtKey = []byte("this is so secret you will never guess it")
+//Identity returns the identity used for authorisation checks. The roles and groups are looked up again rather than taken from
+//the claims, so changes to the users file apply to tokens that have already been issued, and a local user removed from it
+//gets ErrUnknownUser
+func (c *Claims) Identity() (rbac.Identity, error) {
+	return IdentityFor(c.Username, c.Backend)
+}
+
+//jwtKey signs the tokens. It is random until SetJWTKey is called, so tokens only work on the server that issued them
+var jwtKey = randomJWTKey()
+
+func randomJWTKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("unable to generate a JWT signing key: " + err.Error())
+	}
+	return key
+}
+
+//SetJWTKey sets the key tokens are signed with, which must be shared by every node for tokens to work on any of them.
+//Tokens signed with the previous key stop working. Must be called before the server starts
+func SetJWTKey(key []byte) {
+	jwtKey = key
+}
+
+//TokenLifetime is how long a token from IssueJWT is valid for
+var TokenLifetime = 5 * time.Minute
 
 var (
-	ErrCannotBuildJWT = errors.New("cannot build JWT")
-	ErrUnauthorised   = errors.New("unauthorised")
+	ErrCannotBuildJWT       = errors.New("cannot build JWT")
+	ErrUnauthorised         = errors.New("unauthorised")
+	ErrSecondFactorRequired = errors.New("a one time code is needed to log in")
+	ErrUnknownUser          = errors.New("user is not in the users file")
 )
 
 func readCsvFile(filePath string) ([][]string, error) {
@@ -31,6 +67,7 @@ func readCsvFile(filePath string) ([][]string, error) {
 	defer f.Close()
 
 	csvReader := csv.NewReader(f)
+	csvReader.FieldsPerRecord = -1 //the roles and groups columns are optional
 	records, err := csvReader.ReadAll()
 	if err != nil {
 		logging.ErrorLogger.Println("Unable to parse file as CSV for "+filePath, err)
@@ -42,6 +79,8 @@ func readCsvFile(filePath string) ([][]string, error) {
 
 type User struct {
 	Username     string
+	Roles        []rbac.Role
+	Groups       []string
 	passwordHash string
 }
 
@@ -50,13 +89,14 @@ func (u User) CheckPassword(password string) bool {
 	return err == nil
 }
 
-func NewUser(username, password string) (*User, error) {
+func NewUser(username, password string, roles ...rbac.Role) (*User, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 10)
 	if err != nil {
 		return nil, err
 	}
 	user := User{
 		Username:     username,
+		Roles:        roles,
 		passwordHash: string(bytes),
 	}
 	return &user, nil
@@ -64,50 +104,180 @@ func NewUser(username, password string) (*User, error) {
 
 var fakeUser, _ = NewUser("FaketasticMrFake", "fakeyfakeyfakefake")
 
-var userDB = map[string]*User{} //username data will appear as both the key and in the user struct. Although this involves duplication it will greatly improve usability
+var (
+	userDB     = map[string]*User{} //username data will appear as both the key and in the user struct. Although this involves duplication it will greatly improve usability
+	userDBLock sync.RWMutex         //the database can be reloaded while the server is running
+)
+
+//DefaultRoles are given to users in the users file without any roles of their own, and to every user authenticated by an
+//external backend. Users who aren't in the users file get no roles at all
+var DefaultRoles = []rbac.Role{rbac.RoleWriter}
 
 func FillUserDB(userDBFile string) error {
-	users, err := readCsvFile(userDBFile)
+	users, err := readUserDB(userDBFile)
 	if err != nil {
 		return err
 	}
+	userDBLock.Lock()
+	for username, user := range users {
+		userDB[username] = user
+	}
+	userDBLock.Unlock()
+	logging.InfoLogger.Println("successfully built users database")
+	return nil
+}
+
+//ReloadUserDB replaces the user database with the users in the file, so users removed from the file can no longer log in.
+//If the file can't be read the current users are kept. Tokens that have already been issued stay valid until they expire
+func ReloadUserDB(userDBFile string) error {
+	users, err := readUserDB(userDBFile)
+	if err != nil {
+		return err
+	}
+	userDBLock.Lock()
+	userDB = users
+	userDBLock.Unlock()
+	logging.InfoLogger.Println("successfully reloaded users database with", len(users), "users")
+	return nil
+}
+
+//readUserDB reads the users from the csv file, without touching the current database
+func readUserDB(userDBFile string) (map[string]*User, error) {
+	users, err := readCsvFile(userDBFile)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]*User{}
 	for _, user := range users {
+		if len(user) < 2 {
+			return nil, errors.New("each user must have a username and password")
+		}
 		username := user[0]
 		password := user[1]
-		userStruct, err := NewUser(username, password)
+		roles := DefaultRoles
+		if len(user) > 2 && user[2] != "" { //roles are separated by semicolons, e.g. reader;operator
+			roles, err = rbac.ParseRoles(user[2], ";")
+			if err != nil {
+				logging.ErrorLogger.Printf("user %s has an invalid role list %s\n", username, user[2])
+				return nil, err
+			}
+		}
+		userStruct, err := NewUser(username, password, roles...)
 		if err != nil {
 			logging.ErrorLogger.Printf("error constructing the User struct for user with name %s and password %s\n", username, password)
-			return err
+			return nil, err
 		}
-		userDB[username] = userStruct
+		if len(user) > 3 { //groups are also separated by semicolons
+			for _, group := range strings.Split(user[3], ";") {
+				if group = strings.TrimSpace(group); group != "" {
+					userStruct.Groups = append(userStruct.Groups, group)
+				}
+			}
+		}
+		out[username] = userStruct
 	}
-	logging.InfoLogger.Println("successfully built users database")
-	return nil
+	return out, nil
+}
+
+//lookupUser finds the user in the user database
+func lookupUser(username string) (*User, bool) {
+	userDBLock.RLock()
+	defer userDBLock.RUnlock()
+	user, present := userDB[username]
+	return user, present
+}
+
+//IdentityFor returns the identity of a user authenticated by the named backend. Only users of the local backend get the roles
+//and groups in the users file: a user of another backend gets DefaultRoles, even if a local user has the same name.
+//A local user who isn't in the users file, e.g. because it was reloaded without them, gets ErrUnknownUser and no roles
+func IdentityFor(username, backend string) (rbac.Identity, error) {
+	if backend != BackendLocal {
+		return rbac.NewIdentity(username, DefaultRoles...), nil
+	}
+	user, present := lookupUser(username)
+	if !present {
+		return rbac.NewIdentity(username), ErrUnknownUser
+	}
+	identity := rbac.NewIdentity(username, user.Roles...)
+	identity.Groups = user.Groups
+	return identity, nil
+}
+
+//RolesFor returns the roles assigned to the user in the user database, or none if the user is not in it
+func RolesFor(username string) []rbac.Role {
+	user, present := lookupUser(username)
+	if !present {
+		return nil
+	}
+	return user.Roles
+}
+
+//GroupsFor returns the groups the user belongs to. Users that are not in the user database belong to no groups
+func GroupsFor(username string) []string {
+	user, present := lookupUser(username)
+	if !present {
+		return nil
+	}
+	return user.Groups
 }
 
 func WipeUserDB() { //used for testing
+	userDBLock.Lock()
 	userDB = map[string]*User{}
+	userDBLock.Unlock()
 }
 
+//CheckUserPassword checks the password using the configured Authenticator (see SetAuthenticator)
 func CheckUserPassword(username, password string) bool {
-	user, present := userDB[username]
-	if !present {
-		fakeUser.CheckPassword("fakePassword") //perform a fake hashing check to make login constant time
-		return false
+	_, ok := AuthenticateUser(username, password)
+	return ok
+}
+
+//AuthenticateUser is like CheckUserPassword, but also returns the name of the backend that accepted the password, for IdentityFor
+func AuthenticateUser(username, password string) (string, bool) {
+	backend, ok, err := authenticateWith(authenticator, username, password)
+	if err != nil {
+		logging.ErrorLogger.Printf("unable to authenticate user %s using %s: %v\n", username, authenticator.Name(), err)
+		return "", false
 	}
-	return user.CheckPassword(password)
+	return backend, ok
 }
 
+//GenerateJWT checks the password and builds a token, following the same two factor rules as logging in. Users who have enrolled
+//need a one time code, so get ErrSecondFactorRequired, and users who have to enrol only get an enrolOnly token
 func GenerateJWT(username, password string) (string, error) {
-	ok := CheckUserPassword(username, password)
+	backend, ok := AuthenticateUser(username, password)
 	if !ok {
 		return "", ErrUnauthorised
 	}
-	expirationTime := time.Now().Add(5 * time.Minute)
+	if TOTPEnrolled(username) {
+		return "", ErrSecondFactorRequired
+	}
+	identity, err := IdentityFor(username, backend)
+	if err != nil {
+		return "", ErrUnauthorised
+	}
+	return IssueJWT(username, backend, TOTPRequiredFor(identity))
+}
+
+//IssueJWT builds a token for a user who has already been authenticated by the named backend.
+//An enrolOnly token can only be used to set up two factor authentication
+func IssueJWT(username, backend string, enrolOnly bool) (string, error) {
+	issueTime := time.Now()
+	expirationTime := issueTime.Add(TokenLifetime)
+	identity, err := IdentityFor(username, backend)
+	if err != nil {
+		return "", err
+	}
 	claims := &Claims{
-		Username: username,
+		Username:  username,
+		Roles:     identity.RoleNames(),
+		Groups:    identity.Groups,
+		Backend:   backend,
+		EnrolOnly: enrolOnly,
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: expirationTime.Unix(),
+			IssuedAt:  issueTime.Unix(),
 			Issuer:    "KieranKVStore",
 		},
 	}
@@ -120,6 +290,15 @@ func GenerateJWT(username, password string) (string, error) {
 }
 
 func ValidateJWT(tokenString string) (string, bool) {
+	claims, ok := ParseJWT(tokenString)
+	if !ok {
+		return "", false
+	}
+	return claims.Username, true
+}
+
+//ParseJWT validates the token and returns its claims, which include the user's roles
+func ParseJWT(tokenString string) (*Claims, bool) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString,
 		claims,
@@ -127,11 +306,10 @@ func ValidateJWT(tokenString string) (string, bool) {
 			return jwtKey, nil
 		})
 	if err != nil {
-		return "", false
+		return nil, false
 	}
 	if !token.Valid {
-		return "", false
+		return nil, false
 	}
-	username := token.Claims.(*Claims).Username
-	return username, true
+	return token.Claims.(*Claims), true
 }
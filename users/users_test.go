@@ -2,8 +2,12 @@ package users_test
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
 	"store/logging"
+	"store/rbac"
 	"store/users"
 	"testing"
 	"time"
@@ -36,6 +40,57 @@ func TestFillUserDB(t *testing.T) {
 	}
 }
 
+func TestReloadUserDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer users.ReloadUserDB("../users/users.csv")
+
+	adminToken, err := users.IssueJWT("admin", users.BackendLocal, false)
+	if err != nil {
+		t.Fatal("unable to generate a token", err)
+	}
+	path := filepath.Join(dir, "users.csv")
+	if err := ioutil.WriteFile(path, []byte("user_a,newPassword\nuser_new,passwordNew,reader\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.ReloadUserDB(path); err != nil {
+		t.Fatal("cannot reload database", err)
+	}
+	claims, ok := users.ParseJWT(adminToken)
+	if !ok {
+		t.Fatal("token should still be valid after a reload")
+	}
+	if identity, err := claims.Identity(); err != users.ErrUnknownUser || len(identity.Roles) != 0 {
+		t.Errorf("expected a user removed from the file to lose their roles before their token expires, got %v %v\n", identity.Roles, err)
+	}
+	if roles := users.RolesFor("user_b"); len(roles) != 0 {
+		t.Error("expected a removed user to have no roles, got", roles)
+	}
+	if !users.CheckUserPassword("user_new", "passwordNew") || !users.CheckUserPassword("user_a", "newPassword") {
+		t.Error("unable to log in as a user from the reloaded file")
+	}
+	if users.CheckUserPassword("user_b", "passwordB") {
+		t.Error("able to log in as a user removed from the file")
+	}
+	if roles := users.RolesFor("user_new"); len(roles) != 1 || roles[0] != rbac.RoleReader {
+		t.Error("expected the reloaded user to have their roles, got", roles)
+	}
+
+	//a broken file leaves the current users alone
+	if err := ioutil.WriteFile(path, []byte("just_a_username\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.ReloadUserDB(path); err == nil {
+		t.Error("expected an error reloading a broken file")
+	}
+	if !users.CheckUserPassword("user_new", "passwordNew") {
+		t.Error("a failed reload should keep the current users")
+	}
+}
+
 func TestGoodPasswords(t *testing.T) {
 	for _, user := range testUsers {
 		ok := users.CheckUserPassword(user.username, user.password)
@@ -134,3 +189,61 @@ func TestConstantTime(t *testing.T) {
 	}
 
 }
+
+func TestRolesInJWT(t *testing.T) {
+	expected := map[string]rbac.Role{"user_a": rbac.RoleWriter, "user_c": rbac.RoleReader, "admin": rbac.RoleAdmin}
+	for _, user := range testUsers {
+		role, ok := expected[user.username]
+		if !ok {
+			continue
+		}
+		token, err := users.GenerateJWT(user.username, user.password)
+		if err != nil {
+			t.Errorf("unable to generate a token for user %s\n", user.username)
+			continue
+		}
+		claims, ok := users.ParseJWT(token)
+		if !ok {
+			t.Errorf("token generated for user %s was invalid\n", user.username)
+			continue
+		}
+		identity, err := claims.Identity()
+		if err != nil || identity.Username != user.username || !identity.HasRole(role) {
+			t.Errorf("expected user %s to have role %s, got %v\n", user.username, role, identity.Roles)
+		}
+	}
+}
+
+func TestJWTTimes(t *testing.T) {
+	before := time.Now().Add(-time.Second)
+	token, err := users.GenerateJWT(testUsers[0].username, testUsers[0].password)
+	if err != nil {
+		t.Fatal("unable to generate a token", err)
+	}
+	claims, ok := users.ParseJWT(token)
+	if !ok {
+		t.Fatal("generated token was invalid")
+	}
+	issued := time.Unix(claims.IssuedAt, 0)
+	if issued.Before(before) || issued.After(time.Now()) {
+		t.Errorf("token has the wrong issue time %v\n", issued)
+	}
+	if claims.ExpiresAt <= claims.IssuedAt {
+		t.Errorf("token expires at %d, before it was issued at %d\n", claims.ExpiresAt, claims.IssuedAt)
+	}
+}
+
+func TestJWTKey(t *testing.T) {
+	users.SetJWTKey([]byte("0123456789abcdef0123456789abcdef"))
+	token, err := users.GenerateJWT(testUsers[0].username, testUsers[0].password)
+	if err != nil {
+		t.Fatal("unable to generate a token", err)
+	}
+	if _, ok := users.ValidateJWT(token); !ok {
+		t.Error("token signed with the current key was invalid")
+	}
+	users.SetJWTKey([]byte("fedcba9876543210fedcba9876543210"))
+	if _, ok := users.ValidateJWT(token); ok {
+		t.Error("token signed with a different key was valid")
+	}
+}